@@ -3,24 +3,49 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"container/heap"
+	"container/list"
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"hash/fnv"
+	"io"
 	"log"
 	"math"
+	mathrand "math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"plugin"
+	"reflect"
 	"regexp"
 	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/google/uuid"
@@ -32,7 +57,9 @@ import (
 // Core Types and Structures
 // ============================================================================
 
-// Atom represents a packet in the PacketFlow system
+// Atom represents a packet in the PacketFlow system. Timeout overrides the
+// packet's timeout in seconds; an explicit zero runs the atom without a
+// timeout, bounded only by a deadline in Meta.
 type Atom struct {
 	ID       string                 `json:"id" msgpack:"id"`
 	Group    string                 `json:"g" msgpack:"g"`
@@ -42,6 +69,10 @@ type Atom struct {
 	Priority *int                   `json:"p,omitempty" msgpack:"p,omitempty"`
 	Timeout  *int                   `json:"t,omitempty" msgpack:"t,omitempty"`
 	Meta     map[string]interface{} `json:"m,omitempty" msgpack:"m,omitempty"`
+
+	// Caller is the authenticated identity behind the atom. It is set by the
+	// server after authentication and never decoded from the wire.
+	Caller *Caller `json:"-" msgpack:"-"`
 }
 
 // AtomResult represents the result of processing an atom
@@ -58,21 +89,72 @@ type AtomError struct {
 	Message   string      `json:"message" msgpack:"message"`
 	Details   interface{} `json:"details,omitempty" msgpack:"details,omitempty"`
 	Permanent bool        `json:"permanent" msgpack:"permanent"`
+
+	cause error
+}
+
+// Error lets handlers return an AtomError; its code and details reach the
+// result unchanged
+func (e *AtomError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the runtime error the AtomError was built from, if any
+func (e *AtomError) Unwrap() error {
+	return e.cause
+}
+
+// NewFieldError builds an error whose Details carry per-field messages, in
+// the same {"fields": [...]} shape input schema validation uses
+func NewFieldError(code, message string, fields map[string]string) *AtomError {
+	return &AtomError{
+		Code:      code,
+		Message:   message,
+		Details:   map[string]interface{}{"fields": fieldErrorList(fields)},
+		Permanent: isPermanentCode(code),
+	}
+}
+
+// fieldErrorList converts field messages to FieldErrors sorted by field
+func fieldErrorList(fields map[string]string) []FieldError {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fieldErrors := make([]FieldError, len(names))
+	for i, name := range names {
+		fieldErrors[i] = FieldError{Field: name, Message: fields[name]}
+	}
+	return fieldErrors
 }
 
 // PacketHandler represents a function that processes atoms
 type PacketHandler func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error)
 
+// Middleware wraps a PacketHandler; it may act before or after calling next,
+// or short-circuit by returning without calling it
+type Middleware func(next PacketHandler) PacketHandler
+
 // PacketInfo contains metadata about a registered packet
 type PacketInfo struct {
-	Handler     PacketHandler          `json:"-"`
-	Metadata    PacketMetadata         `json:"metadata"`
-	Stats       PacketStats            `json:"stats"`
-	Group       string                 `json:"group"`
-	Element     string                 `json:"element"`
-	Variant     string                 `json:"variant"`
-	Key         string                 `json:"key"`
-	RegisteredAt time.Time             `json:"registered_at"`
+	Handler      PacketHandler  `json:"-"`
+	Metadata     PacketMetadata `json:"metadata"`
+	Stats        PacketStats    `json:"stats"`
+	Group        string         `json:"group"`
+	Element      string         `json:"element"`
+	Variant      string         `json:"variant"`
+	Key          string         `json:"key"`
+	RegisteredAt time.Time      `json:"registered_at"`
+	statsMu      sync.Mutex
+}
+
+// StatsSnapshot returns a consistent copy of the packet's stats
+func (p *PacketInfo) StatsSnapshot() PacketStats {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	return p.Stats
 }
 
 // PacketMetadata contains packet configuration and constraints
@@ -85,52 +167,224 @@ type PacketMetadata struct {
 	Version         string   `json:"version"`
 	Dependencies    []string `json:"dependencies"`
 	Permissions     []string `json:"permissions"`
+	Cacheable       bool     `json:"cacheable"`
+	CacheTTL        int      `json:"cache_ttl"`
+	// Cost is the weight charged against the runtime's cost budget for each
+	// execution (default 1)
+	Cost        int    `json:"cost,omitempty"`
+	InputSchema Schema `json:"input_schema,omitempty"`
+	// OutputSchema, when set, is the result contract: undeclared fields are
+	// stripped and violations fail the atom with E500
+	OutputSchema Schema `json:"output_schema,omitempty"`
+}
+
+// Schema describes the fields a packet expects, keyed by field name
+type Schema map[string]FieldSchema
+
+// FieldSchema describes a single field; Type is one of string, number,
+// integer, boolean, object, array or any. Format optionally names a
+// PacketUtils.Validate check (email, uuid, url, ...) for string values.
+type FieldSchema struct {
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Format      string `json:"format,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// FieldError reports why a single field failed schema validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
 // PacketStats tracks packet performance metrics
 type PacketStats struct {
-	Calls         int64         `json:"calls"`
-	TotalDuration time.Duration `json:"total_duration"`
-	Errors        int64         `json:"errors"`
-	LastCalled    time.Time     `json:"last_called"`
-	AvgDuration   time.Duration `json:"avg_duration"`
+	Calls         int64            `json:"calls"`
+	TotalDuration time.Duration    `json:"total_duration"`
+	Errors        int64            `json:"errors"`
+	LastCalled    time.Time        `json:"last_called"`
+	AvgDuration   time.Duration    `json:"avg_duration"`
+	Latency       LatencyHistogram `json:"latency"`
+}
+
+// merge adds other's counters to s
+func (s *PacketStats) merge(other PacketStats) {
+	s.Calls += other.Calls
+	s.Errors += other.Errors
+	s.TotalDuration += other.TotalDuration
+	s.Latency.Merge(other.Latency)
+	if other.LastCalled.After(s.LastCalled) {
+		s.LastCalled = other.LastCalled
+	}
+	if s.Calls > 0 {
+		s.AvgDuration = s.TotalDuration / time.Duration(s.Calls)
+	}
+}
+
+// latencyBuckets are the histogram's upper bounds; slower calls fall into a
+// final overflow bucket
+var latencyBuckets = [...]time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second,
+	10 * time.Second, 30 * time.Second, time.Minute,
+}
+
+// LatencyHistogram counts durations in fixed exponential buckets, so memory
+// stays constant regardless of call volume
+type LatencyHistogram struct {
+	Counts [len(latencyBuckets) + 1]int64 `json:"counts"`
+	Total  int64                          `json:"total"`
+}
+
+// Observe records a duration
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.Counts[i]++
+	h.Total++
+}
+
+// Merge adds another histogram's counts to this one
+func (h *LatencyHistogram) Merge(other LatencyHistogram) {
+	for i, count := range other.Counts {
+		h.Counts[i] += count
+	}
+	h.Total += other.Total
+}
+
+// Percentile returns the upper bound of the bucket holding the p-th
+// percentile (0-100); the overflow bucket reports the largest bound
+func (h LatencyHistogram) Percentile(p float64) time.Duration {
+	if i := percentileBucket(h.Counts[:], h.Total, p); i >= 0 {
+		return latencyBuckets[i]
+	}
+	return 0
+}
+
+// percentileBucket returns the index of the bound to report for the p-th
+// percentile (0-100) of a histogram's counts, whose final overflow bucket
+// maps to the largest bound. It returns -1 for an empty histogram.
+func percentileBucket(counts []int64, total int64, p float64) int {
+	if total == 0 {
+		return -1
+	}
+
+	rank := int64(math.Ceil(p / 100 * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	largest := len(counts) - 2
+	var seen int64
+	for i, count := range counts[:largest+1] {
+		seen += count
+		if seen >= rank {
+			return i
+		}
+	}
+	return largest
+}
+
+// sizeBuckets are the payload size histogram's upper bounds in bytes; larger
+// payloads fall into a final overflow bucket
+var sizeBuckets = [...]int{
+	64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10,
+	256 << 10, 1 << 20, 4 << 20, 16 << 20,
+}
+
+// SizeHistogram counts payload sizes in fixed exponential buckets
+type SizeHistogram struct {
+	Counts [len(sizeBuckets) + 1]int64 `json:"counts"`
+	Total  int64                       `json:"total"`
+}
+
+// Observe records a size in bytes
+func (h *SizeHistogram) Observe(size int) {
+	i := sort.SearchInts(sizeBuckets[:], size)
+	h.Counts[i]++
+	h.Total++
+}
+
+// Percentile returns the upper bound in bytes of the bucket holding the p-th
+// percentile (0-100), as LatencyHistogram.Percentile does for durations
+func (h SizeHistogram) Percentile(p float64) int {
+	if i := percentileBucket(h.Counts[:], h.Total, p); i >= 0 {
+		return sizeBuckets[i]
+	}
+	return 0
 }
 
 // ExecutionContext provides runtime context to packet handlers
 type ExecutionContext struct {
-	Atom       *Atom                  `json:"atom"`
-	Runtime    *PacketFlowRuntime     `json:"-"`
-	StartTime  time.Time              `json:"start_time"`
-	RequestID  string                 `json:"request_id"`
-	Metadata   PacketMetadata         `json:"metadata"`
-	PacketKey  string                 `json:"packet_key"`
-	Utils      *PacketUtils           `json:"-"`
+	Atom          *Atom              `json:"atom"`
+	Runtime       *PacketFlowRuntime `json:"-"`
+	StartTime     time.Time          `json:"start_time"`
+	RequestID     string             `json:"request_id"`
+	CorrelationID string             `json:"correlation_id"`
+	Context       context.Context    `json:"-"` // cancelled when the atom times out
+	Metadata      PacketMetadata     `json:"metadata"`
+	PacketKey     string             `json:"packet_key"`
+	// RequestedElement and RequestedVariant are as addressed by the atom;
+	// they differ from the packet's own for catch-all handlers
+	RequestedElement string `json:"requested_element"`
+	RequestedVariant string `json:"requested_variant,omitempty"`
+	// Caller is the authenticated identity the atom runs on behalf of; nil
+	// for unauthenticated atoms
+	Caller *Caller      `json:"caller,omitempty"`
+	Utils  *PacketUtils `json:"-"`
 }
 
 // Message represents a binary protocol message
 type Message struct {
-	Version       int                    `msgpack:"v"`
-	Type          int                    `msgpack:"t"`
-	Sequence      int64                  `msgpack:"s"`
-	Timestamp     int64                  `msgpack:"ts"`
-	SourceID      int                    `msgpack:"src"`
-	DestinationID int                    `msgpack:"dst"`
-	Data          interface{}            `msgpack:"d"`
-	Priority      *int                   `msgpack:"p,omitempty"`
-	TTL           *int                   `msgpack:"ttl,omitempty"`
-	CorrelationID *string                `msgpack:"cid,omitempty"`
+	Version       int         `json:"v" msgpack:"v"`
+	Type          int         `json:"t" msgpack:"t"`
+	Sequence      int64       `json:"s" msgpack:"s"`
+	Timestamp     int64       `json:"ts" msgpack:"ts"`
+	SourceID      int         `json:"src" msgpack:"src"`
+	DestinationID int         `json:"dst" msgpack:"dst"`
+	Data          interface{} `json:"d" msgpack:"d"`
+	Priority      *int        `json:"p,omitempty" msgpack:"p,omitempty"`
+	TTL           *int        `json:"ttl,omitempty" msgpack:"ttl,omitempty"`
+	CorrelationID *string     `json:"cid,omitempty" msgpack:"cid,omitempty"`
 }
 
 // RuntimeStats tracks overall runtime performance
 type RuntimeStats struct {
-	Processed       int64         `json:"processed"`
-	Errors          int64         `json:"errors"`
-	AvgLatency      time.Duration `json:"avg_latency"`
-	TotalDuration   time.Duration `json:"total_duration"`
-	Uptime          time.Duration `json:"uptime"`
-	MemoryUsage     int64         `json:"memory_usage"`
-	PacketsTotal    int           `json:"packets_total"`
-	ConnectionCount int           `json:"connection_count"`
+	Processed         int64         `json:"processed"`
+	Errors            int64         `json:"errors"`
+	AvgLatency        time.Duration `json:"avg_latency"`
+	TotalDuration     time.Duration `json:"total_duration"`
+	Uptime            time.Duration `json:"uptime"`
+	MemoryUsage       int64         `json:"memory_usage"`
+	PacketsTotal      int           `json:"packets_total"`
+	ConnectionCount   int           `json:"connection_count"`
+	ActiveAtoms       int           `json:"active_atoms"`
+	QueueDepth        int           `json:"queue_depth"`
+	AbandonedHandlers int64         `json:"abandoned_handlers"`
+	AbandonedTotal    int64         `json:"abandoned_total"`
+	CacheHits         int64         `json:"cache_hits"`
+	CacheMisses       int64         `json:"cache_misses"`
+	ThroughputPerSec  float64       `json:"throughput_per_sec"`
+	ErrorRateWindow   float64       `json:"error_rate_window"`
+	// CostBudgetRemaining is only reported when a cost budget is configured
+	CostBudgetRemaining *float64 `json:"cost_budget_remaining,omitempty"`
+	BudgetRejected      int64    `json:"budget_rejected"`
+	Shed                int64    `json:"shed"`
+	Workers             int      `json:"workers"`
+	// PayloadSizes are MessagePack-encoded atom data sizes; ResultSizes are
+	// encoded result sizes as sent to clients
+	PayloadSizes SizeHistogram `json:"payload_sizes"`
+	ResultSizes  SizeHistogram `json:"result_sizes"`
+}
+
+// ErrorRate returns the percentage of processed atoms that failed, or 0 when
+// nothing has been processed
+func (s RuntimeStats) ErrorRate() float64 {
+	if s.Processed == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Processed) * 100
 }
 
 // ============================================================================
@@ -139,27 +393,248 @@ type RuntimeStats struct {
 
 // PacketFlowRuntime is the main runtime engine
 type PacketFlowRuntime struct {
-	mu               sync.RWMutex
-	packets          map[string]*PacketInfo
-	stats            RuntimeStats
-	startTime        time.Time
-	sequenceCounter  int64
-	config           RuntimeConfig
-	utils            *PacketUtils
-	connections      map[string]*websocket.Conn
-	connectionsMu    sync.RWMutex
+	mu              sync.RWMutex
+	packets         map[string]*PacketInfo
+	stats           RuntimeStats
+	startTime       time.Time
+	sequenceCounter int64
+	config          RuntimeConfig
+	utils           *PacketUtils
+	connections     map[string]*ClientConnection
+	connectionsMu   sync.RWMutex
+	router          *HashRouter
+	reactorClient   *ReactorClient
+	activeAtoms     int
+	queue           atomQueue
+	authorizer      Authorizer
+	deadLetters     DeadLetterSink
+	recorder        *TrafficRecorder
+	slowAtoms       *slowAtomBuffer
+	idempotency     *idempotencyCache
+	budget          *tokenBucket
+	workers         *workerPool
+	budgetRejected  int64
+	shed            int64
+	largePayloads   int64
+	memLoadMu       sync.Mutex
+	memLoad         float64
+	memSampledAt    time.Time
+	resultCache     *lruCache
+	middlewares     []Middleware
+	beforeHooks     []func(atom *Atom)
+	metaMu          sync.RWMutex
+	metaEnrichers   []MetaEnricher
+	metaCollisions  sync.Map // enricher keys already reported as colliding
+	afterHooks      []func(atom *Atom, result *AtomResult)
+	pluginMu        sync.Mutex
+	plugins         map[string]time.Time
+	messageTypes    *messageTypeRegistry
+	abandoned       int64 // timed-out handlers still running; atomic
+	abandonedTotal  int64 // atomic
+	inFlightMu      sync.Mutex
+	inFlight        map[string]struct{}
+	quotas          *QuotaManager
+	stopBackground  chan struct{}
+	background      sync.WaitGroup
+	stopOnce        sync.Once
+	closeMu         sync.RWMutex // orders Close against atoms entering ProcessAtom
+	closeOnce       sync.Once
+	closeErr        error
+	processing      sync.WaitGroup // atoms inside ProcessAtom
+	reactorHealth   map[string]*reactorProbeState
+	cpu             *cpuSampler
+	state           int32 // lifecycle state; atomic
+	window          *slidingWindow
+	pendingStats    map[string]PacketStats // imported for unregistered packets
+	aliases         map[string]packetAlias
+}
+
+// Runtime lifecycle states reported by State and /ready
+const (
+	StateStarting int32 = iota
+	StateReady
+	StateDraining
+	StateClosed
+)
+
+var stateNames = map[int32]string{
+	StateStarting: "starting",
+	StateReady:    "ready",
+	StateDraining: "draining",
+	StateClosed:   "closed",
 }
 
 // RuntimeConfig holds configuration options
 type RuntimeConfig struct {
-	ProtocolVersion  string `json:"protocol_version"`
-	PerformanceMode  bool   `json:"performance_mode"`
-	MaxPacketSize    int    `json:"max_packet_size"`
-	DefaultTimeout   int    `json:"default_timeout"`
-	MaxConcurrent    int    `json:"max_concurrent"`
-	ReactorID        string `json:"reactor_id"`
+	ProtocolVersion string `json:"protocol_version"`
+	PerformanceMode bool   `json:"performance_mode"`
+	MaxPacketSize   int    `json:"max_packet_size"`
+	DefaultTimeout  int    `json:"default_timeout"`
+	// GroupTimeouts gives per-group default timeouts in seconds, used for
+	// packets that don't set their own before falling back to DefaultTimeout
+	GroupTimeouts map[string]int `json:"group_timeouts"`
+	MaxConcurrent int            `json:"max_concurrent"`
+	// Handlers run on a pool of up to WorkerPoolSize goroutines (default
+	// MaxConcurrent; negative starts a goroutine per atom). Workers start on
+	// demand; with ElasticWorkers, idle workers exit after WorkerIdleTimeout
+	// seconds (default 60).
+	WorkerPoolSize    int    `json:"worker_pool_size"`
+	ElasticWorkers    bool   `json:"elastic_workers"`
+	WorkerIdleTimeout int    `json:"worker_idle_timeout"`
+	ReactorID         string `json:"reactor_id"`
+	FanOutWorkers     int    `json:"fan_out_workers"`
+	ReactorTimeout    int    `json:"reactor_timeout"`
+	// Reactors are probed with cf:ping every ReactorHealthInterval milliseconds
+	// (negative disables probing), marked unhealthy after UnhealthyThreshold
+	// consecutive failures and healthy again after HealthyThreshold successes
+	ReactorHealthInterval int `json:"reactor_health_interval"`
+	UnhealthyThreshold    int `json:"unhealthy_threshold"`
+	HealthyThreshold      int `json:"healthy_threshold"`
+	// ForwardUnknown forwards atoms for unregistered packets to a reactor
+	// chosen by the router instead of failing with E404. MaxForwardHops
+	// bounds how many reactors one atom may pass through.
+	ForwardUnknown bool `json:"forward_unknown"`
+	MaxForwardHops int  `json:"max_forward_hops"`
+	// ReactorToken is sent as a Bearer token on every outbound reactor call,
+	// so peers configured with APIKeys accept forwarded and collective atoms.
+	// Relayed atoms carry a caller assertion signed with it; a peer sharing
+	// the same ReactorToken runs them as the originating caller rather than
+	// with the token's own permissions.
+	ReactorToken string `json:"-"`
+	// Outbound reactor connections are pooled per endpoint, at most
+	// ReactorPoolSize each, and closed after ReactorIdleTimeout seconds idle
+	ReactorPoolSize    int      `json:"reactor_pool_size"`
+	ReactorIdleTimeout int      `json:"reactor_idle_timeout"`
+	ClockSkew          int      `json:"clock_skew"`
+	CheckDependencies  bool     `json:"check_dependencies"`
+	APIKeys            []string `json:"-"`
+	AllowedOrigins     []string `json:"allowed_origins"`
+	AllowAllOrigins    bool     `json:"allow_all_origins"`
+	RateLimit          float64  `json:"rate_limit"`
+	RateBurst          int      `json:"rate_burst"`
+	// CostBudget caps the total packet cost (PacketMetadata.Cost) the runtime
+	// executes in a burst; it refills at CostRefillRate units per second
+	// (default CostBudget). Atoms are rejected with E429 once it is spent.
+	CostBudget     float64 `json:"cost_budget"`
+	CostRefillRate float64 `json:"cost_refill_rate"`
+	// Once load (the higher of heap usage and execution-slot usage, in
+	// percent) reaches ShedLoadThreshold, atoms with a priority value above
+	// ShedPriorityCutoff (default DefaultPriority) are rejected with E503.
+	// Zero disables load shedding.
+	ShedLoadThreshold  float64 `json:"shed_load_threshold"`
+	ShedPriorityCutoff int     `json:"shed_priority_cutoff"`
+	// Atoms whose payload reaches LargePayloadLogSize bytes are logged, one
+	// in every LargePayloadSampleEvery (default 10); zero disables logging
+	LargePayloadLogSize     int `json:"large_payload_log_size"`
+	LargePayloadSampleEvery int `json:"large_payload_sample_every"`
+	// Atoms taking at least SlowAtomThreshold milliseconds are traced into a
+	// buffer of the last SlowAtomBufferSize (default 100), served at /slow.
+	// Zero disables sampling.
+	SlowAtomThreshold  int `json:"slow_atom_threshold"`
+	SlowAtomBufferSize int `json:"slow_atom_buffer_size"`
+	// StatsCardinality caps how many variant packets /stats reports
+	// individually; the least used are merged into an "other" entry. Zero
+	// reports every packet.
+	StatsCardinality int `json:"stats_cardinality"`
+	// OmitMetaFields lists built-in response Meta fields (duration_ms,
+	// reactor_id, timestamp) to leave out of every response
+	OmitMetaFields []string `json:"omit_meta_fields"`
+	// Compression negotiates permessage-deflate on WebSocket connections.
+	// Messages smaller than CompressionThreshold bytes are sent uncompressed;
+	// CompressionLevel is a compress/flate level (default BestSpeed).
+	Compression          bool `json:"compression"`
+	CompressionLevel     int  `json:"compression_level"`
+	CompressionThreshold int  `json:"compression_threshold"`
+	// Each WebSocket connection queues up to SendQueueSize outgoing frames;
+	// SendQueuePolicy ("reject" or "close") applies when the queue is full
+	SendQueueSize   int    `json:"send_queue_size"`
+	SendQueuePolicy string `json:"send_queue_policy"`
+	// SequenceCheck ("warn", "reject" or "off") controls what happens when a
+	// connection's inbound message sequence skips or goes backwards
+	SequenceCheck string `json:"sequence_check"`
+
+	// Idempotency replays the cached result of an atom ID the same caller
+	// already submitted to the same packet
+	IdempotencyEnabled       bool `json:"idempotency_enabled"`
+	IdempotencyTTL           int  `json:"idempotency_ttl"`
+	IdempotencySize          int  `json:"idempotency_size"`
+	IdempotencyCacheFailures bool `json:"idempotency_cache_failures"`
+
+	// ResultCacheSize bounds the result cache shared by Cacheable packets
+	ResultCacheSize int `json:"result_cache_size"`
+
+	// Tracer receives atom and pipeline spans; nil disables tracing
+	Tracer Tracer `json:"-"`
+
+	// PluginDir is scanned for Go plugins (.so) at startup and on ReloadPlugins
+	PluginDir string `json:"plugin_dir"`
+
+	// MinClientVersion is the lowest client version advertised by cf:version
+	MinClientVersion string `json:"min_client_version"`
+
+	// RequireUUIDIDs rejects client atoms (WebSocket and /submit) whose ID is
+	// not a UUID v4. Atoms the runtime creates itself, such as pipeline steps
+	// and fan-out shards, carry their own IDs and are not checked.
+	RequireUUIDIDs bool `json:"require_uuid_ids"`
+	// AutoGenerateAtomID assigns an ID from IDGenerator (default UUID v4) to
+	// atoms submitted without one instead of rejecting them
+	AutoGenerateAtomID bool        `json:"auto_generate_atom_id"`
+	IDGenerator        IDGenerator `json:"-"`
+	// RandSource supplies the randomness behind transform operations such as
+	// uuid. Nil uses crypto/rand; tests pass NewSeededRandSource for
+	// repeatable output.
+	RandSource io.Reader `json:"-"`
+	// CoerceTypes lets df:filter and df:validate treat numeric and boolean
+	// strings as the numbers and booleans they spell, e.g. "42" equals 42
+	CoerceTypes bool `json:"coerce_types"`
+	// RejectDuplicateInFlight rejects an atom whose ID is already processing (E409)
+	RejectDuplicateInFlight bool `json:"reject_duplicate_in_flight"`
+
+	// ValidateGroups rejects atoms whose group is not in AllowedGroups
+	ValidateGroups bool     `json:"validate_groups"`
+	AllowedGroups  []string `json:"allowed_groups"`
+
+	// ResourceQuotas caps the total amount rm:allocate may reserve per resource
+	ResourceQuotas map[string]float64 `json:"resource_quotas"`
+	// ReapInterval is how often expired allocations are released, in
+	// milliseconds (default 1000)
+	ReapInterval int `json:"reap_interval"`
+	// ScheduleJitter spreads ScheduleEvery runs by up to this fraction of
+	// their interval either way (0-1) so periodic tasks across reactors
+	// don't fire in lockstep
+	ScheduleJitter float64 `json:"schedule_jitter"`
+
+	// MonitorDiskPath is the filesystem path whose usage rm:monitor reports
+	MonitorDiskPath string `json:"monitor_disk_path"`
+	// CPUSampleInterval is the minimum time between CPU samples, in milliseconds
+	CPUSampleInterval int `json:"cpu_sample_interval"`
+
+	// ThroughputWindow is the sliding window, in seconds, behind
+	// throughput_per_sec and error_rate_window
+	ThroughputWindow int `json:"throughput_window"`
+
+	// Health sets the thresholds cf:health and /health use to report status
+	Health HealthThresholds `json:"health"`
+}
+
+// HealthThresholds mark the runtime degraded or unhealthy once memory load
+// (percent of heap in use), queue depth or error rate (percent) reaches them
+type HealthThresholds struct {
+	DegradedMemoryPercent  float64 `json:"degraded_memory_percent"`
+	UnhealthyMemoryPercent float64 `json:"unhealthy_memory_percent"`
+	DegradedQueueDepth     int     `json:"degraded_queue_depth"`
+	UnhealthyQueueDepth    int     `json:"unhealthy_queue_depth"`
+	DegradedErrorRate      float64 `json:"degraded_error_rate"`
+	UnhealthyErrorRate     float64 `json:"unhealthy_error_rate"`
 }
 
+// Health statuses reported by cf:health and /health
+const (
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
 // NewPacketFlowRuntime creates a new PacketFlow runtime
 func NewPacketFlowRuntime(config RuntimeConfig) *PacketFlowRuntime {
 	if config.ProtocolVersion == "" {
@@ -174,21 +649,178 @@ func NewPacketFlowRuntime(config RuntimeConfig) *PacketFlowRuntime {
 	if config.MaxConcurrent == 0 {
 		config.MaxConcurrent = 1000
 	}
+	if config.WorkerPoolSize == 0 {
+		config.WorkerPoolSize = config.MaxConcurrent
+	}
+	if config.WorkerIdleTimeout == 0 {
+		config.WorkerIdleTimeout = 60
+	}
 	if config.ReactorID == "" {
 		config.ReactorID = "go-reactor-01"
 	}
+	if config.FanOutWorkers == 0 {
+		config.FanOutWorkers = 16
+	}
+	if config.UnhealthyThreshold == 0 {
+		config.UnhealthyThreshold = 3
+	}
+	if config.HealthyThreshold == 0 {
+		config.HealthyThreshold = 2
+	}
+	if config.ReactorTimeout == 0 {
+		config.ReactorTimeout = 5
+	}
+	if config.ClockSkew == 0 {
+		config.ClockSkew = 2
+	}
+	if config.SendQueueSize == 0 {
+		config.SendQueueSize = 256
+	}
+	if config.SendQueuePolicy == "" {
+		config.SendQueuePolicy = SendQueueReject
+	}
+	if config.SequenceCheck == "" {
+		config.SequenceCheck = SequenceCheckWarn
+	}
+	if config.CompressionLevel == 0 {
+		config.CompressionLevel = flate.BestSpeed
+	}
+	if config.CompressionThreshold == 0 {
+		config.CompressionThreshold = 1024
+	}
+	if config.RateLimit > 0 && config.RateBurst == 0 {
+		config.RateBurst = int(math.Ceil(config.RateLimit))
+	}
+	if config.LargePayloadSampleEvery == 0 {
+		config.LargePayloadSampleEvery = 10
+	}
+	if config.ShedPriorityCutoff == 0 {
+		config.ShedPriorityCutoff = DefaultPriority
+	}
+	if config.CostBudget > 0 && config.CostRefillRate == 0 {
+		config.CostRefillRate = config.CostBudget
+	}
+	if config.IdempotencyTTL == 0 {
+		config.IdempotencyTTL = 300
+	}
+	if config.IdempotencySize == 0 {
+		config.IdempotencySize = 10000
+	}
+	if config.ResultCacheSize == 0 {
+		config.ResultCacheSize = 1000
+	}
+	if config.Tracer == nil {
+		config.Tracer = noopTracer{}
+	}
+	if config.IDGenerator == nil {
+		config.IDGenerator = UUIDGenerator{}
+	}
+	if len(config.AllowedGroups) == 0 {
+		config.AllowedGroups = []string{"cf", "df", "ed", "co", "mc", "rm"}
+	}
+	if config.Health == (HealthThresholds{}) {
+		config.Health = HealthThresholds{
+			DegradedMemoryPercent:  85,
+			UnhealthyMemoryPercent: 95,
+			DegradedQueueDepth:     100,
+			UnhealthyQueueDepth:    1000,
+			DegradedErrorRate:      10,
+			UnhealthyErrorRate:     50,
+		}
+	}
+	if config.ThroughputWindow == 0 {
+		config.ThroughputWindow = 60
+	}
+	if config.CPUSampleInterval == 0 {
+		config.CPUSampleInterval = 1000
+	}
+	if config.MonitorDiskPath == "" {
+		config.MonitorDiskPath = "/"
+	}
+	if config.ReapInterval <= 0 {
+		config.ReapInterval = 1000
+	}
+	if config.ReactorPoolSize == 0 {
+		config.ReactorPoolSize = 8
+	}
+	if config.ReactorIdleTimeout == 0 {
+		config.ReactorIdleTimeout = 90
+	}
+	if config.MaxForwardHops == 0 {
+		config.MaxForwardHops = 3
+	}
+	if config.ReactorHealthInterval == 0 {
+		config.ReactorHealthInterval = 10000
+	}
+	if config.ResourceQuotas == nil {
+		config.ResourceQuotas = map[string]float64{
+			"memory": 4096,  // MB
+			"cpu":    100,   // percent
+			"disk":   10240, // MB
+		}
+	}
+
+	utils := NewPacketUtils(config.RandSource)
+	utils.coerceTypes = config.CoerceTypes
 
 	runtime := &PacketFlowRuntime{
-		packets:     make(map[string]*PacketInfo),
-		startTime:   time.Now(),
-		config:      config,
-		utils:       NewPacketUtils(),
-		connections: make(map[string]*websocket.Conn),
+		packets:        make(map[string]*PacketInfo),
+		pendingStats:   make(map[string]PacketStats),
+		aliases:        make(map[string]packetAlias),
+		slowAtoms:      newSlowAtomBuffer(config.SlowAtomBufferSize),
+		startTime:      time.Now(),
+		config:         config,
+		utils:          utils,
+		connections:    make(map[string]*ClientConnection),
+		router:         NewHashRouter(),
+		reactorClient:  NewReactorClient(config.ReactorPoolSize, time.Duration(config.ReactorIdleTimeout)*time.Second, config.ReactorToken),
+		authorizer:     PermissionAuthorizer{},
+		resultCache:    newLRUCache(config.ResultCacheSize),
+		plugins:        make(map[string]time.Time),
+		messageTypes:   newMessageTypeRegistry(),
+		inFlight:       make(map[string]struct{}),
+		quotas:         NewQuotaManager(config.ResourceQuotas),
+		stopBackground: make(chan struct{}),
+		reactorHealth:  make(map[string]*reactorProbeState),
+		cpu:            newCPUSampler(time.Duration(config.CPUSampleInterval) * time.Millisecond),
+		window:         newSlidingWindow(config.ThroughputWindow),
+	}
+
+	if config.IdempotencyEnabled {
+		runtime.idempotency = newIdempotencyCache(config.IdempotencySize, runtime.utils)
+	}
+	if config.CostBudget > 0 {
+		runtime.budget = newCostBucket(config.CostRefillRate, config.CostBudget)
+	}
+	if config.WorkerPoolSize > 0 {
+		runtime.workers = newWorkerPool(config.WorkerPoolSize, config.ElasticWorkers, time.Duration(config.WorkerIdleTimeout)*time.Second)
 	}
 
 	// Register standard library packets
 	runtime.registerStandardLibrary()
 
+	runtime.goBackground(func() {
+		runtime.reapAllocations(time.Duration(config.ReapInterval) * time.Millisecond)
+	})
+	runtime.goBackground(func() {
+		runtime.evictIdleConnections(time.Duration(config.ReactorIdleTimeout) * time.Second / 2)
+	})
+	if config.ReactorHealthInterval > 0 {
+		runtime.goBackground(func() {
+			runtime.checkReactorHealth(time.Duration(config.ReactorHealthInterval) * time.Millisecond)
+		})
+	}
+
+	if config.PluginDir != "" {
+		if _, err := runtime.ReloadPlugins(); err != nil {
+			log.Printf("⚠️  Plugin loading failed: %v", err)
+		}
+	}
+
+	if err := runtime.MarkReady(); err != nil {
+		log.Printf("⚠️  Runtime not ready: %v", err)
+	}
+
 	log.Printf("✅ PacketFlow v1.0 Runtime initialized (Reactor: %s)", config.ReactorID)
 	return runtime
 }
@@ -200,9 +832,6 @@ func (r *PacketFlowRuntime) RegisterPacket(group, element, variant string, handl
 
 	key := r.makePacketKey(group, element, variant)
 	
-	if metadata.Timeout == 0 {
-		metadata.Timeout = r.config.DefaultTimeout
-	}
 	if metadata.MaxPayloadSize == 0 {
 		metadata.MaxPayloadSize = 1024 * 1024 // 1MB default
 	}
@@ -215,11 +844,41 @@ func (r *PacketFlowRuntime) RegisterPacket(group, element, variant string, handl
 	if metadata.Version == "" {
 		metadata.Version = "1.0.0"
 	}
+	if metadata.Cost < 0 {
+		return fmt.Errorf("invalid cost for %s: %d", key, metadata.Cost)
+	}
+	if metadata.Cost == 0 {
+		metadata.Cost = 1
+	}
+	if err := r.utils.CheckSchema(metadata.InputSchema); err != nil {
+		return fmt.Errorf("invalid input schema for %s: %v", key, err)
+	}
+	if err := r.utils.CheckSchema(metadata.OutputSchema); err != nil {
+		return fmt.Errorf("invalid output schema for %s: %v", key, err)
+	}
+
+	if r.config.CheckDependencies {
+		if missing := r.missingDependencies(metadata.Dependencies); len(missing) > 0 {
+			return fmt.Errorf("missing dependencies for %s: %s", key, strings.Join(missing, ", "))
+		}
+	}
+
+	graph := r.dependencyGraph()
+	graph[key] = metadata.Dependencies
+	if cycle := findDependencyCycle(graph); cycle != nil {
+		return fmt.Errorf("dependency cycle detected: %s", strings.Join(cycle, " -> "))
+	}
+
+	// Re-registering a packet, e.g. from a new plugin version, keeps its stats
+	stats := r.pendingStats[key]
+	if existing, exists := r.packets[key]; exists {
+		stats = existing.StatsSnapshot()
+	}
 
 	packetInfo := &PacketInfo{
 		Handler:      handler,
 		Metadata:     metadata,
-		Stats:        PacketStats{},
+		Stats:        stats,
 		Group:        group,
 		Element:      element,
 		Variant:      variant,
@@ -227,1748 +886,11029 @@ func (r *PacketFlowRuntime) RegisterPacket(group, element, variant string, handl
 		RegisteredAt: time.Now(),
 	}
 
+	delete(r.pendingStats, key)
 	r.packets[key] = packetInfo
 	log.Printf("✓ Registered packet: %s (level %d)", key, metadata.ComplianceLevel)
 	return nil
 }
 
-// ProcessAtom processes an atom and returns the result
-func (r *PacketFlowRuntime) ProcessAtom(atom *Atom) *AtomResult {
-	start := time.Now()
-	
-	// Validate atom structure
-	if err := r.validateAtom(atom); err != nil {
-		return &AtomResult{
-			Success: false,
-			Error: &AtomError{
-				Code:      "E400",
-				Message:   err.Error(),
-				Permanent: true,
-			},
-			Meta: r.createResponseMeta(start),
+// packetAlias redirects atoms for one packet key to another
+type packetAlias struct {
+	target   string
+	defaults map[string]interface{}
+}
+
+// RegisterAlias routes atoms addressed to alias to the target packet key,
+// filling in defaults for data fields the atom does not set. Targets may be
+// other aliases or packets registered later; aliases that would form a cycle
+// are rejected.
+func (r *PacketFlowRuntime) RegisterAlias(alias, target string, defaults map[string]interface{}) error {
+	if !strings.Contains(alias, ":") || !strings.Contains(target, ":") {
+		return fmt.Errorf("alias and target must be packet keys (group:element[:variant])")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.packets[alias]; exists {
+		return fmt.Errorf("alias %s conflicts with a registered packet", alias)
+	}
+	for next := target; ; {
+		if next == alias {
+			return fmt.Errorf("alias cycle detected: %s -> %s", alias, target)
 		}
+		link, exists := r.aliases[next]
+		if !exists {
+			break
+		}
+		next = link.target
 	}
 
+	copied, _ := r.utils.deepCopy(defaults).(map[string]interface{})
+	r.aliases[alias] = packetAlias{target: target, defaults: copied}
+	log.Printf("✓ Registered alias: %s -> %s", alias, target)
+	return nil
+}
+
+// resolveAlias follows aliases from the atom's packet key and returns an atom
+// addressed to the final target with alias defaults applied; atoms that are
+// not aliased are returned unchanged. Defaults of the alias the client named
+// win over those further along the chain.
+func (r *PacketFlowRuntime) resolveAlias(atom *Atom) *Atom {
 	key := r.makePacketKey(atom.Group, atom.Element, r.stringValue(atom.Variant))
-	
+
 	r.mu.RLock()
-	packet, exists := r.packets[key]
-	r.mu.RUnlock()
+	defer r.mu.RUnlock()
 
+	link, exists := r.aliases[key]
 	if !exists {
-		return &AtomResult{
-			Success: false,
-			Error: &AtomError{
-				Code:      "E404",
-				Message:   fmt.Sprintf("Unsupported packet type: %s", key),
-				Permanent: true,
-			},
-			Meta: r.createResponseMeta(start),
-		}
+		return atom
 	}
 
-	// Create execution context
-	ctx := &ExecutionContext{
-		Atom:      atom,
-		Runtime:   r,
-		StartTime: start,
-		RequestID: uuid.New().String(),
-		Metadata:  packet.Metadata,
-		PacketKey: key,
-		Utils:     r.utils,
+	resolved := *atom
+	resolved.Data = make(map[string]interface{}, len(atom.Data))
+	for k, v := range atom.Data {
+		resolved.Data[k] = v
 	}
-
-	// Execute with timeout
-	timeout := r.getAtomTimeout(atom, packet)
-	done := make(chan struct{})
-	var result interface{}
-	var err error
-
-	go func() {
-		defer close(done)
-		result, err = packet.Handler(atom.Data, ctx)
-	}()
-
-	select {
-	case <-done:
-		duration := time.Since(start)
-		
-		if err != nil {
-			r.updatePacketStats(packet, duration, false)
-			r.updateRuntimeStats(duration, false)
-			
-			return &AtomResult{
-				Success: false,
-				Error: &AtomError{
-					Code:      r.categorizeError(err),
-					Message:   err.Error(),
-					Permanent: r.isPermanentError(err),
-				},
-				Meta: r.createResponseMeta(start),
+	for exists {
+		for field, value := range link.defaults {
+			if _, set := resolved.Data[field]; !set {
+				resolved.Data[field] = r.utils.deepCopy(value)
 			}
 		}
+		key = link.target
+		link, exists = r.aliases[key]
+	}
 
-		r.updatePacketStats(packet, duration, true)
-		r.updateRuntimeStats(duration, true)
+	parts := strings.SplitN(key, ":", 3)
+	resolved.Group, resolved.Element, resolved.Variant = parts[0], parts[1], nil
+	if len(parts) == 3 {
+		resolved.Variant = &parts[2]
+	}
+	return &resolved
+}
 
-		return &AtomResult{
-			Success: true,
-			Data:    result,
-			Meta:    r.createResponseMeta(start),
-		}
+// ProcessAtom processes an atom and returns the result. Atoms that fail with
+// a permanent error are forwarded to the dead-letter sink, if one is set.
+func (r *PacketFlowRuntime) ProcessAtom(atom *Atom) *AtomResult {
+	start := time.Now()
 
-	case <-time.After(time.Duration(timeout) * time.Second):
-		r.updatePacketStats(packet, time.Since(start), false)
-		r.updateRuntimeStats(time.Since(start), false)
-		
+	if !r.enterProcessing() {
 		return &AtomResult{
 			Success: false,
 			Error: &AtomError{
-				Code:      "E408",
-				Message:   fmt.Sprintf("Packet timeout after %ds", timeout),
+				Code:      "E503",
+				Message:   "runtime is closed",
 				Permanent: false,
 			},
-			Meta: r.createResponseMeta(start),
+			Meta: r.createResponseMeta(start, r.correlationID(atom)),
 		}
 	}
-}
+	defer r.processing.Done()
 
-// GetStats returns current runtime statistics
-func (r *PacketFlowRuntime) GetStats() RuntimeStats {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	span := r.startAtomSpan(atom)
+	defer span.End()
 
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
+	r.mu.RLock()
+	beforeHooks := r.beforeHooks
+	afterHooks := r.afterHooks
+	recorder := r.recorder
+	r.mu.RUnlock()
 
-	stats := r.stats
-	stats.Uptime = time.Since(r.startTime)
-	stats.MemoryUsage = int64(m.Alloc)
-	stats.PacketsTotal = len(r.packets)
-	
-	r.connectionsMu.RLock()
-	stats.ConnectionCount = len(r.connections)
-	r.connectionsMu.RUnlock()
+	// Hooks see copies so they cannot alter the atom after it is validated
+	// or the response sent to the client
+	for _, hook := range beforeHooks {
+		hook(r.copyAtom(atom))
+	}
 
-	if stats.Processed > 0 {
-		stats.AvgLatency = stats.TotalDuration / time.Duration(stats.Processed)
+	var allocatedBefore uint64
+	if r.config.SlowAtomThreshold > 0 {
+		allocatedBefore = heapAllocated()
 	}
 
-	return stats
-}
+	result := r.processAtom(atom)
 
-// Helper methods
-func (r *PacketFlowRuntime) makePacketKey(group, element, variant string) string {
-	if variant == "" {
-		return fmt.Sprintf("%s:%s", group, element)
+	// Replayed failures were dead-lettered on their first run
+	if !result.Success && result.Error != nil && result.Error.Permanent && atom != nil && result.Meta["idempotent_replay"] == nil {
+		r.deadLetter(atom, result, time.Since(start))
 	}
-	return fmt.Sprintf("%s:%s:%s", group, element, variant)
-}
 
-func (r *PacketFlowRuntime) stringValue(s *string) string {
-	if s == nil {
-		return ""
+	if r.config.SlowAtomThreshold > 0 && atom != nil {
+		if duration := time.Since(start); duration >= time.Duration(r.config.SlowAtomThreshold)*time.Millisecond {
+			r.traceSlowAtom(atom, result, duration, heapAllocated()-allocatedBefore)
+		}
 	}
-	return *s
-}
 
-func (r *PacketFlowRuntime) validateAtom(atom *Atom) error {
-	if atom == nil {
-		return fmt.Errorf("atom is nil")
-	}
-	if atom.ID == "" {
-		return fmt.Errorf("atom ID is required")
+	for _, hook := range afterHooks {
+		copied := copyAtomResult(result)
+		copied.Data = r.utils.deepCopy(result.Data)
+		hook(r.copyAtom(atom), copied)
 	}
-	if len(atom.Group) != 2 {
-		return fmt.Errorf("group must be 2 characters")
+
+	if recorder != nil && atom != nil {
+		if err := recorder.Record(atom, result); err != nil {
+			log.Printf("⚠️  Failed to record atom %s: %v", atom.ID, err)
+		}
 	}
-	if atom.Element == "" {
-		return fmt.Errorf("element is required")
+
+	if requestID, ok := result.Meta["request_id"].(string); ok {
+		span.SetAttribute("request_id", requestID)
 	}
-	if atom.Data == nil {
-		atom.Data = make(map[string]interface{})
+	span.SetAttribute("duration_ms", time.Since(start).Milliseconds())
+	span.SetAttribute("success", result.Success)
+	if result.Error != nil {
+		span.RecordError(fmt.Errorf("%s: %s", result.Error.Code, result.Error.Message))
 	}
-	return nil
+	return result
 }
 
-func (r *PacketFlowRuntime) getAtomTimeout(atom *Atom, packet *PacketInfo) int {
-	if atom.Timeout != nil {
-		return *atom.Timeout
-	}
-	return packet.Metadata.Timeout
+// OnBeforeProcess registers a hook invoked with a copy of every atom before
+// ProcessAtom runs it
+func (r *PacketFlowRuntime) OnBeforeProcess(hook func(atom *Atom)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.beforeHooks = append(r.beforeHooks, hook)
 }
 
-func (r *PacketFlowRuntime) categorizeError(err error) string {
-	errMsg := err.Error()
-	if strings.Contains(errMsg, "timeout") {
-		return "E408"
+// OnAfterProcess registers a hook invoked with a copy of every ProcessAtom result
+func (r *PacketFlowRuntime) OnAfterProcess(hook func(atom *Atom, result *AtomResult)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.afterHooks = append(r.afterHooks, hook)
+}
+
+// copyAtom copies an atom with its Data, Meta, optional fields and Caller
+func (r *PacketFlowRuntime) copyAtom(atom *Atom) *Atom {
+	if atom == nil {
+		return nil
 	}
-	if strings.Contains(errMsg, "not found") {
-		return "E404"
+	copied := *atom
+	if atom.Data != nil {
+		copied.Data, _ = r.utils.deepCopy(atom.Data).(map[string]interface{})
 	}
-	if strings.Contains(errMsg, "validation") {
-		return "E403"
+	if atom.Meta != nil {
+		copied.Meta, _ = r.utils.deepCopy(atom.Meta).(map[string]interface{})
 	}
-	if strings.Contains(errMsg, "too large") {
-		return "E413"
+	if atom.Variant != nil {
+		variant := *atom.Variant
+		copied.Variant = &variant
 	}
-	return "E500"
-}
-
-func (r *PacketFlowRuntime) isPermanentError(err error) bool {
-	code := r.categorizeError(err)
-	permanentCodes := []string{"E400", "E401", "E402", "E403", "E404", "E413"}
-	for _, pc := range permanentCodes {
-		if code == pc {
-			return true
-		}
+	if atom.Priority != nil {
+		priority := *atom.Priority
+		copied.Priority = &priority
 	}
-	return false
-}
-
-func (r *PacketFlowRuntime) createResponseMeta(start time.Time) map[string]interface{} {
-	return map[string]interface{}{
-		"duration_ms": time.Since(start).Milliseconds(),
-		"reactor_id":  r.config.ReactorID,
-		"timestamp":   time.Now().Unix(),
+	if atom.Timeout != nil {
+		timeout := *atom.Timeout
+		copied.Timeout = &timeout
 	}
+	if atom.Caller != nil {
+		caller := *atom.Caller
+		caller.Permissions = append([]string(nil), atom.Caller.Permissions...)
+		copied.Caller = &caller
+	}
+	return &copied
 }
 
-func (r *PacketFlowRuntime) updatePacketStats(packet *PacketInfo, duration time.Duration, success bool) {
-	packet.Stats.Calls++
-	packet.Stats.TotalDuration += duration
-	packet.Stats.LastCalled = time.Now()
-	if !success {
-		packet.Stats.Errors++
+// copyAtomResult copies the result envelope, Error and Meta; Data is shared
+func copyAtomResult(result *AtomResult) *AtomResult {
+	copied := *result
+	if result.Error != nil {
+		atomError := *result.Error
+		copied.Error = &atomError
 	}
-	if packet.Stats.Calls > 0 {
-		packet.Stats.AvgDuration = packet.Stats.TotalDuration / time.Duration(packet.Stats.Calls)
+	copied.Meta = make(map[string]interface{}, len(result.Meta))
+	for k, v := range result.Meta {
+		copied.Meta[k] = v
 	}
+	return &copied
 }
 
-func (r *PacketFlowRuntime) updateRuntimeStats(duration time.Duration, success bool) {
-	r.stats.Processed++
-	r.stats.TotalDuration += duration
-	if !success {
-		r.stats.Errors++
+// startAtomSpan starts a span named after the packet key, continuing any
+// trace context carried in the atom's Meta
+func (r *PacketFlowRuntime) startAtomSpan(atom *Atom) Span {
+	if atom == nil {
+		_, span := r.config.Tracer.Start(context.Background(), "packetflow.atom", nil)
+		return span
 	}
-}
 
-// ============================================================================
-// Packet Utilities
-// ============================================================================
+	ctx := r.config.Tracer.Extract(context.Background(), traceCarrier(atom.Meta))
+	_, span := r.config.Tracer.Start(ctx, r.makePacketKey(atom.Group, atom.Element, r.stringValue(atom.Variant)), map[string]interface{}{
+		"atom_id": atom.ID,
+		"group":   atom.Group,
+		"element": atom.Element,
+	})
+	return span
+}
 
-// PacketUtils provides utility functions for packet handlers
-type PacketUtils struct {
-	emailRegex *regexp.Regexp
-	uuidRegex  *regexp.Regexp
+// replayResult copies a cached result, including its Data, flagging the
+// replay in its Meta
+func (r *PacketFlowRuntime) replayResult(cached *AtomResult, flag string) *AtomResult {
+	replay := copyAtomResult(cached)
+	replay.Data = r.utils.deepCopy(cached.Data)
+	replay.Meta[flag] = true
+	return replay
 }
 
-// NewPacketUtils creates a new PacketUtils instance
-func NewPacketUtils() *PacketUtils {
-	return &PacketUtils{
-		emailRegex: regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`),
-		uuidRegex:  regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+func (r *PacketFlowRuntime) processAtom(atom *Atom) *AtomResult {
+	start := time.Now()
+	correlationID := r.correlationID(atom)
+
+	// Validate atom structure
+	if err := r.validateAtom(atom); err != nil {
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      "E400",
+				Message:   err.Error(),
+				Permanent: true,
+			},
+			Meta: r.createResponseMeta(start, correlationID),
+		}
 	}
-}
 
-// Transform provides data transformation utilities
-func (u *PacketUtils) Transform(input interface{}, operation string) (interface{}, error) {
-	switch operation {
-	case "uppercase":
-		return strings.ToUpper(fmt.Sprintf("%v", input)), nil
-	case "lowercase":
-		return strings.ToLower(fmt.Sprintf("%v", input)), nil
-	case "trim":
-		return strings.TrimSpace(fmt.Sprintf("%v", input)), nil
-	case "uuid":
-		return uuid.New().String(), nil
-	case "hash_md5":
-		hash := md5.Sum([]byte(fmt.Sprintf("%v", input)))
-		return fmt.Sprintf("%x", hash), nil
-	case "hash_sha256":
-		hash := sha256.Sum256([]byte(fmt.Sprintf("%v", input)))
-		return fmt.Sprintf("%x", hash), nil
-	case "base64_encode":
-		return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%v", input))), nil
-	case "base64_decode":
-		decoded, err := base64.StdEncoding.DecodeString(fmt.Sprintf("%v", input))
-		if err != nil {
-			return nil, err
+	// Under overload, shed low-priority atoms to keep serving urgent ones
+	if r.config.ShedLoadThreshold > 0 && r.atomPriority(atom) > r.config.ShedPriorityCutoff {
+		if load := r.currentLoad(); load >= r.config.ShedLoadThreshold {
+			atomic.AddInt64(&r.shed, 1)
+			return &AtomResult{
+				Success: false,
+				Error: &AtomError{
+					Code:      "E503",
+					Message:   fmt.Sprintf("reactor overloaded (load %.1f%%): shedding atoms with priority above %d", load, r.config.ShedPriorityCutoff),
+					Permanent: false,
+				},
+				Meta: r.createResponseMeta(start, correlationID),
+			}
 		}
-		return string(decoded), nil
-	case "url_encode":
-		return url.QueryEscape(fmt.Sprintf("%v", input)), nil
-	case "url_decode":
-		return url.QueryUnescape(fmt.Sprintf("%v", input))
-	case "json_parse":
-		var result interface{}
-		err := json.Unmarshal([]byte(fmt.Sprintf("%v", input)), &result)
-		return result, err
-	case "json_stringify":
-		return json.Marshal(input)
-	default:
-		return nil, fmt.Errorf("unknown transformation operation: %s", operation)
 	}
-}
 
-// Validate provides data validation utilities
-func (u *PacketUtils) Validate(data interface{}, schema string) (bool, error) {
-	dataStr := fmt.Sprintf("%v", data)
-	
-	switch schema {
-	case "email":
-		return u.emailRegex.MatchString(dataStr), nil
-	case "uuid":
-		return u.uuidRegex.MatchString(strings.ToLower(dataStr)), nil
-	case "url":
-		_, err := url.Parse(dataStr)
-		return err == nil, nil
-	case "integer":
-		_, err := strconv.Atoi(dataStr)
-		return err == nil, nil
-	case "float":
-		_, err := strconv.ParseFloat(dataStr, 64)
-		return err == nil, nil
-	case "boolean":
-		_, err := strconv.ParseBool(dataStr)
-		return err == nil, nil
-	case "json":
-		var temp interface{}
-		err := json.Unmarshal([]byte(dataStr), &temp)
-		return err == nil, nil
-	default:
-		return false, fmt.Errorf("unknown schema: %s", schema)
+	if r.config.RejectDuplicateInFlight {
+		if !r.claimInFlight(atom.ID) {
+			return &AtomResult{
+				Success: false,
+				Error: &AtomError{
+					Code:      "E409",
+					Message:   fmt.Sprintf("atom %s is already being processed", atom.ID),
+					Permanent: false,
+				},
+				Meta: r.createResponseMeta(start, correlationID),
+			}
+		}
+		defer r.releaseInFlight(atom.ID)
 	}
-}
 
-// CalculateStatistics calculates basic statistics for numeric data
-func (u *PacketUtils) CalculateStatistics(data []float64) map[string]interface{} {
-	if len(data) == 0 {
-		return map[string]interface{}{"error": "no data provided"}
+	requestedKey := r.makePacketKey(atom.Group, atom.Element, r.stringValue(atom.Variant))
+	atom = r.resolveAlias(atom)
+
+	r.mu.RLock()
+	packet, exists := r.resolvePacket(atom.Group, atom.Element, r.stringValue(atom.Variant))
+	r.mu.RUnlock()
+
+	if !exists {
+		if r.config.ForwardUnknown {
+			if result, forwarded := r.forwardAtom(atom, start, correlationID); forwarded {
+				return result
+			}
+		}
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      "E404",
+				Message:   fmt.Sprintf("Unsupported packet type: %s", requestedKey),
+				Permanent: true,
+			},
+			Meta: r.createResponseMeta(start, correlationID),
+		}
 	}
+	key := packet.Key
 
-	// Sort for median calculation
-	sorted := make([]float64, len(data))
-	copy(sorted, data)
-	sort.Float64s(sorted)
+	if r.config.CheckDependencies {
+		r.mu.RLock()
+		missing := r.missingDependencies(packet.Metadata.Dependencies)
+		r.mu.RUnlock()
 
-	// Calculate basic statistics
-	sum := 0.0
-	for _, v := range data {
-		sum += v
+		if len(missing) > 0 {
+			return &AtomResult{
+				Success: false,
+				Error: &AtomError{
+					Code:      "E503",
+					Message:   fmt.Sprintf("missing dependencies for %s: %s", key, strings.Join(missing, ", ")),
+					Permanent: false,
+				},
+				Meta: r.createResponseMeta(start, correlationID),
+			}
+		}
 	}
-	mean := sum / float64(len(data))
 
-	// Median
-	var median float64
-	n := len(sorted)
-	if n%2 == 0 {
-		median = (sorted[n/2-1] + sorted[n/2]) / 2
-	} else {
-		median = sorted[n/2]
+	r.mu.RLock()
+	authorizer := r.authorizer
+	handler := r.chainMiddleware(packet.Handler)
+	r.mu.RUnlock()
+
+	if err := authorizer.Authorize(atom, packet); err != nil {
+		code := "E403"
+		if errors.Is(err, ErrUnauthenticated) {
+			code = "E401"
+		}
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      code,
+				Message:   err.Error(),
+				Permanent: true,
+				cause:     err,
+			},
+			Meta: r.createResponseMeta(start, correlationID),
+		}
 	}
 
-	// Variance and standard deviation
-	variance := 0.0
-	for _, v := range data {
-		variance += math.Pow(v-mean, 2)
+	execute := func() *AtomResult {
+		return r.executeAtom(atom, packet, handler, requestedKey, start, correlationID)
+	}
+	if r.idempotency == nil || atom.ID == "" {
+		return execute()
 	}
-	variance /= float64(len(data))
-	stdDev := math.Sqrt(variance)
 
-	return map[string]interface{}{
-		"count":              len(data),
-		"sum":                sum,
-		"mean":               mean,
-		"median":             median,
-		"min":                sorted[0],
-		"max":                sorted[n-1],
-		"variance":           variance,
-		"standard_deviation": stdDev,
+	// Duplicate submissions replay the cached result without re-running the
+	// handler. Replays follow authorization and are scoped to the caller and
+	// packet, so one caller cannot read another's result by guessing its ID.
+	ttl := time.Duration(r.config.IdempotencyTTL) * time.Second
+	result, replayed := r.idempotency.Do(idempotencyKey(atom, key), ttl, execute, func(result *AtomResult) bool {
+		return result.Success || r.config.IdempotencyCacheFailures
+	})
+	if replayed {
+		return r.replayResult(result, "idempotent_replay")
 	}
+	return result
 }
 
-// FilterData filters slice data based on conditions
-func (u *PacketUtils) FilterData(data []map[string]interface{}, condition map[string]interface{}) []map[string]interface{} {
-	var result []map[string]interface{}
-	
-	for _, item := range data {
-		if u.matchesCondition(item, condition) {
-			result = append(result, item)
+// executeAtom runs the checks that follow authorization and then the
+// packet handler
+func (r *PacketFlowRuntime) executeAtom(atom *Atom, packet *PacketInfo, handler PacketHandler, requestedKey string, start time.Time, correlationID string) *AtomResult {
+	key := packet.Key
+
+	// Reject oversized payloads before they reach the handler
+	if err := r.checkPayloadSize(atom, packet); err != nil {
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      "E413",
+				Message:   err.Error(),
+				Permanent: true,
+			},
+			Meta: r.createResponseMeta(start, correlationID),
 		}
 	}
-	
-	return result
-}
 
-func (u *PacketUtils) matchesCondition(item, condition map[string]interface{}) bool {
-	for key, value := range condition {
-		itemValue, exists := item[key]
-		if !exists {
-			return false
+	// Reject input that does not match the packet's declared schema
+	if fieldErrors := r.utils.ValidateSchema(atom.Data, packet.Metadata.InputSchema); len(fieldErrors) > 0 {
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      "E400",
+				Message:   fmt.Sprintf("invalid input for %s: %d field error(s)", key, len(fieldErrors)),
+				Details:   map[string]interface{}{"fields": fieldErrors},
+				Permanent: true,
+			},
+			Meta: r.createResponseMeta(start, correlationID),
 		}
-		
-		// Handle operator objects like {$gt: 18}
-		if valueMap, ok := value.(map[string]interface{}); ok {
-			if !u.evaluateOperators(itemValue, valueMap) {
-				return false
-			}
-		} else {
-			// Direct value comparison
-			if itemValue != value {
-				return false
+	}
+
+	// Deterministic packets replay a cached result for identical input
+	var cacheKey string
+	if packet.Metadata.Cacheable {
+		cacheKey = r.resultCacheKey(key, atom.Data)
+		if cacheKey != "" {
+			if cached, hit := r.resultCache.Get(cacheKey); hit {
+				r.recordCacheLookup(true)
+				// Each hit gets its own copy so callers cannot alter the entry
+				replay := &AtomResult{
+					Success: true,
+					Data:    r.utils.deepCopy(cached.(*AtomResult).Data),
+					Meta:    r.createResponseMeta(start, correlationID),
+				}
+				replay.Meta["cached"] = true
+				return replay
 			}
+			r.recordCacheLookup(false)
 		}
 	}
-	return true
-}
 
-func (u *PacketUtils) evaluateOperators(itemValue interface{}, operators map[string]interface{}) bool {
-	for op, val := range operators {
-		switch op {
-		case "$gt":
-			if !u.compareValues(itemValue, val, ">") {
-				return false
-			}
-		case "$gte":
-			if !u.compareValues(itemValue, val, ">=") {
-				return false
-			}
-		case "$lt":
-			if !u.compareValues(itemValue, val, "<") {
-				return false
-			}
-		case "$lte":
-			if !u.compareValues(itemValue, val, "<=") {
-				return false
-			}
-		case "$ne":
-			if itemValue == val {
-				return false
-			}
-		default:
-			if itemValue != val {
-				return false
+	// Heavy packets draw more from the cost budget than cheap ones
+	if r.budget != nil {
+		cost := packetCost(packet)
+		if !r.budget.AllowN(cost) {
+			atomic.AddInt64(&r.budgetRejected, 1)
+			return &AtomResult{
+				Success: false,
+				Error: &AtomError{
+					Code:      "E429",
+					Message:   fmt.Sprintf("cost budget exhausted: %s costs %g, %.2f remaining", key, cost, r.budget.Available()),
+					Permanent: false,
+				},
+				Meta: r.createResponseMeta(start, correlationID),
 			}
 		}
 	}
-	return true
-}
 
-func (u *PacketUtils) compareValues(a, b interface{}, op string) bool {
-	// Convert to float64 for numeric comparison
-	aFloat, aOk := u.toFloat64(a)
-	bFloat, bOk := u.toFloat64(b)
-	
-	if !aOk || !bOk {
-		return false
+	// Create execution context
+	ctx := &ExecutionContext{
+		Atom:             atom,
+		Runtime:          r,
+		StartTime:        start,
+		RequestID:        uuid.New().String(),
+		CorrelationID:    correlationID,
+		Metadata:         packet.Metadata,
+		PacketKey:        key,
+		RequestedElement: atom.Element,
+		RequestedVariant: r.stringValue(atom.Variant),
+		Caller:           atom.Caller,
+		Utils:            r.utils,
 	}
-	
-	switch op {
-	case ">":
-		return aFloat > bFloat
-	case ">=":
-		return aFloat >= bFloat
-	case "<":
-		return aFloat < bFloat
-	case "<=":
-		return aFloat <= bFloat
-	default:
-		return false
+	responseMeta := func() map[string]interface{} {
+		meta := r.createResponseMeta(start, correlationID)
+		meta["request_id"] = ctx.RequestID
+		if key != requestedKey {
+			meta["resolved_packet"] = key
+		}
+		return meta
 	}
-}
 
-func (u *PacketUtils) toFloat64(v interface{}) (float64, bool) {
-	switch val := v.(type) {
-	case float64:
-		return val, true
-	case float32:
-		return float64(val), true
-	case int:
-		return float64(val), true
-	case int64:
-		return float64(val), true
-	case int32:
-		return float64(val), true
-	default:
-		if str, ok := v.(string); ok {
-			if f, err := strconv.ParseFloat(str, 64); err == nil {
-				return f, true
-			}
+	// The timeout covers queueing and execution; handlers that honour
+	// ctx.Context stop once it expires. An absolute deadline in Meta shortens
+	// the timeout.
+	timeout := r.getAtomTimeout(atom, packet)
+	budget, open := r.deadlineBudget(atom, time.Duration(timeout)*time.Second)
+	if !open {
+		r.updatePacketStats(packet, time.Since(start), false)
+		r.updateRuntimeStats(time.Since(start), false)
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      "E408",
+				Message:   "atom deadline has already passed",
+				Permanent: true,
+			},
+			Meta: responseMeta(),
 		}
-		return 0, false
 	}
-}
-
-// ============================================================================
-// Standard Library Implementation
-// ============================================================================
+	timeoutMessage := fmt.Sprintf("Packet timeout after %ds", timeout)
+	if timeout == 0 || budget < time.Duration(timeout)*time.Second {
+		timeoutMessage = fmt.Sprintf("atom deadline exceeded after %s", budget.Round(time.Millisecond))
+	}
+	var handlerCtx context.Context
+	var cancel context.CancelFunc
+	if budget > 0 {
+		handlerCtx, cancel = context.WithTimeout(context.Background(), budget)
+	} else {
+		// An explicit zero timeout without a deadline is unbounded
+		handlerCtx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	ctx.Context = handlerCtx
 
-func (r *PacketFlowRuntime) registerStandardLibrary() {
-	// Control Flow packets (Level 1 - Core)
-	r.registerControlFlowPackets()
-	
-	// Data Flow packets (Level 1 - Core)
-	r.registerDataFlowPackets()
-	
-	// Event Driven packets (Level 1 - Core)
-	r.registerEventDrivenPackets()
-	
-	// Collective packets (Level 1 - Core)
-	r.registerCollectivePackets()
-	
-	// Resource Management packets (Level 1 - Core)
-	r.registerResourceManagementPackets()
-}
+	// Wait for an execution slot; higher-priority atoms are admitted first under load
+	if err := r.acquireSlot(handlerCtx, r.atomPriority(atom)); err != nil {
+		r.updatePacketStats(packet, time.Since(start), false)
+		r.updateRuntimeStats(time.Since(start), false)
 
-func (r *PacketFlowRuntime) registerControlFlowPackets() {
-	// cf:ping - Basic connectivity test
-	r.RegisterPacket("cf", "ping", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		startTime := time.Now()
-		
-		echo := "pong"
-		if echoVal, exists := data["echo"]; exists {
-			echo = fmt.Sprintf("%v", echoVal)
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      "E408",
+				Message:   timeoutMessage + " waiting for an execution slot",
+				Permanent: false,
+			},
+			Meta: responseMeta(),
 		}
-		
-		var clientTime *int64
-		if ts, exists := data["timestamp"]; exists {
-			if tsInt, ok := ts.(int64); ok {
-				clientTime = &tsInt
+	}
+	defer r.releaseSlot()
+
+	// state moves from running to finished or abandoned exactly once
+	const (
+		handlerRunning int32 = iota
+		handlerFinished
+		handlerAbandoned
+	)
+	var state int32
+	done := make(chan struct{})
+	var result interface{}
+	var err error
+	var panicked *AtomError
+
+	started := r.execute(handlerCtx, func() {
+		defer close(done)
+		// A panicking handler fails its atom instead of crashing the runtime
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				stack := string(debug.Stack())
+				log.Printf("❌ Packet %s panicked: %v\n%s", key, recovered, stack)
+				panicked = &AtomError{
+					Code:    "E500",
+					Message: fmt.Sprintf("handler panic: %v", recovered),
+					Details: map[string]interface{}{
+						"panic": fmt.Sprint(recovered),
+						"stack": stack,
+					},
+					Permanent: false,
+				}
 			}
-		}
-		
-		result := map[string]interface{}{
-			"echo":        echo,
-			"server_time": time.Now().UnixMilli(),
-		}
-		
-		if clientTime != nil {
-			result["client_time"] = *clientTime
-			result["latency_ms"] = time.Now().UnixMilli() - *clientTime
-		}
-		
-		log.Printf("[cf:ping] Response time: %v", time.Since(startTime))
-		return result, nil
-	}, PacketMetadata{
-		Timeout:         5,
-		ComplianceLevel: 1,
-		Description:     "Basic connectivity and latency testing",
-		MaxPayloadSize:  1024,
+		}()
+		defer func() {
+			if !atomic.CompareAndSwapInt32(&state, handlerRunning, handlerFinished) {
+				atomic.AddInt64(&r.abandoned, -1)
+			}
+		}()
+		result, err = handler(atom.Data, ctx)
 	})
+	if !started {
+		// The deadline passed before a worker was free; the handler never ran
+		r.updatePacketStats(packet, time.Since(start), false)
+		r.updateRuntimeStats(time.Since(start), false)
 
-	// cf:health - Health status information
-	r.RegisterPacket("cf", "health", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		var m runtime.MemStats
-		runtime.ReadMemStats(&m)
-		
-		detail := false
-		if detailVal, exists := data["detail"]; exists {
-			if detailBool, ok := detailVal.(bool); ok {
-				detail = detailBool
-			}
-		}
-		
-		health := map[string]interface{}{
-			"status":  "healthy",
-			"load":    int(float64(m.HeapInuse) / float64(m.HeapSys) * 100),
-			"uptime":  time.Since(ctx.Runtime.startTime).Seconds(),
-			"version": "1.0.0",
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      "E408",
+				Message:   timeoutMessage + " waiting for a worker",
+				Permanent: false,
+			},
+			Meta: responseMeta(),
 		}
+	}
+
+	select {
+	case <-done:
+		duration := time.Since(start)
 		
-		if detail {
-			health["details"] = map[string]interface{}{
-				"memory_mb":     m.Alloc / 1024 / 1024,
-				"cpu_percent":   runtime.NumGoroutine(), // Proxy for CPU activity
-				"queue_depth":   0,                       // Would implement actual queue tracking
-				"connections":   ctx.Runtime.GetStats().ConnectionCount,
+		if panicked != nil {
+			r.updatePacketStats(packet, duration, false)
+			r.updateRuntimeStats(duration, false)
+
+			return &AtomResult{
+				Success: false,
+				Error:   panicked,
+				Meta:    responseMeta(),
 			}
 		}
-		
-		return health, nil
-	}, PacketMetadata{
-		Timeout:         10,
-		ComplianceLevel: 1,
-		Description:     "Reactor health and status information",
-	})
 
-	// cf:info - Reactor capabilities
-	r.RegisterPacket("cf", "info", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		packets := make([]string, 0, len(ctx.Runtime.packets))
-		ctx.Runtime.mu.RLock()
-		for key := range ctx.Runtime.packets {
-			packets = append(packets, key)
+		if err != nil {
+			r.updatePacketStats(packet, duration, false)
+			r.updateRuntimeStats(duration, false)
+			
+			return &AtomResult{
+				Success: false,
+				Error:   r.handlerError(err),
+				Meta:    responseMeta(),
+			}
 		}
-		ctx.Runtime.mu.RUnlock()
-		
-		return map[string]interface{}{
-			"name":     ctx.Runtime.config.ReactorID,
-			"version":  "1.0.0",
-			"types":    []string{"general", "cpu_bound", "memory_bound", "io_bound"},
-			"groups":   []string{"cf", "df", "ed", "co", "rm"},
-			"packets":  packets,
-			"capacity": map[string]interface{}{
-				"max_concurrent":     ctx.Runtime.config.MaxConcurrent,
-				"max_queue_depth":    10000,
-				"max_message_size":   ctx.Runtime.config.MaxPacketSize,
-			},
-			"features": []string{"standard_library", "binary_protocol"},
-		}, nil
-	}, PacketMetadata{
-		Timeout:         5,
-		ComplianceLevel: 1,
-		Description:     "Reactor capabilities and configuration",
-	})
-}
 
-func (r *PacketFlowRuntime) registerDataFlowPackets() {
-	// df:transform - Generic data transformation
-	r.RegisterPacket("df", "transform", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		input, exists := data["input"]
-		if !exists {
-			return nil, fmt.Errorf("input is required")
+		if len(packet.Metadata.OutputSchema) > 0 {
+			sanitized, fieldErrors := r.utils.SanitizeOutput(result, packet.Metadata.OutputSchema)
+			if len(fieldErrors) > 0 {
+				r.updatePacketStats(packet, duration, false)
+				r.updateRuntimeStats(duration, false)
+
+				return &AtomResult{
+					Success: false,
+					Error: &AtomError{
+						Code:      "E500",
+						Message:   fmt.Sprintf("invalid output from %s: %d field error(s)", key, len(fieldErrors)),
+						Details:   map[string]interface{}{"fields": fieldErrors},
+						Permanent: false,
+					},
+					Meta: responseMeta(),
+				}
+			}
+			result = sanitized
 		}
-		
-		operation, exists := data["operation"]
-		if !exists {
-			return nil, fmt.Errorf("operation is required")
+
+		r.updatePacketStats(packet, duration, true)
+		r.updateRuntimeStats(duration, true)
+
+		atomResult := &AtomResult{
+			Success: true,
+			Data:    result,
+			Meta:    responseMeta(),
 		}
-		
-		opStr, ok := operation.(string)
-		if !ok {
-			return nil, fmt.Errorf("operation must be a string")
+		if cacheKey != "" {
+			cached := &AtomResult{Success: true, Data: r.utils.deepCopy(result)}
+			r.resultCache.Set(cacheKey, cached, r.cacheTTL(packet))
 		}
-		
-		result, err := ctx.Utils.Transform(input, opStr)
-		if err != nil {
-			return nil, err
+		return atomResult
+
+	case <-handlerCtx.Done():
+		// Count the handler as abandoned before publishing the state so its
+		// goroutine never decrements ahead of the increment
+		atomic.AddInt64(&r.abandoned, 1)
+		if !atomic.CompareAndSwapInt32(&state, handlerRunning, handlerAbandoned) {
+			atomic.AddInt64(&r.abandoned, -1)
+		} else {
+			atomic.AddInt64(&r.abandonedTotal, 1)
 		}
-		
-		return map[string]interface{}{
-			"input":          input,
-			"operation":      operation,
-			"result":         result,
-			"transformed_at": time.Now().Unix(),
-		}, nil
-	}, PacketMetadata{
-		Timeout:         30,
-		ComplianceLevel: 1,
-		Description:     "Generic data transformation",
-		MaxPayloadSize:  100 * 1024, // 100KB
+
+		r.updatePacketStats(packet, time.Since(start), false)
+		r.updateRuntimeStats(time.Since(start), false)
+
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      "E408",
+				Message:   timeoutMessage,
+				Permanent: false,
+			},
+			Meta: responseMeta(),
+		}
+	}
+}
+
+// ProcessBatch processes atoms concurrently, bounded by MaxConcurrent, and
+// returns their results in input order. A failing atom does not affect the others.
+func (r *PacketFlowRuntime) ProcessBatch(atoms []*Atom) []*AtomResult {
+	results := make([]*AtomResult, len(atoms))
+	semaphore := make(chan struct{}, r.config.MaxConcurrent)
+	var wg sync.WaitGroup
+
+	for i, atom := range atoms {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, atom *Atom) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			results[i] = r.ProcessAtom(atom)
+		}(i, atom)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// SetDeadLetterSink sets the sink receiving permanently failed atoms; nil disables it
+func (r *PacketFlowRuntime) SetDeadLetterSink(sink DeadLetterSink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deadLetters = sink
+}
+
+// SetRecorder sets the recorder capturing every processed atom and its
+// result; nil stops recording. The previous recorder is not closed.
+func (r *PacketFlowRuntime) SetRecorder(recorder *TrafficRecorder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recorder = recorder
+}
+
+func (r *PacketFlowRuntime) deadLetter(atom *Atom, result *AtomResult, duration time.Duration) {
+	r.mu.RLock()
+	sink := r.deadLetters
+	r.mu.RUnlock()
+
+	if sink == nil {
+		return
+	}
+
+	correlationID, _ := result.Meta["correlation_id"].(string)
+	letter := DeadLetter{
+		Atom:          atom,
+		Error:         result.Error,
+		PacketKey:     r.makePacketKey(atom.Group, atom.Element, r.stringValue(atom.Variant)),
+		CorrelationID: correlationID,
+		FailedAt:      time.Now(),
+		Duration:      duration,
+	}
+	if err := sink.Send(letter); err != nil {
+		log.Printf("Dead-letter delivery failed for atom %s: %v", atom.ID, err)
+	}
+}
+
+// Use appends a middleware around every packet handler. Middlewares run in
+// registration order: the first registered is the outermost.
+func (r *PacketFlowRuntime) Use(mw Middleware) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middlewares = append(r.middlewares, mw)
+}
+
+// chainMiddleware composes the registered middlewares around handler; the
+// caller must hold r.mu
+func (r *PacketFlowRuntime) chainMiddleware(handler PacketHandler) PacketHandler {
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		handler = r.middlewares[i](handler)
+	}
+	return handler
+}
+
+// SetAuthorizer replaces the authorizer used to check packet permissions
+func (r *PacketFlowRuntime) SetAuthorizer(authorizer Authorizer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.authorizer = authorizer
+}
+
+// MarkReady moves a starting runtime to ready once every declared dependency
+// is registered. Call it again after registering packets that fixed an error.
+func (r *PacketFlowRuntime) MarkReady() error {
+	if err := r.ValidateDependencies(); err != nil {
+		return err
+	}
+	atomic.CompareAndSwapInt32(&r.state, StateStarting, StateReady)
+	return nil
+}
+
+// Drain marks the runtime as draining so readiness probes stop routing to it
+func (r *PacketFlowRuntime) Drain() {
+	for {
+		state := atomic.LoadInt32(&r.state)
+		if state == StateClosed || atomic.CompareAndSwapInt32(&r.state, state, StateDraining) {
+			return
+		}
+	}
+}
+
+// State returns the lifecycle state: starting, ready, draining or closed
+func (r *PacketFlowRuntime) State() string {
+	return stateNames[atomic.LoadInt32(&r.state)]
+}
+
+// Close tears the runtime down for good. New atoms are rejected with E503;
+// background work and scheduled tasks stop, WebSocket clients and reactor
+// connections are closed, and Close waits for in-flight atoms and the worker
+// pool until ctx ends. Later calls return the first call's result.
+func (r *PacketFlowRuntime) Close(ctx context.Context) error {
+	r.closeOnce.Do(func() {
+		r.closeErr = r.close(ctx)
 	})
+	return r.closeErr
+}
 
-	// df:validate - Data validation
-	r.RegisterPacket("df", "validate", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		inputData, exists := data["data"]
-		if !exists {
-			return nil, fmt.Errorf("data is required")
+func (r *PacketFlowRuntime) close(ctx context.Context) error {
+	r.closeMu.Lock()
+	atomic.StoreInt32(&r.state, StateClosed)
+	r.closeMu.Unlock()
+
+	r.connectionsMu.RLock()
+	clients := make([]*ClientConnection, 0, len(r.connections))
+	for _, client := range r.connections {
+		clients = append(clients, client)
+	}
+	r.connectionsMu.RUnlock()
+
+	// As with a full send queue, the close frame is best effort
+	for _, client := range clients {
+		client.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "runtime closed"), time.Now().Add(time.Second))
+		client.Conn.Close()
+	}
+
+	if err := waitContext(ctx, r.StopBackground); err != nil {
+		return fmt.Errorf("stopping background work: %w", err)
+	}
+	if err := waitContext(ctx, r.processing.Wait); err != nil {
+		return fmt.Errorf("draining in-flight atoms: %w", err)
+	}
+	if err := r.ShutdownWorkers(ctx); err != nil {
+		return fmt.Errorf("stopping workers: %w", err)
+	}
+	r.reactorClient.Close()
+
+	log.Printf("🛑 PacketFlow runtime closed (Reactor: %s)", r.config.ReactorID)
+	return nil
+}
+
+// waitContext runs wait, returning early with ctx's error if ctx ends first
+func waitContext(ctx context.Context, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *PacketFlowRuntime) enterProcessing() bool {
+	r.closeMu.RLock()
+	defer r.closeMu.RUnlock()
+
+	if atomic.LoadInt32(&r.state) == StateClosed {
+		return false
+	}
+	r.processing.Add(1)
+	return true
+}
+
+// ValidateDependencies verifies that every declared dependency is registered
+// and that the dependency graph is acyclic
+func (r *PacketFlowRuntime) ValidateDependencies() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]string, 0, len(r.packets))
+	for key := range r.packets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, key := range keys {
+		if missing := r.missingDependencies(r.packets[key].Metadata.Dependencies); len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("%s requires %s", key, strings.Join(missing, ", ")))
 		}
-		
-		schema, exists := data["schema"]
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("missing dependencies: %s", strings.Join(problems, "; "))
+	}
+
+	if cycle := findDependencyCycle(r.dependencyGraph()); cycle != nil {
+		return fmt.Errorf("dependency cycle detected: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// GetDependencyGraph returns the packet dependency adjacency map
+func (r *PacketFlowRuntime) GetDependencyGraph() map[string][]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.dependencyGraph()
+}
+
+// GetConnectionStats returns per-connection statistics keyed by connection ID
+func (r *PacketFlowRuntime) GetConnectionStats() map[string]ConnectionStats {
+	r.connectionsMu.RLock()
+	defer r.connectionsMu.RUnlock()
+
+	stats := make(map[string]ConnectionStats, len(r.connections))
+	for id, conn := range r.connections {
+		stats[id] = conn.Stats()
+	}
+	return stats
+}
+
+// GetStats returns current runtime statistics
+func (r *PacketFlowRuntime) GetStats() RuntimeStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := r.stats
+	stats.Uptime = time.Since(r.startTime)
+	stats.MemoryUsage = int64(m.Alloc)
+	stats.PacketsTotal = len(r.packets)
+	stats.ActiveAtoms = r.activeAtoms
+	stats.QueueDepth = r.queue.Len()
+	stats.ThroughputPerSec, stats.ErrorRateWindow = r.window.Rates(time.Now(), r.startTime)
+	stats.AbandonedHandlers = atomic.LoadInt64(&r.abandoned)
+	stats.AbandonedTotal = atomic.LoadInt64(&r.abandonedTotal)
+	stats.BudgetRejected = atomic.LoadInt64(&r.budgetRejected)
+	stats.Shed = atomic.LoadInt64(&r.shed)
+	if r.workers != nil {
+		stats.Workers = r.workers.Size()
+	}
+	if r.budget != nil {
+		remaining := r.budget.Available()
+		stats.CostBudgetRemaining = &remaining
+	}
+
+	r.connectionsMu.RLock()
+	stats.ConnectionCount = len(r.connections)
+	r.connectionsMu.RUnlock()
+
+	if stats.Processed > 0 {
+		stats.AvgLatency = stats.TotalDuration / time.Duration(stats.Processed)
+	}
+
+	return stats
+}
+
+// PacketStatsEntry is one packet's stats as reported by PacketStatsReport
+type PacketStatsEntry struct {
+	Stats           PacketStats
+	ComplianceLevel int
+}
+
+// OtherPacketStats merges the stats of variant packets beyond the
+// StatsCardinality cap
+type OtherPacketStats struct {
+	Packets int
+	Stats   PacketStats
+}
+
+// PacketStatsReport returns stats snapshots by packet key. Packets without a
+// variant are always reported. When StatsCardinality is set, only that many
+// variants are reported individually, the most called (then most recently
+// called) first, and the rest are merged into the returned other stats.
+func (r *PacketFlowRuntime) PacketStatsReport() (map[string]PacketStatsEntry, *OtherPacketStats) {
+	type variantStats struct {
+		key   string
+		entry PacketStatsEntry
+	}
+
+	entries := make(map[string]PacketStatsEntry)
+	var variants []variantStats
+
+	r.mu.RLock()
+	for key, packet := range r.packets {
+		entry := PacketStatsEntry{Stats: packet.StatsSnapshot(), ComplianceLevel: packet.Metadata.ComplianceLevel}
+		if packet.Variant == "" || r.config.StatsCardinality <= 0 {
+			entries[key] = entry
+			continue
+		}
+		variants = append(variants, variantStats{key, entry})
+	}
+	r.mu.RUnlock()
+
+	if len(variants) <= r.config.StatsCardinality {
+		for _, variant := range variants {
+			entries[variant.key] = variant.entry
+		}
+		return entries, nil
+	}
+
+	sort.Slice(variants, func(i, j int) bool {
+		a, b := variants[i].entry.Stats, variants[j].entry.Stats
+		if a.Calls != b.Calls {
+			return a.Calls > b.Calls
+		}
+		if !a.LastCalled.Equal(b.LastCalled) {
+			return a.LastCalled.After(b.LastCalled)
+		}
+		return variants[i].key < variants[j].key
+	})
+
+	for _, variant := range variants[:r.config.StatsCardinality] {
+		entries[variant.key] = variant.entry
+	}
+
+	other := &OtherPacketStats{}
+	for _, variant := range variants[r.config.StatsCardinality:] {
+		other.Packets++
+		other.Stats.merge(variant.entry.Stats)
+	}
+	return entries, other
+}
+
+// SavedStats holds the cumulative counters carried across restarts by
+// ExportStats and ImportStats
+type SavedStats struct {
+	SavedAt       time.Time              `json:"saved_at"`
+	Processed     int64                  `json:"processed"`
+	Errors        int64                  `json:"errors"`
+	TotalDuration time.Duration          `json:"total_duration"`
+	CacheHits     int64                  `json:"cache_hits"`
+	CacheMisses   int64                  `json:"cache_misses"`
+	Packets       map[string]PacketStats `json:"packets"`
+}
+
+// ExportStats serializes the cumulative runtime and per-packet counters as
+// JSON. Uptime and gauges such as active atoms are not included.
+func (r *PacketFlowRuntime) ExportStats() ([]byte, error) {
+	r.mu.RLock()
+	saved := SavedStats{
+		SavedAt:       time.Now(),
+		Processed:     r.stats.Processed,
+		Errors:        r.stats.Errors,
+		TotalDuration: r.stats.TotalDuration,
+		CacheHits:     r.stats.CacheHits,
+		CacheMisses:   r.stats.CacheMisses,
+		Packets:       make(map[string]PacketStats, len(r.packets)+len(r.pendingStats)),
+	}
+	for key, stats := range r.pendingStats {
+		saved.Packets[key] = stats
+	}
+	for key, packet := range r.packets {
+		saved.Packets[key] = packet.StatsSnapshot()
+	}
+	r.mu.RUnlock()
+
+	return json.Marshal(saved)
+}
+
+// ImportStats adds counters saved by ExportStats to the current ones, so a
+// restarted reactor resumes its totals. Stats for packets that are not yet
+// registered are kept and applied when the packet registers.
+func (r *PacketFlowRuntime) ImportStats(data []byte) error {
+	var saved SavedStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid stats snapshot: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stats.Processed += saved.Processed
+	r.stats.Errors += saved.Errors
+	r.stats.TotalDuration += saved.TotalDuration
+	r.stats.CacheHits += saved.CacheHits
+	r.stats.CacheMisses += saved.CacheMisses
+
+	for key, stats := range saved.Packets {
+		packet, exists := r.packets[key]
 		if !exists {
-			return nil, fmt.Errorf("schema is required")
+			pending := r.pendingStats[key]
+			pending.merge(stats)
+			r.pendingStats[key] = pending
+			continue
 		}
-		
-		schemaStr, ok := schema.(string)
-		if !ok {
-			return nil, fmt.Errorf("schema must be a string")
+		packet.statsMu.Lock()
+		packet.Stats.merge(stats)
+		packet.statsMu.Unlock()
+	}
+	return nil
+}
+
+// dependencyGraph builds the adjacency map; the caller must hold r.mu
+func (r *PacketFlowRuntime) dependencyGraph() map[string][]string {
+	graph := make(map[string][]string, len(r.packets))
+	for key, packet := range r.packets {
+		deps := make([]string, len(packet.Metadata.Dependencies))
+		copy(deps, packet.Metadata.Dependencies)
+		graph[key] = deps
+	}
+	return graph
+}
+
+// missingDependencies lists dependencies that are not registered; the caller must hold r.mu
+func (r *PacketFlowRuntime) missingDependencies(deps []string) []string {
+	var missing []string
+	for _, dep := range deps {
+		if _, exists := r.packets[dep]; !exists {
+			missing = append(missing, dep)
 		}
-		
-		valid, err := ctx.Utils.Validate(inputData, schemaStr)
-		if err != nil {
-			return nil, err
+	}
+	return missing
+}
+
+// findDependencyCycle returns the first cycle found in the graph as a path
+// that starts and ends at the same packet, or nil when the graph is acyclic
+func findDependencyCycle(graph map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int, len(graph))
+	var path []string
+	var visit func(key string) []string
+	visit = func(key string) []string {
+		switch state[key] {
+		case visiting:
+			for i, k := range path {
+				if k == key {
+					return append(append([]string{}, path[i:]...), key)
+				}
+			}
+		case visited:
+			return nil
 		}
-		
-		result := map[string]interface{}{
-			"valid": valid,
+
+		state[key] = visiting
+		path = append(path, key)
+		for _, dep := range graph[key] {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
 		}
-		
-		if !valid {
-			result["errors"] = []string{fmt.Sprintf("validation failed for schema: %s", schemaStr)}
+		path = path[:len(path)-1]
+		state[key] = visited
+		return nil
+	}
+
+	keys := make([]string, 0, len(graph))
+	for key := range graph {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if cycle := visit(key); cycle != nil {
+			return cycle
 		}
-		
-		return result, nil
-	}, PacketMetadata{
-		Timeout:         15,
-		ComplianceLevel: 1,
-		Description:     "Data validation against schemas",
+	}
+	return nil
+}
+
+// Helper methods
+// DescribePacket returns a packet's metadata, stats, registration time and
+// input schema
+func (r *PacketFlowRuntime) DescribePacket(key string) (map[string]interface{}, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	packet, exists := r.packets[key]
+	if !exists {
+		return nil, false
+	}
+
+	return map[string]interface{}{
+		"key":           packet.Key,
+		"group":         packet.Group,
+		"element":       packet.Element,
+		"variant":       packet.Variant,
+		"metadata":      packet.Metadata,
+		"stats":         packet.StatsSnapshot(),
+		"registered_at": packet.RegisteredAt,
+		"input_schema":  packet.Metadata.InputSchema,
+		"output_schema": packet.Metadata.OutputSchema,
+	}, true
+}
+
+// features lists the optional capabilities enabled on this runtime
+func (r *PacketFlowRuntime) features() []string {
+	features := []string{
+		"standard_library",
+		"binary_protocol",
+		"crc32_checksum",
+		"batch_submit",
+		"correlation_ids",
+		"priority_scheduling",
+		"result_cache",
+	}
+
+	r.mu.RLock()
+	if r.deadLetters != nil {
+		features = append(features, "dead_letters")
+	}
+	if len(r.middlewares) > 0 {
+		features = append(features, "middleware")
+	}
+	r.mu.RUnlock()
+
+	if len(r.config.APIKeys) > 0 {
+		features = append(features, "authentication")
+	}
+	if r.config.RateLimit > 0 {
+		features = append(features, "rate_limiting")
+	}
+	if r.config.CostBudget > 0 {
+		features = append(features, "cost_budget")
+	}
+	if r.config.ShedLoadThreshold > 0 {
+		features = append(features, "load_shedding")
+	}
+	if r.config.IdempotencyEnabled {
+		features = append(features, "idempotency")
+	}
+	if r.config.CheckDependencies {
+		features = append(features, "dependency_checks")
+	}
+	if _, disabled := r.config.Tracer.(noopTracer); !disabled {
+		features = append(features, "tracing")
+	}
+	if r.config.PluginDir != "" {
+		features = append(features, "plugins")
+	}
+	return features
+}
+
+// CapabilityRequirements lists the packets, message types and features a
+// client needs from a reactor
+type CapabilityRequirements struct {
+	Packets      []string `json:"packets"`
+	MessageTypes []string `json:"message_types"`
+	Features     []string `json:"features"`
+}
+
+// CapabilityReport splits a client's requirements into those the reactor
+// supports and those it lacks
+type CapabilityReport struct {
+	Satisfied bool                   `json:"satisfied"`
+	Supported CapabilityRequirements `json:"supported"`
+	Missing   CapabilityRequirements `json:"missing"`
+}
+
+// CheckCapabilities compares requirements against the registered packets,
+// message types and enabled features. Packet keys may name a variant,
+// including "latest".
+func (r *PacketFlowRuntime) CheckCapabilities(required CapabilityRequirements) CapabilityReport {
+	report := CapabilityReport{
+		Supported: CapabilityRequirements{Packets: []string{}, MessageTypes: []string{}, Features: []string{}},
+		Missing:   CapabilityRequirements{Packets: []string{}, MessageTypes: []string{}, Features: []string{}},
+	}
+
+	r.mu.RLock()
+	for _, key := range required.Packets {
+		parts := strings.SplitN(key, ":", 3)
+		for len(parts) < 3 {
+			parts = append(parts, "")
+		}
+		if _, exists := r.resolvePacket(parts[0], parts[1], parts[2]); exists {
+			report.Supported.Packets = append(report.Supported.Packets, key)
+		} else {
+			report.Missing.Packets = append(report.Missing.Packets, key)
+		}
+	}
+	r.mu.RUnlock()
+
+	messageTypes := r.messageTypes.Codes()
+	for _, name := range required.MessageTypes {
+		if _, exists := messageTypes[name]; exists {
+			report.Supported.MessageTypes = append(report.Supported.MessageTypes, name)
+		} else {
+			report.Missing.MessageTypes = append(report.Missing.MessageTypes, name)
+		}
+	}
+
+	enabled := make(map[string]bool)
+	for _, feature := range r.features() {
+		enabled[feature] = true
+	}
+	for _, feature := range required.Features {
+		if enabled[feature] {
+			report.Supported.Features = append(report.Supported.Features, feature)
+		} else {
+			report.Missing.Features = append(report.Missing.Features, feature)
+		}
+	}
+
+	report.Satisfied = len(report.Missing.Packets)+len(report.Missing.MessageTypes)+len(report.Missing.Features) == 0
+	return report
+}
+
+// compareVersions compares dotted numeric versions such as "1.2.0", ignoring
+// a leading "v"; missing components count as zero
+func compareVersions(a, b string) int {
+	partsA := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	partsB := strings.Split(strings.TrimPrefix(b, "v"), ".")
+
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var x, y int
+		if i < len(partsA) {
+			x, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			y, _ = strconv.Atoi(partsB[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// LatestVariant resolves to the highest registered version variant of a packet
+const LatestVariant = "latest"
+
+var versionVariantRegex = regexp.MustCompile(`^v?\d+(\.\d+)*$`)
+
+// Wildcard registers a catch-all packet: "df:*" handles any df atom without
+// a matching packet, and "*:*" any atom at all. Handlers read the requested
+// element and variant from ExecutionContext.
+const Wildcard = "*"
+
+// resolvePacket finds the packet for an atom; the caller must hold r.mu.
+// A registered packet or version variant wins (see resolveVariant), then the
+// group's catch-all, then the global catch-all.
+func (r *PacketFlowRuntime) resolvePacket(group, element, variant string) (*PacketInfo, bool) {
+	if packet, exists := r.resolveVariant(group, element, variant); exists {
+		return packet, true
+	}
+	if packet, exists := r.packets[r.makePacketKey(group, Wildcard, "")]; exists {
+		return packet, true
+	}
+	packet, exists := r.packets[r.makePacketKey(Wildcard, Wildcard, "")]
+	return packet, exists
+}
+
+// resolveVariant matches registered packets only; the caller must hold r.mu.
+// An exact key match wins. Otherwise "latest" selects the highest version
+// variant (v1, v2, v2.1, ...), and a missing version variant falls back to the
+// highest registered version with the same major that does not exceed it.
+// Either falls back to the base packet when no version variant matches.
+func (r *PacketFlowRuntime) resolveVariant(group, element, variant string) (*PacketInfo, bool) {
+	if packet, exists := r.packets[r.makePacketKey(group, element, variant)]; exists {
+		return packet, true
+	}
+
+	requested := variant != LatestVariant
+	if requested && !versionVariantRegex.MatchString(variant) {
+		return nil, false
+	}
+
+	var best *PacketInfo
+	for _, packet := range r.packets {
+		if packet.Group != group || packet.Element != element || !versionVariantRegex.MatchString(packet.Variant) {
+			continue
+		}
+		if requested && (majorVersion(packet.Variant) != majorVersion(variant) || compareVersions(packet.Variant, variant) > 0) {
+			continue
+		}
+		if best == nil || compareVersions(packet.Variant, best.Variant) > 0 {
+			best = packet
+		}
+	}
+	if best != nil {
+		return best, true
+	}
+
+	packet, exists := r.packets[r.makePacketKey(group, element, "")]
+	return packet, exists
+}
+
+func majorVersion(version string) string {
+	return strings.SplitN(strings.TrimPrefix(version, "v"), ".", 2)[0]
+}
+
+func (r *PacketFlowRuntime) makePacketKey(group, element, variant string) string {
+	if variant == "" {
+		return fmt.Sprintf("%s:%s", group, element)
+	}
+	return fmt.Sprintf("%s:%s:%s", group, element, variant)
+}
+
+func (r *PacketFlowRuntime) stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func (r *PacketFlowRuntime) validateAtom(atom *Atom) error {
+	if atom == nil {
+		return fmt.Errorf("atom is nil")
+	}
+	if atom.ID == "" {
+		if !r.config.AutoGenerateAtomID {
+			return fmt.Errorf("atom ID is required")
+		}
+		atom.ID = r.config.IDGenerator.NewID()
+	}
+	if len(atom.Group) != 2 {
+		return fmt.Errorf("group must be 2 characters")
+	}
+	if r.config.ValidateGroups && !r.groupAllowed(atom.Group) {
+		return fmt.Errorf("unknown group %q (allowed: %s)", atom.Group, strings.Join(r.config.AllowedGroups, ", "))
+	}
+	if atom.Element == "" {
+		return fmt.Errorf("element is required")
+	}
+	if atom.Timeout != nil && *atom.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if atom.Data == nil {
+		atom.Data = make(map[string]interface{})
+	}
+	return nil
+}
+
+func (r *PacketFlowRuntime) groupAllowed(group string) bool {
+	for _, allowed := range r.config.AllowedGroups {
+		if group == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// claimInFlight marks id as processing, reporting false if it already is
+func (r *PacketFlowRuntime) claimInFlight(id string) bool {
+	r.inFlightMu.Lock()
+	defer r.inFlightMu.Unlock()
+
+	if _, exists := r.inFlight[id]; exists {
+		return false
+	}
+	r.inFlight[id] = struct{}{}
+	return true
+}
+
+func (r *PacketFlowRuntime) releaseInFlight(id string) {
+	r.inFlightMu.Lock()
+	defer r.inFlightMu.Unlock()
+	delete(r.inFlight, id)
+}
+
+// errPayloadLimit aborts payload encoding once the size limit is exceeded
+var errPayloadLimit = errors.New("payload limit exceeded")
+
+// payloadCounter counts encoded bytes without buffering them
+type payloadCounter struct {
+	size  int
+	limit int
+}
+
+func (c *payloadCounter) Write(p []byte) (int, error) {
+	c.size += len(p)
+	if c.size > c.limit {
+		return 0, errPayloadLimit
+	}
+	return len(p), nil
+}
+
+// checkPayloadSize measures the MessagePack-encoded size of the atom data
+// against the packet's MaxPayloadSize, stopping as soon as the limit is
+// passed. The same pass feeds the payload size histogram; oversized payloads
+// are recorded at the size reached when encoding stopped.
+func (r *PacketFlowRuntime) checkPayloadSize(atom *Atom, packet *PacketInfo) error {
+	limit := packet.Metadata.MaxPayloadSize
+	if limit <= 0 {
+		limit = math.MaxInt
+	}
+
+	counter := &payloadCounter{limit: limit}
+	err := msgpack.NewEncoder(counter).Encode(atom.Data)
+	if err != nil && !errors.Is(err, errPayloadLimit) {
+		return fmt.Errorf("payload could not be measured: %v", err)
+	}
+	r.observePayloadSize(atom, packet, counter.size)
+
+	if err != nil {
+		return fmt.Errorf("payload too large: exceeds %d byte limit for %s", limit, packet.Key)
+	}
+	return nil
+}
+
+// observePayloadSize records an inbound payload size, logging a sample of
+// atoms at or above LargePayloadLogSize
+func (r *PacketFlowRuntime) observePayloadSize(atom *Atom, packet *PacketInfo, size int) {
+	r.mu.Lock()
+	r.stats.PayloadSizes.Observe(size)
+	r.mu.Unlock()
+
+	if r.config.LargePayloadLogSize <= 0 || size < r.config.LargePayloadLogSize {
+		return
+	}
+	if (atomic.AddInt64(&r.largePayloads, 1)-1)%int64(r.config.LargePayloadSampleEvery) != 0 {
+		return
+	}
+
+	fields := make([]string, 0, len(atom.Data))
+	for field := range atom.Data {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	log.Printf("📦 Large payload: atom %s for %s is %d bytes (fields: %s)", atom.ID, packet.Key, size, strings.Join(fields, ", "))
+}
+
+// ObserveResultSize records the encoded size of a result sent to a client
+func (r *PacketFlowRuntime) ObserveResultSize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.ResultSizes.Observe(size)
+}
+
+func (r *PacketFlowRuntime) getAtomTimeout(atom *Atom, packet *PacketInfo) int {
+	timeout, _ := r.resolveTimeout(atom, packet)
+	return timeout
+}
+
+// resolveTimeout picks an atom's timeout from the atom override, the packet
+// metadata, the group default and DefaultTimeout, in that order, and reports
+// which one applied. An explicit zero override resolves to 0, meaning no
+// timeout. packet may be nil for atoms not handled locally.
+func (r *PacketFlowRuntime) resolveTimeout(atom *Atom, packet *PacketInfo) (int, string) {
+	if atom.Timeout != nil {
+		return *atom.Timeout, "atom"
+	}
+	if packet != nil && packet.Metadata.Timeout > 0 {
+		return packet.Metadata.Timeout, "packet"
+	}
+	group := atom.Group
+	if packet != nil {
+		group = packet.Group
+	}
+	if timeout, ok := r.config.GroupTimeouts[group]; ok && timeout > 0 {
+		return timeout, "group"
+	}
+	return r.config.DefaultTimeout, "default"
+}
+
+// DeadlineMeta is the atom Meta key holding an absolute deadline in unix
+// milliseconds. It is copied along with the rest of Meta when atoms are
+// forwarded, and from a pipeline's or workflow's Meta into each step or node
+// atom, so the end-to-end deadline holds across hops.
+const DeadlineMeta = "deadline"
+
+// deadlineBudget caps limit by the time left before the atom's deadline, if
+// it has one. A zero limit means none, so the budget stays zero without a
+// deadline. It reports false when the deadline has already passed.
+func (r *PacketFlowRuntime) deadlineBudget(atom *Atom, limit time.Duration) (time.Duration, bool) {
+	millis, ok := r.utils.toFloat64(atom.Meta[DeadlineMeta])
+	if !ok || millis <= 0 {
+		return limit, true
+	}
+	remaining := time.Until(time.UnixMilli(int64(millis)))
+	if remaining <= 0 {
+		return 0, false
+	}
+	if limit == 0 || remaining < limit {
+		return remaining, true
+	}
+	return limit, true
+}
+
+// ErrInvalidInput marks handler errors caused by the client's input; they
+// map to E400
+var ErrInvalidInput = errors.New("invalid input")
+
+// CodedError is implemented by handler errors that choose their own error
+// code. Permanence follows the code unless the error also implements
+// Permanent() bool.
+type CodedError interface {
+	error
+	Code() string
+}
+
+// NewCodedError returns an error that fails the atom with code
+func NewCodedError(code, message string) *AtomError {
+	return &AtomError{
+		Code:      code,
+		Message:   message,
+		Permanent: isPermanentCode(code),
+	}
+}
+
+// handlerError converts a handler's error into the result's AtomError. An
+// AtomError (possibly wrapped) keeps its code, permanence and details, and a
+// CodedError its code; only plain errors are classified by categorizeError.
+func (r *PacketFlowRuntime) handlerError(err error) *AtomError {
+	var atomError *AtomError
+	if errors.As(err, &atomError) {
+		copied := *atomError
+		copied.Message = err.Error()
+		return &copied
+	}
+
+	var coded CodedError
+	if errors.As(err, &coded) {
+		code := coded.Code()
+		permanent := isPermanentCode(code)
+		var permanence interface{ Permanent() bool }
+		if errors.As(err, &permanence) {
+			permanent = permanence.Permanent()
+		}
+		return &AtomError{
+			Code:      code,
+			Message:   err.Error(),
+			Permanent: permanent,
+		}
+	}
+
+	return &AtomError{
+		Code:      r.categorizeError(err),
+		Message:   err.Error(),
+		Permanent: r.isPermanentError(err),
+	}
+}
+
+func (r *PacketFlowRuntime) categorizeError(err error) string {
+	if errors.Is(err, ErrQuotaExceeded) {
+		return "E507"
+	}
+	if errors.Is(err, ErrInvalidInput) {
+		return "E400"
+	}
+	errMsg := err.Error()
+	if strings.Contains(errMsg, "timeout") {
+		return "E408"
+	}
+	if strings.Contains(errMsg, "not found") {
+		return "E404"
+	}
+	if strings.Contains(errMsg, "validation") {
+		return "E403"
+	}
+	if strings.Contains(errMsg, "too large") {
+		return "E413"
+	}
+	return "E500"
+}
+
+func (r *PacketFlowRuntime) isPermanentError(err error) bool {
+	return isPermanentCode(r.categorizeError(err))
+}
+
+// isPermanentCode reports whether retrying an atom that failed with code
+// cannot succeed
+func isPermanentCode(code string) bool {
+	permanentCodes := []string{"E400", "E401", "E402", "E403", "E404", "E413"}
+	for _, pc := range permanentCodes {
+		if code == pc {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *PacketFlowRuntime) createResponseMeta(start time.Time, correlationID string) map[string]interface{} {
+	meta := map[string]interface{}{
+		"duration_ms": time.Since(start).Milliseconds(),
+		"reactor_id":  r.config.ReactorID,
+		"timestamp":   time.Now().Unix(),
+	}
+	for _, field := range r.config.OmitMetaFields {
+		delete(meta, field)
+	}
+	if correlationID != "" {
+		meta["correlation_id"] = correlationID
+	}
+
+	r.metaMu.RLock()
+	enrichers := r.metaEnrichers
+	r.metaMu.RUnlock()
+
+	for _, enricher := range enrichers {
+		for key, value := range enricher(correlationID) {
+			if _, taken := meta[key]; taken || reservedMetaKeys[key] {
+				if _, reported := r.metaCollisions.LoadOrStore(key, true); !reported {
+					log.Printf("⚠️  Meta enricher key %q collides with an existing field; ignoring it", key)
+				}
+				continue
+			}
+			meta[key] = value
+		}
+	}
+	return meta
+}
+
+// MetaEnricher contributes fields to every response Meta. It receives the
+// response's correlation ID, which is empty for responses not tied to an
+// atom.
+type MetaEnricher func(correlationID string) map[string]interface{}
+
+// reservedMetaKeys are response Meta fields the runtime sets itself, some
+// only after createResponseMeta; enrichers may not use them even when
+// omitted
+var reservedMetaKeys = map[string]bool{
+	"duration_ms": true, "reactor_id": true, "timestamp": true,
+	"correlation_id": true, "request_id": true, "resolved_packet": true,
+	"cached": true, "idempotent_replay": true, "forwarded_to": true,
+}
+
+// AddMetaEnricher registers an enricher applied to every response Meta, in
+// registration order. Keys already present, from the runtime or an earlier
+// enricher, are kept and the colliding value is dropped.
+func (r *PacketFlowRuntime) AddMetaEnricher(enricher MetaEnricher) {
+	r.metaMu.Lock()
+	defer r.metaMu.Unlock()
+	r.metaEnrichers = append(r.metaEnrichers, enricher)
+}
+
+// correlationID returns the atom's correlation ID from Meta["correlation_id"],
+// generating and recording one when absent
+func (r *PacketFlowRuntime) correlationID(atom *Atom) string {
+	if atom == nil {
+		return uuid.New().String()
+	}
+	if cid, ok := atom.Meta["correlation_id"].(string); ok && cid != "" {
+		return cid
+	}
+
+	cid := uuid.New().String()
+	if atom.Meta == nil {
+		atom.Meta = make(map[string]interface{})
+	}
+	atom.Meta["correlation_id"] = cid
+	return cid
+}
+
+func (r *PacketFlowRuntime) updatePacketStats(packet *PacketInfo, duration time.Duration, success bool) {
+	packet.statsMu.Lock()
+	defer packet.statsMu.Unlock()
+
+	packet.Stats.Calls++
+	packet.Stats.TotalDuration += duration
+	packet.Stats.Latency.Observe(duration)
+	packet.Stats.LastCalled = time.Now()
+	if !success {
+		packet.Stats.Errors++
+	}
+	if packet.Stats.Calls > 0 {
+		packet.Stats.AvgDuration = packet.Stats.TotalDuration / time.Duration(packet.Stats.Calls)
+	}
+}
+
+// resultCacheKey hashes the packet key and the msgpack encoding of the atom
+// data. Map keys are sorted so the hash is stable across map ordering, and
+// msgpack keeps binary values distinct from their base64 strings. Data that
+// cannot be encoded is not cached.
+func (r *PacketFlowRuntime) resultCacheKey(packetKey string, data map[string]interface{}) string {
+	var encoded bytes.Buffer
+	encoder := msgpack.NewEncoder(&encoded)
+	encoder.SetSortMapKeys(true)
+	if err := encoder.Encode(data); err != nil {
+		return ""
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(packetKey))
+	hash.Write([]byte{0})
+	hash.Write(encoded.Bytes())
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// cacheTTL returns the packet's result cache TTL, defaulting to 60 seconds
+func (r *PacketFlowRuntime) cacheTTL(packet *PacketInfo) time.Duration {
+	if packet.Metadata.CacheTTL > 0 {
+		return time.Duration(packet.Metadata.CacheTTL) * time.Second
+	}
+	return 60 * time.Second
+}
+
+func (r *PacketFlowRuntime) recordCacheLookup(hit bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if hit {
+		r.stats.CacheHits++
+	} else {
+		r.stats.CacheMisses++
+	}
+}
+
+func (r *PacketFlowRuntime) updateRuntimeStats(duration time.Duration, success bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.window.Record(time.Now(), success)
+	r.stats.Processed++
+	r.stats.TotalDuration += duration
+	if !success {
+		r.stats.Errors++
+	}
+}
+
+// ============================================================================
+// Authorization
+// ============================================================================
+
+// Caller identifies an authenticated client and the permissions it holds
+type Caller struct {
+	ID          string   `json:"id"`
+	Permissions []string `json:"permissions"`
+}
+
+// HasPermission reports whether the caller holds permission
+func (c *Caller) HasPermission(permission string) bool {
+	if c == nil {
+		return false
+	}
+	for _, granted := range c.Permissions {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrUnauthenticated is returned when a packet requires permissions but the
+// atom carries no caller identity
+var ErrUnauthenticated = errors.New("caller permissions required")
+
+// ErrForbidden is returned when the caller lacks a required permission
+var ErrForbidden = errors.New("permission denied")
+
+// Authorizer decides whether an atom may invoke a packet. Errors wrapping
+// ErrUnauthenticated map to E401; any other error maps to E403.
+type Authorizer interface {
+	Authorize(atom *Atom, packet *PacketInfo) error
+}
+
+// PermissionAuthorizer grants access when the atom's authenticated caller
+// holds every permission the packet declares
+type PermissionAuthorizer struct{}
+
+// Authorize implements Authorizer using simple set membership
+func (PermissionAuthorizer) Authorize(atom *Atom, packet *PacketInfo) error {
+	if len(packet.Metadata.Permissions) == 0 {
+		return nil
+	}
+	if atom.Caller == nil {
+		return fmt.Errorf("%w for %s", ErrUnauthenticated, packet.Key)
+	}
+
+	var missing []string
+	for _, permission := range packet.Metadata.Permissions {
+		if !atom.Caller.HasPermission(permission) {
+			missing = append(missing, permission)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s requires %s", ErrForbidden, packet.Key, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkClientAtomID applies RequireUUIDIDs to an atom received from a client.
+// An empty ID is left for validateAtom to reject or generate.
+func (r *PacketFlowRuntime) checkClientAtomID(atom *Atom) error {
+	if r.config.RequireUUIDIDs && atom.ID != "" && !r.utils.uuidRegex.MatchString(strings.ToLower(atom.ID)) {
+		return fmt.Errorf("atom ID must be a UUID v4")
+	}
+	return nil
+}
+
+// stripCallerMeta removes identity claims a client put in the atom's meta;
+// permissions only come from the authenticated Caller
+func stripCallerMeta(atom *Atom) {
+	if atom != nil {
+		delete(atom.Meta, "permissions")
+		delete(atom.Meta, CallerAssertionMeta)
+	}
+}
+
+// CallerAssertionMeta is the atom Meta key carrying the caller a reactor
+// vouches for when it forwards or relays an atom to a peer
+const CallerAssertionMeta = "caller_assertion"
+
+// ErrInvalidAssertion is returned when a peer reactor's caller assertion
+// does not verify against ReactorToken or names a different atom
+var ErrInvalidAssertion = errors.New("invalid caller assertion")
+
+// callerAssertion binds a caller to the atom ID and packet it was issued for
+type callerAssertion struct {
+	Caller *Caller `json:"caller"`
+	AtomID string  `json:"atom_id"`
+	Packet string  `json:"packet"`
+}
+
+// assertCaller gives atom a Meta of its own, free of identity claims, that
+// carries a signed assertion that it runs as caller, so the peer authorizes
+// the originating caller instead of this reactor's token. A nil caller
+// asserts an anonymous one. Without a ReactorToken there is nothing to sign
+// with and no assertion is added.
+func (r *PacketFlowRuntime) assertCaller(atom *Atom, caller *Caller) {
+	meta := make(map[string]interface{}, len(atom.Meta)+1)
+	for k, v := range atom.Meta {
+		meta[k] = v
+	}
+	atom.Meta = meta
+	stripCallerMeta(atom)
+	if r.config.ReactorToken == "" {
+		return
+	}
+
+	payload, err := json.Marshal(callerAssertion{
+		Caller: caller,
+		AtomID: atom.ID,
+		Packet: r.makePacketKey(atom.Group, atom.Element, r.stringValue(atom.Variant)),
+	})
+	if err != nil {
+		return
+	}
+	atom.Meta[CallerAssertionMeta] = base64.RawURLEncoding.EncodeToString(payload) + "." + r.signAssertion(payload)
+}
+
+func (r *PacketFlowRuntime) signAssertion(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(r.config.ReactorToken))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isReactorToken reports whether token is this cluster's ReactorToken
+func (r *PacketFlowRuntime) isReactorToken(token string) bool {
+	return r.config.ReactorToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(r.config.ReactorToken)) == 1
+}
+
+// bindCaller sets the identity an atom runs as and removes identity claims
+// from its Meta. Atoms from a peer reactor, authenticated with ReactorToken,
+// run as the caller a valid assertion names; all others run as caller, and
+// assertions from anyone else are ignored.
+func (r *PacketFlowRuntime) bindCaller(atom *Atom, caller *Caller, fromReactor bool) error {
+	assertion, asserted := atom.Meta[CallerAssertionMeta]
+	stripCallerMeta(atom)
+	atom.Caller = caller
+	if !asserted || !fromReactor {
+		return nil
+	}
+
+	encoded, _ := assertion.(string)
+	encoded, signature, found := strings.Cut(encoded, ".")
+	if !found {
+		return ErrInvalidAssertion
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(r.signAssertion(payload))) {
+		return ErrInvalidAssertion
+	}
+	var claim callerAssertion
+	if err := json.Unmarshal(payload, &claim); err != nil {
+		return ErrInvalidAssertion
+	}
+	if claim.AtomID != atom.ID || claim.Packet != r.makePacketKey(atom.Group, atom.Element, r.stringValue(atom.Variant)) {
+		return fmt.Errorf("%w: issued for another atom", ErrInvalidAssertion)
+	}
+	atom.Caller = claim.Caller
+	return nil
+}
+
+// ============================================================================
+// LRU Cache
+// ============================================================================
+
+// lruCache is a size-bounded LRU cache whose entries expire after a per-entry TTL
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type lruEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns an unexpired value and marks it most recently used
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.items[key]
+	if !exists {
+		return nil, false
+	}
+
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Set stores a value for ttl, evicting the least recently used entry when full
+func (c *lruCache) Set(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(ttl)
+	if element, exists := c.items[key]; exists {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Len returns the number of cached entries, including expired ones not yet evicted
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// idempotencyCache caches results by idempotency key. A key is claimed while
+// its first submission runs, so concurrent duplicates wait for that result
+// instead of running the handler a second time.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	results *lruCache
+	claims  map[string]chan struct{}
+	utils   *PacketUtils
+}
+
+func newIdempotencyCache(capacity int, utils *PacketUtils) *idempotencyCache {
+	return &idempotencyCache{
+		results: newLRUCache(capacity),
+		claims:  make(map[string]chan struct{}),
+		utils:   utils,
+	}
+}
+
+// Do returns the cached result for key, reporting true, or runs run and
+// caches its result for ttl when keep accepts it. A duplicate arriving while
+// key is claimed waits and then retries, so it runs only if the first
+// submission's result was not kept.
+func (c *idempotencyCache) Do(key string, ttl time.Duration, run func() *AtomResult, keep func(*AtomResult) bool) (*AtomResult, bool) {
+	for {
+		c.mu.Lock()
+		if cached, hit := c.results.Get(key); hit {
+			c.mu.Unlock()
+			return cached.(*AtomResult), true
+		}
+		pending, claimed := c.claims[key]
+		if !claimed {
+			done := make(chan struct{})
+			c.claims[key] = done
+			c.mu.Unlock()
+			return c.runClaimed(key, done, ttl, run, keep), false
+		}
+		c.mu.Unlock()
+		<-pending
+	}
+}
+
+func (c *idempotencyCache) runClaimed(key string, done chan struct{}, ttl time.Duration, run func() *AtomResult, keep func(*AtomResult) bool) (result *AtomResult) {
+	defer func() {
+		c.mu.Lock()
+		if result != nil && keep(result) {
+			// The first caller owns result, so the cache keeps its own copy
+			stored := copyAtomResult(result)
+			stored.Data = c.utils.deepCopy(result.Data)
+			c.results.Set(key, stored, ttl)
+		}
+		delete(c.claims, key)
+		c.mu.Unlock()
+		close(done)
+	}()
+	return run()
+}
+
+// idempotencyKey scopes an atom ID to its caller and packet
+func idempotencyKey(atom *Atom, packetKey string) string {
+	callerID := ""
+	if atom.Caller != nil {
+		callerID = atom.Caller.ID
+	}
+	return callerID + "\x00" + packetKey + "\x00" + atom.ID
+}
+
+// ============================================================================
+// Plugins
+// ============================================================================
+
+// PluginPacketsSymbol names the variable a plugin exports to publish handlers,
+// keyed by packet key ("group:element" or "group:element:variant"):
+//
+//	var Packets = map[string]func(data map[string]interface{}) (interface{}, error){...}
+//
+// Plugins cannot import package main, so the contract uses only builtin types.
+const PluginPacketsSymbol = "Packets"
+
+// PluginMetadataSymbol optionally names a map[string]string from the same
+// packet keys to JSON-encoded PacketMetadata
+const PluginMetadataSymbol = "Metadata"
+
+// ReloadPlugins scans PluginDir and registers the packets of every new or
+// changed plugin, returning how many packets were registered. Bad plugins are
+// logged and skipped. Go cannot unload a plugin, so a plugin is upgraded by
+// deploying it as a new version, "name-<version>.so", built from a module path
+// of its own (Go refuses to load two plugins with the same package path). Only
+// the newest version of each plugin is loaded, and its packets replace the
+// previously registered ones.
+func (r *PacketFlowRuntime) ReloadPlugins() (int, error) {
+	if r.config.PluginDir == "" {
+		return 0, nil
+	}
+
+	r.pluginMu.Lock()
+	defer r.pluginMu.Unlock()
+
+	paths, err := latestPluginVersions(r.config.PluginDir)
+	if err != nil {
+		return 0, err
+	}
+
+	registered := 0
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("⚠️  Skipping plugin %s: %v", path, err)
+			continue
+		}
+
+		if loadedAt, seen := r.plugins[path]; seen {
+			if info.ModTime().After(loadedAt) {
+				log.Printf("⚠️  Plugin %s changed on disk; deploy it as a new version (name-<version>.so) to reload it", path)
+				r.plugins[path] = info.ModTime()
+			}
+			continue
+		}
+
+		count, err := r.loadPlugin(path)
+		r.plugins[path] = info.ModTime()
+		if err != nil {
+			log.Printf("⚠️  Skipping plugin %s: %v", path, err)
+			continue
+		}
+		registered += count
+	}
+
+	return registered, nil
+}
+
+// pluginVersionPattern splits "name-<version>" plugin file names; versions
+// start with a digit, optionally prefixed with "v"
+var pluginVersionPattern = regexp.MustCompile(`^(.+)-v?[0-9][0-9A-Za-z._]*$`)
+
+// latestPluginVersions lists the .so files in dir, keeping only the most
+// recently modified version of each plugin name
+func latestPluginVersions(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.so"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan plugin directory: %v", err)
+	}
+	sort.Strings(paths)
+
+	type candidate struct {
+		path    string
+		modTime time.Time
+	}
+	latest := make(map[string]candidate)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("⚠️  Skipping plugin %s: %v", path, err)
+			continue
+		}
+
+		name := strings.TrimSuffix(filepath.Base(path), ".so")
+		if match := pluginVersionPattern.FindStringSubmatch(name); match != nil {
+			name = match[1]
+		}
+		// Paths are sorted, so equal times resolve to the later file name
+		if current, exists := latest[name]; !exists || !info.ModTime().Before(current.modTime) {
+			latest[name] = candidate{path: path, modTime: info.ModTime()}
+		}
+	}
+
+	selected := make([]string, 0, len(latest))
+	for _, c := range latest {
+		selected = append(selected, c.path)
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
+
+func (r *PacketFlowRuntime) loadPlugin(path string) (int, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	symbol, err := p.Lookup(PluginPacketsSymbol)
+	if err != nil {
+		return 0, err
+	}
+
+	var packets map[string]func(map[string]interface{}) (interface{}, error)
+	switch v := symbol.(type) {
+	case *map[string]func(map[string]interface{}) (interface{}, error):
+		packets = *v
+	case map[string]func(map[string]interface{}) (interface{}, error):
+		packets = v
+	default:
+		return 0, fmt.Errorf("symbol %s has unexpected type %T", PluginPacketsSymbol, symbol)
+	}
+
+	metadata := make(map[string]string)
+	if symbol, err := p.Lookup(PluginMetadataSymbol); err == nil {
+		if v, ok := symbol.(*map[string]string); ok {
+			metadata = *v
+		}
+	}
+
+	registered := 0
+	for key, handler := range packets {
+		parts := strings.Split(key, ":")
+		if len(parts) < 2 || len(parts) > 3 || handler == nil {
+			log.Printf("⚠️  Plugin %s: invalid packet %q", path, key)
+			continue
+		}
+		variant := ""
+		if len(parts) == 3 {
+			variant = parts[2]
+		}
+
+		var meta PacketMetadata
+		if raw, exists := metadata[key]; exists {
+			if err := json.Unmarshal([]byte(raw), &meta); err != nil {
+				log.Printf("⚠️  Plugin %s: invalid metadata for %s: %v", path, key, err)
+				continue
+			}
+		}
+		if meta.CreatedBy == "" {
+			meta.CreatedBy = filepath.Base(path)
+		}
+
+		pluginHandler := handler
+		err := r.RegisterPacket(parts[0], parts[1], variant, func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+			return pluginHandler(data)
+		}, meta)
+		if err != nil {
+			log.Printf("⚠️  Plugin %s: failed to register %s: %v", path, key, err)
+			continue
+		}
+		registered++
+	}
+
+	return registered, nil
+}
+
+// ============================================================================
+// Manifests
+// ============================================================================
+
+// Manifest lists packets to register in bulk:
+//
+//	{"packets": [{"group": "df", "element": "clean", "handler": "clean",
+//	              "metadata": {"timeout": 10, "description": "..."}}]}
+type Manifest struct {
+	Packets []ManifestPacket `json:"packets"`
+}
+
+// ManifestPacket describes one packet; Handler names an entry in the handler
+// map passed to RegisterFromManifest
+type ManifestPacket struct {
+	Group    string         `json:"group"`
+	Element  string         `json:"element"`
+	Variant  string         `json:"variant,omitempty"`
+	Handler  string         `json:"handler"`
+	Metadata PacketMetadata `json:"metadata"`
+}
+
+// RegisterFromManifest reads a JSON manifest and registers its packets with
+// handlers looked up by name. The manifest is validated as a whole first: if
+// any entry is malformed, names an unknown handler or repeats a packet key,
+// nothing is registered and every problem is returned. Registration errors
+// are then collected per packet without stopping the others.
+func (r *PacketFlowRuntime) RegisterFromManifest(reader io.Reader, handlers map[string]PacketHandler) error {
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+
+	var manifest Manifest
+	if err := decoder.Decode(&manifest); err != nil {
+		return fmt.Errorf("invalid manifest: %v", err)
+	}
+	if len(manifest.Packets) == 0 {
+		return fmt.Errorf("invalid manifest: no packets")
+	}
+
+	var problems []error
+	seen := make(map[string]int, len(manifest.Packets))
+	for i, entry := range manifest.Packets {
+		switch {
+		case entry.Group == "" || entry.Element == "":
+			problems = append(problems, fmt.Errorf("packet %d: group and element are required", i))
+			continue
+		case entry.Handler == "":
+			problems = append(problems, fmt.Errorf("packet %d: handler is required", i))
+		case handlers[entry.Handler] == nil:
+			problems = append(problems, fmt.Errorf("packet %d: unknown handler %q", i, entry.Handler))
+		}
+
+		key := r.makePacketKey(entry.Group, entry.Element, entry.Variant)
+		if first, duplicate := seen[key]; duplicate {
+			problems = append(problems, fmt.Errorf("packet %d: %s already declared by packet %d", i, key, first))
+			continue
+		}
+		seen[key] = i
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid manifest: %w", errors.Join(problems...))
+	}
+
+	for _, entry := range manifest.Packets {
+		if err := r.RegisterPacket(entry.Group, entry.Element, entry.Variant, handlers[entry.Handler], entry.Metadata); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d of %d manifest packets failed to register: %w", len(problems), len(manifest.Packets), errors.Join(problems...))
+	}
+	return nil
+}
+
+// ============================================================================
+// Resource Quotas
+// ============================================================================
+
+// ErrQuotaExceeded is returned when an allocation would exceed its resource quota
+var ErrQuotaExceeded = errors.New("resource quota exceeded")
+
+// Allocation is a reservation against a resource quota
+type Allocation struct {
+	ID          string    `json:"allocation_id"`
+	Resource    string    `json:"resource"`
+	Amount      float64   `json:"amount"`
+	AllocatedAt time.Time `json:"allocated_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// QuotaManager accounts for allocations against per-resource totals.
+// Expired allocations are released lazily on every call.
+type QuotaManager struct {
+	mu          sync.Mutex
+	limits      map[string]float64
+	used        map[string]float64
+	allocations map[string]*Allocation
+}
+
+// NewQuotaManager creates a quota manager with the given per-resource totals
+func NewQuotaManager(limits map[string]float64) *QuotaManager {
+	copied := make(map[string]float64, len(limits))
+	for resource, limit := range limits {
+		copied[resource] = limit
+	}
+	return &QuotaManager{
+		limits:      copied,
+		used:        make(map[string]float64),
+		allocations: make(map[string]*Allocation),
+	}
+}
+
+// Allocate reserves amount of resource for ttl
+func (q *QuotaManager) Allocate(resource string, amount float64, ttl time.Duration) (*Allocation, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	q.releaseExpired(now)
+
+	limit, exists := q.limits[resource]
+	if !exists {
+		return nil, fmt.Errorf("unsupported resource type: %s", resource)
+	}
+	if available := limit - q.used[resource]; amount > available {
+		return nil, fmt.Errorf("%w: %s requested %v, %v of %v available", ErrQuotaExceeded, resource, amount, available, limit)
+	}
+
+	allocation := &Allocation{
+		ID:          uuid.New().String(),
+		Resource:    resource,
+		Amount:      amount,
+		AllocatedAt: now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	q.allocations[allocation.ID] = allocation
+	q.used[resource] += amount
+	return allocation, nil
+}
+
+// Release returns an allocation's reservation before it expires
+func (q *QuotaManager) Release(id string) (*Allocation, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	allocation, exists := q.allocations[id]
+	if !exists {
+		return nil, false
+	}
+	q.release(allocation)
+	return allocation, true
+}
+
+// ReleaseExpired returns the reservations of allocations expired at now
+func (q *QuotaManager) ReleaseExpired(now time.Time) []*Allocation {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.releaseExpired(now)
+}
+
+// ReleaseAll returns every outstanding reservation
+func (q *QuotaManager) ReleaseAll() []*Allocation {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	released := make([]*Allocation, 0, len(q.allocations))
+	for _, allocation := range q.allocations {
+		q.release(allocation)
+		released = append(released, allocation)
+	}
+	return released
+}
+
+// Report returns the limit, usage and availability of each resource
+func (q *QuotaManager) Report() map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.releaseExpired(time.Now())
+
+	counts := make(map[string]int)
+	for _, allocation := range q.allocations {
+		counts[allocation.Resource]++
+	}
+
+	report := make(map[string]interface{}, len(q.limits))
+	for resource, limit := range q.limits {
+		report[resource] = map[string]interface{}{
+			"limit":       limit,
+			"used":        q.used[resource],
+			"available":   limit - q.used[resource],
+			"allocations": counts[resource],
+		}
+	}
+	return report
+}
+
+// releaseExpired releases allocations expired at now; the caller must hold q.mu
+func (q *QuotaManager) releaseExpired(now time.Time) []*Allocation {
+	var released []*Allocation
+	for _, allocation := range q.allocations {
+		if !now.Before(allocation.ExpiresAt) {
+			q.release(allocation)
+			released = append(released, allocation)
+		}
+	}
+	return released
+}
+
+// release returns an allocation's reservation; the caller must hold q.mu
+func (q *QuotaManager) release(allocation *Allocation) {
+	delete(q.allocations, allocation.ID)
+	q.used[allocation.Resource] -= allocation.Amount
+	if q.used[allocation.Resource] < 1e-9 {
+		delete(q.used, allocation.Resource)
+	}
+}
+
+// reapAllocations releases expired allocations every interval until
+// StopBackground
+func (r *PacketFlowRuntime) reapAllocations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopBackground:
+			return
+		case now := <-ticker.C:
+			for _, allocation := range r.quotas.ReleaseExpired(now) {
+				log.Printf("[rm:reaper] Released expired %s allocation %s (%v units)", allocation.Resource, allocation.ID, allocation.Amount)
+			}
+		}
+	}
+}
+
+// goBackground runs fn as tracked background work stopped by StopBackground
+func (r *PacketFlowRuntime) goBackground(fn func()) {
+	r.background.Add(1)
+	go func() {
+		defer r.background.Done()
+		fn()
+	}()
+}
+
+// StopBackground stops the runtime's background loops (allocation reaper,
+// reactor health checks, discovery, idle connection eviction, scheduled
+// tasks) and waits for them to exit
+func (r *PacketFlowRuntime) StopBackground() {
+	r.stopOnce.Do(func() {
+		close(r.stopBackground)
+	})
+	r.background.Wait()
+}
+
+// ============================================================================
+// Scheduler
+// ============================================================================
+
+// ScheduleEvery runs fn every interval (spread by ScheduleJitter) as tracked
+// background work until the returned cancel is called or StopBackground.
+// A panicking run is logged and the schedule carries on
+func (r *PacketFlowRuntime) ScheduleEvery(interval time.Duration, fn func()) (cancel func()) {
+	stop := make(chan struct{})
+	var once sync.Once
+	cancel = func() {
+		once.Do(func() { close(stop) })
+	}
+	if interval <= 0 {
+		log.Printf("⚠️  Ignoring schedule with non-positive interval %v", interval)
+		return cancel
+	}
+
+	r.goBackground(func() {
+		timer := time.NewTimer(r.scheduleDelay(interval))
+		defer timer.Stop()
+		for {
+			select {
+			case <-r.stopBackground:
+				return
+			case <-stop:
+				return
+			case <-timer.C:
+				r.runScheduled(fn)
+				timer.Reset(r.scheduleDelay(interval))
+			}
+		}
+	})
+	return cancel
+}
+
+// SchedulePacket processes an atom for the packet key (group:element[:variant])
+// every interval, logging failed runs. The key must resolve when scheduled
+func (r *PacketFlowRuntime) SchedulePacket(interval time.Duration, key string, data map[string]interface{}) (cancel func(), err error) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%w: packet must be a packet key (group:element[:variant])", ErrInvalidInput)
+	}
+	target := &Atom{Group: parts[0], Element: parts[1]}
+	if len(parts) == 3 {
+		target.Variant = &parts[2]
+	}
+	resolved := r.resolveAlias(target)
+	r.mu.RLock()
+	_, exists := r.resolvePacket(resolved.Group, resolved.Element, r.stringValue(resolved.Variant))
+	r.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("packet %s not found", key)
+	}
+
+	// Each schedule gets its own ID prefix, so two schedules of one packet
+	// never share an idempotency key
+	schedule := uuid.New().String()
+	var runs int64
+	return r.ScheduleEvery(interval, func() {
+		payload, _ := r.utils.deepCopy(data).(map[string]interface{})
+		if payload == nil {
+			payload = map[string]interface{}{}
+		}
+		atom := *target
+		atom.ID = fmt.Sprintf("scheduled_%s_%s_%s_%d", atom.Group, atom.Element, schedule, atomic.AddInt64(&runs, 1))
+		atom.Data = payload
+
+		if result := r.ProcessAtom(&atom); !result.Success {
+			log.Printf("⚠️  Scheduled %s failed: %s", key, result.Error.Message)
+		}
+	}), nil
+}
+
+// scheduleDelay returns interval spread by up to ScheduleJitter either way
+func (r *PacketFlowRuntime) scheduleDelay(interval time.Duration) time.Duration {
+	jitter := math.Min(r.config.ScheduleJitter, 1)
+	if jitter <= 0 {
+		return interval
+	}
+	spread := float64(interval) * jitter
+	delay := time.Duration(float64(interval) + (mathrand.Float64()*2-1)*spread)
+	if delay < time.Millisecond {
+		delay = time.Millisecond
+	}
+	return delay
+}
+
+func (r *PacketFlowRuntime) runScheduled(fn func()) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("⚠️  Scheduled task panicked: %v", recovered)
+		}
+	}()
+	fn()
+}
+
+// ============================================================================
+// Tracing
+// ============================================================================
+
+// Tracer starts spans and propagates trace context. It mirrors the subset of
+// OpenTelemetry used by the runtime so an OTel tracer and propagator can be
+// adapted without the runtime depending on the SDK.
+type Tracer interface {
+	Start(ctx context.Context, name string, attributes map[string]interface{}) (context.Context, Span)
+	Extract(ctx context.Context, carrier map[string]string) context.Context
+	Inject(ctx context.Context, carrier map[string]string)
+}
+
+// Span is a single traced operation
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attributes map[string]interface{}) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return ctx
+}
+
+func (noopTracer) Inject(ctx context.Context, carrier map[string]string) {}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// traceCarrier collects the string values of an atom's Meta for extraction
+func traceCarrier(meta map[string]interface{}) map[string]string {
+	carrier := make(map[string]string, len(meta))
+	for k, v := range meta {
+		if str, ok := v.(string); ok {
+			carrier[k] = str
+		}
+	}
+	return carrier
+}
+
+// ============================================================================
+// Slow Atoms
+// ============================================================================
+
+// SlowAtomTrace describes an atom that took at least SlowAtomThreshold
+type SlowAtomTrace struct {
+	AtomID        string        `json:"atom_id"`
+	PacketKey     string        `json:"packet_key"`
+	CorrelationID string        `json:"correlation_id,omitempty"`
+	InputSize     int           `json:"input_size"`
+	Duration      time.Duration `json:"duration"`
+	// ProcessAllocated is the heap allocated by the whole process during the
+	// atom's run, not by the atom alone; concurrent atoms add to it
+	ProcessAllocated uint64    `json:"process_allocated_bytes"`
+	Success          bool      `json:"success"`
+	ErrorCode        string    `json:"error_code,omitempty"`
+	CompletedAt      time.Time `json:"completed_at"`
+}
+
+// slowAtomBuffer keeps the most recent slow atom traces in a ring buffer
+type slowAtomBuffer struct {
+	mu     sync.Mutex
+	traces []SlowAtomTrace
+	next   int
+	full   bool
+}
+
+func newSlowAtomBuffer(capacity int) *slowAtomBuffer {
+	if capacity <= 0 {
+		capacity = 100
+	}
+	return &slowAtomBuffer{traces: make([]SlowAtomTrace, capacity)}
+}
+
+func (b *slowAtomBuffer) add(trace SlowAtomTrace) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.traces[b.next] = trace
+	b.next = (b.next + 1) % len(b.traces)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// list returns the buffered traces, oldest first
+func (b *slowAtomBuffer) list() []SlowAtomTrace {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.full {
+		return append([]SlowAtomTrace{}, b.traces[:b.next]...)
+	}
+	traces := make([]SlowAtomTrace, 0, len(b.traces))
+	traces = append(traces, b.traces[b.next:]...)
+	return append(traces, b.traces[:b.next]...)
+}
+
+// heapAllocated returns the cumulative bytes allocated on the heap; unlike
+// runtime.ReadMemStats it does not stop the world
+func heapAllocated() uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// SlowAtoms returns traces of the most recent slow atoms, oldest first
+func (r *PacketFlowRuntime) SlowAtoms() []SlowAtomTrace {
+	return r.slowAtoms.list()
+}
+
+func (r *PacketFlowRuntime) traceSlowAtom(atom *Atom, result *AtomResult, duration time.Duration, allocated uint64) {
+	trace := SlowAtomTrace{
+		AtomID:           atom.ID,
+		PacketKey:        r.makePacketKey(atom.Group, atom.Element, r.stringValue(atom.Variant)),
+		Duration:         duration,
+		ProcessAllocated: allocated,
+		Success:          result.Success,
+		CompletedAt:      time.Now(),
+	}
+	if resolved, ok := result.Meta["resolved_packet"].(string); ok {
+		trace.PacketKey = resolved
+	}
+	trace.CorrelationID, _ = result.Meta["correlation_id"].(string)
+	if result.Error != nil {
+		trace.ErrorCode = result.Error.Code
+	}
+
+	counter := &payloadCounter{limit: math.MaxInt}
+	if err := msgpack.NewEncoder(counter).Encode(atom.Data); err == nil {
+		trace.InputSize = counter.size
+	}
+
+	r.slowAtoms.add(trace)
+	log.Printf("🐢 Slow atom %s (%s) took %s", atom.ID, trace.PacketKey, duration)
+}
+
+// ============================================================================
+// Dead Letters
+// ============================================================================
+
+// DeadLetter records an atom whose processing ended in a permanent error
+type DeadLetter struct {
+	Atom          *Atom         `json:"atom"`
+	Error         *AtomError    `json:"error"`
+	PacketKey     string        `json:"packet_key"`
+	CorrelationID string        `json:"correlation_id,omitempty"`
+	FailedAt      time.Time     `json:"failed_at"`
+	Duration      time.Duration `json:"duration"`
+}
+
+// DeadLetterSink receives permanently failed atoms
+type DeadLetterSink interface {
+	Send(letter DeadLetter) error
+}
+
+// MemoryDeadLetterSink keeps the most recent dead letters in a ring buffer
+type MemoryDeadLetterSink struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+	next    int
+	full    bool
+}
+
+// NewMemoryDeadLetterSink creates a ring buffer holding up to capacity letters
+func NewMemoryDeadLetterSink(capacity int) *MemoryDeadLetterSink {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &MemoryDeadLetterSink{
+		letters: make([]DeadLetter, capacity),
+	}
+}
+
+// Send stores the letter, overwriting the oldest once the buffer is full
+func (s *MemoryDeadLetterSink) Send(letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters[s.next] = letter
+	s.next = (s.next + 1) % len(s.letters)
+	if s.next == 0 {
+		s.full = true
+	}
+	return nil
+}
+
+// GetDeadLetters returns the buffered letters, oldest first
+func (s *MemoryDeadLetterSink) GetDeadLetters() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.full {
+		return append([]DeadLetter(nil), s.letters[:s.next]...)
+	}
+	letters := make([]DeadLetter, 0, len(s.letters))
+	letters = append(letters, s.letters[s.next:]...)
+	return append(letters, s.letters[:s.next]...)
+}
+
+// FileDeadLetterSink appends dead letters to a file as JSON lines
+type FileDeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileDeadLetterSink opens path for appending, creating it if needed
+func NewFileDeadLetterSink(path string) (*FileDeadLetterSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead-letter file: %v", err)
+	}
+	return &FileDeadLetterSink{file: file}, nil
+}
+
+// Send appends the letter as a single JSON line
+func (s *FileDeadLetterSink) Send(letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying file
+func (s *FileDeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// ============================================================================
+// Traffic Recording
+// ============================================================================
+
+// Defaults for NewTrafficRecorder
+const (
+	DefaultRecordMaxBytes = 64 * 1024 * 1024
+	DefaultRecordMaxFiles = 3
+)
+
+// AtomRecord is one line of a traffic recording
+type AtomRecord struct {
+	Time   time.Time   `json:"time"`
+	Atom   *Atom       `json:"atom"`
+	Result *AtomResult `json:"result"`
+}
+
+// TrafficRecorder appends processed atoms and their results to a file as
+// JSON lines. Once the file would exceed maxBytes it is rotated to path.1,
+// path.2, ... keeping at most maxFiles rotated files.
+type TrafficRecorder struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// NewTrafficRecorder opens path for appending, creating it if needed. Zero
+// limits use DefaultRecordMaxBytes and DefaultRecordMaxFiles.
+func NewTrafficRecorder(path string, maxBytes int64, maxFiles int) (*TrafficRecorder, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultRecordMaxBytes
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultRecordMaxFiles
+	}
+
+	recorder := &TrafficRecorder{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := recorder.open(); err != nil {
+		return nil, err
+	}
+	return recorder, nil
+}
+
+func (t *TrafficRecorder) open() error {
+	file, err := os.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open recording file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat recording file: %v", err)
+	}
+	t.file = file
+	t.size = info.Size()
+	return nil
+}
+
+// Record appends the atom and its result as a single JSON line
+func (t *TrafficRecorder) Record(atom *Atom, result *AtomResult) error {
+	line, err := json.Marshal(AtomRecord{Time: time.Now(), Atom: atom, Result: result})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file == nil {
+		return fmt.Errorf("recorder is closed")
+	}
+	if t.size > 0 && t.size+int64(len(line)) > t.maxBytes {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := t.file.Write(line)
+	t.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and starts a new
+// file; the caller must hold t.mu
+func (t *TrafficRecorder) rotate() error {
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+	t.file = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", t.path, t.maxFiles))
+	for i := t.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", t.path, i), fmt.Sprintf("%s.%d", t.path, i+1))
+	}
+	if err := os.Rename(t.path, t.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate recording file: %v", err)
+	}
+	return t.open()
+}
+
+// Close closes the recording file
+func (t *TrafficRecorder) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// ReplayReport summarizes a replay. An atom matches when it succeeds or fails
+// as recorded, with the same error code or result data.
+type ReplayReport struct {
+	Total      int              `json:"total"`
+	Matched    int              `json:"matched"`
+	Mismatches []ReplayMismatch `json:"mismatches,omitempty"`
+	Duration   time.Duration    `json:"duration"`
+}
+
+// ReplayMismatch describes an atom whose replayed result differs from the recording
+type ReplayMismatch struct {
+	AtomID   string      `json:"atom_id"`
+	Recorded *AtomResult `json:"recorded"`
+	Replayed *AtomResult `json:"replayed"`
+}
+
+// ReplayFile re-submits the atoms recorded in path, in order. rate scales
+// the recorded gaps between atoms: 1 replays at the original pace, 2 twice
+// as fast, and 0 or less without delays.
+func (r *PacketFlowRuntime) ReplayFile(path string, rate float64) (*ReplayReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %v", err)
+	}
+	defer file.Close()
+
+	report := &ReplayReport{}
+	start := time.Now()
+	var previous time.Time
+
+	decoder := json.NewDecoder(file)
+	for line := 1; ; line++ {
+		var record AtomRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return report, fmt.Errorf("invalid record %d: %v", line, err)
+		}
+		if record.Atom == nil {
+			return report, fmt.Errorf("invalid record %d: missing atom", line)
+		}
+
+		if rate > 0 && !previous.IsZero() {
+			if gap := record.Time.Sub(previous); gap > 0 {
+				time.Sleep(time.Duration(float64(gap) / rate))
+			}
+		}
+		previous = record.Time
+
+		replayed := r.ProcessAtom(record.Atom)
+		report.Total++
+		if sameOutcome(record.Result, replayed) {
+			report.Matched++
+		} else {
+			report.Mismatches = append(report.Mismatches, ReplayMismatch{
+				AtomID:   record.Atom.ID,
+				Recorded: record.Result,
+				Replayed: replayed,
+			})
+		}
+	}
+
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// sameOutcome compares results by success, error code and JSON-encoded data
+func sameOutcome(recorded, replayed *AtomResult) bool {
+	if recorded == nil || replayed == nil {
+		return recorded == replayed
+	}
+	if recorded.Success != replayed.Success {
+		return false
+	}
+	if !recorded.Success {
+		return recorded.Error != nil && replayed.Error != nil && recorded.Error.Code == replayed.Error.Code
+	}
+
+	// Recorded data has been through JSON, so compare both sides in that form
+	left, err := json.Marshal(recorded.Data)
+	if err != nil {
+		return false
+	}
+	right, err := json.Marshal(replayed.Data)
+	if err != nil {
+		return false
+	}
+	var leftValue, rightValue interface{}
+	json.Unmarshal(left, &leftValue)
+	json.Unmarshal(right, &rightValue)
+	return reflect.DeepEqual(leftValue, rightValue)
+}
+
+// ============================================================================
+// Priority Scheduling
+// ============================================================================
+
+// DefaultPriority is used for atoms that do not specify a priority
+const DefaultPriority = 5
+
+// queuedAtom is an atom waiting for an execution slot
+type queuedAtom struct {
+	priority int
+	sequence int64
+	index    int // position in the heap, -1 once handed a slot
+	ready    chan struct{}
+}
+
+// atomQueue is a heap of waiting atoms ordered by priority (1 = highest), then arrival
+type atomQueue []*queuedAtom
+
+func (q atomQueue) Len() int { return len(q) }
+
+func (q atomQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].sequence < q[j].sequence
+}
+
+func (q atomQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *atomQueue) Push(x interface{}) {
+	item := x.(*queuedAtom)
+	item.index = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *atomQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.index = -1
+	*q = old[:n-1]
+	return item
+}
+
+// acquireSlot blocks until one of the MaxConcurrent execution slots is free,
+// or ctx ends. Atoms only queue when every slot is busy, so priority matters
+// only under contention.
+func (r *PacketFlowRuntime) acquireSlot(ctx context.Context, priority int) error {
+	r.mu.Lock()
+	if r.activeAtoms < r.config.MaxConcurrent {
+		r.activeAtoms++
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.sequenceCounter++
+	waiter := &queuedAtom{
+		priority: priority,
+		sequence: r.sequenceCounter,
+		ready:    make(chan struct{}),
+	}
+	heap.Push(&r.queue, waiter)
+	r.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if waiter.index >= 0 {
+		heap.Remove(&r.queue, waiter.index)
+	} else {
+		// releaseSlot handed over the slot as ctx ended; pass it on
+		r.releaseSlotLocked()
+	}
+	return ctx.Err()
+}
+
+// releaseSlot hands the slot directly to the highest-priority waiting atom, if any
+func (r *PacketFlowRuntime) releaseSlot() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.releaseSlotLocked()
+}
+
+func (r *PacketFlowRuntime) releaseSlotLocked() {
+	if r.queue.Len() > 0 {
+		waiter := heap.Pop(&r.queue).(*queuedAtom)
+		close(waiter.ready)
+		return
+	}
+	r.activeAtoms--
+}
+
+// memLoadSampleInterval bounds how often currentLoad reads runtime.MemStats
+const memLoadSampleInterval = 250 * time.Millisecond
+
+// currentLoad returns the higher of heap usage and execution-slot usage as a
+// percentage. Queued atoms count towards slot usage, so it can exceed 100.
+func (r *PacketFlowRuntime) currentLoad() float64 {
+	r.memLoadMu.Lock()
+	if time.Since(r.memSampledAt) >= memLoadSampleInterval {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		r.memLoad = float64(m.HeapInuse) / float64(m.HeapSys) * 100
+		r.memSampledAt = time.Now()
+	}
+	load := r.memLoad
+	r.memLoadMu.Unlock()
+
+	r.mu.RLock()
+	inFlight := r.activeAtoms + r.queue.Len()
+	r.mu.RUnlock()
+
+	return math.Max(load, float64(inFlight)/float64(r.config.MaxConcurrent)*100)
+}
+
+// packetCost is the packet's declared cost, at least 1
+func packetCost(packet *PacketInfo) float64 {
+	if packet.Metadata.Cost > 0 {
+		return float64(packet.Metadata.Cost)
+	}
+	return 1
+}
+
+func (r *PacketFlowRuntime) atomPriority(atom *Atom) int {
+	if atom.Priority != nil {
+		return *atom.Priority
+	}
+	return DefaultPriority
+}
+
+// ============================================================================
+// Worker Pool
+// ============================================================================
+
+// execute runs task on the worker pool, or on its own goroutine when the pool
+// is disabled. It reports false if ctx ended before a worker took the task.
+func (r *PacketFlowRuntime) execute(ctx context.Context, task func()) bool {
+	if r.workers == nil {
+		go task()
+		return true
+	}
+	return r.workers.Submit(ctx, task)
+}
+
+// ShutdownWorkers stops the worker pool once running handlers return, or
+// when ctx ends. Handlers submitted afterwards run on their own goroutines.
+func (r *PacketFlowRuntime) ShutdownWorkers(ctx context.Context) error {
+	if r.workers == nil {
+		return nil
+	}
+	return r.workers.Shutdown(ctx)
+}
+
+// workerPool runs tasks on at most max goroutines, started on demand. Elastic
+// pools let workers exit after idleTimeout without work; fixed pools keep
+// them until shutdown.
+type workerPool struct {
+	tasks       chan func()
+	max         int32
+	running     int32
+	elastic     bool
+	idleTimeout time.Duration
+	// freed wakes a waiting Submit when an elastic worker exits
+	freed chan struct{}
+	stop  chan struct{}
+	// mu orders worker reservations against Shutdown, so no worker joins wg
+	// once Shutdown has started waiting on it
+	mu      sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(max int, elastic bool, idleTimeout time.Duration) *workerPool {
+	return &workerPool{
+		tasks:       make(chan func()),
+		max:         int32(max),
+		elastic:     elastic,
+		idleTimeout: idleTimeout,
+		freed:       make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Submit hands task to an idle worker, starting a new one if the pool is not
+// full, and otherwise waits for a worker until ctx ends
+func (p *workerPool) Submit(ctx context.Context, task func()) bool {
+	select {
+	case <-p.stop:
+		go task()
+		return true
+	case p.tasks <- task:
+		return true
+	default:
+	}
+
+	for {
+		if p.grow() {
+			go p.work(task)
+			return true
+		}
+
+		select {
+		case p.tasks <- task:
+			return true
+		case <-p.freed:
+		case <-p.stop:
+			go task()
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// grow reserves a worker if the pool is below max and not shut down
+func (p *workerPool) grow() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	for {
+		running := atomic.LoadInt32(&p.running)
+		if running >= p.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.running, running, running+1) {
+			p.wg.Add(1)
+			return true
+		}
+	}
+}
+
+func (p *workerPool) work(task func()) {
+	defer p.wg.Done()
+
+	for task != nil {
+		task()
+		task = p.next()
+	}
+
+	atomic.AddInt32(&p.running, -1)
+	select {
+	case p.freed <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for the worker's next task, returning nil when it should exit
+func (p *workerPool) next() func() {
+	var idle <-chan time.Time
+	if p.elastic {
+		timer := time.NewTimer(p.idleTimeout)
+		defer timer.Stop()
+		idle = timer.C
+	}
+
+	select {
+	case task := <-p.tasks:
+		return task
+	case <-idle:
+		return nil
+	case <-p.stop:
+		return nil
+	}
+}
+
+// Size returns the number of running workers
+func (p *workerPool) Size() int {
+	return int(atomic.LoadInt32(&p.running))
+}
+
+// Shutdown stops idle workers and waits for busy ones to finish their task
+func (p *workerPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.stop)
+	}
+	p.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("worker pool shutdown: %v", ctx.Err())
+	}
+}
+
+// ============================================================================
+// ID Generation
+// ============================================================================
+
+// IDGenerator produces IDs for atoms submitted without one
+type IDGenerator interface {
+	NewID() string
+}
+
+// UUIDGenerator produces random UUID v4 IDs
+type UUIDGenerator struct{}
+
+func (UUIDGenerator) NewID() string {
+	return uuid.New().String()
+}
+
+// crockford is the ULID alphabet: Crockford base32 without I, L, O and U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDGenerator produces 26-character ULIDs: a 48-bit millisecond timestamp
+// followed by 80 random bits. IDs generated within the same millisecond
+// increment the random part, so they sort in generation order.
+type ULIDGenerator struct {
+	mu       sync.Mutex
+	lastTime uint64
+	entropy  [10]byte
+}
+
+func NewULIDGenerator() *ULIDGenerator {
+	return &ULIDGenerator{}
+}
+
+func (g *ULIDGenerator) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= g.lastTime && g.increment() {
+		ms = g.lastTime
+	} else {
+		if _, err := rand.Read(g.entropy[:]); err != nil {
+			panic(fmt.Sprintf("ulid: reading entropy: %v", err))
+		}
+		if ms < g.lastTime {
+			// Keep IDs monotonic if the clock steps backwards
+			ms = g.lastTime
+		}
+		g.lastTime = ms
+	}
+
+	var raw [16]byte
+	raw[0] = byte(ms >> 40)
+	raw[1] = byte(ms >> 32)
+	raw[2] = byte(ms >> 24)
+	raw[3] = byte(ms >> 16)
+	raw[4] = byte(ms >> 8)
+	raw[5] = byte(ms)
+	copy(raw[6:], g.entropy[:])
+	return encodeULID(raw)
+}
+
+// increment adds one to the random part, reporting false on overflow
+func (g *ULIDGenerator) increment() bool {
+	for i := len(g.entropy) - 1; i >= 0; i-- {
+		g.entropy[i]++
+		if g.entropy[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID writes the 128 bits as 26 base32 digits, the first holding
+// the top 3 bits
+func encodeULID(raw [16]byte) string {
+	hi := binary.BigEndian.Uint64(raw[:8])
+	lo := binary.BigEndian.Uint64(raw[8:])
+
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// TimestampIDGenerator produces IDs of the form "<nanoseconds>-<random>",
+// the timestamp as 16 hex digits so IDs sort lexically by creation time.
+// The timestamp never repeats within a process.
+type TimestampIDGenerator struct {
+	mu   sync.Mutex
+	last int64
+}
+
+func NewTimestampIDGenerator() *TimestampIDGenerator {
+	return &TimestampIDGenerator{}
+}
+
+func (g *TimestampIDGenerator) NewID() string {
+	g.mu.Lock()
+	ns := time.Now().UnixNano()
+	if ns <= g.last {
+		ns = g.last + 1
+	}
+	g.last = ns
+	g.mu.Unlock()
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		panic(fmt.Sprintf("timestamp id: reading entropy: %v", err))
+	}
+	return fmt.Sprintf("%016x-%s", ns, hex.EncodeToString(suffix))
+}
+
+// seededRand is a deterministic splitmix64 byte stream
+type seededRand struct {
+	mu    sync.Mutex
+	state uint64
+}
+
+// NewSeededRandSource returns a reader producing the same bytes for the same
+// seed. It is for tests and replays only; it is not cryptographically secure.
+func NewSeededRandSource(seed uint64) io.Reader {
+	return &seededRand{state: seed}
+}
+
+func (s *seededRand) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var word [8]byte
+	for i := 0; i < len(p); i += 8 {
+		s.state += 0x9e3779b97f4a7c15
+		z := s.state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		binary.LittleEndian.PutUint64(word[:], z^(z>>31))
+		copy(p[i:], word[:])
+	}
+	return len(p), nil
+}
+
+// ============================================================================
+// Data Access
+// ============================================================================
+
+// DataAccessor reads typed values from decoded atom or message data. Numbers
+// may arrive as any Go numeric type (float64 from JSON, sized integers from
+// MessagePack); integer getters accept floats only when they are whole.
+// Strings are never coerced to numbers or booleans. Getters return def when
+// the key is missing, null or of the wrong type; Lookup variants report
+// whether a usable value was present, so an explicit 0 is not mistaken for
+// a missing field.
+//
+//	priority := DataAccessor(data).GetInt("priority", 5)
+type DataAccessor map[string]interface{}
+
+// GetString returns the string at key
+func (d DataAccessor) GetString(key, def string) string {
+	if value, ok := d[key].(string); ok {
+		return value
+	}
+	return def
+}
+
+// GetInt returns the integer at key
+func (d DataAccessor) GetInt(key string, def int) int {
+	if value, ok := d.LookupInt(key); ok {
+		return value
+	}
+	return def
+}
+
+// LookupInt returns the integer at key and whether one was present
+func (d DataAccessor) LookupInt(key string) (int, bool) {
+	value, ok := integerValue(d[key])
+	if !ok || value < math.MinInt || value > math.MaxInt {
+		return 0, false
+	}
+	return int(value), true
+}
+
+// GetInt64 returns the integer at key
+func (d DataAccessor) GetInt64(key string, def int64) int64 {
+	if value, ok := d.LookupInt64(key); ok {
+		return value
+	}
+	return def
+}
+
+// LookupInt64 returns the integer at key and whether one was present
+func (d DataAccessor) LookupInt64(key string) (int64, bool) {
+	return integerValue(d[key])
+}
+
+// GetFloat returns the number at key
+func (d DataAccessor) GetFloat(key string, def float64) float64 {
+	if value, ok := numberValue(d[key]); ok {
+		return value
+	}
+	return def
+}
+
+// GetBool returns the boolean at key
+func (d DataAccessor) GetBool(key string, def bool) bool {
+	if value, ok := d[key].(bool); ok {
+		return value
+	}
+	return def
+}
+
+// GetMap returns the object at key
+func (d DataAccessor) GetMap(key string, def map[string]interface{}) map[string]interface{} {
+	if value, ok := d[key].(map[string]interface{}); ok {
+		return value
+	}
+	return def
+}
+
+// GetSlice returns the array at key
+func (d DataAccessor) GetSlice(key string, def []interface{}) []interface{} {
+	if value, ok := d[key].([]interface{}); ok {
+		return value
+	}
+	return def
+}
+
+// GetBytes returns the binary value at key; strings are not decoded
+func (d DataAccessor) GetBytes(key string, def []byte) []byte {
+	if value, ok := d[key].([]byte); ok {
+		return value
+	}
+	return def
+}
+
+// GetTime returns the timestamp at key, as decoded from the msgpack
+// timestamp extension
+func (d DataAccessor) GetTime(key string, def time.Time) time.Time {
+	if value, ok := d[key].(time.Time); ok {
+		return value
+	}
+	return def
+}
+
+// numberValue converts any Go numeric type to float64
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	}
+	if i, ok := integerValue(v); ok {
+		return float64(i), true
+	}
+	if u, ok := v.(uint64); ok {
+		return float64(u), true
+	}
+	return 0, false
+}
+
+// integerValue converts integer types, and whole floats within int64 range,
+// to int64
+func integerValue(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case float32:
+		return integerValue(float64(n))
+	case float64:
+		if n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// ============================================================================
+// Packet Utilities
+// ============================================================================
+
+// PacketUtils provides utility functions for packet handlers
+type PacketUtils struct {
+	emailRegex *regexp.Regexp
+	uuidRegex  *regexp.Regexp
+	random     io.Reader
+	// coerceTypes enables CoercePair in filter conditions and Validate
+	coerceTypes bool
+}
+
+// NewPacketUtils creates a new PacketUtils instance drawing randomness from
+// random, or crypto/rand when nil
+func NewPacketUtils(random io.Reader) *PacketUtils {
+	if random == nil {
+		random = rand.Reader
+	}
+	return &PacketUtils{
+		emailRegex: regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`),
+		uuidRegex:  regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`),
+		random:     random,
+	}
+}
+
+// NewUUID returns a UUID v4 drawn from the utils' random source
+func (u *PacketUtils) NewUUID() (string, error) {
+	id, err := uuid.NewRandomFromReader(u.random)
+	if err != nil {
+		return "", fmt.Errorf("uuid: %v", err)
+	}
+	return id.String(), nil
+}
+
+// Transform provides data transformation utilities
+func (u *PacketUtils) Transform(input interface{}, operation string) (interface{}, error) {
+	return u.TransformWithParams(input, operation, nil)
+}
+
+// TransformWithParams applies a transformation with operation-specific params,
+// e.g. "layout" for parse_date/format_date or "decimal_separator" for parse_float
+func (u *PacketUtils) TransformWithParams(input interface{}, operation string, params map[string]interface{}) (interface{}, error) {
+	switch operation {
+	case "uppercase":
+		return strings.ToUpper(transformString(input)), nil
+	case "lowercase":
+		return strings.ToLower(transformString(input)), nil
+	case "trim":
+		return strings.TrimSpace(transformString(input)), nil
+	case "uuid":
+		return u.NewUUID()
+	case "hash_md5":
+		hash := md5.Sum([]byte(transformString(input)))
+		return fmt.Sprintf("%x", hash), nil
+	case "hash_sha256":
+		hash := sha256.Sum256([]byte(transformString(input)))
+		return fmt.Sprintf("%x", hash), nil
+	case "base64_encode":
+		return base64.StdEncoding.EncodeToString([]byte(transformString(input))), nil
+	case "base64_decode":
+		decoded, err := base64.StdEncoding.DecodeString(fmt.Sprintf("%v", input))
+		if err != nil {
+			return nil, err
+		}
+		return string(decoded), nil
+	case "url_encode":
+		return url.QueryEscape(transformString(input)), nil
+	case "url_decode":
+		return url.QueryUnescape(fmt.Sprintf("%v", input))
+	case "json_parse":
+		var result interface{}
+		err := json.Unmarshal([]byte(fmt.Sprintf("%v", input)), &result)
+		return result, err
+	case "json_stringify":
+		return json.Marshal(input)
+	case "parse_int":
+		return u.parseNumber(input, params, true)
+	case "parse_float":
+		return u.parseNumber(input, params, false)
+	case "parse_date":
+		return u.parseDate(input, params)
+	case "format_date":
+		return u.formatDate(input, params)
+	case "xml_parse":
+		return u.parseXML(transformString(input))
+	case "xml_stringify":
+		return u.stringifyXML(input, params)
+	default:
+		return nil, fmt.Errorf("unknown transformation operation: %s", operation)
+	}
+}
+
+// transformString formats a transform input as text. Binary values keep
+// their raw bytes and timestamps use RFC 3339, matching the JSON encoding.
+func transformString(input interface{}) string {
+	switch value := input.(type) {
+	case []byte:
+		return string(value)
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%v", input)
+}
+
+// dateLayouts are tried in order by parse_date when no layout param is given
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	time.ANSIC,
+	"02 Jan 2006",
+	"Jan 2, 2006",
+	"01/02/2006",
+}
+
+// parseNumber parses numeric strings such as "1,234.56" or, with
+// decimal_separator ",", "1.234,56". Spaces, apostrophes and underscores are
+// always treated as grouping separators.
+func (u *PacketUtils) parseNumber(input interface{}, params map[string]interface{}, integer bool) (interface{}, error) {
+	// Strings go through separator handling; "1.234" is 1234 with decimal_separator ","
+	str, ok := input.(string)
+	if !ok {
+		number, ok := u.toFloat64(input)
+		if !ok {
+			return nil, fmt.Errorf("cannot parse %T as a number", input)
+		}
+		if integer {
+			if number != math.Trunc(number) {
+				return nil, fmt.Errorf("parse_int: %v is not an integer", input)
+			}
+			return int64(number), nil
+		}
+		return number, nil
+	}
+
+	decimal, _ := params["decimal_separator"].(string)
+	if decimal == "" {
+		decimal = "."
+	}
+	thousands, _ := params["thousands_separator"].(string)
+	if thousands == "" {
+		thousands = ","
+		if decimal == "," {
+			thousands = "."
+		}
+	}
+
+	normalized := strings.NewReplacer(thousands, "", " ", "", "\u00a0", "", "'", "", "_", "").Replace(strings.TrimSpace(str))
+	normalized = strings.Replace(normalized, decimal, ".", 1)
+
+	if integer {
+		value, err := strconv.ParseInt(normalized, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse_int: invalid integer %q", str)
+		}
+		return value, nil
+	}
+
+	value, err := strconv.ParseFloat(normalized, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse_float: invalid number %q", str)
+	}
+	return value, nil
+}
+
+// parseDate parses a date string into a unix timestamp using the "layout"
+// param, or the common layouts in dateLayouts. Dates without a zone are UTC.
+func (u *PacketUtils) parseDate(input interface{}, params map[string]interface{}) (interface{}, error) {
+	if timestamp, ok := input.(time.Time); ok {
+		return timestamp.Unix(), nil
+	}
+	str, ok := input.(string)
+	if !ok {
+		return nil, fmt.Errorf("parse_date: input must be a string")
+	}
+	str = strings.TrimSpace(str)
+
+	layouts := dateLayouts
+	if layout, ok := params["layout"].(string); ok && layout != "" {
+		layouts = []string{layout}
+	}
+
+	for _, layout := range layouts {
+		if parsed, err := time.Parse(layout, str); err == nil {
+			return parsed.Unix(), nil
+		}
+	}
+	return nil, fmt.Errorf("parse_date: unrecognised date %q", str)
+}
+
+// formatDate formats a unix timestamp using the "layout" param (RFC3339 by
+// default) in the "timezone" param's location (UTC by default)
+func (u *PacketUtils) formatDate(input interface{}, params map[string]interface{}) (interface{}, error) {
+	seconds, ok := u.toFloat64(input)
+	if timestamp, isTime := input.(time.Time); isTime {
+		seconds, ok = float64(timestamp.UnixNano())/1e9, true
+	}
+	if !ok {
+		str, isStr := input.(string)
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if !isStr || err != nil {
+			return nil, fmt.Errorf("format_date: input must be a unix timestamp")
+		}
+		seconds = parsed
+	}
+
+	layout, _ := params["layout"].(string)
+	if layout == "" {
+		layout = time.RFC3339
+	}
+
+	location := time.UTC
+	if zone, ok := params["timezone"].(string); ok && zone != "" {
+		loaded, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("format_date: unknown timezone %q", zone)
+		}
+		location = loaded
+	}
+
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)).In(location).Format(layout), nil
+}
+
+// Validate provides data validation utilities. With type coercion enabled,
+// integer, float and boolean accept both typed values and strings spelling them.
+func (u *PacketUtils) Validate(data interface{}, schema string) (bool, error) {
+	if u.coerceTypes {
+		switch schema {
+		case "integer":
+			number, ok := u.toFloat64(data)
+			return ok && number == math.Trunc(number), nil
+		case "float":
+			_, ok := u.toFloat64(data)
+			return ok, nil
+		case "boolean":
+			_, ok := coerceBool(data)
+			return ok, nil
+		}
+	}
+
+	dataStr := fmt.Sprintf("%v", data)
+
+	switch schema {
+	case "email":
+		return u.emailRegex.MatchString(dataStr), nil
+	case "uuid":
+		return u.uuidRegex.MatchString(strings.ToLower(dataStr)), nil
+	case "url":
+		_, err := url.Parse(dataStr)
+		return err == nil, nil
+	case "integer":
+		_, err := strconv.Atoi(dataStr)
+		return err == nil, nil
+	case "float":
+		_, err := strconv.ParseFloat(dataStr, 64)
+		return err == nil, nil
+	case "boolean":
+		_, err := strconv.ParseBool(dataStr)
+		return err == nil, nil
+	case "json":
+		var temp interface{}
+		err := json.Unmarshal([]byte(dataStr), &temp)
+		return err == nil, nil
+	default:
+		return false, fmt.Errorf("unknown schema: %s", schema)
+	}
+}
+
+// schemaTypes are the field types a Schema may declare
+var schemaTypes = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true,
+	"object": true, "array": true, "any": true,
+}
+
+// CheckSchema reports the first field declaring an unknown type or format
+func (u *PacketUtils) CheckSchema(schema Schema) error {
+	fields := make([]string, 0, len(schema))
+	for field := range schema {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		fieldSchema := schema[field]
+		if !schemaTypes[fieldSchema.Type] {
+			return fmt.Errorf("field %s: unknown type %q", field, fieldSchema.Type)
+		}
+		if fieldSchema.Format != "" {
+			if _, err := u.Validate("", fieldSchema.Format); err != nil {
+				return fmt.Errorf("field %s: %v", field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateSchema checks data against a schema, returning one error per
+// failing field ordered by field name. Fields not in the schema are allowed.
+func (u *PacketUtils) ValidateSchema(data map[string]interface{}, schema Schema) []FieldError {
+	var fieldErrors []FieldError
+
+	fields := make([]string, 0, len(schema))
+	for field := range schema {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		fieldSchema := schema[field]
+		value, exists := data[field]
+		if !exists || value == nil {
+			if fieldSchema.Required {
+				fieldErrors = append(fieldErrors, FieldError{Field: field, Message: "is required"})
+			}
+			continue
+		}
+
+		if !u.matchesType(value, fieldSchema.Type) {
+			fieldErrors = append(fieldErrors, FieldError{
+				Field:   field,
+				Message: fmt.Sprintf("must be %s, got %s", fieldSchema.Type, u.typeName(value)),
+			})
+			continue
+		}
+
+		if fieldSchema.Format != "" {
+			if valid, err := u.Validate(value, fieldSchema.Format); err != nil || !valid {
+				fieldErrors = append(fieldErrors, FieldError{
+					Field:   field,
+					Message: fmt.Sprintf("must be a valid %s", fieldSchema.Format),
+				})
+			}
+		}
+	}
+
+	return fieldErrors
+}
+
+// SanitizeOutput validates a handler result against an output schema and
+// returns a copy holding only the declared fields. Results must be an object
+// or an array of objects; array errors are prefixed with the element index.
+func (u *PacketUtils) SanitizeOutput(output interface{}, schema Schema) (interface{}, []FieldError) {
+	switch value := output.(type) {
+	case map[string]interface{}:
+		return u.sanitizeObject(value, schema, "")
+	case []map[string]interface{}:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = item
+		}
+		return u.sanitizeArray(items, schema)
+	case []interface{}:
+		return u.sanitizeArray(value, schema)
+	}
+	return nil, []FieldError{{Field: "", Message: fmt.Sprintf("output must be an object or array of objects, got %s", u.typeName(output))}}
+}
+
+func (u *PacketUtils) sanitizeArray(items []interface{}, schema Schema) (interface{}, []FieldError) {
+	var fieldErrors []FieldError
+	sanitized := make([]interface{}, len(items))
+
+	for i, item := range items {
+		prefix := fmt.Sprintf("[%d]", i)
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			fieldErrors = append(fieldErrors, FieldError{Field: prefix, Message: fmt.Sprintf("must be object, got %s", u.typeName(item))})
+			continue
+		}
+
+		var itemErrors []FieldError
+		sanitized[i], itemErrors = u.sanitizeObject(object, schema, prefix+".")
+		fieldErrors = append(fieldErrors, itemErrors...)
+	}
+	return sanitized, fieldErrors
+}
+
+func (u *PacketUtils) sanitizeObject(object map[string]interface{}, schema Schema, prefix string) (map[string]interface{}, []FieldError) {
+	fieldErrors := u.ValidateSchema(object, schema)
+	for i := range fieldErrors {
+		fieldErrors[i].Field = prefix + fieldErrors[i].Field
+	}
+
+	sanitized := make(map[string]interface{}, len(schema))
+	for field := range schema {
+		if value, exists := object[field]; exists {
+			sanitized[field] = value
+		}
+	}
+	return sanitized, fieldErrors
+}
+
+func (u *PacketUtils) matchesType(value interface{}, fieldType string) bool {
+	switch fieldType {
+	case "any":
+		return true
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, isString := value.(string)
+		_, ok := u.toFloat64(value)
+		return ok && !isString
+	case "integer":
+		_, isString := value.(string)
+		f, ok := u.toFloat64(value)
+		return ok && !isString && f == math.Trunc(f)
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		kind := reflect.ValueOf(value).Kind()
+		return kind == reflect.Slice || kind == reflect.Array
+	}
+	return false
+}
+
+// typeName describes a value using schema type names
+func (u *PacketUtils) typeName(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	}
+	if f, ok := u.toFloat64(value); ok {
+		if f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	kind := reflect.ValueOf(value).Kind()
+	if kind == reflect.Slice || kind == reflect.Array {
+		return "array"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// CalculateStatistics calculates basic statistics for numeric data
+func (u *PacketUtils) CalculateStatistics(data []float64) map[string]interface{} {
+	if len(data) == 0 {
+		return map[string]interface{}{"error": "no data provided"}
+	}
+
+	// Sort for median calculation
+	sorted := make([]float64, len(data))
+	copy(sorted, data)
+	sort.Float64s(sorted)
+
+	// Calculate basic statistics
+	sum := 0.0
+	for _, v := range data {
+		sum += v
+	}
+	mean := sum / float64(len(data))
+
+	// Median
+	var median float64
+	n := len(sorted)
+	if n%2 == 0 {
+		median = (sorted[n/2-1] + sorted[n/2]) / 2
+	} else {
+		median = sorted[n/2]
+	}
+
+	// Variance and standard deviation
+	variance := 0.0
+	for _, v := range data {
+		variance += math.Pow(v-mean, 2)
+	}
+	variance /= float64(len(data))
+	stdDev := math.Sqrt(variance)
+
+	return map[string]interface{}{
+		"count":              len(data),
+		"sum":                sum,
+		"mean":               mean,
+		"median":             median,
+		"min":                sorted[0],
+		"max":                sorted[n-1],
+		"variance":           variance,
+		"standard_deviation": stdDev,
+	}
+}
+
+// DiffResult lists the differences between two values by dotted path
+type DiffResult struct {
+	Added   []DiffEntry  `json:"added"`
+	Removed []DiffEntry  `json:"removed"`
+	Changed []DiffChange `json:"changed"`
+}
+
+// DiffEntry is a path present on only one side
+type DiffEntry struct {
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// DiffChange is a path whose value differs between the two sides
+type DiffChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// Diff compares two values recursively. Objects are compared by field and
+// arrays element-wise by index ("items.0"), or, when arrayKey is set and
+// both arrays hold objects carrying that field, matched by its value
+// ("items[id=42]"). Keys must be unique within each array and all strings or
+// all numbers, since "1" and 1 would share a path; otherwise the arrays are
+// compared by index. Numbers compare by value, so 1 and 1.0 are equal.
+func (u *PacketUtils) Diff(left, right interface{}, arrayKey string) DiffResult {
+	result := DiffResult{
+		Added:   []DiffEntry{},
+		Removed: []DiffEntry{},
+		Changed: []DiffChange{},
+	}
+	u.diffValues("", left, right, arrayKey, &result)
+	return result
+}
+
+func (u *PacketUtils) diffValues(path string, left, right interface{}, arrayKey string, result *DiffResult) {
+	leftMap, leftIsMap := left.(map[string]interface{})
+	rightMap, rightIsMap := right.(map[string]interface{})
+	if leftIsMap && rightIsMap {
+		u.diffMaps(path, leftMap, rightMap, arrayKey, result)
+		return
+	}
+
+	leftSlice, leftIsSlice := left.([]interface{})
+	rightSlice, rightIsSlice := right.([]interface{})
+	if leftIsSlice && rightIsSlice {
+		if arrayKey != "" && u.keyedBy(arrayKey, leftSlice, rightSlice) {
+			u.diffKeyed(path, leftSlice, rightSlice, arrayKey, result)
+		} else {
+			u.diffIndexed(path, leftSlice, rightSlice, arrayKey, result)
+		}
+		return
+	}
+
+	if !u.valuesEqual(left, right) {
+		result.Changed = append(result.Changed, DiffChange{Path: path, Old: left, New: right})
+	}
+}
+
+func (u *PacketUtils) diffMaps(path string, left, right map[string]interface{}, arrayKey string, result *DiffResult) {
+	keys := make([]string, 0, len(left)+len(right))
+	for key := range left {
+		keys = append(keys, key)
+	}
+	for key := range right {
+		if _, exists := left[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		childPath := u.joinPath(path, key)
+		leftValue, inLeft := left[key]
+		rightValue, inRight := right[key]
+		switch {
+		case !inLeft:
+			result.Added = append(result.Added, DiffEntry{Path: childPath, Value: rightValue})
+		case !inRight:
+			result.Removed = append(result.Removed, DiffEntry{Path: childPath, Value: leftValue})
+		default:
+			u.diffValues(childPath, leftValue, rightValue, arrayKey, result)
+		}
+	}
+}
+
+func (u *PacketUtils) diffIndexed(path string, left, right []interface{}, arrayKey string, result *DiffResult) {
+	for i := 0; i < len(left) || i < len(right); i++ {
+		childPath := u.joinPath(path, strconv.Itoa(i))
+		switch {
+		case i >= len(left):
+			result.Added = append(result.Added, DiffEntry{Path: childPath, Value: right[i]})
+		case i >= len(right):
+			result.Removed = append(result.Removed, DiffEntry{Path: childPath, Value: left[i]})
+		default:
+			u.diffValues(childPath, left[i], right[i], arrayKey, result)
+		}
+	}
+}
+
+func (u *PacketUtils) diffKeyed(path string, left, right []interface{}, arrayKey string, result *DiffResult) {
+	elementPath := func(item interface{}) string {
+		return fmt.Sprintf("%s[%s=%v]", path, arrayKey, item.(map[string]interface{})[arrayKey])
+	}
+
+	rightByKey := make(map[string]interface{}, len(right))
+	for _, item := range right {
+		rightByKey[elementPath(item)] = item
+	}
+
+	leftByKey := make(map[string]bool, len(left))
+	for _, item := range left {
+		childPath := elementPath(item)
+		leftByKey[childPath] = true
+		if match, exists := rightByKey[childPath]; exists {
+			u.diffValues(childPath, item, match, arrayKey, result)
+		} else {
+			result.Removed = append(result.Removed, DiffEntry{Path: childPath, Value: item})
+		}
+	}
+	for _, item := range right {
+		if childPath := elementPath(item); !leftByKey[childPath] {
+			result.Added = append(result.Added, DiffEntry{Path: childPath, Value: item})
+		}
+	}
+}
+
+// keyedBy reports whether every element of each array is an object carrying
+// key, with values unique within its array and either all strings or all
+// numbers across both, so each names one element unambiguously
+func (u *PacketUtils) keyedBy(key string, arrays ...[]interface{}) bool {
+	kind := ""
+	for _, items := range arrays {
+		seen := make(map[string]bool, len(items))
+		for _, item := range items {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			value, exists := itemMap[key]
+			if !exists {
+				return false
+			}
+			valueKind := "number"
+			if _, isString := value.(string); isString {
+				valueKind = "string"
+			} else if _, isNumber := u.toFloat64(value); !isNumber {
+				return false
+			}
+			if kind != "" && valueKind != kind {
+				return false
+			}
+			kind = valueKind
+
+			id := fmt.Sprint(value)
+			if seen[id] {
+				return false
+			}
+			seen[id] = true
+		}
+	}
+	return true
+}
+
+// valuesEqual compares scalars, treating numbers of any type as equal by
+// value; strings are never equal to numbers
+func (u *PacketUtils) valuesEqual(left, right interface{}) bool {
+	_, leftIsString := left.(string)
+	_, rightIsString := right.(string)
+	if !leftIsString && !rightIsString {
+		leftFloat, leftIsNumber := u.toFloat64(left)
+		rightFloat, rightIsNumber := u.toFloat64(right)
+		if leftIsNumber && rightIsNumber {
+			return leftFloat == rightFloat
+		}
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+func (u *PacketUtils) joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Array strategies for Merge
+const (
+	MergeArraysReplace = "replace"
+	MergeArraysConcat  = "concat"
+	MergeArraysUnion   = "union"
+)
+
+// Merge deep-merges objects in order, later sources overriding earlier
+// ones. Objects present on both sides merge recursively; any other pair,
+// including a type conflict or an explicit null, is resolved by the later
+// value. Arrays on both sides follow the strategy: replace keeps the later
+// array, concat appends it, union appends only elements not already present.
+// Inputs are not modified.
+func (u *PacketUtils) Merge(inputs []map[string]interface{}, arrayStrategy string) (map[string]interface{}, error) {
+	switch arrayStrategy {
+	case "":
+		arrayStrategy = MergeArraysReplace
+	case MergeArraysReplace, MergeArraysConcat, MergeArraysUnion:
+	default:
+		return nil, fmt.Errorf("unsupported array strategy: %s", arrayStrategy)
+	}
+
+	merged := make(map[string]interface{})
+	for _, input := range inputs {
+		u.mergeInto(merged, input, arrayStrategy)
+	}
+	return merged, nil
+}
+
+func (u *PacketUtils) mergeInto(target, source map[string]interface{}, arrayStrategy string) {
+	for key, value := range source {
+		existing, exists := target[key]
+		if !exists {
+			target[key] = u.deepCopy(value)
+			continue
+		}
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if existingMap, ok := existing.(map[string]interface{}); ok {
+				u.mergeInto(existingMap, value, arrayStrategy)
+				continue
+			}
+		case []interface{}:
+			if existingSlice, ok := existing.([]interface{}); ok {
+				target[key] = u.mergeArrays(existingSlice, value, arrayStrategy)
+				continue
+			}
+		}
+		target[key] = u.deepCopy(value)
+	}
+}
+
+func (u *PacketUtils) mergeArrays(existing, incoming []interface{}, arrayStrategy string) []interface{} {
+	switch arrayStrategy {
+	case MergeArraysConcat:
+		return append(existing, u.deepCopy(incoming).([]interface{})...)
+	case MergeArraysUnion:
+		for _, item := range incoming {
+			present := false
+			for _, current := range existing {
+				if u.equalValues(current, item) {
+					present = true
+					break
+				}
+			}
+			if !present {
+				existing = append(existing, u.deepCopy(item))
+			}
+		}
+		return existing
+	}
+	return u.deepCopy(incoming).([]interface{})
+}
+
+// equalValues reports whether two values have no differences
+func (u *PacketUtils) equalValues(left, right interface{}) bool {
+	diff := u.Diff(left, right, "")
+	return len(diff.Added)+len(diff.Removed)+len(diff.Changed) == 0
+}
+
+// deepCopy copies nested objects and arrays so merged output never aliases
+// its inputs
+func (u *PacketUtils) deepCopy(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			copied[k] = u.deepCopy(v)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, v := range value {
+			copied[i] = u.deepCopy(v)
+		}
+		return copied
+	case []map[string]interface{}:
+		copied := make([]map[string]interface{}, len(value))
+		for i, v := range value {
+			copied[i], _ = u.deepCopy(v).(map[string]interface{})
+		}
+		return copied
+	}
+	return value
+}
+
+// ExtractPath selects a value from nested maps and slices using a dotted
+// path such as "user.email", "items.0.id" or "items[0].id". An empty path
+// returns data itself. Negative indices count from the end of a slice.
+func (u *PacketUtils) ExtractPath(data interface{}, path string) (interface{}, bool) {
+	path = strings.NewReplacer("[", ".", "]", "").Replace(path)
+
+	current := data
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			continue
+		}
+
+		if node, ok := current.(map[string]interface{}); ok {
+			value, exists := node[segment]
+			if !exists {
+				return nil, false
+			}
+			current = value
+			continue
+		}
+
+		rv := reflect.ValueOf(current)
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array:
+			index, err := strconv.Atoi(segment)
+			if err != nil {
+				return nil, false
+			}
+			if index < 0 {
+				index += rv.Len()
+			}
+			if index < 0 || index >= rv.Len() {
+				return nil, false
+			}
+			current = rv.Index(index).Interface()
+		case reflect.Map:
+			if rv.Type().Key().Kind() != reflect.String {
+				return nil, false
+			}
+			value := rv.MapIndex(reflect.ValueOf(segment).Convert(rv.Type().Key()))
+			if !value.IsValid() {
+				return nil, false
+			}
+			current = value.Interface()
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// jsonPathStep is one segment of a parsed JSONPath
+type jsonPathStep struct {
+	kind       int
+	key        string
+	index      int
+	start, end *int
+	step       int
+}
+
+const (
+	jsonPathKey = iota
+	jsonPathIndex
+	jsonPathWildcard
+	jsonPathSlice
+)
+
+// parseJSONPath parses the subset of JSONPath df:query supports: $, .name,
+// ['name'], [n], .* or [*], and [start:end:step] slices. It also reports
+// whether the path can match more than one value.
+func parseJSONPath(path string) ([]jsonPathStep, bool, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, false, fmt.Errorf("path must start with $")
+	}
+
+	var steps []jsonPathStep
+	multiple := false
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			return nil, false, fmt.Errorf("recursive descent (..) is not supported")
+		case rest[0] == '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = rest[end:]
+			switch name {
+			case "":
+				return nil, false, fmt.Errorf("empty name in path %s", path)
+			case "*":
+				steps = append(steps, jsonPathStep{kind: jsonPathWildcard})
+				multiple = true
+			default:
+				steps = append(steps, jsonPathStep{kind: jsonPathKey, key: name})
+			}
+		case rest[0] == '[':
+			if len(rest) > 1 && (rest[1] == '\'' || rest[1] == '"') {
+				quote := rest[1]
+				end := strings.IndexByte(rest[2:], quote)
+				if end < 0 || !strings.HasPrefix(rest[2+end+1:], "]") {
+					return nil, false, fmt.Errorf("unterminated quoted name in path %s", path)
+				}
+				steps = append(steps, jsonPathStep{kind: jsonPathKey, key: rest[2 : 2+end]})
+				rest = rest[2+end+2:]
+				continue
+			}
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, false, fmt.Errorf("unterminated [ in path %s", path)
+			}
+			step, err := parseJSONPathBracket(rest[1:end])
+			if err != nil {
+				return nil, false, err
+			}
+			if step.kind != jsonPathIndex {
+				multiple = true
+			}
+			steps = append(steps, step)
+			rest = rest[end+1:]
+		default:
+			return nil, false, fmt.Errorf("unexpected %q in path %s", rest[0], path)
+		}
+	}
+	return steps, multiple, nil
+}
+
+func parseJSONPathBracket(selector string) (jsonPathStep, error) {
+	selector = strings.TrimSpace(selector)
+	if selector == "*" {
+		return jsonPathStep{kind: jsonPathWildcard}, nil
+	}
+	if !strings.Contains(selector, ":") {
+		index, err := strconv.Atoi(selector)
+		if err != nil {
+			return jsonPathStep{}, fmt.Errorf("invalid index [%s]", selector)
+		}
+		return jsonPathStep{kind: jsonPathIndex, index: index}, nil
+	}
+
+	parts := strings.Split(selector, ":")
+	if len(parts) > 3 {
+		return jsonPathStep{}, fmt.Errorf("invalid slice [%s]", selector)
+	}
+	step := jsonPathStep{kind: jsonPathSlice, step: 1}
+	bounds := []**int{&step.start, &step.end}
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return jsonPathStep{}, fmt.Errorf("invalid slice [%s]", selector)
+		}
+		if i == 2 {
+			if value <= 0 {
+				return jsonPathStep{}, fmt.Errorf("slice step must be positive in [%s]", selector)
+			}
+			step.step = value
+			continue
+		}
+		*bounds[i] = &value
+	}
+	return step, nil
+}
+
+// sliceBound resolves an optional slice bound against length n, counting
+// negative bounds from the end and clamping to [0, n]
+func sliceBound(bound *int, fallback, n int) int {
+	if bound == nil {
+		return fallback
+	}
+	value := *bound
+	if value < 0 {
+		value += n
+	}
+	if value < 0 {
+		return 0
+	}
+	if value > n {
+		return n
+	}
+	return value
+}
+
+// QueryPath evaluates a JSONPath (see parseJSONPath) against nested maps and
+// slices, returning every match in document order; object wildcards visit
+// keys in sorted order. The bool reports whether the path could match more
+// than one value.
+func (u *PacketUtils) QueryPath(data interface{}, path string) ([]interface{}, bool, error) {
+	steps, multiple, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	current := []interface{}{data}
+	for _, step := range steps {
+		var next []interface{}
+		for _, node := range current {
+			switch value := node.(type) {
+			case map[string]interface{}:
+				switch step.kind {
+				case jsonPathKey:
+					if child, exists := value[step.key]; exists {
+						next = append(next, child)
+					}
+				case jsonPathWildcard:
+					keys := make([]string, 0, len(value))
+					for key := range value {
+						keys = append(keys, key)
+					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						next = append(next, value[key])
+					}
+				}
+			case []interface{}:
+				switch step.kind {
+				case jsonPathIndex:
+					index := step.index
+					if index < 0 {
+						index += len(value)
+					}
+					if index >= 0 && index < len(value) {
+						next = append(next, value[index])
+					}
+				case jsonPathWildcard:
+					next = append(next, value...)
+				case jsonPathSlice:
+					start := sliceBound(step.start, 0, len(value))
+					end := sliceBound(step.end, len(value), len(value))
+					for i := start; i < end; i += step.step {
+						next = append(next, value[i])
+					}
+				}
+			}
+		}
+		current = next
+	}
+	return current, multiple, nil
+}
+
+// FilterData filters slice data based on conditions
+func (u *PacketUtils) FilterData(data []map[string]interface{}, condition map[string]interface{}) []map[string]interface{} {
+	var result []map[string]interface{}
+	
+	for _, item := range data {
+		if u.matchesCondition(item, condition) {
+			result = append(result, item)
+		}
+	}
+	
+	return result
+}
+
+func (u *PacketUtils) matchesCondition(item, condition map[string]interface{}) bool {
+	for key, value := range condition {
+		itemValue, exists := item[key]
+		if !exists {
+			return false
+		}
+		
+		// Handle operator objects like {$gt: 18}
+		if valueMap, ok := value.(map[string]interface{}); ok {
+			if !u.evaluateOperators(itemValue, valueMap) {
+				return false
+			}
+		} else if !u.scalarsEqual(itemValue, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *PacketUtils) evaluateOperators(itemValue interface{}, operators map[string]interface{}) bool {
+	for op, val := range operators {
+		switch op {
+		case "$gt":
+			if !u.compareValues(itemValue, val, ">") {
+				return false
+			}
+		case "$gte":
+			if !u.compareValues(itemValue, val, ">=") {
+				return false
+			}
+		case "$lt":
+			if !u.compareValues(itemValue, val, "<") {
+				return false
+			}
+		case "$lte":
+			if !u.compareValues(itemValue, val, "<=") {
+				return false
+			}
+		case "$ne":
+			if u.scalarsEqual(itemValue, val) {
+				return false
+			}
+		default:
+			if !u.scalarsEqual(itemValue, val) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// scalarsEqual compares filter values: numbers by value regardless of Go
+// type, and with type coercion enabled, after CoercePair
+func (u *PacketUtils) scalarsEqual(a, b interface{}) bool {
+	if u.coerceTypes {
+		a, b = u.CoercePair(a, b)
+	}
+	return u.valuesEqual(a, b)
+}
+
+// CoercePair normalizes two scalars for comparison: a numeric string paired
+// with a number becomes a float64, and "true" or "false" paired with a bool
+// becomes a bool. Any other pair is returned unchanged.
+func (u *PacketUtils) CoercePair(a, b interface{}) (interface{}, interface{}) {
+	_, aIsString := a.(string)
+	_, bIsString := b.(string)
+	if aIsString == bIsString {
+		return a, b
+	}
+
+	str, other := a, b
+	if bIsString {
+		str, other = b, a
+	}
+
+	var coerced interface{}
+	if _, isBool := other.(bool); isBool {
+		value, ok := coerceBool(str)
+		if !ok {
+			return a, b
+		}
+		coerced = value
+	} else if _, isNumber := u.toFloat64(other); isNumber {
+		value, ok := u.toFloat64(str)
+		if !ok {
+			return a, b
+		}
+		coerced = value
+	} else {
+		return a, b
+	}
+
+	if aIsString {
+		return coerced, b
+	}
+	return a, coerced
+}
+
+// coerceBool accepts a bool or a string ParseBool understands
+func coerceBool(value interface{}) (bool, bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case string:
+		parsed, err := strconv.ParseBool(strings.TrimSpace(v))
+		return parsed, err == nil
+	}
+	return false, false
+}
+
+func (u *PacketUtils) compareValues(a, b interface{}, op string) bool {
+	// Convert to float64 for numeric comparison
+	aFloat, aOk := u.toFloat64(a)
+	bFloat, bOk := u.toFloat64(b)
+	
+	if !aOk || !bOk {
+		return false
+	}
+	
+	switch op {
+	case ">":
+		return aFloat > bFloat
+	case ">=":
+		return aFloat >= bFloat
+	case "<":
+		return aFloat < bFloat
+	case "<=":
+		return aFloat <= bFloat
+	default:
+		return false
+	}
+}
+
+func (u *PacketUtils) toFloat64(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case int32:
+		return float64(val), true
+	case int16:
+		return float64(val), true
+	case int8:
+		return float64(val), true
+	case uint:
+		return float64(val), true
+	case uint64:
+		return float64(val), true
+	case uint32:
+		return float64(val), true
+	case uint16:
+		return float64(val), true
+	case uint8:
+		return float64(val), true
+	default:
+		if str, ok := v.(string); ok {
+			if f, err := strconv.ParseFloat(str, 64); err == nil {
+				return f, true
+			}
+		}
+		return 0, false
+	}
+}
+
+// ============================================================================
+// Expression Evaluator
+// ============================================================================
+
+// Expression limits keep df:eval sandboxed: the language has no I/O, loops or
+// assignment, and every evaluated node counts against a step budget.
+const (
+	DefaultExpressionSteps = 1000
+	MaxExpressionSteps     = 100000
+	MaxExpressionLength    = 4096
+	maxExpressionDepth     = 64
+)
+
+// EvaluateExpression parses and evaluates expr against input, returning the
+// result and the number of steps taken. Identifiers resolve as dotted paths
+// into input, e.g. "price * qty > 100 && upper(user.name) == \"ADA\"".
+func (u *PacketUtils) EvaluateExpression(expr string, input interface{}, maxSteps int) (interface{}, int, error) {
+	if len(expr) > MaxExpressionLength {
+		return nil, 0, fmt.Errorf("expression exceeds %d characters", MaxExpressionLength)
+	}
+	if maxSteps <= 0 {
+		maxSteps = DefaultExpressionSteps
+	}
+
+	tokens, err := tokenizeExpression(expr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	parser := &exprParser{tokens: tokens}
+	node, err := parser.parseExpression()
+	if err != nil {
+		return nil, 0, err
+	}
+	if parser.peek().kind != tokenEOF {
+		return nil, 0, fmt.Errorf("unexpected %q at position %d", parser.peek().text, parser.peek().pos)
+	}
+
+	env := &exprEnv{input: input, maxSteps: maxSteps, utils: u}
+	value, err := node.eval(env)
+	return value, env.steps, err
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOperator
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenizeExpression(expr string) ([]exprToken, error) {
+	var tokens []exprToken
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(expr) && expr[i+1] >= '0' && expr[i+1] <= '9':
+			start := i
+			for i < len(expr) && (expr[i] >= '0' && expr[i] <= '9' || expr[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenNumber, text: expr[start:i], pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for i < len(expr) && expr[i] != c {
+				if expr[i] == '\\' && i+1 < len(expr) {
+					i++
+				}
+				sb.WriteByte(expr[i])
+				i++
+			}
+			if i >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{kind: tokenString, text: sb.String(), pos: start})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(expr) && (expr[i] == '_' || expr[i] == '.' || expr[i] == '[' || expr[i] == ']' ||
+				expr[i] >= 'a' && expr[i] <= 'z' || expr[i] >= 'A' && expr[i] <= 'Z' || expr[i] >= '0' && expr[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenIdent, text: expr[start:i], pos: start})
+		default:
+			if i+1 < len(expr) {
+				switch two := expr[i : i+2]; two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					tokens = append(tokens, exprToken{kind: tokenOperator, text: two, pos: i})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/%<>!(),", rune(c)) {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, exprToken{kind: tokenOperator, text: string(c), pos: i})
+			i++
+		}
+	}
+
+	return append(tokens, exprToken{kind: tokenEOF, pos: len(expr)}), nil
+}
+
+// exprParser is a recursive-descent parser; precedence from lowest to highest
+// is ||, &&, comparison, additive, multiplicative, unary
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	depth  int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	token := p.peek()
+	if token.kind != tokenOperator {
+		return "", false
+	}
+	for _, op := range ops {
+		if token.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) parseExpression() (exprNode, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxExpressionDepth {
+		return nil, fmt.Errorf("expression nested deeper than %d levels", maxExpressionDepth)
+	}
+	return p.parseBinary(0)
+}
+
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(exprPrecedence[level]...)
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if op, ok := p.accept("!", "-"); ok {
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > maxExpressionDepth {
+			return nil, fmt.Errorf("expression nested deeper than %d levels", maxExpressionDepth)
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token := p.next()
+	switch token.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", token.text, token.pos)
+		}
+		return &literalNode{value: value}, nil
+	case tokenString:
+		return &literalNode{value: token.text}, nil
+	case tokenIdent:
+		switch token.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(token)
+		}
+		return &fieldNode{path: token.text}, nil
+	case tokenOperator:
+		if token.text == "(" {
+			node, err := p.parseExpression()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.accept(")"); !ok {
+				return nil, fmt.Errorf("expected ) at position %d", p.peek().pos)
+			}
+			return node, nil
+		}
+	case tokenEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", token.text, token.pos)
+}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	if _, exists := exprFunctions[name.text]; !exists {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+
+	call := &callNode{name: name.text}
+	if _, ok := p.accept(")"); ok {
+		return call, nil
+	}
+	for {
+		arg, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+
+		if _, ok := p.accept(")"); ok {
+			return call, nil
+		}
+		if _, ok := p.accept(","); !ok {
+			return nil, fmt.Errorf("expected , or ) at position %d", p.peek().pos)
+		}
+	}
+}
+
+type exprEnv struct {
+	input    interface{}
+	steps    int
+	maxSteps int
+	utils    *PacketUtils
+}
+
+func (env *exprEnv) step() error {
+	env.steps++
+	if env.steps > env.maxSteps {
+		return fmt.Errorf("expression exceeded %d evaluation steps", env.maxSteps)
+	}
+	return nil
+}
+
+type exprNode interface {
+	eval(env *exprEnv) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(env *exprEnv) (interface{}, error) {
+	return n.value, env.step()
+}
+
+type fieldNode struct {
+	path string
+}
+
+func (n *fieldNode) eval(env *exprEnv) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	value, _ := env.utils.ExtractPath(env.input, n.path)
+	return value, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(env *exprEnv) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !exprTruthy(value), nil
+	}
+	number, ok := env.utils.toFloat64(value)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate %T", value)
+	}
+	return -number, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(env *exprEnv) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logical operators short-circuit
+	switch n.op {
+	case "&&":
+		if !exprTruthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(env)
+		return exprTruthy(right), err
+	case "||":
+		if exprTruthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(env)
+		return exprTruthy(right), err
+	}
+
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return exprEqual(env.utils, left, right), nil
+	case "!=":
+		return !exprEqual(env.utils, left, right), nil
+	}
+
+	leftStr, leftIsStr := left.(string)
+	rightStr, rightIsStr := right.(string)
+	if n.op == "+" && (leftIsStr || rightIsStr) {
+		return exprString(left) + exprString(right), nil
+	}
+	if leftIsStr && rightIsStr {
+		switch n.op {
+		case "<":
+			return leftStr < rightStr, nil
+		case "<=":
+			return leftStr <= rightStr, nil
+		case ">":
+			return leftStr > rightStr, nil
+		case ">=":
+			return leftStr >= rightStr, nil
+		}
+	}
+
+	a, aOk := env.utils.toFloat64(left)
+	b, bOk := env.utils.toFloat64(right)
+	if !aOk || !bOk {
+		return nil, fmt.Errorf("operator %s requires numbers, got %T and %T", n.op, left, right)
+	}
+
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return a / b, nil
+	case "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return math.Mod(a, b), nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (n *callNode) eval(env *exprEnv) (interface{}, error) {
+	if err := env.step(); err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	return exprFunctions[n.name](env.utils, args)
+}
+
+// exprFunctions are the builtins available to expressions
+var exprFunctions = map[string]func(u *PacketUtils, args []interface{}) (interface{}, error){
+	"len": func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("len expects 1 argument")
+		}
+		switch v := args[0].(type) {
+		case string:
+			return float64(len([]rune(v))), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("len does not support %T", args[0])
+	},
+	"upper": exprStringFunc("upper", strings.ToUpper),
+	"lower": exprStringFunc("lower", strings.ToLower),
+	"trim":  exprStringFunc("trim", strings.TrimSpace),
+	"str": func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("str expects 1 argument")
+		}
+		return exprString(args[0]), nil
+	},
+	"num": func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("num expects 1 argument")
+		}
+		if number, ok := u.toFloat64(args[0]); ok {
+			return number, nil
+		}
+		if str, ok := args[0].(string); ok {
+			if number, err := strconv.ParseFloat(strings.TrimSpace(str), 64); err == nil {
+				return number, nil
+			}
+		}
+		return nil, fmt.Errorf("cannot convert %v to a number", args[0])
+	},
+	"concat": func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		var sb strings.Builder
+		for _, arg := range args {
+			sb.WriteString(exprString(arg))
+		}
+		return sb.String(), nil
+	},
+	"contains": func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("contains expects 2 arguments")
+		}
+		return strings.Contains(exprString(args[0]), exprString(args[1])), nil
+	},
+	"substr": func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		if len(args) < 2 || len(args) > 3 {
+			return nil, fmt.Errorf("substr expects 2 or 3 arguments")
+		}
+		runes := []rune(exprString(args[0]))
+		start, ok := u.toFloat64(args[1])
+		if !ok || math.IsNaN(start) || math.IsInf(start, 0) {
+			return nil, fmt.Errorf("substr start must be a finite number")
+		}
+		// Clamp as float64 so huge values never overflow the int conversion
+		size := float64(len(runes))
+		from := math.Max(0, math.Min(start, size))
+		to := size
+		if len(args) == 3 {
+			length, ok := u.toFloat64(args[2])
+			if !ok || math.IsNaN(length) || math.IsInf(length, 0) {
+				return nil, fmt.Errorf("substr length must be a finite number")
+			}
+			to = math.Min(from+math.Max(0, length), size)
+		}
+		return string(runes[int(from):int(to)]), nil
+	},
+	"abs":   exprNumberFunc("abs", math.Abs),
+	"round": exprNumberFunc("round", math.Round),
+	"floor": exprNumberFunc("floor", math.Floor),
+	"ceil":  exprNumberFunc("ceil", math.Ceil),
+	"min":   exprReduceFunc("min", math.Min),
+	"max":   exprReduceFunc("max", math.Max),
+	"if": func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		if len(args) != 3 {
+			return nil, fmt.Errorf("if expects 3 arguments")
+		}
+		if exprTruthy(args[0]) {
+			return args[1], nil
+		}
+		return args[2], nil
+	},
+}
+
+func exprStringFunc(name string, fn func(string) string) func(*PacketUtils, []interface{}) (interface{}, error) {
+	return func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s expects 1 argument", name)
+		}
+		return fn(exprString(args[0])), nil
+	}
+}
+
+func exprNumberFunc(name string, fn func(float64) float64) func(*PacketUtils, []interface{}) (interface{}, error) {
+	return func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s expects 1 argument", name)
+		}
+		number, ok := u.toFloat64(args[0])
+		if !ok {
+			return nil, fmt.Errorf("%s expects a number, got %T", name, args[0])
+		}
+		return fn(number), nil
+	}
+}
+
+func exprReduceFunc(name string, fn func(a, b float64) float64) func(*PacketUtils, []interface{}) (interface{}, error) {
+	return func(u *PacketUtils, args []interface{}) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("%s expects at least 1 argument", name)
+		}
+		var result float64
+		for i, arg := range args {
+			number, ok := u.toFloat64(arg)
+			if !ok {
+				return nil, fmt.Errorf("%s expects numbers, got %T", name, arg)
+			}
+			if i == 0 {
+				result = number
+			} else {
+				result = fn(result, number)
+			}
+		}
+		return result, nil
+	}
+}
+
+func exprTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	}
+	return true
+}
+
+func exprString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+func exprEqual(u *PacketUtils, a, b interface{}) bool {
+	if x, ok := u.toFloat64(a); ok {
+		if y, ok := u.toFloat64(b); ok {
+			return x == y
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// ============================================================================
+// CSV
+// ============================================================================
+
+// Ragged row policies for ParseCSV: rows whose field count differs from the
+// header (or first row) either fail the parse, are padded with empty fields
+// and truncated, or are skipped
+const (
+	CSVRaggedError = "error"
+	CSVRaggedPad   = "pad"
+	CSVRaggedSkip  = "skip"
+)
+
+// CSVOptions configures ParseCSV and StringifyCSV
+type CSVOptions struct {
+	Delimiter rune
+	Header    bool
+	Ragged    string
+	Columns   []string
+}
+
+// csvOptions reads the delimiter, header, ragged and columns fields shared by
+// the CSV packets. Header defaults to true and the delimiter to a comma.
+func (u *PacketUtils) csvOptions(data map[string]interface{}) (CSVOptions, error) {
+	options := CSVOptions{Delimiter: ',', Header: true, Ragged: CSVRaggedError}
+
+	if delimiter, ok := data["delimiter"].(string); ok && delimiter != "" {
+		runes := []rune(delimiter)
+		if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+			return options, fmt.Errorf("%w: delimiter must be a single character other than a quote or newline", ErrInvalidInput)
+		}
+		options.Delimiter = runes[0]
+	}
+	if header, ok := data["header"].(bool); ok {
+		options.Header = header
+	}
+	if ragged, ok := data["ragged"].(string); ok && ragged != "" {
+		switch ragged {
+		case CSVRaggedError, CSVRaggedPad, CSVRaggedSkip:
+			options.Ragged = ragged
+		default:
+			return options, fmt.Errorf("%w: ragged must be error, pad or skip", ErrInvalidInput)
+		}
+	}
+	if columns, ok := data["columns"].([]interface{}); ok {
+		for i, column := range columns {
+			name, ok := column.(string)
+			if !ok {
+				return options, fmt.Errorf("%w: columns[%d] must be a string", ErrInvalidInput, i)
+			}
+			options.Columns = append(options.Columns, name)
+		}
+	}
+	return options, nil
+}
+
+// ParseCSV parses RFC 4180 CSV. With a header row each record becomes an
+// object keyed by column name; without one, records are arrays of strings.
+// It also returns the column names (nil without a header).
+func (u *PacketUtils) ParseCSV(text string, options CSVOptions) ([]interface{}, []string, error) {
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.Comma = options.Delimiter
+	reader.FieldsPerRecord = -1
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+
+	records := make([]interface{}, 0, len(rows))
+	if len(rows) == 0 {
+		return records, nil, nil
+	}
+
+	var columns []string
+	width := len(rows[0])
+	if options.Header {
+		columns = rows[0]
+		rows = rows[1:]
+	}
+
+	for i, row := range rows {
+		if len(row) != width {
+			switch options.Ragged {
+			case CSVRaggedSkip:
+				continue
+			case CSVRaggedPad:
+				padded := make([]string, width)
+				copy(padded, row)
+				row = padded
+			default:
+				return nil, nil, fmt.Errorf("%w: record %d has %d fields, expected %d", ErrInvalidInput, i+1, len(row), width)
+			}
+		}
+
+		if !options.Header {
+			fields := make([]interface{}, len(row))
+			for j, field := range row {
+				fields[j] = field
+			}
+			records = append(records, fields)
+			continue
+		}
+		record := make(map[string]interface{}, width)
+		for j, column := range columns {
+			record[column] = row[j]
+		}
+		records = append(records, record)
+	}
+	return records, columns, nil
+}
+
+// StringifyCSV writes records as RFC 4180 CSV. Objects are written in
+// options.Columns order, defaulting to the sorted union of their keys;
+// arrays are written as they are. Nested values are written as JSON.
+func (u *PacketUtils) StringifyCSV(records []interface{}, options CSVOptions) (string, error) {
+	columns := options.Columns
+	if len(columns) == 0 {
+		seen := make(map[string]bool)
+		for _, item := range records {
+			if record, ok := item.(map[string]interface{}); ok {
+				for key := range record {
+					if !seen[key] {
+						seen[key] = true
+						columns = append(columns, key)
+					}
+				}
+			}
+		}
+		sort.Strings(columns)
+	}
+
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Comma = options.Delimiter
+
+	if options.Header && len(columns) > 0 {
+		if err := writer.Write(columns); err != nil {
+			return "", err
+		}
+	}
+	for i, item := range records {
+		var row []string
+		switch record := item.(type) {
+		case map[string]interface{}:
+			row = make([]string, len(columns))
+			for j, column := range columns {
+				row[j] = fieldString(record[column])
+			}
+		case []interface{}:
+			row = make([]string, len(record))
+			for j, value := range record {
+				row[j] = fieldString(value)
+			}
+		default:
+			return "", fmt.Errorf("%w: records[%d] must be an object or an array", ErrInvalidInput, i)
+		}
+		if err := writer.Write(row); err != nil {
+			return "", err
+		}
+	}
+	writer.Flush()
+	return buf.String(), writer.Error()
+}
+
+// fieldString formats a value as CSV field or XML text
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(encoded)
+	}
+	return transformString(value)
+}
+
+// ============================================================================
+// XML
+// ============================================================================
+
+// XML documents map to nested objects: {"root": element}. An element with
+// neither attributes nor children is its trimmed text; otherwise it is an
+// object holding attributes under XMLAttrsKey, non-blank text under
+// XMLTextKey and children by name, repeated children becoming an array.
+// Namespaces are dropped, and single-element arrays come back from a round
+// trip as a plain element.
+const (
+	XMLAttrsKey = "@attrs"
+	XMLTextKey  = "#text"
+)
+
+var xmlNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+type xmlNode struct {
+	name     string
+	attrs    map[string]interface{}
+	children map[string]interface{}
+	text     strings.Builder
+}
+
+func (n *xmlNode) addChild(name string, value interface{}) {
+	if n.children == nil {
+		n.children = make(map[string]interface{})
+	}
+	switch existing := n.children[name].(type) {
+	case nil:
+		n.children[name] = value
+	case []interface{}:
+		n.children[name] = append(existing, value)
+	default:
+		n.children[name] = []interface{}{existing, value}
+	}
+}
+
+func (n *xmlNode) value() interface{} {
+	text := strings.TrimSpace(n.text.String())
+	if len(n.attrs) == 0 && len(n.children) == 0 {
+		return text
+	}
+	element := make(map[string]interface{}, len(n.children)+2)
+	for name, child := range n.children {
+		element[name] = child
+	}
+	if len(n.attrs) > 0 {
+		element[XMLAttrsKey] = n.attrs
+	}
+	if text != "" {
+		element[XMLTextKey] = text
+	}
+	return element
+}
+
+// parseXML decodes an XML document with a single root element
+func (u *PacketUtils) parseXML(text string) (interface{}, error) {
+	decoder := xml.NewDecoder(strings.NewReader(text))
+
+	var stack []*xmlNode
+	var root map[string]interface{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: xml decode error: %v", ErrInvalidInput, err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 && root != nil {
+				return nil, fmt.Errorf("%w: xml decode error: multiple root elements", ErrInvalidInput)
+			}
+			node := &xmlNode{name: t.Name.Local}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				if node.attrs == nil {
+					node.attrs = make(map[string]interface{})
+				}
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				root = map[string]interface{}{node.name: node.value()}
+			} else {
+				stack[len(stack)-1].addChild(node.name, node.value())
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, fmt.Errorf("%w: xml decode error: text outside the root element", ErrInvalidInput)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("%w: xml decode error: no root element", ErrInvalidInput)
+	}
+	return root, nil
+}
+
+// stringifyXML encodes an object with a single root key, or any value under
+// the "root" param, as XML. Keys are written in sorted order; the "indent"
+// param pretty-prints the output.
+func (u *PacketUtils) stringifyXML(input interface{}, params map[string]interface{}) (string, error) {
+	name, _ := params["root"].(string)
+	value := input
+	if name == "" {
+		object, ok := input.(map[string]interface{})
+		if !ok || len(object) != 1 {
+			return "", fmt.Errorf("%w: xml_stringify needs an object with a single root key or a root param", ErrInvalidInput)
+		}
+		for key, child := range object {
+			name, value = key, child
+		}
+	}
+	if _, repeated := value.([]interface{}); repeated {
+		return "", fmt.Errorf("%w: the root element %s cannot be an array", ErrInvalidInput, name)
+	}
+
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
+	if indent, ok := params["indent"].(string); ok {
+		encoder.Indent("", indent)
+	}
+	if err := writeXMLElement(encoder, name, value); err != nil {
+		return "", err
+	}
+	if err := encoder.Flush(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func writeXMLElement(encoder *xml.Encoder, name string, value interface{}) error {
+	if !xmlNameRegex.MatchString(name) {
+		return fmt.Errorf("%w: invalid XML element name %q", ErrInvalidInput, name)
+	}
+	if items, ok := value.([]interface{}); ok {
+		for _, item := range items {
+			if err := writeXMLElement(encoder, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	element, isObject := value.(map[string]interface{})
+	if attrs, ok := element[XMLAttrsKey].(map[string]interface{}); ok {
+		keys := make([]string, 0, len(attrs))
+		for key := range attrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !xmlNameRegex.MatchString(key) {
+				return fmt.Errorf("%w: invalid XML attribute name %q", ErrInvalidInput, key)
+			}
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: key}, Value: fieldString(attrs[key])})
+		}
+	}
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+
+	if !isObject {
+		if value != nil {
+			if err := encoder.EncodeToken(xml.CharData(fieldString(value))); err != nil {
+				return err
+			}
+		}
+		return encoder.EncodeToken(start.End())
+	}
+
+	if text, ok := element[XMLTextKey]; ok {
+		if err := encoder.EncodeToken(xml.CharData(fieldString(text))); err != nil {
+			return err
+		}
+	}
+	keys := make([]string, 0, len(element))
+	for key := range element {
+		if key != XMLAttrsKey && key != XMLTextKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := writeXMLElement(encoder, key, element[key]); err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+// ============================================================================
+// Template Rendering
+// ============================================================================
+
+// Template limits for df:template_render; output beyond the limit fails the
+// render rather than being truncated
+const (
+	DefaultTemplateOutput = 64 * 1024
+	MaxTemplateOutput     = 1024 * 1024
+	MaxTemplateLength     = 64 * 1024
+)
+
+var errTemplateOutputLimit = errors.New("template output too large")
+
+// templateWriter buffers rendered output up to limit bytes
+type templateWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *templateWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errTemplateOutputLimit
+	}
+	return w.buf.Write(p)
+}
+
+// templateFuncs are available to templates alongside text/template's
+// builtins. None of them reach files, the network or other processes.
+func (u *PacketUtils) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"upper":     func(v interface{}) string { return strings.ToUpper(transformString(v)) },
+		"lower":     func(v interface{}) string { return strings.ToLower(transformString(v)) },
+		"trim":      func(v interface{}) string { return strings.TrimSpace(transformString(v)) },
+		"replace":   func(v interface{}, old, new string) string { return strings.ReplaceAll(transformString(v), old, new) },
+		"contains":  func(v interface{}, sub string) bool { return strings.Contains(transformString(v), sub) },
+		"hasPrefix": func(v interface{}, prefix string) bool { return strings.HasPrefix(transformString(v), prefix) },
+		"hasSuffix": func(v interface{}, suffix string) bool { return strings.HasSuffix(transformString(v), suffix) },
+		"split":     func(v interface{}, sep string) []string { return strings.Split(transformString(v), sep) },
+		"join": func(items interface{}, sep string) string {
+			values, ok := items.([]interface{})
+			if !ok {
+				return transformString(items)
+			}
+			parts := make([]string, len(values))
+			for i, item := range values {
+				parts[i] = transformString(item)
+			}
+			return strings.Join(parts, sep)
+		},
+		"default": func(fallback, v interface{}) interface{} {
+			if v == nil || v == "" {
+				return fallback
+			}
+			return v
+		},
+		"json": func(v interface{}) (string, error) {
+			encoded, err := json.Marshal(v)
+			return string(encoded), err
+		},
+		"add": func(a, b interface{}) float64 {
+			x, _ := u.toFloat64(a)
+			y, _ := u.toFloat64(b)
+			return x + y
+		},
+		"sub": func(a, b interface{}) float64 {
+			x, _ := u.toFloat64(a)
+			y, _ := u.toFloat64(b)
+			return x - y
+		},
+	}
+}
+
+// RenderTemplate renders text as a Go text/template against data. Parse and
+// execution errors wrap ErrInvalidInput; output over maxOutput bytes fails
+// with a "too large" error. With strict set, missing map keys are errors
+// instead of rendering as "<no value>".
+func (u *PacketUtils) RenderTemplate(text string, data interface{}, maxOutput int, strict bool) (string, error) {
+	if len(text) > MaxTemplateLength {
+		return "", fmt.Errorf("%w: template exceeds %d bytes", ErrInvalidInput, MaxTemplateLength)
+	}
+
+	tmpl := template.New("template_render").Funcs(u.templateFuncs())
+	if strict {
+		tmpl = tmpl.Option("missingkey=error")
+	}
+	tmpl, err := tmpl.Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+
+	out := &templateWriter{limit: maxOutput}
+	if err := tmpl.Execute(out, data); err != nil {
+		if errors.Is(err, errTemplateOutputLimit) {
+			return "", fmt.Errorf("template output too large: exceeds %d bytes", maxOutput)
+		}
+		return "", fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	return out.buf.String(), nil
+}
+
+// ============================================================================
+// Standard Library Implementation
+// ============================================================================
+
+func (r *PacketFlowRuntime) registerStandardLibrary() {
+	// Control Flow packets (Level 1 - Core)
+	r.registerControlFlowPackets()
+	
+	// Data Flow packets (Level 1 - Core)
+	r.registerDataFlowPackets()
+	
+	// Event Driven packets (Level 1 - Core)
+	r.registerEventDrivenPackets()
+	
+	// Collective packets (Level 1 - Core)
+	r.registerCollectivePackets()
+	
+	// Resource Management packets (Level 1 - Core)
+	r.registerResourceManagementPackets()
+}
+
+func (r *PacketFlowRuntime) registerControlFlowPackets() {
+	// cf:ping - Basic connectivity test
+	r.RegisterPacket("cf", "ping", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		startTime := time.Now()
+		
+		echo := "pong"
+		if echoVal, exists := data["echo"]; exists {
+			echo = fmt.Sprintf("%v", echoVal)
+		}
+		
+		var clientTime *int64
+		if ts, exists := data["timestamp"]; exists {
+			if tsInt, ok := ts.(int64); ok {
+				clientTime = &tsInt
+			}
+		}
+		
+		result := map[string]interface{}{
+			"echo":        echo,
+			"server_time": time.Now().UnixMilli(),
+		}
+		
+		if clientTime != nil {
+			result["client_time"] = *clientTime
+			result["latency_ms"] = time.Now().UnixMilli() - *clientTime
+		}
+		
+		log.Printf("[cf:ping] Response time: %v", time.Since(startTime))
+		return result, nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Basic connectivity and latency testing",
+		MaxPayloadSize:  1024,
+	})
+
+	// cf:echo_binary - Protocol conformance: returns data exactly as decoded
+	r.RegisterPacket("cf", "echo_binary", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return data, nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Echo the data payload unchanged to verify codec round-trips",
+	})
+
+	// cf:health - Health status information
+	r.RegisterPacket("cf", "health", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		
+		detail := false
+		if detailVal, exists := data["detail"]; exists {
+			if detailBool, ok := detailVal.(bool); ok {
+				detail = detailBool
+			}
+		}
+		
+		report := ctx.Runtime.Health()
+		health := map[string]interface{}{
+			"status":  report.Status,
+			"load":    report.Load,
+			"uptime":  time.Since(ctx.Runtime.startTime).Seconds(),
+			"version": "1.0.0",
+		}
+		if len(report.Reasons) > 0 {
+			health["reasons"] = report.Reasons
+		}
+
+		if detail {
+			health["details"] = map[string]interface{}{
+				"memory_mb":   m.Alloc / 1024 / 1024,
+				"cpu_percent": ctx.Runtime.cpu.Percent(),
+				"goroutines":  runtime.NumGoroutine(),
+				"queue_depth": ctx.Runtime.GetStats().QueueDepth,
+				"connections": ctx.Runtime.GetStats().ConnectionCount,
+			}
+		}
+
+		return health, nil
+	}, PacketMetadata{
+		Timeout:         10,
+		ComplianceLevel: 1,
+		Description:     "Reactor health and status information",
+	})
+
+	// cf:info - Reactor capabilities
+	r.RegisterPacket("cf", "info", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		packets := make([]string, 0, len(ctx.Runtime.packets))
+		ctx.Runtime.mu.RLock()
+		for key := range ctx.Runtime.packets {
+			packets = append(packets, key)
+		}
+		ctx.Runtime.mu.RUnlock()
+		
+		return map[string]interface{}{
+			"name":     ctx.Runtime.config.ReactorID,
+			"version":  "1.0.0",
+			"types":    []string{"general", "cpu_bound", "memory_bound", "io_bound"},
+			"groups":   []string{"cf", "df", "ed", "co", "rm"},
+			"packets":  packets,
+			"capacity": map[string]interface{}{
+				"max_concurrent":     ctx.Runtime.config.MaxConcurrent,
+				"max_queue_depth":    10000,
+				"max_message_size":   ctx.Runtime.config.MaxPacketSize,
+			},
+			"features": []string{"standard_library", "binary_protocol"},
+		}, nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Reactor capabilities and configuration",
+	})
+
+	// cf:describe - Packet introspection
+	r.RegisterPacket("cf", "describe", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		key := data["packet"].(string)
+		description, exists := ctx.Runtime.DescribePacket(key)
+		if !exists {
+			return nil, fmt.Errorf("packet not found: %s", key)
+		}
+		return description, nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Packet metadata, stats and input schema",
+		InputSchema: Schema{
+			"packet": {Type: "string", Required: true, Description: "Packet key, e.g. df:transform"},
+		},
+	})
+
+	// cf:version - Protocol version and capability negotiation
+	r.RegisterPacket("cf", "version", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		codecNames := make([]string, 0, len(codecs))
+		for name := range codecs {
+			codecNames = append(codecNames, name)
+		}
+		sort.Strings(codecNames)
+
+		result := map[string]interface{}{
+			"reactor_id":       ctx.Runtime.config.ReactorID,
+			"protocol_version": ctx.Runtime.config.ProtocolVersion,
+			"wire_version":     MessageVersion,
+			"message_types":    ctx.Runtime.messageTypes.Codes(),
+			"codecs":           codecNames,
+			"features":         ctx.Runtime.features(),
+		}
+
+		minVersion := ctx.Runtime.config.MinClientVersion
+		if minVersion != "" {
+			result["min_client_version"] = minVersion
+		}
+		if clientVersion, ok := data["client_version"].(string); ok && clientVersion != "" {
+			result["client_version"] = clientVersion
+			result["compatible"] = minVersion == "" || compareVersions(clientVersion, minVersion) >= 0
+		}
+
+		return result, nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Protocol version and capability negotiation",
+	})
+
+	// cf:capabilities - Which of a client's requirements this reactor supports
+	r.RegisterPacket("cf", "capabilities", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		var required CapabilityRequirements
+		for field, target := range map[string]*[]string{
+			"packets":       &required.Packets,
+			"message_types": &required.MessageTypes,
+			"features":      &required.Features,
+		} {
+			for i, item := range DataAccessor(data).GetSlice(field, nil) {
+				name, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s[%d] must be a string", field, i)
+				}
+				*target = append(*target, name)
+			}
+		}
+		return ctx.Runtime.CheckCapabilities(required), nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Check required packets, message types and features",
+		InputSchema: Schema{
+			"packets":       {Type: "array", Description: "Packet keys, e.g. df:transform or df:transform:latest"},
+			"message_types": {Type: "array", Description: "Message type names, e.g. batch_submit"},
+			"features":      {Type: "array", Description: "Feature names as listed by cf:version"},
+		},
+	})
+
+	// cf:benchmark - Run a packet repeatedly and report throughput and latency
+	r.RegisterPacket("cf", "benchmark", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		fields := DataAccessor(data)
+		sample, _ := data["data"].(map[string]interface{})
+		return ctx.Runtime.Benchmark(ctx, fields.GetString("packet", ""), sample,
+			fields.GetInt("iterations", DefaultBenchmarkIterations), fields.GetInt("concurrency", 1))
+	}, PacketMetadata{
+		Timeout:         120,
+		ComplianceLevel: 1,
+		Description:     "Run a packet repeatedly and report throughput and latency",
+		InputSchema: Schema{
+			"packet":      {Type: "string", Required: true, Description: "Packet key to benchmark, e.g. cf:ping"},
+			"data":        {Type: "object", Description: "Data sent with every atom"},
+			"iterations":  {Type: "integer", Description: "Atoms to run (default 100, at most 10000)"},
+			"concurrency": {Type: "integer", Description: "Atoms in flight at once (default 1, below MaxConcurrent)"},
+		},
+	})
+
+	// cf:trace - Routing and timeout breakdown for a sample atom, without executing it
+	r.RegisterPacket("cf", "trace", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		spec := data["atom"].(map[string]interface{})
+		return ctx.Runtime.TraceAtom(ctx.Runtime.atomFromSpec(spec)), nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Routing and timeout breakdown for a sample atom",
+		InputSchema: Schema{
+			"atom": {Type: "object", Required: true, Description: "Atom spec using wire field names (id, g, e, v, t, m)"},
+		},
+	})
+}
+
+// Benchmark limits for cf:benchmark
+const (
+	DefaultBenchmarkIterations = 100
+	MaxBenchmarkIterations     = 10000
+)
+
+// BenchmarkMeta is set in the Meta of atoms run by a benchmark, so a
+// benchmark can never (even through aliases or pipelines) run another
+const BenchmarkMeta = "benchmark"
+
+// BenchmarkReport summarises a cf:benchmark run. Latency percentiles are
+// LatencyHistogram bucket bounds.
+type BenchmarkReport struct {
+	Packet           string           `json:"packet"`
+	Iterations       int              `json:"iterations"`
+	Completed        int              `json:"completed"`
+	Errors           int              `json:"errors"`
+	ErrorCodes       map[string]int   `json:"error_codes,omitempty"`
+	Concurrency      int              `json:"concurrency"`
+	Elapsed          time.Duration    `json:"elapsed"`
+	ThroughputPerSec float64          `json:"throughput_per_sec"`
+	MinLatency       time.Duration    `json:"min_latency"`
+	MaxLatency       time.Duration    `json:"max_latency"`
+	MeanLatency      time.Duration    `json:"mean_latency"`
+	P50Latency       time.Duration    `json:"p50_latency"`
+	P95Latency       time.Duration    `json:"p95_latency"`
+	P99Latency       time.Duration    `json:"p99_latency"`
+	Latency          LatencyHistogram `json:"latency"`
+	// Cancelled is set when the benchmark's own timeout cut the run short
+	Cancelled bool `json:"cancelled"`
+}
+
+// Benchmark runs the packet at key iterations times through ProcessAtom,
+// with at most concurrency atoms in flight, stopping early if ctx's
+// context ends. The atoms count towards runtime and packet stats like any
+// others.
+func (r *PacketFlowRuntime) Benchmark(ctx *ExecutionContext, key string, sample map[string]interface{}, iterations, concurrency int) (*BenchmarkReport, error) {
+	if ctx.Atom != nil {
+		if _, nested := ctx.Atom.Meta[BenchmarkMeta]; nested {
+			return nil, fmt.Errorf("%w: benchmarks cannot run other benchmarks", ErrInvalidInput)
+		}
+	}
+	if iterations <= 0 || iterations > MaxBenchmarkIterations {
+		return nil, fmt.Errorf("%w: iterations must be between 1 and %d", ErrInvalidInput, MaxBenchmarkIterations)
+	}
+	// The benchmark holds an execution slot itself, so its atoms get the rest
+	if limit := r.config.MaxConcurrent - 1; concurrency <= 0 || concurrency > limit {
+		return nil, fmt.Errorf("%w: concurrency must be between 1 and %d", ErrInvalidInput, limit)
+	}
+
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%w: packet must be a packet key (group:element[:variant])", ErrInvalidInput)
+	}
+	target := &Atom{Group: parts[0], Element: parts[1], Caller: ctx.Caller}
+	if len(parts) == 3 {
+		target.Variant = &parts[2]
+	}
+	resolved := r.resolveAlias(target)
+	r.mu.RLock()
+	packet, exists := r.resolvePacket(resolved.Group, resolved.Element, r.stringValue(resolved.Variant))
+	r.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("packet %s not found", key)
+	}
+	if packet.Key == ctx.PacketKey {
+		return nil, fmt.Errorf("%w: %s cannot benchmark itself", ErrInvalidInput, ctx.PacketKey)
+	}
+
+	report := &BenchmarkReport{
+		Packet:      packet.Key,
+		Iterations:  iterations,
+		Concurrency: concurrency,
+		ErrorCodes:  make(map[string]int),
+	}
+	var mu sync.Mutex
+	var total time.Duration
+
+	runCtx := ctx.Context
+	if runCtx == nil {
+		runCtx = context.Background()
+	}
+	parentID := "benchmark"
+	if ctx.Atom != nil {
+		parentID = ctx.Atom.ID
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				data, _ := r.utils.deepCopy(sample).(map[string]interface{})
+				if data == nil {
+					data = map[string]interface{}{}
+				}
+				atom := *target
+				atom.ID = fmt.Sprintf("%s_bench_%d", parentID, i)
+				atom.Data = data
+				atom.Meta = map[string]interface{}{BenchmarkMeta: true}
+
+				atomStart := time.Now()
+				result := r.ProcessAtom(&atom)
+				latency := time.Since(atomStart)
+
+				mu.Lock()
+				report.Completed++
+				report.Latency.Observe(latency)
+				total += latency
+				if report.MinLatency == 0 || latency < report.MinLatency {
+					report.MinLatency = latency
+				}
+				if latency > report.MaxLatency {
+					report.MaxLatency = latency
+				}
+				if !result.Success {
+					report.Errors++
+					if result.Error != nil {
+						report.ErrorCodes[result.Error.Code]++
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; i < iterations; i++ {
+		select {
+		case next <- i:
+		case <-runCtx.Done():
+			report.Cancelled = true
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	report.Elapsed = time.Since(start)
+	if report.Completed > 0 {
+		report.MeanLatency = total / time.Duration(report.Completed)
+		report.ThroughputPerSec = float64(report.Completed) / report.Elapsed.Seconds()
+	}
+	report.P50Latency = report.Latency.Percentile(50)
+	report.P95Latency = report.Latency.Percentile(95)
+	report.P99Latency = report.Latency.Percentile(99)
+	return report, nil
+}
+
+// atomFromSpec builds an atom from its wire field names (id, g, e, v, t, m),
+// generating an ID when none is given
+func (r *PacketFlowRuntime) atomFromSpec(spec map[string]interface{}) *Atom {
+	fields := DataAccessor(spec)
+	atom := &Atom{
+		ID:      fields.GetString("id", ""),
+		Group:   fields.GetString("g", ""),
+		Element: fields.GetString("e", ""),
+		Data:    map[string]interface{}{},
+	}
+	if variant := fields.GetString("v", ""); variant != "" {
+		atom.Variant = &variant
+	}
+	if timeout, ok := fields.LookupInt("t"); ok {
+		atom.Timeout = &timeout
+	}
+	if meta := fields.GetMap("m", nil); meta != nil {
+		atom.Meta = meta
+	}
+	if atom.ID == "" {
+		atom.ID = uuid.New().String()
+	}
+	return atom
+}
+
+// TraceAtom reports how an atom would be handled: whether a local packet
+// matches, which reactors are candidates for its group, which one the router
+// would select, and the timeout that would apply
+func (r *PacketFlowRuntime) TraceAtom(atom *Atom) map[string]interface{} {
+	requestedKey := r.makePacketKey(atom.Group, atom.Element, r.stringValue(atom.Variant))
+	atom = r.resolveAlias(atom)
+
+	r.mu.RLock()
+	packet, local := r.resolvePacket(atom.Group, atom.Element, r.stringValue(atom.Variant))
+	r.mu.RUnlock()
+
+	selected, candidates := r.router.Explain(atom)
+
+	trace := map[string]interface{}{
+		"atom_id":    atom.ID,
+		"packet_key": requestedKey,
+		"local":      local,
+		"candidates": candidates,
+		"selected":   nil,
+	}
+	if selected != nil {
+		trace["selected"] = selected.ID
+	}
+
+	var timeoutPacket *PacketInfo
+	if local {
+		timeoutPacket = packet
+	}
+	timeout, timeoutSource := r.resolveTimeout(atom, timeoutPacket)
+
+	if local {
+		trace["resolved_packet"] = packet.Key
+	} else if r.config.ForwardUnknown && selected != nil && selected.ID != r.config.ReactorID {
+		trace["forward_to"] = selected.ID
+		// Forwarded atoms are bounded by the reactor call timeout as well
+		if timeout == 0 || r.config.ReactorTimeout < timeout {
+			timeoutSource = "reactor"
+			timeout = r.config.ReactorTimeout
+		}
+	}
+	if budget, open := r.deadlineBudget(atom, time.Duration(timeout)*time.Second); !open || (budget > 0 && (timeout == 0 || budget < time.Duration(timeout)*time.Second)) {
+		timeoutSource = "deadline"
+		timeout = int(math.Ceil(budget.Seconds()))
+	}
+	trace["timeout_seconds"] = timeout
+	trace["timeout_source"] = timeoutSource
+
+	return trace
+}
+
+func (r *PacketFlowRuntime) registerDataFlowPackets() {
+	// df:transform - Generic data transformation
+	r.RegisterPacket("df", "transform", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		input, exists := data["input"]
+		if !exists {
+			return nil, fmt.Errorf("input is required")
+		}
+		
+		operation, exists := data["operation"]
+		if !exists {
+			return nil, fmt.Errorf("operation is required")
+		}
+		
+		opStr, ok := operation.(string)
+		if !ok {
+			return nil, fmt.Errorf("operation must be a string")
+		}
+
+		params, _ := data["params"].(map[string]interface{})
+
+		result, err := ctx.Utils.TransformWithParams(input, opStr, params)
+		if err != nil {
+			return nil, err
+		}
+		
+		return map[string]interface{}{
+			"input":          input,
+			"operation":      operation,
+			"result":         result,
+			"transformed_at": time.Now().Unix(),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         30,
+		ComplianceLevel: 1,
+		Description:     "Generic data transformation",
+		MaxPayloadSize:  100 * 1024, // 100KB
+	})
+
+	// df:validate - Data validation
+	r.RegisterPacket("df", "validate", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		inputData, exists := data["data"]
+		if !exists {
+			return nil, NewFieldError("E400", "data is required", map[string]string{"data": "required"})
+		}
+		
+		schema, exists := data["schema"]
+		if !exists {
+			return nil, NewFieldError("E400", "schema is required", map[string]string{"schema": "required"})
+		}
+		strict, _ := data["strict"].(bool)
+
+		// An object schema maps each field of data to the schema it must match
+		fieldSchemas, isObject := schema.(map[string]interface{})
+		if !isObject {
+			schemaStr, ok := schema.(string)
+			if !ok {
+				return nil, NewFieldError("E400", "schema must be a string or an object", map[string]string{"schema": "must be a string or an object"})
+			}
+
+			valid, err := ctx.Utils.Validate(inputData, schemaStr)
+			if err != nil {
+				return nil, NewFieldError("E400", err.Error(), map[string]string{"schema": err.Error()})
+			}
+
+			result := map[string]interface{}{
+				"valid": valid,
+			}
+
+			if !valid {
+				message := fmt.Sprintf("validation failed for schema: %s", schemaStr)
+				if strict {
+					return nil, NewFieldError("E422", message, map[string]string{"data": message})
+				}
+				result["errors"] = []string{message}
+			}
+
+			return result, nil
+		}
+
+		record, ok := inputData.(map[string]interface{})
+		if !ok {
+			return nil, NewFieldError("E400", "data must be an object when schema is an object", map[string]string{"data": "must be an object"})
+		}
+		
+		failures := make(map[string]string)
+		for field, fieldSchema := range fieldSchemas {
+			schemaStr, ok := fieldSchema.(string)
+			if !ok {
+				return nil, NewFieldError("E400", fmt.Sprintf("schema for %s must be a string", field), map[string]string{"schema." + field: "must be a string"})
+			}
+			value, present := record[field]
+			if !present {
+				failures[field] = "required"
+				continue
+			}
+			valid, err := ctx.Utils.Validate(value, schemaStr)
+			if err != nil {
+				return nil, NewFieldError("E400", err.Error(), map[string]string{"schema." + field: err.Error()})
+			}
+			if !valid {
+				failures[field] = fmt.Sprintf("must match schema %s", schemaStr)
+			}
+		}
+		
+		if strict && len(failures) > 0 {
+			return nil, NewFieldError("E422", fmt.Sprintf("validation failed for %d field(s)", len(failures)), failures)
+		}
+		
+		return map[string]interface{}{
+			"valid":  len(failures) == 0,
+			"errors": fieldErrorList(failures),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         15,
+		ComplianceLevel: 1,
+		Description:     "Data validation against schemas",
+		InputSchema: Schema{
+			"data":   {Type: "any", Required: true, Description: "Value, or object of fields, to validate"},
+			"schema": {Type: "any", Required: true, Description: "Schema name (email, uuid, ...) or an object mapping fields to schema names"},
+			"strict": {Type: "boolean", Description: "Fail with E422 and per-field details instead of returning valid: false"},
+		},
+	})
+
+	// df:filter - Data filtering
+	r.RegisterPacket("df", "filter", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		input, exists := data["input"]
+		if !exists {
+			return nil, fmt.Errorf("input is required")
+		}
+		
+		inputSlice, ok := input.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("input must be an array")
+		}
+		
+		// Convert to []map[string]interface{} for filtering
+		var dataSlice []map[string]interface{}
+		for _, item := range inputSlice {
+			if itemMap, ok := item.(map[string]interface{}); ok {
+				dataSlice = append(dataSlice, itemMap)
+			}
+		}
+		
+		condition, exists := data["condition"]
+		if !exists {
+			// No condition, return all
+			return map[string]interface{}{
+				"results":       dataSlice,
+				"total_matches": len(dataSlice),
+				"returned":      len(dataSlice),
+			}, nil
+		}
+		
+		conditionMap, ok := condition.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("condition must be an object")
+		}
+		
+		filtered := ctx.Utils.FilterData(dataSlice, conditionMap)
+		
+		// Handle limit and offset, which JSON clients send as float64
+		fields := DataAccessor(data)
+		offset, ok := fields.LookupInt("offset")
+		if !ok || offset < 0 {
+			offset = 0
+		}
+		
+		if offset > len(filtered) {
+			offset = len(filtered)
+		}
+		result := filtered[offset:]
+		
+		if limit, ok := fields.LookupInt("limit"); ok && limit > 0 && limit < len(result) {
+			result = result[:limit]
+		}
+		
+		return map[string]interface{}{
+			"results":       result,
+			"total_matches": len(filtered),
+			"returned":      len(result),
+			"offset":        offset,
+		}, nil
+	}, PacketMetadata{
+		Timeout:         30,
+		ComplianceLevel: 1,
+		Description:     "Data filtering and selection",
+	})
+
+	// df:aggregate - Data aggregation
+	r.RegisterPacket("df", "aggregate", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		input, exists := data["input"]
+		if !exists {
+			return nil, fmt.Errorf("input is required")
+		}
+		
+		inputSlice, ok := input.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("input must be an array")
+		}
+		
+		operations, exists := data["operations"]
+		if !exists {
+			return nil, fmt.Errorf("operations are required")
+		}
+		
+		operationsMap, ok := operations.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("operations must be an object")
+		}
+		
+		// Convert input to workable format
+		var dataSlice []map[string]interface{}
+		for _, item := range inputSlice {
+			if itemMap, ok := item.(map[string]interface{}); ok {
+				dataSlice = append(dataSlice, itemMap)
+			}
+		}
+		
+		// Simple aggregation without grouping for MVP
+		result := make(map[string]interface{})
+		
+		for field, operation := range operationsMap {
+			opStr, ok := operation.(string)
+			if !ok {
+				continue
+			}
+			
+			values := make([]float64, 0)
+			for _, item := range dataSlice {
+				if val, exists := item[field]; exists {
+					if floatVal, ok := ctx.Utils.toFloat64(val); ok {
+						values = append(values, floatVal)
+					}
+				}
+			}
+			
+			switch opStr {
+			case "sum":
+				sum := 0.0
+				for _, v := range values {
+					sum += v
+				}
+				result[field] = sum
+			case "count":
+				result[field] = len(values)
+			case "avg":
+				if len(values) > 0 {
+					sum := 0.0
+					for _, v := range values {
+						sum += v
+					}
+					result[field] = sum / float64(len(values))
+				} else {
+					result[field] = 0
+				}
+			case "min":
+				if len(values) > 0 {
+					min := values[0]
+					for _, v := range values {
+						if v < min {
+							min = v
+						}
+					}
+					result[field] = min
+				}
+			case "max":
+				if len(values) > 0 {
+					max := values[0]
+					for _, v := range values {
+						if v > max {
+							max = v
+						}
+					}
+					result[field] = max
+				}
+			case "median", "stddev", "variance":
+				if len(values) > 0 {
+					statistics := ctx.Utils.CalculateStatistics(values)
+					statKey := opStr
+					if opStr == "stddev" {
+						statKey = "standard_deviation"
+					}
+					result[field] = statistics[statKey]
+				}
+			}
+		}
+		
+		return map[string]interface{}{
+			"aggregated":    []map[string]interface{}{result},
+			"operations":    operations,
+			"input_count":   len(inputSlice),
+			"output_count":  1,
+		}, nil
+	}, PacketMetadata{
+		Timeout:         60,
+		ComplianceLevel: 2,
+		Description:     "Data aggregation and grouping",
+	})
+
+	// df:window - Rolling window aggregation over ordered data
+	r.RegisterPacket("df", "window", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		input, exists := data["input"]
+		if !exists {
+			return nil, fmt.Errorf("input is required")
+		}
+
+		inputSlice, ok := input.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("input must be an array")
+		}
+
+		windowFloat, ok := ctx.Utils.toFloat64(data["window"])
+		if !ok || windowFloat < 1 {
+			return nil, fmt.Errorf("window must be a positive number")
+		}
+		window := int(windowFloat)
+
+		operation, _ := data["operation"].(string)
+		if operation == "" {
+			operation = "avg"
+		}
+		switch operation {
+		case "sum", "avg", "min", "max":
+		default:
+			return nil, fmt.Errorf("unsupported window operation: %s", operation)
+		}
+
+		align, _ := data["align"].(string)
+		if align == "" {
+			align = "trailing"
+		}
+		if align != "trailing" && align != "centered" {
+			return nil, fmt.Errorf("align must be trailing or centered")
+		}
+
+		// Edge policy for positions whose window extends past the input:
+		// partial aggregates what is available, null emits nil, drop omits them
+		edges, _ := data["edges"].(string)
+		if edges == "" {
+			edges = "partial"
+		}
+		if edges != "partial" && edges != "null" && edges != "drop" {
+			return nil, fmt.Errorf("edges must be partial, null or drop")
+		}
+
+		// Items are numbers, or objects whose field holds a number
+		field, _ := data["field"].(string)
+		values := make([]*float64, len(inputSlice))
+		for i, item := range inputSlice {
+			if field != "" {
+				itemMap, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				item = itemMap[field]
+			}
+			if value, ok := ctx.Utils.toFloat64(item); ok {
+				values[i] = &value
+			}
+		}
+
+		before, after := window-1, 0
+		if align == "centered" {
+			before, after = (window-1)/2, window/2
+		}
+
+		results := make([]interface{}, 0, len(values))
+		startIndex := -1
+		for i := range values {
+			from, to := i-before, i+after
+			complete := from >= 0 && to < len(values)
+			if !complete {
+				if edges == "drop" {
+					continue
+				}
+				if edges == "null" {
+					results = append(results, nil)
+					continue
+				}
+			}
+			if startIndex < 0 {
+				startIndex = i
+			}
+
+			var aggregate float64
+			count := 0
+			for j := from; j <= to; j++ {
+				if j < 0 || j >= len(values) || values[j] == nil {
+					continue
+				}
+				v := *values[j]
+				switch {
+				case count == 0:
+					aggregate = v
+				case operation == "min":
+					aggregate = math.Min(aggregate, v)
+				case operation == "max":
+					aggregate = math.Max(aggregate, v)
+				default:
+					aggregate += v
+				}
+				count++
+			}
+
+			if count == 0 {
+				results = append(results, nil)
+				continue
+			}
+			if operation == "avg" {
+				aggregate /= float64(count)
+			}
+			results = append(results, aggregate)
+		}
+
+		if edges != "drop" || startIndex < 0 {
+			startIndex = 0
+		}
+
+		return map[string]interface{}{
+			"values":      results,
+			"start_index": startIndex,
+			"window":      window,
+			"operation":   operation,
+			"align":       align,
+			"edges":       edges,
+			"input_count": len(inputSlice),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         30,
+		ComplianceLevel: 2,
+		Description:     "Rolling window aggregation",
+	})
+
+	// df:eval - Sandboxed expression evaluation
+	r.RegisterPacket("df", "eval", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		expression, ok := data["expression"].(string)
+		if !ok || expression == "" {
+			return nil, fmt.Errorf("expression is required")
+		}
+
+		maxSteps := DefaultExpressionSteps
+		if steps, exists := data["max_steps"]; exists {
+			if stepsFloat, ok := ctx.Utils.toFloat64(steps); ok && stepsFloat > 0 {
+				maxSteps = int(math.Min(stepsFloat, MaxExpressionSteps))
+			}
+		}
+
+		result, steps, err := ctx.Utils.EvaluateExpression(expression, data["input"], maxSteps)
+		if err != nil {
+			return nil, fmt.Errorf("expression evaluation failed: %v", err)
+		}
+
+		return map[string]interface{}{
+			"expression": expression,
+			"result":     result,
+			"steps":      steps,
+		}, nil
+	}, PacketMetadata{
+		Timeout:         10,
+		ComplianceLevel: 2,
+		Description:     "Sandboxed expression evaluation",
+	})
+
+	// df:template_render - Go text/template rendering with a sandboxed function set
+	r.RegisterPacket("df", "template_render", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		text, ok := data["template"].(string)
+		if !ok || text == "" {
+			return nil, fmt.Errorf("%w: template is required", ErrInvalidInput)
+		}
+
+		maxOutput := DefaultTemplateOutput
+		if limit, ok := ctx.Utils.toFloat64(data["max_output"]); ok && limit > 0 {
+			maxOutput = int(math.Min(limit, MaxTemplateOutput))
+		}
+		strict, _ := data["strict"].(bool)
+
+		output, err := ctx.Utils.RenderTemplate(text, data["data"], maxOutput, strict)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"output": output,
+			"length": len(output),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         10,
+		ComplianceLevel: 2,
+		Description:     "Render a Go text/template against structured data",
+		InputSchema: Schema{
+			"template":   {Type: "string", Required: true, Description: "text/template source"},
+			"data":       {Type: "any", Description: "Value the template renders against (dot)"},
+			"max_output": {Type: "number", Description: "Output byte limit (default 64KB, at most 1MB)"},
+			"strict":     {Type: "boolean", Description: "Fail on missing keys instead of rendering <no value>"},
+		},
+	})
+
+	// df:csv_parse - RFC 4180 CSV to records
+	r.RegisterPacket("df", "csv_parse", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		text, ok := data["input"].(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: input must be a CSV string", ErrInvalidInput)
+		}
+		options, err := ctx.Utils.csvOptions(data)
+		if err != nil {
+			return nil, err
+		}
+
+		records, columns, err := ctx.Utils.ParseCSV(text, options)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"records": records,
+			"columns": columns,
+			"count":   len(records),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         30,
+		ComplianceLevel: 1,
+		Description:     "Parse RFC 4180 CSV into records",
+		InputSchema: Schema{
+			"input":     {Type: "string", Required: true, Description: "CSV text"},
+			"header":    {Type: "boolean", Description: "First row names the columns (default true); without it records are arrays"},
+			"delimiter": {Type: "string", Description: "Field delimiter (default ,)"},
+			"ragged":    {Type: "string", Description: "Rows with the wrong field count: error (default), pad or skip"},
+		},
+	})
+
+	// df:csv_stringify - Records to RFC 4180 CSV
+	r.RegisterPacket("df", "csv_stringify", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		records, ok := data["records"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: records must be an array", ErrInvalidInput)
+		}
+		options, err := ctx.Utils.csvOptions(data)
+		if err != nil {
+			return nil, err
+		}
+
+		output, err := ctx.Utils.StringifyCSV(records, options)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"output": output,
+			"count":  len(records),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         30,
+		ComplianceLevel: 1,
+		Description:     "Write records as RFC 4180 CSV",
+		InputSchema: Schema{
+			"records":   {Type: "array", Required: true, Description: "Objects, or arrays of fields"},
+			"columns":   {Type: "array", Description: "Column order (default: sorted keys of all records)"},
+			"header":    {Type: "boolean", Description: "Write a header row (default true)"},
+			"delimiter": {Type: "string", Description: "Field delimiter (default ,)"},
+		},
+	})
+
+	// df:query - JSONPath extraction from nested data
+	r.RegisterPacket("df", "query", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		path, _ := data["path"].(string)
+		matches, multiple, err := ctx.Utils.QueryPath(data["input"], path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+		}
+
+		// Paths naming a single value return it (or null); wildcards and
+		// slices return every match
+		var result interface{} = matches
+		if !multiple {
+			result = nil
+			if len(matches) > 0 {
+				result = matches[0]
+			}
+		} else if matches == nil {
+			result = []interface{}{}
+		}
+
+		return map[string]interface{}{
+			"path":   path,
+			"result": result,
+			"count":  len(matches),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         15,
+		ComplianceLevel: 1,
+		Description:     "Extract values from nested data with a JSONPath subset",
+		InputSchema: Schema{
+			"input": {Type: "any", Required: true, Description: "Object or array to query"},
+			"path":  {Type: "string", Required: true, Description: "JSONPath: $.a.b[0], $['k'], wildcards (* / [*]) and slices ([1:3], [::2])"},
+		},
+	})
+
+	// df:merge - Deep merge of objects, later inputs overriding earlier ones
+	r.RegisterPacket("df", "merge", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		var inputs []map[string]interface{}
+		switch inputSlice := data["inputs"].(type) {
+		case []map[string]interface{}:
+			inputs = inputSlice
+		case []interface{}:
+			inputs = make([]map[string]interface{}, len(inputSlice))
+			for i, item := range inputSlice {
+				input, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("inputs[%d] must be an object", i)
+				}
+				inputs[i] = input
+			}
+		default:
+			return nil, fmt.Errorf("inputs must be an array of objects")
+		}
+
+		arrayStrategy, _ := data["array_strategy"].(string)
+		merged, err := ctx.Utils.Merge(inputs, arrayStrategy)
+		if err != nil {
+			return nil, err
+		}
+
+		return map[string]interface{}{
+			"result":      merged,
+			"input_count": len(inputs),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         30,
+		ComplianceLevel: 1,
+		Description:     "Deep merge of objects, later inputs overriding earlier ones",
+		InputSchema: Schema{
+			"inputs":         {Type: "array", Required: true, Description: "Objects to merge, in priority order"},
+			"array_strategy": {Type: "string", Description: "replace (default), concat or union"},
+		},
+	})
+
+	// df:diff - Structural differences between two objects
+	r.RegisterPacket("df", "diff", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		arrayKey, _ := data["array_key"].(string)
+		diff := ctx.Utils.Diff(data["left"], data["right"], arrayKey)
+
+		return map[string]interface{}{
+			"added":   diff.Added,
+			"removed": diff.Removed,
+			"changed": diff.Changed,
+			"equal":   len(diff.Added)+len(diff.Removed)+len(diff.Changed) == 0,
+		}, nil
+	}, PacketMetadata{
+		Timeout:         30,
+		ComplianceLevel: 1,
+		Description:     "Structural differences between two objects",
+		InputSchema: Schema{
+			"left":      {Type: "object", Required: true, Description: "Original object"},
+			"right":     {Type: "object", Required: true, Description: "Updated object"},
+			"array_key": {Type: "string", Description: "Field matching array elements by key instead of index"},
+		},
+	})
+}
+
+// HealthReport is the runtime's health status and the readings behind it
+type HealthReport struct {
+	Status     string   `json:"status"`
+	Reasons    []string `json:"reasons,omitempty"`
+	Load       int      `json:"load"`
+	QueueDepth int      `json:"queue_depth"`
+	ErrorRate  float64  `json:"error_rate"`
+}
+
+// Health evaluates memory load, queue depth and error rate against the
+// configured thresholds; a zero threshold is not checked
+func (r *PacketFlowRuntime) Health() HealthReport {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	stats := r.GetStats()
+
+	report := HealthReport{
+		Status:     HealthHealthy,
+		Load:       int(float64(m.HeapInuse) / float64(m.HeapSys) * 100),
+		QueueDepth: stats.QueueDepth,
+		ErrorRate:  stats.ErrorRate(),
+	}
+
+	thresholds := r.config.Health
+	check := func(name string, value, degraded, unhealthy float64) {
+		switch {
+		case unhealthy > 0 && value >= unhealthy:
+			report.Status = HealthUnhealthy
+			report.Reasons = append(report.Reasons, fmt.Sprintf("%s %.1f >= %.1f", name, value, unhealthy))
+		case degraded > 0 && value >= degraded:
+			if report.Status == HealthHealthy {
+				report.Status = HealthDegraded
+			}
+			report.Reasons = append(report.Reasons, fmt.Sprintf("%s %.1f >= %.1f", name, value, degraded))
+		}
+	}
+	check("memory_load", float64(report.Load), thresholds.DegradedMemoryPercent, thresholds.UnhealthyMemoryPercent)
+	check("queue_depth", float64(report.QueueDepth), float64(thresholds.DegradedQueueDepth), float64(thresholds.UnhealthyQueueDepth))
+	check("error_rate", report.ErrorRate, thresholds.DegradedErrorRate, thresholds.UnhealthyErrorRate)
+
+	return report
+}
+
+// slidingWindow counts processed atoms and errors in a ring of one-second
+// buckets covering the last size seconds
+type slidingWindow struct {
+	mu      sync.Mutex
+	buckets []windowBucket
+}
+
+type windowBucket struct {
+	second    int64
+	processed int64
+	errors    int64
+}
+
+func newSlidingWindow(size int) *slidingWindow {
+	return &slidingWindow{buckets: make([]windowBucket, size)}
+}
+
+// Record counts one processed atom at now
+func (w *slidingWindow) Record(now time.Time, success bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	second := now.Unix()
+	bucket := &w.buckets[second%int64(len(w.buckets))]
+	if bucket.second != second {
+		*bucket = windowBucket{second: second}
+	}
+	bucket.processed++
+	if !success {
+		bucket.errors++
+	}
+}
+
+// Rates returns atoms per second and the error percentage over the window,
+// averaging over the uptime instead while the runtime is younger than it
+func (w *slidingWindow) Rates(now, started time.Time) (throughput, errorRate float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	size := int64(len(w.buckets))
+	oldest := now.Unix() - size + 1
+
+	var processed, failed int64
+	for _, bucket := range w.buckets {
+		if bucket.second >= oldest {
+			processed += bucket.processed
+			failed += bucket.errors
+		}
+	}
+
+	span := float64(size)
+	if uptime := math.Ceil(now.Sub(started).Seconds()); uptime < span {
+		span = math.Max(uptime, 1)
+	}
+
+	throughput = float64(processed) / span
+	if processed > 0 {
+		errorRate = float64(failed) / float64(processed) * 100
+	}
+	return throughput, errorRate
+}
+
+// cpuSampler computes process CPU utilisation from the CPU time consumed
+// between samples. Readings are cached for the sample interval so callers
+// never block; readings within the first interval after startup are 0.
+type cpuSampler struct {
+	mu       sync.Mutex
+	interval time.Duration
+	lastWall time.Time
+	lastCPU  time.Duration
+	percent  float64
+}
+
+func newCPUSampler(interval time.Duration) *cpuSampler {
+	sampler := &cpuSampler{interval: interval, lastWall: time.Now()}
+	sampler.lastCPU, _ = processCPUTime()
+	return sampler
+}
+
+// Percent returns CPU utilisation as a percentage of one core, so values
+// range from 0 to 100 * runtime.NumCPU()
+func (s *cpuSampler) Percent() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(s.lastWall)
+	if elapsed < s.interval {
+		return s.percent
+	}
+
+	cpuTime, ok := processCPUTime()
+	if !ok {
+		return 0
+	}
+
+	// CPU time read after the wall clock can overshoot by a tick
+	s.percent = math.Round(float64(cpuTime-s.lastCPU)/float64(elapsed)*10000) / 100
+	s.percent = math.Min(s.percent, float64(100*runtime.NumCPU()))
+	s.lastWall = now
+	s.lastCPU = cpuTime
+	return s.percent
+}
+
+// netCounters holds an interface's cumulative byte counters
+type netCounters struct {
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// diskMetrics reports usage of the filesystem holding path, falling back to
+// mock values where the platform is unsupported
+func diskMetrics(path string) map[string]interface{} {
+	total, used, ok := diskUsage(path)
+	if !ok || total == 0 {
+		return map[string]interface{}{
+			"used":          50, // Mock values
+			"total":         100,
+			"unit":          "GB",
+			"usage_percent": 50,
+			"mock":          true,
+		}
+	}
+
+	const gb = 1024 * 1024 * 1024
+	return map[string]interface{}{
+		"path":          path,
+		"used":          math.Round(float64(used)/gb*100) / 100,
+		"total":         math.Round(float64(total)/gb*100) / 100,
+		"unit":          "GB",
+		"usage_percent": int(float64(used) / float64(total) * 100),
+	}
+}
+
+// networkMetrics reports byte counters summed over interfaces and per
+// interface, falling back to mock values where the platform is unsupported
+func networkMetrics() map[string]interface{} {
+	counters, ok := networkCounters()
+	if !ok {
+		return map[string]interface{}{
+			"rx_bytes": int64(1000000), // Mock values
+			"tx_bytes": int64(500000),
+			"mock":     true,
+		}
+	}
+
+	var rx, tx uint64
+	for _, counter := range counters {
+		rx += counter.RxBytes
+		tx += counter.TxBytes
+	}
+	return map[string]interface{}{
+		"rx_bytes":   rx,
+		"tx_bytes":   tx,
+		"interfaces": counters,
+	}
+}
+
+func (r *PacketFlowRuntime) registerEventDrivenPackets() {
+	// ed:signal - Event signaling
+	r.RegisterPacket("ed", "signal", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		event, exists := data["event"]
+		if !exists {
+			return nil, fmt.Errorf("event name is required")
+		}
+		
+		eventStr, ok := event.(string)
+		if !ok {
+			return nil, fmt.Errorf("event must be a string")
+		}
+
+		payload := data["payload"]
+		priority := DataAccessor(data).GetInt("priority", DefaultPriority)
+
+		// Log the signal (in a real implementation, would broadcast to subscribers)
+		log.Printf("[ed:signal] Event: %s, Priority: %d", eventStr, priority)
+
+		return map[string]interface{}{
+			"signaled":  true,
+			"event":     event,
+			"timestamp": time.Now().Unix(),
+			"payload":   payload,
+		}, nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Event signaling and notification",
+	})
+
+	// ed:notify - Direct notification
+	r.RegisterPacket("ed", "notify", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		channel, exists := data["channel"]
+		if !exists {
+			return nil, fmt.Errorf("channel is required")
+		}
+		
+		recipient, exists := data["recipient"]
+		if !exists {
+			return nil, fmt.Errorf("recipient is required")
+		}
+		
+		channelStr, ok := channel.(string)
+		if !ok {
+			return nil, fmt.Errorf("channel must be a string")
+		}
+		
+		// Validate supported channels
+		supportedChannels := map[string]bool{
+			"email": true, "sms": true, "push": true, "webhook": true, "slack": true,
+		}
+		
+		if !supportedChannels[channelStr] {
+			return nil, fmt.Errorf("unsupported notification channel: %s", channelStr)
+		}
+		
+		// Mock notification sending
+		notificationID := uuid.New().String()
+		log.Printf("[ed:notify] %s notification sent to %v (ID: %s)", channelStr, recipient, notificationID)
+		
+		recipientCount := 1
+		if recipientSlice, ok := recipient.([]interface{}); ok {
+			recipientCount = len(recipientSlice)
+		}
+		
+		return map[string]interface{}{
+			"notification_sent": true,
+			"notification_id":   notificationID,
+			"channel":           channel,
+			"recipients":        recipientCount,
+			"sent_at":           time.Now().Unix(),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         30,
+		ComplianceLevel: 1,
+		Description:     "Direct notification delivery",
+	})
+}
+
+func (r *PacketFlowRuntime) registerCollectivePackets() {
+	// co:broadcast - Cluster-wide broadcasting
+	r.RegisterPacket("co", "broadcast", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		message, exists := data["message"]
+		if !exists {
+			return nil, fmt.Errorf("message is required")
+		}
+		
+		event := "co.broadcast"
+		if eventVal, exists := data["event"]; exists {
+			if eventStr, ok := eventVal.(string); ok && eventStr != "" {
+				event = eventStr
+			}
+		}
+
+		healthy, skipped := ctx.Runtime.collectiveTargets(data)
+		timeout := ctx.Runtime.reactorTimeout(data)
+
+		// Deliver the message to every healthy reactor as an ed:signal atom
+		atomFor := func(reactor *Reactor) *Atom {
+			atom := &Atom{
+				ID:      fmt.Sprintf("%s_broadcast_%s", ctx.Atom.ID, reactor.ID),
+				Group:   "ed",
+				Element: "signal",
+				Data: map[string]interface{}{
+					"event":   event,
+					"payload": message,
+					"source":  ctx.Runtime.config.ReactorID,
+				},
+			}
+			ctx.Runtime.assertCaller(atom, ctx.Caller)
+			return atom
+		}
+
+		responses := make(map[string]interface{})
+		successful := 0
+
+		for resp := range ctx.Runtime.fanOut(ctx.Context, healthy, atomFor, timeout) {
+			if resp.succeeded() {
+				successful++
+			}
+			responses[resp.ReactorID] = resp.toMap()
+		}
+
+		for reactorID, reason := range skipped {
+			responses[reactorID] = map[string]interface{}{
+				"reactor_id": reactorID,
+				"success":    false,
+				"error": map[string]interface{}{
+					"code":    "E503",
+					"message": reason,
+				},
+			}
+		}
+		
+		total := len(healthy) + len(skipped)
+		summary := map[string]interface{}{
+			"total":      total,
+			"successful": successful,
+			"failed":     total - successful,
+			"skipped":    len(skipped),
+		}
+
+		log.Printf("[co:broadcast] Broadcasted to %d reactors (%d successful)", total, successful)
+
+		return map[string]interface{}{
+			"broadcast_complete": true,
+			"responses":          responses,
+			"summary":            summary,
+		}, nil
+	}, PacketMetadata{
+		Timeout:         60,
+		ComplianceLevel: 1,
+		Description:     "Cluster-wide message broadcasting",
+	})
+
+	// co:gather - Collect data from multiple reactors
+	r.RegisterPacket("co", "gather", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		packet, exists := data["packet"]
+		if !exists {
+			return nil, fmt.Errorf("packet is required")
+		}
+		
+		template, err := ctx.Runtime.atomFromPacket(packet)
+		if err != nil {
+			return nil, err
+		}
+
+		healthy, skipped := ctx.Runtime.collectiveTargets(data)
+		timeout := ctx.Runtime.reactorTimeout(data)
+
+		// A quorum of 0 waits for every reactor
+		quorum := 0
+		if quorumVal, exists := data["quorum"]; exists {
+			quorumFloat, ok := ctx.Utils.toFloat64(quorumVal)
+			if !ok || quorumFloat < 0 {
+				return nil, fmt.Errorf("quorum must be a non-negative number")
+			}
+			quorum = int(quorumFloat)
+		}
+
+		// Peers run the relayed packet as this atom's caller
+		atomFor := func(reactor *Reactor) *Atom {
+			atom := *template
+			atom.ID = fmt.Sprintf("%s_gather_%s", ctx.Atom.ID, reactor.ID)
+			ctx.Runtime.assertCaller(&atom, ctx.Caller)
+			return &atom
+		}
+
+		gatherCtx, cancel := context.WithCancel(ctx.Context)
+		defer cancel()
+
+		results := make([]map[string]interface{}, 0, len(healthy))
+		successful := 0
+
+		// Stop collecting once quorum is met; cancelling the context aborts stragglers
+		for resp := range ctx.Runtime.fanOut(gatherCtx, healthy, atomFor, timeout) {
+			if resp.succeeded() {
+				successful++
+			}
+			results = append(results, resp.toMap())
+			if quorum > 0 && successful >= quorum {
+				cancel()
+				break
+			}
+		}
+		
+		for reactorID, reason := range skipped {
+			results = append(results, map[string]interface{}{
+				"reactor_id": reactorID,
+				"success":    false,
+				"error": map[string]interface{}{
+					"code":    "E503",
+					"message": reason,
+				},
+			})
+		}
+
+		totalSent := len(healthy)
+		responded := len(results) - len(skipped)
+		summary := map[string]interface{}{
+			"total_sent": totalSent,
+			"successful": successful,
+			"failed":     len(results) - successful,
+			"cancelled":  totalSent - responded,
+			"skipped":    len(skipped),
+		}
+
+		if quorum > 0 {
+			summary["quorum"] = quorum
+			summary["quorum_met"] = successful >= quorum
+		}
+
+		log.Printf("[co:gather] Gathered from %d/%d reactors (%d successful)", responded, totalSent, successful)
+
+		return map[string]interface{}{
+			"gather_complete": true,
+			"results":         results,
+			"summary":         summary,
+		}, nil
+	}, PacketMetadata{
+		Timeout:         120,
+		ComplianceLevel: 1,
+		Description:     "Collect data from multiple reactors",
+	})
+
+	// co:scatter_gather - Dispatch per-reactor sub-packets and merge the results
+	r.RegisterPacket("co", "scatter_gather", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		shardsVal, exists := data["shards"]
+		if !exists {
+			return nil, fmt.Errorf("shards are required")
+		}
+
+		shardsMap, ok := shardsVal.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("shards must be an object keyed by reactor id")
+		}
+
+		strategy := "keyed"
+		if mergeVal, exists := data["merge"]; exists {
+			mergeStr, ok := mergeVal.(string)
+			if !ok || (mergeStr != "keyed" && mergeStr != "concat") {
+				return nil, fmt.Errorf("merge must be one of: keyed, concat")
+			}
+			strategy = mergeStr
+		}
+
+		start := time.Now()
+		timeout := ctx.Runtime.reactorTimeout(data)
+		shardResults := make(map[string]interface{})
+		shardData := make(map[string]interface{})
+
+		// Resolve each shard to its reactor and atom; bad shards fail on their own
+		atoms := make(map[string]*Atom)
+		targets := make([]*Reactor, 0, len(shardsMap))
+		for reactorID, shardPacket := range shardsMap {
+			failShard := func(code, message string) {
+				shardResults[reactorID] = map[string]interface{}{
+					"reactor_id": reactorID,
+					"success":    false,
+					"error": map[string]interface{}{
+						"code":    code,
+						"message": message,
+					},
+				}
+			}
+
+			atom, err := ctx.Runtime.atomFromPacket(shardPacket)
+			if err != nil {
+				failShard("E400", err.Error())
+				continue
+			}
+
+			reactor, found := ctx.Runtime.router.GetReactor(reactorID)
+			if !found {
+				failShard("E503", "reactor not registered")
+				continue
+			}
+			if !reactor.Healthy {
+				failShard("E503", "reactor unhealthy")
+				continue
+			}
+
+			atom.ID = fmt.Sprintf("%s_shard_%s", ctx.Atom.ID, reactorID)
+			ctx.Runtime.assertCaller(atom, ctx.Caller)
+			atoms[reactorID] = atom
+			targets = append(targets, reactor)
+		}
+
+		atomFor := func(reactor *Reactor) *Atom {
+			return atoms[reactor.ID]
+		}
+
+		successful := 0
+		for resp := range ctx.Runtime.fanOut(ctx.Context, targets, atomFor, timeout) {
+			if resp.succeeded() {
+				successful++
+				shardData[resp.ReactorID] = resp.Result.Data
+			}
+			shardResults[resp.ReactorID] = resp.toMap()
+		}
+
+		var merged interface{}
+		switch strategy {
+		case "concat":
+			// Concatenate in reactor id order so the output is deterministic
+			reactorIDs := make([]string, 0, len(shardData))
+			for reactorID := range shardData {
+				reactorIDs = append(reactorIDs, reactorID)
+			}
+			sort.Strings(reactorIDs)
+
+			concatenated := make([]interface{}, 0)
+			for _, reactorID := range reactorIDs {
+				if items, ok := shardData[reactorID].([]interface{}); ok {
+					concatenated = append(concatenated, items...)
+				} else {
+					concatenated = append(concatenated, shardData[reactorID])
+				}
+			}
+			merged = concatenated
+		default:
+			merged = shardData
+		}
+
+		summary := map[string]interface{}{
+			"total":      len(shardsMap),
+			"successful": successful,
+			"failed":     len(shardsMap) - successful,
+		}
+
+		log.Printf("[co:scatter_gather] %d/%d shards successful (merge: %s)", successful, len(shardsMap), strategy)
+
+		return map[string]interface{}{
+			"scatter_gather_complete": true,
+			"merge":                   strategy,
+			"merged":                  merged,
+			"shards":                  shardResults,
+			"summary":                 summary,
+			"duration_ms":             time.Since(start).Milliseconds(),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         120,
+		ComplianceLevel: 2,
+		Description:     "Scatter per-reactor sub-packets and merge the results",
+	})
+}
+
+func (r *PacketFlowRuntime) registerResourceManagementPackets() {
+	// rm:monitor - System resource monitoring
+	r.RegisterPacket("rm", "monitor", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		
+		resources := map[string]interface{}{
+			"cpu": map[string]interface{}{
+				"usage":      ctx.Runtime.cpu.Percent(),
+				"unit":       "percent",
+				"cores":      runtime.NumCPU(),
+				"goroutines": runtime.NumGoroutine(),
+			},
+			"memory": map[string]interface{}{
+				"used":           m.Alloc / 1024 / 1024,
+				"total":          m.Sys / 1024 / 1024,
+				"unit":           "MB",
+				"usage_percent":  int(float64(m.Alloc) / float64(m.Sys) * 100),
+			},
+			"disk":    diskMetrics(ctx.Runtime.config.MonitorDiskPath),
+			"network": networkMetrics(),
+		}
+		
+		// Filter requested resources if specified
+		if resourcesReq, exists := data["resources"]; exists {
+			if resourcesList, ok := resourcesReq.([]interface{}); ok {
+				filtered := make(map[string]interface{})
+				for _, res := range resourcesList {
+					if resStr, ok := res.(string); ok {
+						if val, exists := resources[resStr]; exists {
+							filtered[resStr] = val
+						}
+					}
+				}
+				resources = filtered
+			}
+		}
+		
+		return map[string]interface{}{
+			"monitoring_complete": true,
+			"resources":           resources,
+			"collected_at":        time.Now().Unix(),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         60,
+		ComplianceLevel: 1,
+		Description:     "System resource monitoring",
+	})
+
+	// rm:allocate - Resource allocation
+	r.RegisterPacket("rm", "allocate", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		resource, exists := data["resource"]
+		if !exists {
+			return nil, fmt.Errorf("resource type is required")
+		}
+		
+		amount, exists := data["amount"]
+		if !exists {
+			return nil, fmt.Errorf("amount is required")
+		}
+		
+		resourceStr, ok := resource.(string)
+		if !ok {
+			return nil, fmt.Errorf("resource must be a string")
+		}
+		
+		amountFloat, ok := ctx.Utils.toFloat64(amount)
+		if !ok || amountFloat <= 0 {
+			return nil, fmt.Errorf("amount must be a positive number")
+		}
+		
+		timeout := 30
+		if timeoutVal, exists := data["timeout"]; exists {
+			if timeoutFloat, ok := ctx.Utils.toFloat64(timeoutVal); ok && timeoutFloat > 0 {
+				timeout = int(timeoutFloat)
+			}
+		}
+		
+		allocation, err := ctx.Runtime.quotas.Allocate(resourceStr, amountFloat, time.Duration(timeout)*time.Second)
+		if err != nil {
+			log.Printf("[rm:allocate] %s allocation of %v units failed: %v", resourceStr, amount, err)
+			return nil, err
+		}
+
+		log.Printf("[rm:allocate] %s allocation: %v units (id: %s)", resourceStr, amount, allocation.ID)
+
+		return map[string]interface{}{
+			"allocated":     true,
+			"resource":      resource,
+			"amount":        amount,
+			"allocation_id": allocation.ID,
+			"expires_at":    allocation.ExpiresAt.Unix(),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         60,
+		ComplianceLevel: 1,
+		Description:     "Resource allocation",
+	})
+
+	// rm:cleanup - Resource cleanup
+	r.RegisterPacket("rm", "cleanup", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		force := false
+		if forceVal, exists := data["force"]; exists {
+			if forceBool, ok := forceVal.(bool); ok {
+				force = forceBool
+			}
+		}
+		
+		// Mock cleanup operations
+		operations := []string{}
+		spaceFeed := 0
+		
+		// Trigger garbage collection
+		runtime.GC()
+		operations = append(operations, "garbage_collection")
+		spaceFeed += 50 // Mock freed space
+		
+		if force {
+			operations = append(operations, "force_cleanup")
+			spaceFeed += 100
+		}
+		
+		// Expired reservations are always returned; force returns all of them
+		var released []*Allocation
+		if force {
+			released = ctx.Runtime.quotas.ReleaseAll()
+		} else {
+			released = ctx.Runtime.quotas.ReleaseExpired(time.Now())
+		}
+		operations = append(operations, "quota_release")
+
+		log.Printf("[rm:cleanup] Cleanup completed (force: %v, allocations released: %d)", force, len(released))
+
+		return map[string]interface{}{
+			"cleanup_complete":     true,
+			"resources_cleaned":    len(operations),
+			"space_freed":          spaceFeed,
+			"operations":           operations,
+			"allocations_released": len(released),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         120,
+		ComplianceLevel: 1,
+		Description:     "Resource cleanup and garbage collection",
+	})
+
+	// rm:release - Early release of an allocation
+	r.RegisterPacket("rm", "release", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		allocationID, ok := data["allocation_id"].(string)
+		if !ok || allocationID == "" {
+			return nil, fmt.Errorf("allocation_id is required")
+		}
+
+		allocation, exists := ctx.Runtime.quotas.Release(allocationID)
+		if !exists {
+			return nil, fmt.Errorf("allocation not found: %s", allocationID)
+		}
+
+		log.Printf("[rm:release] Released %s allocation %s (%v units)", allocation.Resource, allocation.ID, allocation.Amount)
+
+		return map[string]interface{}{
+			"released":      true,
+			"allocation_id": allocation.ID,
+			"resource":      allocation.Resource,
+			"amount":        allocation.Amount,
+		}, nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Release a resource allocation",
+	})
+
+	// rm:quota - Resource quota usage report
+	r.RegisterPacket("rm", "quota", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return map[string]interface{}{
+			"quotas":    ctx.Runtime.quotas.Report(),
+			"timestamp": time.Now().Unix(),
+		}, nil
+	}, PacketMetadata{
+		Timeout:         5,
+		ComplianceLevel: 1,
+		Description:     "Resource quota usage",
+	})
+}
+
+// ============================================================================
+// Binary Message Protocol
+// ============================================================================
+
+// MessageVersion is the binary protocol version emitted by EncodeMessage.
+// Version 2 frames carry a CRC32 trailer after the encoded body.
+const MessageVersion = 2
+
+// ErrChecksumMismatch is returned when a version 2 frame fails CRC32 validation
+var ErrChecksumMismatch = errors.New("message checksum mismatch")
+
+// ExtTimestamp is the MessagePack timestamp extension type. It is registered
+// explicitly so time.Time values inside Message.Data encode the same way on
+// every reactor and always decode back to time.Time in UTC. []byte needs no
+// extension: it travels as a msgpack bin value and decodes back to []byte.
+const ExtTimestamp int8 = -1
+
+func init() {
+	msgpack.RegisterExtEncoder(ExtTimestamp, time.Time{}, encodeTimestampExt)
+	msgpack.RegisterExtDecoder(ExtTimestamp, time.Time{}, decodeTimestampExt)
+}
+
+// encodeTimestampExt uses the smallest of the 32, 64 and 96-bit timestamp
+// layouts that can hold the value
+func encodeTimestampExt(_ *msgpack.Encoder, v reflect.Value) ([]byte, error) {
+	timestamp := v.Interface().(time.Time)
+	secs := timestamp.Unix()
+	nsec := uint32(timestamp.Nanosecond())
+
+	if secs >= 0 && uint64(secs)>>34 == 0 {
+		packed := uint64(nsec)<<34 | uint64(secs)
+		if packed>>32 == 0 {
+			buf := make([]byte, 4)
+			binary.BigEndian.PutUint32(buf, uint32(packed))
+			return buf, nil
+		}
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, packed)
+		return buf, nil
+	}
+
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint32(buf, nsec)
+	binary.BigEndian.PutUint64(buf[4:], uint64(secs))
+	return buf, nil
+}
+
+func decodeTimestampExt(dec *msgpack.Decoder, v reflect.Value, extLen int) error {
+	buf := make([]byte, extLen)
+	if err := dec.ReadFull(buf); err != nil {
+		return err
+	}
+
+	var timestamp time.Time
+	switch extLen {
+	case 4:
+		timestamp = time.Unix(int64(binary.BigEndian.Uint32(buf)), 0)
+	case 8:
+		packed := binary.BigEndian.Uint64(buf)
+		timestamp = time.Unix(int64(packed&(1<<34-1)), int64(packed>>34))
+	case 12:
+		timestamp = time.Unix(int64(binary.BigEndian.Uint64(buf[4:])), int64(binary.BigEndian.Uint32(buf)))
+	default:
+		return fmt.Errorf("invalid timestamp extension length %d", extLen)
+	}
+
+	v.Set(reflect.ValueOf(timestamp.UTC()))
+	return nil
+}
+
+// Codec serializes protocol messages for the wire
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// MsgpackCodec encodes messages as MessagePack (the default)
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string                               { return "msgpack" }
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpack.Marshal(v) }
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// JSONCodec encodes messages as JSON for clients without MessagePack support
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                               { return "json" }
+func (JSONCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// codecs lists the codecs available for negotiation by name
+var codecs = map[string]Codec{
+	"msgpack": MsgpackCodec{},
+	"json":    JSONCodec{},
+}
+
+// CodecByName returns the codec registered under name
+func CodecByName(name string) (Codec, bool) {
+	codec, exists := codecs[name]
+	return codec, exists
+}
+
+// MessageHandler handles binary protocol messages
+type MessageHandler struct {
+	runtime         *PacketFlowRuntime
+	codec           Codec
+	sequenceCounter int64
+	mu              sync.Mutex
+	types           *messageTypeRegistry
+	// lastInbound is the highest inbound sequence accepted so far
+	lastInbound int64
+	// caller is the authenticated identity of the connection, attached to
+	// every atom the handler decodes
+	caller *Caller
+	// fromReactor marks a connection authenticated with ReactorToken, whose
+	// atoms may carry caller assertions
+	fromReactor bool
+}
+
+// Inbound sequence checking modes for RuntimeConfig.SequenceCheck
+const (
+	SequenceCheckWarn   = "warn"
+	SequenceCheckReject = "reject"
+	SequenceCheckOff    = "off"
+)
+
+// MessageTypeHandler handles a custom message type and returns the encoded response
+type MessageTypeHandler func(message *Message) ([]byte, error)
+
+// messageTypeRegistry maps message type names to codes and custom handlers
+type messageTypeRegistry struct {
+	mu       sync.RWMutex
+	codes    map[string]int
+	names    map[int]string
+	handlers map[int]MessageTypeHandler
+}
+
+// newMessageTypeRegistry creates a registry holding the built-in message types
+func newMessageTypeRegistry() *messageTypeRegistry {
+	types := &messageTypeRegistry{
+		codes:    make(map[string]int),
+		names:    make(map[int]string),
+		handlers: make(map[int]MessageTypeHandler),
+	}
+
+	builtinTypes := map[string]int{
+		"submit":       1,
+		"result":       2,
+		"error":        3,
+		"ping":         4,
+		"register":     5,
+		"batch_submit": 6,
+	}
+	for name, code := range builtinTypes {
+		types.codes[name] = code
+		types.names[code] = name
+	}
+	return types
+}
+
+// Codes returns a copy of the registered message type codes by name
+func (t *messageTypeRegistry) Codes() map[string]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	codes := make(map[string]int, len(t.codes))
+	for name, code := range t.codes {
+		codes[name] = code
+	}
+	return codes
+}
+
+// NewMessageHandler creates a new message handler using the MessagePack codec.
+// Handlers for the same runtime share its message type registry.
+func NewMessageHandler(runtime *PacketFlowRuntime) *MessageHandler {
+	types := newMessageTypeRegistry()
+	if runtime != nil {
+		types = runtime.messageTypes
+	}
+
+	return &MessageHandler{
+		runtime: runtime,
+		codec:   MsgpackCodec{},
+		types:   types,
+	}
+}
+
+// WithCodec returns a handler that encodes with codec, sharing this handler's
+// message type registry but keeping its own sequence numbering
+func (h *MessageHandler) WithCodec(codec Codec) *MessageHandler {
+	return &MessageHandler{
+		runtime: h.runtime,
+		codec:   codec,
+		types:   h.types,
+	}
+}
+
+// RegisterMessageType adds a protocol extension message type. Names and codes
+// must not collide with built-in or previously registered types.
+func (h *MessageHandler) RegisterMessageType(name string, code int, handler MessageTypeHandler) error {
+	if name == "" || handler == nil {
+		return fmt.Errorf("message type requires a name and handler")
+	}
+
+	h.types.mu.Lock()
+	defer h.types.mu.Unlock()
+
+	if existing, exists := h.types.codes[name]; exists {
+		return fmt.Errorf("message type %q already registered with code %d", name, existing)
+	}
+	if existing, exists := h.types.names[code]; exists {
+		return fmt.Errorf("message type code %d already registered as %q", code, existing)
+	}
+
+	h.types.codes[name] = code
+	h.types.names[code] = name
+	h.types.handlers[code] = handler
+	return nil
+}
+
+// EncodeMessage encodes a message using the handler's codec
+func (h *MessageHandler) EncodeMessage(msgType string, data interface{}, options map[string]interface{}) ([]byte, error) {
+	return h.EncodeMessageWith(h.codec, msgType, data, options)
+}
+
+// EncodeMessageWith encodes a message using the given codec
+func (h *MessageHandler) EncodeMessageWith(codec Codec, msgType string, data interface{}, options map[string]interface{}) ([]byte, error) {
+	h.mu.Lock()
+	h.sequenceCounter++
+	sequence := h.sequenceCounter
+	h.mu.Unlock()
+	
+	message := Message{
+		Version:       MessageVersion,
+		Type:          h.getMessageTypeCode(msgType),
+		Sequence:      sequence,
+		Timestamp:     time.Now().Unix(),
+		SourceID:      1,
+		DestinationID: 1,
+		Data:          data,
+	}
+	
+	// Add optional fields
+	if priority, exists := options["priority"]; exists {
+		if priorityInt, ok := priority.(int); ok && priorityInt != 5 {
+			message.Priority = &priorityInt
+		}
+	}
+	
+	if ttl, exists := options["ttl"]; exists {
+		if ttlInt, ok := ttl.(int); ok && ttlInt != 30 {
+			message.TTL = &ttlInt
+		}
+	}
+	
+	if cid, exists := options["correlation_id"]; exists {
+		if cidStr, ok := cid.(string); ok {
+			message.CorrelationID = &cidStr
+		}
+	}
+	
+	// Version 1 peers expect a bare frame without the checksum trailer
+	if version, ok := DataAccessor(options).LookupInt("version"); ok && version > 0 {
+		message.Version = version
+	}
+
+	encoded, err := codec.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if message.Version >= 2 {
+		encoded = binary.BigEndian.AppendUint32(encoded, crc32.ChecksumIEEE(encoded))
+	}
+	return encoded, nil
+}
+
+// DecodeMessage decodes a message using the handler's codec
+func (h *MessageHandler) DecodeMessage(data []byte) (*Message, error) {
+	return h.DecodeMessageWith(h.codec, data)
+}
+
+// DecodeMessageWith decodes a message using the given codec, verifying the
+// CRC32 trailer of version 2 frames
+func (h *MessageHandler) DecodeMessageWith(codec Codec, data []byte) (*Message, error) {
+	n := len(data)
+	if n > 4 {
+		body, trailer := data[:n-4], data[n-4:]
+		if binary.BigEndian.Uint32(trailer) == crc32.ChecksumIEEE(body) {
+			var message Message
+			if err := codec.Unmarshal(body, &message); err == nil && message.Version >= 2 {
+				message.Data = NormalizeMaps(message.Data)
+				return &message, nil
+			}
+		}
+	}
+
+	var message Message
+	if err := codec.Unmarshal(data, &message); err != nil {
+		// A corrupted version 2 frame may still decode once its trailer is stripped
+		if n > 4 {
+			var stripped Message
+			if codec.Unmarshal(data[:n-4], &stripped) == nil && stripped.Version >= 2 {
+				return nil, ErrChecksumMismatch
+			}
+		}
+		return nil, fmt.Errorf("failed to decode message: %v", err)
+	}
+
+	if message.Version >= 2 {
+		return nil, ErrChecksumMismatch
+	}
+	message.Data = NormalizeMaps(message.Data)
+	return &message, nil
+}
+
+// DecodeMessages decodes a frame carrying one or more concatenated messages,
+// each version 2 message followed by its own CRC32 trailer. Truncated or
+// trailing bytes fail the whole frame.
+func (h *MessageHandler) DecodeMessages(data []byte) ([]*Message, error) {
+	reader := bytes.NewReader(data)
+	var messages []*Message
+
+	for reader.Len() > 0 {
+		start := len(data) - reader.Len()
+		message, err := h.decodeNext(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("truncated message %d at byte %d", len(messages), start)
+			}
+			return nil, fmt.Errorf("failed to decode message %d at byte %d: %v", len(messages), start, err)
+		}
+		end := len(data) - reader.Len()
+
+		if message.Version >= 2 {
+			if reader.Len() < 4 {
+				return nil, fmt.Errorf("truncated checksum for message %d at byte %d", len(messages), end)
+			}
+			trailer := make([]byte, 4)
+			reader.Read(trailer)
+			if binary.BigEndian.Uint32(trailer) != crc32.ChecksumIEEE(data[start:end]) {
+				return nil, fmt.Errorf("message %d: %w", len(messages), ErrChecksumMismatch)
+			}
+		}
+		message.Data = NormalizeMaps(message.Data)
+		messages = append(messages, message)
+	}
+
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("failed to decode message: empty frame")
+	}
+	return messages, nil
+}
+
+// decodeNext decodes one message from reader, leaving it positioned at the
+// first byte after the message
+func (h *MessageHandler) decodeNext(reader *bytes.Reader) (*Message, error) {
+	var message Message
+
+	switch h.codec.(type) {
+	case MsgpackCodec:
+		// bytes.Reader is an io.ByteScanner, so the decoder reads no further
+		// than the message
+		if err := msgpack.NewDecoder(reader).Decode(&message); err != nil {
+			return nil, err
+		}
+	case JSONCodec:
+		start := reader.Size() - int64(reader.Len())
+		decoder := json.NewDecoder(reader)
+		if err := decoder.Decode(&message); err != nil {
+			return nil, err
+		}
+		reader.Seek(start+decoder.InputOffset(), io.SeekStart)
+	default:
+		return nil, fmt.Errorf("codec %s does not support multi-message frames", h.codec.Name())
+	}
+
+	return &message, nil
+}
+
+func (h *MessageHandler) getMessageTypeCode(typeName string) int {
+	h.types.mu.RLock()
+	defer h.types.mu.RUnlock()
+
+	if code, exists := h.types.codes[typeName]; exists {
+		return code
+	}
+	return 1
+}
+
+func (h *MessageHandler) getMessageTypeName(typeCode int) string {
+	h.types.mu.RLock()
+	defer h.types.mu.RUnlock()
+
+	if name, exists := h.types.names[typeCode]; exists {
+		return name
+	}
+	return "unknown"
+}
+
+// HandleMessage processes an incoming binary frame. A frame carrying several
+// messages is answered with their responses concatenated in the same order.
+func (h *MessageHandler) HandleMessage(data []byte) ([]byte, error) {
+	messages, err := h.DecodeMessages(data)
+	if err != nil && !errors.Is(err, ErrChecksumMismatch) {
+		// Codecs without streaming support still carry single messages
+		if message, singleErr := h.DecodeMessage(data); singleErr == nil {
+			messages, err = []*Message{message}, nil
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrChecksumMismatch) {
+			return h.createErrorResponse(nil, "", "E422", err.Error())
+		}
+		return h.createErrorResponse(nil, "", "E400", err.Error())
+	}
+	
+	if len(messages) == 1 {
+		return h.handleDecoded(messages[0])
+	}
+
+	var responses []byte
+	for _, message := range messages {
+		response, err := h.handleDecoded(message)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, response...)
+	}
+	return responses, nil
+}
+
+func (h *MessageHandler) handleDecoded(message *Message) ([]byte, error) {
+	if problem := h.checkSequence(message); problem != "" {
+		// In reject mode the error response acts as a NACK naming the expected sequence
+		if h.runtime.config.SequenceCheck == SequenceCheckReject {
+			return h.createErrorResponse(message, h.getCorrelationID(message), "E409", problem)
+		}
+		log.Printf("⚠️  Inbound %s", problem)
+	}
+
+	if h.isExpired(message) {
+		return h.createErrorResponse(message, h.getCorrelationID(message), "E410", "Message expired before processing")
+	}
+
+	switch h.getMessageTypeName(message.Type) {
+	case "submit":
+		return h.handleSubmit(message)
+	case "batch_submit":
+		return h.handleBatchSubmit(message)
+	case "ping":
+		return h.handlePing(message)
+	default:
+		h.types.mu.RLock()
+		handler, exists := h.types.handlers[message.Type]
+		h.types.mu.RUnlock()
+
+		if exists {
+			return handler(message)
+		}
+		return h.createErrorResponse(message, h.getCorrelationID(message), "E501", "Message type not implemented")
+	}
+}
+
+// checkSequence tracks inbound sequence numbers, describing a gap or
+// regression if the message breaks continuity. Sequence 0 means the sender
+// does not number its messages. Rejected messages do not advance the
+// expected sequence, so the sender can resend from the one named.
+func (h *MessageHandler) checkSequence(message *Message) string {
+	if h.runtime == nil || h.runtime.config.SequenceCheck == SequenceCheckOff || message.Sequence == 0 {
+		return ""
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	expected := h.lastInbound + 1
+	var problem string
+	switch {
+	case h.lastInbound == 0 || message.Sequence == expected:
+	case message.Sequence > expected:
+		problem = fmt.Sprintf("sequence gap: expected %d, got %d (%d missing)", expected, message.Sequence, message.Sequence-expected)
+	default:
+		problem = fmt.Sprintf("sequence out of order: expected %d, got %d", expected, message.Sequence)
+	}
+
+	if problem != "" && h.runtime.config.SequenceCheck == SequenceCheckReject {
+		return problem
+	}
+	if message.Sequence > h.lastInbound {
+		h.lastInbound = message.Sequence
+	}
+	return problem
+}
+
+// isExpired reports whether a message has outlived its TTL, allowing for the
+// configured clock skew between sender and receiver. Messages without a
+// timestamp never expire; a missing TTL falls back to the default timeout.
+func (h *MessageHandler) isExpired(message *Message) bool {
+	if message.Timestamp == 0 {
+		return false
+	}
+
+	ttl := h.runtime.config.DefaultTimeout
+	if message.TTL != nil {
+		ttl = *message.TTL
+	}
+
+	expiresAt := message.Timestamp + int64(ttl) + int64(h.runtime.config.ClockSkew)
+	return time.Now().Unix() > expiresAt
+}
+
+func (h *MessageHandler) handleSubmit(message *Message) ([]byte, error) {
+	// Convert message data to Atom
+	atomData, err := stringKeyedMap(message.Data)
+	if err != nil {
+		return h.createErrorResponse(message, h.getCorrelationID(message), "E400", fmt.Sprintf("Invalid atom data: %v", err))
+	}
+	
+	atom, err := h.decodeAtom(atomData)
+	if err != nil {
+		return h.createErrorResponse(message, h.getCorrelationID(message), atomErrorCode(err), fmt.Sprintf("Invalid atom data: %v", err))
+	}
+	if atom.Priority == nil {
+		atom.Priority = message.Priority
+	}
+	h.propagateCorrelationID(message, atom)
+
+	// Process atom
+	result := h.runtime.ProcessAtom(atom)
+
+	// Echo the runtime's correlation ID so generated IDs reach the client
+	correlationID, _ := result.Meta["correlation_id"].(string)
+	if result.Success {
+		return h.createResultResponse(message, correlationID, result.Data)
+	} else {
+		return h.createErrorResponse(message, correlationID, result.Error.Code, result.Error.Message)
+	}
+}
+
+func (h *MessageHandler) handleBatchSubmit(message *Message) ([]byte, error) {
+	batchData, ok := message.Data.([]interface{})
+	if !ok {
+		return h.createErrorResponse(message, h.getCorrelationID(message), "E400", fmt.Sprintf("Batch data must be an array of atoms, got %s", describeType(message.Data)))
+	}
+
+	atoms := make([]*Atom, len(batchData))
+	for i, item := range batchData {
+		atomData, err := stringKeyedMap(item)
+		if err == nil {
+			atoms[i], err = h.decodeAtom(atomData)
+		}
+		if err != nil {
+			return h.createErrorResponse(message, h.getCorrelationID(message), atomErrorCode(err), fmt.Sprintf("Invalid atom data at index %d: %v", i, err))
+		}
+		if atoms[i].Priority == nil {
+			atoms[i].Priority = message.Priority
+		}
+		h.propagateCorrelationID(message, atoms[i])
+	}
+
+	results := h.runtime.ProcessBatch(atoms)
+	return h.createResultResponse(message, h.getCorrelationID(message), results)
+}
+
+// decodeAtom converts decoded atom fields into an Atom. Missing data
+// becomes an empty map; data or meta that is not a map is an error.
+func (h *MessageHandler) decodeAtom(atomData map[string]interface{}) (*Atom, error) {
+	fields := DataAccessor(atomData)
+	atom := &Atom{
+		ID:      fields.GetString("id", ""),
+		Group:   fields.GetString("g", ""),
+		Element: fields.GetString("e", ""),
+		Data:    make(map[string]interface{}),
+	}
+
+	if data, exists := atomData["d"]; exists && data != nil {
+		converted, err := stringKeyedMap(data)
+		if err != nil {
+			return nil, fmt.Errorf("field d: %v", err)
+		}
+		atom.Data = converted
+	}
+	if meta, exists := atomData["m"]; exists && meta != nil {
+		converted, err := stringKeyedMap(meta)
+		if err != nil {
+			return nil, fmt.Errorf("field m: %v", err)
+		}
+		atom.Meta = converted
+	}
+	if err := h.runtime.checkClientAtomID(atom); err != nil {
+		return nil, err
+	}
+
+	if variant := fields.GetString("v", ""); variant != "" {
+		atom.Variant = &variant
+	}
+	
+	if priority, ok := fields.LookupInt("p"); ok {
+		atom.Priority = &priority
+	}
+	
+	if timeout, ok := fields.LookupInt("t"); ok {
+		atom.Timeout = &timeout
+	}
+
+	// The caller is bound last, since an assertion names the atom's packet
+	if err := h.runtime.bindCaller(atom, h.caller, h.fromReactor); err != nil {
+		return nil, err
+	}
+	return atom, nil
+}
+
+// atomErrorCode maps an atom decoding error to its error code
+func atomErrorCode(err error) string {
+	if errors.Is(err, ErrInvalidAssertion) {
+		return "E401"
+	}
+	return "E400"
+}
+
+// stringKeyedMap returns a decoded value as a string-keyed map. Some msgpack
+// encoders produce interface-keyed maps; those are converted as long as
+// every key is a string.
+func stringKeyedMap(value interface{}) (map[string]interface{}, error) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key %v is %s, not a string", k, describeType(k))
+			}
+			converted[key] = v
+		}
+		return converted, nil
+	}
+	return nil, fmt.Errorf("expected a map, got %s", describeType(value))
+}
+
+// NormalizeMaps recursively converts interface-keyed maps, as some msgpack
+// encoders produce, into string-keyed maps so handlers see the same shapes
+// as from JSON. Non-string keys are formatted with fmt. Maps and slices
+// are converted in place where possible.
+func NormalizeMaps(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = NormalizeMaps(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			name, ok := key.(string)
+			if !ok {
+				name = fmt.Sprint(key)
+			}
+			converted[name] = NormalizeMaps(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range v {
+			v[i] = NormalizeMaps(item)
+		}
+		return v
+	}
+	return value
+}
+
+// describeType names a decoded value's type for error messages
+func describeType(value interface{}) string {
+	if value == nil {
+		return "nil"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// propagateCorrelationID carries the message correlation ID onto an atom
+// that does not already have one
+func (h *MessageHandler) propagateCorrelationID(message *Message, atom *Atom) {
+	correlationID := h.getCorrelationID(message)
+	if correlationID == "" {
+		return
+	}
+	if atom.Meta == nil {
+		atom.Meta = make(map[string]interface{})
+	}
+	if _, exists := atom.Meta["correlation_id"]; !exists {
+		atom.Meta["correlation_id"] = correlationID
+	}
+}
+
+func (h *MessageHandler) handlePing(message *Message) ([]byte, error) {
+	pingData, _ := stringKeyedMap(message.Data)
+	fields := DataAccessor(pingData)
+
+	echo := fields.GetString("echo", "")
+	if echo == "" {
+		echo = "pong"
+	}
+	response := map[string]interface{}{
+		"echo":        echo,
+		"server_time": time.Now().UnixMilli(),
+	}
+	
+	if clientTime, ok := fields.LookupInt64("timestamp"); ok {
+		response["client_time"] = clientTime
+	}
+	
+	return h.createResultResponse(message, h.getCorrelationID(message), response)
+}
+
+// createResultResponse answers request, which is nil when the inbound frame
+// could not be decoded
+func (h *MessageHandler) createResultResponse(request *Message, correlationID string, data interface{}) ([]byte, error) {
+	options := h.replyOptions(request, correlationID)
+
+	response := map[string]interface{}{
+		"sequence":  requestSequence(request),
+		"data":      data,
+		"timestamp": time.Now().Unix(),
+	}
+
+	encoded, err := h.EncodeMessage("result", response, options)
+	if err == nil && h.runtime != nil {
+		h.runtime.ObserveResultSize(len(encoded))
+	}
+	return encoded, err
+}
+
+// createErrorResponse answers request, which is nil when the inbound frame
+// could not be decoded
+func (h *MessageHandler) createErrorResponse(request *Message, correlationID, code, message string) ([]byte, error) {
+	options := h.replyOptions(request, correlationID)
+
+	response := map[string]interface{}{
+		"sequence": requestSequence(request),
+		"error": map[string]interface{}{
+			"code":      code,
+			"message":   message,
+			"permanent": h.isPermanentError(code),
+		},
+		"timestamp": time.Now().Unix(),
+	}
+	
+	return h.EncodeMessage("error", response, options)
+}
+
+// replyOptions answers a message in its own protocol version, so version 1
+// peers get frames without the checksum trailer. Replies to frames that could
+// not be decoded use version 1, which every peer accepts.
+func (h *MessageHandler) replyOptions(request *Message, correlationID string) map[string]interface{} {
+	version := 1
+	if request != nil && request.Version > version {
+		version = request.Version
+	}
+	if version > MessageVersion {
+		version = MessageVersion
+	}
+
+	options := map[string]interface{}{"version": version}
+	if correlationID != "" {
+		options["correlation_id"] = correlationID
+	}
+	return options
+}
+
+func requestSequence(request *Message) int64 {
+	if request == nil {
+		return 0
+	}
+	return request.Sequence
+}
+
+func (h *MessageHandler) isPermanentError(code string) bool {
+	return isPermanentCode(code)
+}
+
+func (h *MessageHandler) getCorrelationID(message *Message) string {
+	if message.CorrelationID != nil {
+		return *message.CorrelationID
+	}
+	return ""
+}
+
+// ============================================================================
+// Hash-Based Router
+// ============================================================================
+
+// HashRouter implements consistent hash-based routing
+type HashRouter struct {
+	reactors map[string]*Reactor
+	mu       sync.RWMutex
+}
+
+// Reactor represents a processing node
+type Reactor struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Endpoint string   `json:"endpoint"`
+	Types    []string `json:"types"`
+	Capacity int      `json:"capacity"`
+	Load     int      `json:"load"`
+	Healthy  bool     `json:"healthy"`
+}
+
+// NewHashRouter creates a new hash router
+func NewHashRouter() *HashRouter {
+	return &HashRouter{
+		reactors: make(map[string]*Reactor),
+	}
+}
+
+// RegisterReactor registers a new reactor
+func (hr *HashRouter) RegisterReactor(reactor *Reactor) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.reactors[reactor.ID] = reactor
+}
+
+// SetHealthy sets a reactor's health flag, reporting whether the reactor exists
+func (hr *HashRouter) SetHealthy(id string, healthy bool) bool {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	reactor, exists := hr.reactors[id]
+	if !exists {
+		return false
+	}
+	reactor.Healthy = healthy
+	return true
+}
+
+// GetReactor returns a snapshot of a registered reactor by ID
+func (hr *HashRouter) GetReactor(id string) (*Reactor, bool) {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	reactor, exists := hr.reactors[id]
+	if !exists {
+		return nil, false
+	}
+	snapshot := *reactor
+	return &snapshot, true
+}
+
+// GetReactors returns snapshots of all registered reactors ordered by ID
+func (hr *HashRouter) GetReactors() []*Reactor {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	reactors := make([]*Reactor, 0, len(hr.reactors))
+	for _, reactor := range hr.reactors {
+		snapshot := *reactor
+		reactors = append(reactors, &snapshot)
+	}
+	sort.Slice(reactors, func(i, j int) bool {
+		return reactors[i].ID < reactors[j].ID
 	})
+	return reactors
+}
 
-	// df:filter - Data filtering
-	r.RegisterPacket("df", "filter", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		input, exists := data["input"]
-		if !exists {
-			return nil, fmt.Errorf("input is required")
+// Route routes an atom to an appropriate reactor. Rendezvous hashing picks
+// the candidate with the highest hash of atom and reactor ID, so adding or
+// removing a reactor only moves the atoms that reactor wins or loses.
+func (hr *HashRouter) Route(atom *Atom) *Reactor {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	
+	// Get candidates for the atom group
+	candidates := hr.getCandidatesForGroup(atom.Group)
+	return hr.pickReactor(atom.ID, candidates)
+}
+
+// Explain reports the healthy candidates for an atom's group and the reactor
+// Route would select, as snapshots ordered by ID, without routing the atom
+func (hr *HashRouter) Explain(atom *Atom) (selected *Reactor, candidates []*Reactor) {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	matches := hr.getCandidatesForGroup(atom.Group)
+	candidates = make([]*Reactor, 0, len(matches))
+	for _, reactor := range matches {
+		snapshot := *reactor
+		candidates = append(candidates, &snapshot)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ID < candidates[j].ID
+	})
+	return hr.pickReactor(atom.ID, candidates), candidates
+}
+
+func (hr *HashRouter) pickReactor(atomID string, candidates []*Reactor) *Reactor {
+	var best *Reactor
+	var bestHash uint64
+	for _, reactor := range candidates {
+		hash := rendezvousScore(atomID, reactor.ID)
+		if best == nil || hash > bestHash || (hash == bestHash && reactor.ID < best.ID) {
+			best, bestHash = reactor, hash
 		}
-		
-		inputSlice, ok := input.([]interface{})
-		if !ok {
-			return nil, fmt.Errorf("input must be an array")
+	}
+	return best
+}
+
+// Reconcile replaces the reactor table with a discovered set. Known reactors
+// keep their health and load, new ones start healthy and missing ones are
+// removed. It returns the IDs added and removed.
+func (hr *HashRouter) Reconcile(discovered []*Reactor) (added, removed []string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+
+	seen := make(map[string]bool, len(discovered))
+	for _, reactor := range discovered {
+		if reactor == nil || reactor.ID == "" || seen[reactor.ID] {
+			continue
 		}
-		
-		// Convert to []map[string]interface{} for filtering
-		var dataSlice []map[string]interface{}
-		for _, item := range inputSlice {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				dataSlice = append(dataSlice, itemMap)
-			}
+		seen[reactor.ID] = true
+
+		if existing, exists := hr.reactors[reactor.ID]; exists {
+			existing.Name = reactor.Name
+			existing.Endpoint = reactor.Endpoint
+			existing.Types = append([]string(nil), reactor.Types...)
+			existing.Capacity = reactor.Capacity
+			continue
 		}
-		
-		condition, exists := data["condition"]
-		if !exists {
-			// No condition, return all
-			return map[string]interface{}{
-				"results":       dataSlice,
-				"total_matches": len(dataSlice),
-				"returned":      len(dataSlice),
-			}, nil
+
+		entry := *reactor
+		entry.Types = append([]string(nil), reactor.Types...)
+		entry.Load = 0
+		entry.Healthy = true
+		hr.reactors[entry.ID] = &entry
+		added = append(added, entry.ID)
+	}
+
+	for id := range hr.reactors {
+		if !seen[id] {
+			delete(hr.reactors, id)
+			removed = append(removed, id)
 		}
-		
-		conditionMap, ok := condition.(map[string]interface{})
-		if !ok {
-			return nil, fmt.Errorf("condition must be an object")
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func (hr *HashRouter) getCandidatesForGroup(group string) []*Reactor {
+	var candidates []*Reactor
+	
+	// Group to reactor type mapping
+	groupTypes := map[string][]string{
+		"cf": {"cpu_bound", "general"},
+		"df": {"memory_bound", "general"},
+		"ed": {"io_bound", "general"},
+		"co": {"network_bound", "general"},
+		"mc": {"cpu_bound", "general"},
+		"rm": {"general"},
+	}
+	
+	preferredTypes, exists := groupTypes[group]
+	if !exists {
+		preferredTypes = []string{"general"}
+	}
+	
+	for _, reactor := range hr.reactors {
+		if !reactor.Healthy {
+			continue
 		}
 		
-		filtered := ctx.Utils.FilterData(dataSlice, conditionMap)
-		
-		// Handle limit and offset
-		offset := 0
-		if offsetVal, exists := data["offset"]; exists {
-			if offsetInt, ok := offsetVal.(int); ok {
-				offset = offsetInt
+		// Check if reactor supports any of the preferred types
+		for _, reactorType := range reactor.Types {
+			for _, preferredType := range preferredTypes {
+				if reactorType == preferredType {
+					candidates = append(candidates, reactor)
+					goto nextReactor
+				}
 			}
 		}
-		
-		result := filtered
-		if offset > 0 && offset < len(filtered) {
-			result = filtered[offset:]
-		}
-		
-		if limitVal, exists := data["limit"]; exists {
-			if limitInt, ok := limitVal.(int); ok && limitInt > 0 && limitInt < len(result) {
-				result = result[:limitInt]
+		nextReactor:
+	}
+	
+	return candidates
+}
+
+// rendezvousScore hashes a key and reactor pair, finishing with the
+// splitmix64 mixer so IDs differing in one byte still spread evenly
+func rendezvousScore(key, reactorID string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write([]byte(reactorID))
+
+	z := hash.Sum64()
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (hr *HashRouter) simpleHash(str string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(str))
+	return int(hash.Sum32())
+}
+
+// ============================================================================
+// Service Discovery
+// ============================================================================
+
+// ServiceDiscovery reports the current set of reactors. Each value sent on
+// the channel is a complete membership list; the channel closes when ctx is
+// done.
+type ServiceDiscovery interface {
+	Watch(ctx context.Context) <-chan []*Reactor
+}
+
+// StaticDiscovery reports a fixed reactor list once
+type StaticDiscovery struct {
+	reactors []*Reactor
+}
+
+// NewStaticDiscovery creates a discovery source for a fixed reactor list
+func NewStaticDiscovery(reactors []*Reactor) *StaticDiscovery {
+	return &StaticDiscovery{reactors: reactors}
+}
+
+// Watch sends the static list and closes the channel when ctx is done
+func (sd *StaticDiscovery) Watch(ctx context.Context) <-chan []*Reactor {
+	updates := make(chan []*Reactor, 1)
+	updates <- sd.reactors
+	go func() {
+		<-ctx.Done()
+		close(updates)
+	}()
+	return updates
+}
+
+// DefaultDiscoveryInterval is how often HTTPDiscovery polls its registry
+const DefaultDiscoveryInterval = 15 * time.Second
+
+// HTTPDiscovery polls a registry endpoint returning a JSON array of reactors
+type HTTPDiscovery struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+}
+
+// NewHTTPDiscovery creates a discovery source polling url every interval
+func NewHTTPDiscovery(url string, interval time.Duration) *HTTPDiscovery {
+	if interval <= 0 {
+		interval = DefaultDiscoveryInterval
+	}
+	return &HTTPDiscovery{
+		url:      url,
+		interval: interval,
+		client:   &http.Client{Timeout: interval},
+	}
+}
+
+// Watch polls the registry until ctx is done. Failed polls are logged and
+// skipped so a registry outage keeps the last known membership.
+func (hd *HTTPDiscovery) Watch(ctx context.Context) <-chan []*Reactor {
+	updates := make(chan []*Reactor)
+	go func() {
+		defer close(updates)
+
+		ticker := time.NewTicker(hd.interval)
+		defer ticker.Stop()
+
+		for {
+			reactors, err := hd.fetch(ctx)
+			if err != nil {
+				log.Printf("[discovery] Registry poll failed: %v", err)
+			} else {
+				select {
+				case updates <- reactors:
+				case <-ctx.Done():
+					return
+				}
 			}
-		}
-		
-		return map[string]interface{}{
-			"results":       result,
-			"total_matches": len(filtered),
-			"returned":      len(result),
-			"offset":        offset,
-		}, nil
-	}, PacketMetadata{
-		Timeout:         30,
-		ComplianceLevel: 1,
-		Description:     "Data filtering and selection",
-	})
 
-	// df:aggregate - Data aggregation
-	r.RegisterPacket("df", "aggregate", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		input, exists := data["input"]
-		if !exists {
-			return nil, fmt.Errorf("input is required")
-		}
-		
-		inputSlice, ok := input.([]interface{})
-		if !ok {
-			return nil, fmt.Errorf("input must be an array")
-		}
-		
-		operations, exists := data["operations"]
-		if !exists {
-			return nil, fmt.Errorf("operations are required")
-		}
-		
-		operationsMap, ok := operations.(map[string]interface{})
-		if !ok {
-			return nil, fmt.Errorf("operations must be an object")
-		}
-		
-		// Convert input to workable format
-		var dataSlice []map[string]interface{}
-		for _, item := range inputSlice {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				dataSlice = append(dataSlice, itemMap)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 			}
 		}
-		
-		// Simple aggregation without grouping for MVP
-		result := make(map[string]interface{})
-		
-		for field, operation := range operationsMap {
-			opStr, ok := operation.(string)
-			if !ok {
-				continue
-			}
-			
-			values := make([]float64, 0)
-			for _, item := range dataSlice {
-				if val, exists := item[field]; exists {
-					if floatVal, ok := ctx.Utils.toFloat64(val); ok {
-						values = append(values, floatVal)
-					}
-				}
-			}
-			
-			switch opStr {
-			case "sum":
-				sum := 0.0
-				for _, v := range values {
-					sum += v
-				}
-				result[field] = sum
-			case "count":
-				result[field] = len(values)
-			case "avg":
-				if len(values) > 0 {
-					sum := 0.0
-					for _, v := range values {
-						sum += v
-					}
-					result[field] = sum / float64(len(values))
-				} else {
-					result[field] = 0
-				}
-			case "min":
-				if len(values) > 0 {
-					min := values[0]
-					for _, v := range values {
-						if v < min {
-							min = v
-						}
-					}
-					result[field] = min
-				}
-			case "max":
-				if len(values) > 0 {
-					max := values[0]
-					for _, v := range values {
-						if v > max {
-							max = v
-						}
-					}
-					result[field] = max
+	}()
+	return updates
+}
+
+func (hd *HTTPDiscovery) fetch(ctx context.Context) ([]*Reactor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hd.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := hd.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry returned HTTP %d", resp.StatusCode)
+	}
+
+	var reactors []*Reactor
+	if err := json.NewDecoder(resp.Body).Decode(&reactors); err != nil {
+		return nil, fmt.Errorf("invalid registry response: %v", err)
+	}
+	return reactors, nil
+}
+
+// WatchDiscovery reconciles the router against discovery updates until
+// StopBackground
+func (r *PacketFlowRuntime) WatchDiscovery(discovery ServiceDiscovery) {
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := discovery.Watch(ctx)
+
+	r.goBackground(func() {
+		defer cancel()
+		for {
+			select {
+			case <-r.stopBackground:
+				return
+			case reactors, ok := <-updates:
+				if !ok {
+					return
 				}
+				r.reconcileReactors(reactors)
 			}
 		}
-		
-		return map[string]interface{}{
-			"aggregated":    []map[string]interface{}{result},
-			"operations":    operations,
-			"input_count":   len(inputSlice),
-			"output_count":  1,
-		}, nil
-	}, PacketMetadata{
-		Timeout:         60,
-		ComplianceLevel: 2,
-		Description:     "Data aggregation and grouping",
 	})
 }
 
-func (r *PacketFlowRuntime) registerEventDrivenPackets() {
-	// ed:signal - Event signaling
-	r.RegisterPacket("ed", "signal", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		event, exists := data["event"]
-		if !exists {
-			return nil, fmt.Errorf("event name is required")
+func (r *PacketFlowRuntime) reconcileReactors(reactors []*Reactor) {
+	added, removed := r.router.Reconcile(reactors)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	for _, id := range removed {
+		delete(r.reactorHealth, id)
+	}
+	r.mu.Unlock()
+
+	log.Printf("[discovery] Reactors added %v, removed %v", added, removed)
+}
+
+// ============================================================================
+// Connection Pool
+// ============================================================================
+
+// PoolStats summarises WebSocket pool activity
+type PoolStats struct {
+	Created int64                `json:"created"`
+	Reused  int64                `json:"reused"`
+	Evicted int64                `json:"evicted"`
+	Hosts   map[string]HostStats `json:"hosts"`
+}
+
+// HostStats reports the connections held for one endpoint
+type HostStats struct {
+	Open  int `json:"open"`
+	Idle  int `json:"idle"`
+	InUse int `json:"in_use"`
+}
+
+// connPool keeps WebSocket connections per endpoint and subprotocol. Each
+// host has a slot semaphore bounding open connections; idle connections are
+// reused most-recently-used first and pinged before reuse.
+type connPool struct {
+	dialer      *websocket.Dialer
+	header      http.Header
+	maxPerHost  int
+	idleTimeout time.Duration
+
+	mu      sync.Mutex
+	hosts   map[string]*poolHost
+	created int64
+	reused  int64
+	evicted int64
+	closed  bool
+}
+
+type poolHost struct {
+	slots chan struct{}
+	idle  []*pooledConn
+	open  int
+}
+
+type pooledConn struct {
+	conn     *websocket.Conn
+	key      string
+	lastUsed time.Time
+	reused   bool
+}
+
+func newConnPool(dialer *websocket.Dialer, header http.Header, maxPerHost int, idleTimeout time.Duration) *connPool {
+	if maxPerHost <= 0 {
+		maxPerHost = 1
+	}
+	return &connPool{
+		dialer:      dialer,
+		header:      header,
+		maxPerHost:  maxPerHost,
+		idleTimeout: idleTimeout,
+		hosts:       make(map[string]*poolHost),
+	}
+}
+
+func (p *connPool) host(key string) *poolHost {
+	host, exists := p.hosts[key]
+	if !exists {
+		host = &poolHost{slots: make(chan struct{}, p.maxPerHost)}
+		p.hosts[key] = host
+	}
+	return host
+}
+
+// Acquire returns a connection to endpoint, waiting for a free slot when the
+// host is at its limit
+func (p *connPool) Acquire(ctx context.Context, endpoint, subprotocol string) (*pooledConn, error) {
+	key := endpoint
+	if subprotocol != "" {
+		key += " " + subprotocol
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("connection pool is closed")
+	}
+	host := p.host(key)
+	p.mu.Unlock()
+
+	select {
+	case host.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		p.mu.Lock()
+		n := len(host.idle)
+		if n == 0 {
+			break
 		}
-		
-		eventStr, ok := event.(string)
-		if !ok {
-			return nil, fmt.Errorf("event must be a string")
+		pc := host.idle[n-1]
+		host.idle = host.idle[:n-1]
+		expired := p.idleTimeout > 0 && time.Since(pc.lastUsed) > p.idleTimeout
+		if expired {
+			host.open--
+			p.evicted++
 		}
-		
-		payload := data["payload"]
-		priority := 5
-		if priorityVal, exists := data["priority"]; exists {
-			if priorityInt, ok := priorityVal.(int); ok {
-				priority = priorityInt
-			}
+		p.mu.Unlock()
+
+		if !expired && pc.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)) == nil {
+			p.mu.Lock()
+			p.reused++
+			p.mu.Unlock()
+			pc.reused = true
+			return pc, nil
 		}
-		
-		// Log the signal (in a real implementation, would broadcast to subscribers)
-		log.Printf("[ed:signal] Event: %s, Priority: %d", eventStr, priority)
-		
-		return map[string]interface{}{
-			"signaled":  true,
-			"event":     event,
-			"timestamp": time.Now().Unix(),
-			"payload":   payload,
-		}, nil
-	}, PacketMetadata{
-		Timeout:         5,
-		ComplianceLevel: 1,
-		Description:     "Event signaling and notification",
-	})
 
-	// ed:notify - Direct notification
-	r.RegisterPacket("ed", "notify", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		channel, exists := data["channel"]
-		if !exists {
-			return nil, fmt.Errorf("channel is required")
-		}
-		
-		recipient, exists := data["recipient"]
-		if !exists {
-			return nil, fmt.Errorf("recipient is required")
+		pc.conn.Close()
+		if !expired {
+			p.mu.Lock()
+			host.open--
+			p.mu.Unlock()
 		}
-		
-		channelStr, ok := channel.(string)
-		if !ok {
-			return nil, fmt.Errorf("channel must be a string")
+	}
+	host.open++
+	p.mu.Unlock()
+
+	dialer := *p.dialer
+	if subprotocol != "" {
+		dialer.Subprotocols = []string{subprotocol}
+	}
+	conn, _, err := dialer.DialContext(ctx, endpoint, p.header)
+	if err != nil {
+		p.mu.Lock()
+		host.open--
+		p.mu.Unlock()
+		<-host.slots
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.created++
+	p.mu.Unlock()
+	return &pooledConn{conn: conn, key: key}, nil
+}
+
+// Release returns a connection to its host's idle list, or closes it when
+// it is not reusable or the pool is closed
+func (p *connPool) Release(pc *pooledConn, reusable bool) {
+	p.mu.Lock()
+	host := p.host(pc.key)
+	if reusable && !p.closed {
+		pc.lastUsed = time.Now()
+		pc.reused = false
+		host.idle = append(host.idle, pc)
+	} else {
+		host.open--
+		pc.conn.Close()
+	}
+	p.mu.Unlock()
+	<-host.slots
+}
+
+// EvictIdle closes connections idle past the idle timeout
+func (p *connPool) EvictIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, host := range p.hosts {
+		kept := host.idle[:0]
+		for _, pc := range host.idle {
+			if p.idleTimeout > 0 && time.Since(pc.lastUsed) > p.idleTimeout {
+				pc.conn.Close()
+				host.open--
+				p.evicted++
+				continue
+			}
+			kept = append(kept, pc)
 		}
-		
-		// Validate supported channels
-		supportedChannels := map[string]bool{
-			"email": true, "sms": true, "push": true, "webhook": true, "slack": true,
+		host.idle = kept
+	}
+}
+
+// Close closes idle connections and stops pooling
+func (p *connPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, host := range p.hosts {
+		for _, pc := range host.idle {
+			pc.conn.Close()
+			host.open--
 		}
-		
-		if !supportedChannels[channelStr] {
-			return nil, fmt.Errorf("unsupported notification channel: %s", channelStr)
+		host.idle = nil
+	}
+}
+
+// Stats returns a snapshot of pool counters and per-host connections
+func (p *connPool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := PoolStats{
+		Created: p.created,
+		Reused:  p.reused,
+		Evicted: p.evicted,
+		Hosts:   make(map[string]HostStats, len(p.hosts)),
+	}
+	for key, host := range p.hosts {
+		stats.Hosts[key] = HostStats{
+			Open:  host.open,
+			Idle:  len(host.idle),
+			InUse: host.open - len(host.idle),
 		}
-		
-		// Mock notification sending
-		notificationID := uuid.New().String()
-		log.Printf("[ed:notify] %s notification sent to %v (ID: %s)", channelStr, recipient, notificationID)
-		
-		recipientCount := 1
-		if recipientSlice, ok := recipient.([]interface{}); ok {
-			recipientCount = len(recipientSlice)
+	}
+	return stats
+}
+
+// ============================================================================
+// Reactor Client
+// ============================================================================
+
+// ReactorClient delivers atoms to remote reactors over HTTP or WebSocket,
+// reusing connections per endpoint
+type ReactorClient struct {
+	httpClient *http.Client
+	pool       *connPool
+	token      string
+}
+
+// reactorResponse captures the outcome of sending an atom to a single reactor
+type reactorResponse struct {
+	ReactorID string
+	Result    *AtomResult
+	Err       error
+	Duration  time.Duration
+}
+
+// NewReactorClient creates a reactor client keeping at most maxPerHost
+// connections per endpoint and closing connections idle for idleTimeout.
+// A non-empty token is sent as a Bearer token on every request and dial.
+func NewReactorClient(maxPerHost int, idleTimeout time.Duration, token string) *ReactorClient {
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	return &ReactorClient{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost: maxPerHost,
+				MaxConnsPerHost:     maxPerHost,
+				IdleConnTimeout:     idleTimeout,
+			},
+		},
+		pool:  newConnPool(&websocket.Dialer{HandshakeTimeout: 10 * time.Second}, header, maxPerHost, idleTimeout),
+		token: token,
+	}
+}
+
+// PoolStats reports WebSocket pool usage
+func (c *ReactorClient) PoolStats() PoolStats {
+	return c.pool.Stats()
+}
+
+// EvictIdle closes pooled connections idle past the idle timeout
+func (c *ReactorClient) EvictIdle() {
+	c.pool.EvictIdle()
+	c.httpClient.CloseIdleConnections()
+}
+
+// Close closes all idle connections; connections in use close on release
+func (c *ReactorClient) Close() {
+	c.pool.Close()
+	c.httpClient.CloseIdleConnections()
+}
+
+// Send delivers an atom to the reactor's endpoint and returns the remote result.
+// http(s) endpoints receive the atom as a JSON POST body; ws(s) endpoints
+// receive it as a JSON text message on the PacketFlow WebSocket.
+func (c *ReactorClient) Send(ctx context.Context, reactor *Reactor, atom *Atom) (*AtomResult, error) {
+	endpoint, err := url.Parse(reactor.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reactor endpoint %q: %v", reactor.Endpoint, err)
+	}
+
+	switch endpoint.Scheme {
+	case "http", "https":
+		return c.sendHTTP(ctx, endpoint.String(), atom)
+	case "ws", "wss":
+		return c.sendWebSocket(ctx, endpoint.String(), atom)
+	default:
+		return nil, fmt.Errorf("unsupported reactor endpoint scheme: %q", endpoint.Scheme)
+	}
+}
+
+func (c *ReactorClient) sendHTTP(ctx context.Context, endpoint string, atom *Atom) (*AtomResult, error) {
+	body, err := json.Marshal(atom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode atom: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Error statuses still carry an AtomResult body when the reactor handled the atom
+	var result AtomResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("reactor returned HTTP %d without a valid result: %v", resp.StatusCode, err)
+	}
+	return &result, nil
+}
+
+func (c *ReactorClient) sendWebSocket(ctx context.Context, endpoint string, atom *Atom) (*AtomResult, error) {
+	body, err := json.Marshal(atom)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode atom: %v", err)
+	}
+
+	response, err := c.roundTrip(ctx, endpoint, "", websocket.TextMessage, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result AtomResult
+	if err := json.Unmarshal(response, &result); err != nil {
+		return nil, fmt.Errorf("reactor returned an invalid result: %v", err)
+	}
+	return &result, nil
+}
+
+// Forward delivers an atom like Send, but uses the binary protocol for ws(s)
+// endpoints
+func (c *ReactorClient) Forward(ctx context.Context, reactor *Reactor, atom *Atom) (*AtomResult, error) {
+	endpoint, err := url.Parse(reactor.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reactor endpoint %q: %v", reactor.Endpoint, err)
+	}
+
+	if endpoint.Scheme == "ws" || endpoint.Scheme == "wss" {
+		return c.sendBinary(ctx, endpoint.String(), atom)
+	}
+	return c.Send(ctx, reactor, atom)
+}
+
+// sendBinary submits an atom as a MessagePack submit message and converts
+// the result or error message back into an AtomResult
+func (c *ReactorClient) sendBinary(ctx context.Context, endpoint string, atom *Atom) (*AtomResult, error) {
+	messages := NewMessageHandler(nil)
+	body, err := messages.EncodeMessage("submit", atom, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode atom: %v", err)
+	}
+
+	response, err := c.roundTrip(ctx, endpoint, "packetflow.msgpack", websocket.BinaryMessage, body)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := messages.DecodeMessage(response)
+	if err != nil {
+		return nil, fmt.Errorf("reactor returned an invalid message: %v", err)
+	}
+
+	payload, _ := stringKeyedMap(message.Data)
+	result := &AtomResult{Meta: make(map[string]interface{})}
+	if cid := messages.getCorrelationID(message); cid != "" {
+		result.Meta["correlation_id"] = cid
+	}
+
+	switch messages.getMessageTypeName(message.Type) {
+	case "result":
+		result.Success = true
+		result.Data = payload["data"]
+	case "error":
+		errData := DataAccessor(DataAccessor(payload).GetMap("error", nil))
+		result.Error = &AtomError{
+			Code:      errData.GetString("code", ""),
+			Message:   errData.GetString("message", ""),
+			Permanent: errData.GetBool("permanent", false),
 		}
-		
-		return map[string]interface{}{
-			"notification_sent": true,
-			"notification_id":   notificationID,
-			"channel":           channel,
-			"recipients":        recipientCount,
-			"sent_at":           time.Now().Unix(),
-		}, nil
-	}, PacketMetadata{
-		Timeout:         30,
-		ComplianceLevel: 1,
-		Description:     "Direct notification delivery",
-	})
+	default:
+		return nil, fmt.Errorf("reactor returned unexpected message type %d", message.Type)
+	}
+	return result, nil
 }
 
-func (r *PacketFlowRuntime) registerCollectivePackets() {
-	// co:broadcast - Cluster-wide broadcasting
-	r.RegisterPacket("co", "broadcast", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		message, exists := data["message"]
-		if !exists {
-			return nil, fmt.Errorf("message is required")
+// roundTrip writes one message on a pooled connection and reads the reply.
+// A reused connection that fails on write is replaced by a fresh one, since
+// the remote reactor cannot have seen the message; connections are only
+// returned to the pool after a clean exchange.
+func (c *ReactorClient) roundTrip(ctx context.Context, endpoint, subprotocol string, messageType int, body []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		pc, err := c.pool.Acquire(ctx, endpoint, subprotocol)
+		if err != nil {
+			return nil, err
 		}
-		
-		// Mock broadcast to multiple reactors
-		mockReactors := []string{"reactor-1", "reactor-2", "reactor-3"}
-		responses := make(map[string]interface{})
-		successful := 0
-		
-		for _, reactorID := range mockReactors {
-			// Simulate network delay
-			time.Sleep(time.Millisecond * 10)
-			
-			// Mock successful response
-			responses[reactorID] = map[string]interface{}{
-				"success":        true,
-				"message_received": message,
-				"processed_at":   time.Now().Unix(),
+
+		// Unblock pending reads and writes once the context is done
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				pc.conn.Close()
+			case <-stop:
 			}
-			successful++
-		}
-		
-		summary := map[string]interface{}{
-			"total":      len(mockReactors),
-			"successful": successful,
-			"failed":     len(mockReactors) - successful,
+		}()
+
+		if err := pc.conn.WriteMessage(messageType, body); err != nil {
+			close(stop)
+			c.pool.Release(pc, false)
+			if pc.reused && attempt == 0 && ctx.Err() == nil {
+				continue
+			}
+			return nil, c.contextError(ctx, err)
 		}
-		
-		log.Printf("[co:broadcast] Broadcasted to %d reactors", len(mockReactors))
-		
-		return map[string]interface{}{
-			"broadcast_complete": true,
-			"responses":          responses,
-			"summary":            summary,
-		}, nil
-	}, PacketMetadata{
-		Timeout:         60,
-		ComplianceLevel: 1,
-		Description:     "Cluster-wide message broadcasting",
-	})
 
-	// co:gather - Collect data from multiple reactors
-	r.RegisterPacket("co", "gather", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		packet, exists := data["packet"]
-		if !exists {
-			return nil, fmt.Errorf("packet is required")
+		_, response, err := pc.conn.ReadMessage()
+		close(stop)
+		c.pool.Release(pc, err == nil && ctx.Err() == nil)
+		if err != nil {
+			return nil, c.contextError(ctx, err)
 		}
-		
-		// Mock gathering from multiple reactors
-		mockReactors := []string{"reactor-1", "reactor-2", "reactor-3"}
-		results := make([]map[string]interface{}, 0)
-		
-		for _, reactorID := range mockReactors {
-			// Simulate processing
-			time.Sleep(time.Millisecond * 20)
-			
-			result := map[string]interface{}{
-				"reactor_id": reactorID,
-				"success":    true,
-				"data":       map[string]interface{}{"processed": packet},
+		return response, nil
+	}
+}
+
+// contextError prefers the context error over the connection error it caused
+func (c *ReactorClient) contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (resp reactorResponse) succeeded() bool {
+	return resp.Err == nil && resp.Result != nil && resp.Result.Success
+}
+
+func (resp reactorResponse) toMap() map[string]interface{} {
+	entry := map[string]interface{}{
+		"reactor_id":  resp.ReactorID,
+		"success":     resp.succeeded(),
+		"duration_ms": resp.Duration.Milliseconds(),
+	}
+
+	switch {
+	case resp.Err != nil:
+		code := "E503"
+		if errors.Is(resp.Err, context.DeadlineExceeded) {
+			code = "E408"
+		}
+		entry["error"] = map[string]interface{}{
+			"code":    code,
+			"message": resp.Err.Error(),
+		}
+	case !resp.Result.Success:
+		if resp.Result.Error != nil {
+			entry["error"] = resp.Result.Error
+		} else {
+			entry["error"] = map[string]interface{}{
+				"code":    "E500",
+				"message": "reactor reported failure without an error",
 			}
-			results = append(results, result)
 		}
-		
-		summary := map[string]interface{}{
-			"total_sent":  len(mockReactors),
-			"successful":  len(results),
-			"failed":      0,
+	default:
+		entry["data"] = resp.Result.Data
+	}
+
+	return entry
+}
+
+// fanOut sends an atom to each reactor through a bounded worker pool, applying
+// the timeout per reactor. The returned channel is closed once every reactor
+// has responded or ctx is cancelled.
+func (r *PacketFlowRuntime) fanOut(ctx context.Context, reactors []*Reactor, atomFor func(*Reactor) *Atom, timeout time.Duration) <-chan reactorResponse {
+	responses := make(chan reactorResponse, len(reactors))
+	jobs := make(chan *Reactor)
+
+	workers := r.config.FanOutWorkers
+	if workers > len(reactors) {
+		workers = len(reactors)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for reactor := range jobs {
+				responses <- r.sendToReactor(ctx, reactor, atomFor(reactor), timeout)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, reactor := range reactors {
+			select {
+			case jobs <- reactor:
+			case <-ctx.Done():
+				return
+			}
 		}
-		
-		log.Printf("[co:gather] Gathered from %d reactors", len(mockReactors))
-		
-		return map[string]interface{}{
-			"gather_complete": true,
-			"results":         results,
-			"summary":         summary,
-		}, nil
-	}, PacketMetadata{
-		Timeout:         120,
-		ComplianceLevel: 1,
-		Description:     "Collect data from multiple reactors",
-	})
+	}()
+
+	go func() {
+		wg.Wait()
+		close(responses)
+	}()
+
+	return responses
 }
 
-func (r *PacketFlowRuntime) registerResourceManagementPackets() {
-	// rm:monitor - System resource monitoring
-	r.RegisterPacket("rm", "monitor", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		var m runtime.MemStats
-		runtime.ReadMemStats(&m)
-		
-		resources := map[string]interface{}{
-			"cpu": map[string]interface{}{
-				"usage": runtime.NumGoroutine(), // Proxy for CPU activity
-				"cores": runtime.NumCPU(),
-			},
-			"memory": map[string]interface{}{
-				"used":           m.Alloc / 1024 / 1024,
-				"total":          m.Sys / 1024 / 1024,
-				"unit":           "MB",
-				"usage_percent":  int(float64(m.Alloc) / float64(m.Sys) * 100),
-			},
-			"disk": map[string]interface{}{
-				"used":          50, // Mock values
-				"total":         100,
-				"unit":          "GB",
-				"usage_percent": 50,
-			},
-			"network": map[string]interface{}{
-				"rx_bytes": int64(1000000),
-				"tx_bytes": int64(500000),
+func (r *PacketFlowRuntime) sendToReactor(ctx context.Context, reactor *Reactor, atom *Atom, timeout time.Duration) reactorResponse {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result, err := r.reactorClient.Send(ctx, reactor, atom)
+	return reactorResponse{
+		ReactorID: reactor.ID,
+		Result:    result,
+		Err:       err,
+		Duration:  time.Since(start),
+	}
+}
+
+// ForwardCountMeta is the atom Meta key counting how many times an atom has
+// been forwarded between reactors
+const ForwardCountMeta = "forward_count"
+
+// forwardAtom sends an atom for an unregistered packet to the reactor the
+// router picks for its group. It reports false when the atom has reached the
+// hop limit or no other reactor is available, leaving the caller to fail
+// with E404.
+func (r *PacketFlowRuntime) forwardAtom(atom *Atom, start time.Time, correlationID string) (*AtomResult, bool) {
+	hops, _ := r.utils.toFloat64(atom.Meta[ForwardCountMeta])
+	if int(hops) >= r.config.MaxForwardHops {
+		log.Printf("[forward] Atom %s reached the %d hop limit", atom.ID, r.config.MaxForwardHops)
+		return nil, false
+	}
+
+	reactor := r.router.Route(atom)
+	if reactor == nil || reactor.ID == r.config.ReactorID {
+		return nil, false
+	}
+
+	// The peer authorizes the forwarded atom against the caller this reactor
+	// asserts, never against this reactor's own token
+	forwarded := *atom
+	r.assertCaller(&forwarded, atom.Caller)
+	forwarded.Meta[ForwardCountMeta] = int(hops) + 1
+
+	budget, open := r.deadlineBudget(atom, time.Duration(r.config.ReactorTimeout)*time.Second)
+	if !open {
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      "E408",
+				Message:   "atom deadline has already passed",
+				Permanent: true,
 			},
+			Meta: r.createResponseMeta(start, correlationID),
+		}, true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+	defer cancel()
+
+	result, err := r.reactorClient.Forward(ctx, reactor, &forwarded)
+	if err != nil {
+		code := "E503"
+		if errors.Is(err, context.DeadlineExceeded) {
+			code = "E408"
 		}
-		
-		// Filter requested resources if specified
-		if resourcesReq, exists := data["resources"]; exists {
-			if resourcesList, ok := resourcesReq.([]interface{}); ok {
-				filtered := make(map[string]interface{})
-				for _, res := range resourcesList {
-					if resStr, ok := res.(string); ok {
-						if val, exists := resources[resStr]; exists {
-							filtered[resStr] = val
-						}
-					}
-				}
-				resources = filtered
-			}
-		}
-		
-		return map[string]interface{}{
-			"monitoring_complete": true,
-			"resources":           resources,
-			"collected_at":        time.Now().Unix(),
-		}, nil
-	}, PacketMetadata{
-		Timeout:         60,
-		ComplianceLevel: 1,
-		Description:     "System resource monitoring",
-	})
+		return &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      code,
+				Message:   fmt.Sprintf("forwarding to reactor %s failed: %v", reactor.ID, err),
+				Permanent: false,
+			},
+			Meta: r.createResponseMeta(start, correlationID),
+		}, true
+	}
 
-	// rm:allocate - Resource allocation
-	r.RegisterPacket("rm", "allocate", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		resource, exists := data["resource"]
-		if !exists {
-			return nil, fmt.Errorf("resource type is required")
+	if result.Meta == nil {
+		result.Meta = r.createResponseMeta(start, correlationID)
+	}
+	result.Meta["forwarded_to"] = reactor.ID
+	return result, true
+}
+
+// evictIdleConnections closes idle pooled reactor connections every interval
+// until StopBackground
+func (r *PacketFlowRuntime) evictIdleConnections(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopBackground:
+			return
+		case <-ticker.C:
+			r.reactorClient.EvictIdle()
 		}
-		
-		amount, exists := data["amount"]
-		if !exists {
-			return nil, fmt.Errorf("amount is required")
+	}
+}
+
+// reactorProbeState counts consecutive probe outcomes for one reactor
+type reactorProbeState struct {
+	failures  int
+	successes int
+}
+
+// checkReactorHealth probes every registered reactor each interval until
+// StopBackground
+func (r *PacketFlowRuntime) checkReactorHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stopBackground:
+			return
+		case <-ticker.C:
+			r.probeReactors()
 		}
-		
-		resourceStr, ok := resource.(string)
-		if !ok {
-			return nil, fmt.Errorf("resource must be a string")
+	}
+}
+
+// probeReactors pings all reactors, healthy or not, and flips their Healthy
+// flag once a failure or success streak reaches its threshold
+func (r *PacketFlowRuntime) probeReactors() {
+	reactors := r.router.GetReactors()
+	if len(reactors) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stopBackground:
+			cancel()
+		case <-ctx.Done():
 		}
-		
-		allocationID := uuid.New().String()
-		
-		// Mock allocation logic
-		var success bool
-		switch resourceStr {
-		case "memory", "cpu", "disk":
-			success = true // Assume allocation succeeds for demo
-		default:
-			return nil, fmt.Errorf("unsupported resource type: %s", resourceStr)
+	}()
+
+	atomFor := func(reactor *Reactor) *Atom {
+		return &Atom{
+			ID:      uuid.New().String(),
+			Group:   "cf",
+			Element: "ping",
+			Data:    map[string]interface{}{"echo": reactor.ID},
 		}
-		
-		timeout := 30
-		if timeoutVal, exists := data["timeout"]; exists {
-			if timeoutInt, ok := timeoutVal.(int); ok {
-				timeout = timeoutInt
+	}
+	timeout := time.Duration(r.config.ReactorTimeout) * time.Second
+
+	healthy := make(map[string]bool, len(reactors))
+	for _, reactor := range reactors {
+		healthy[reactor.ID] = reactor.Healthy
+	}
+
+	for resp := range r.fanOut(ctx, reactors, atomFor, timeout) {
+		r.recordProbe(resp.ReactorID, resp.succeeded(), healthy[resp.ReactorID])
+	}
+}
+
+func (r *PacketFlowRuntime) recordProbe(reactorID string, success, healthy bool) {
+	r.mu.Lock()
+	state, exists := r.reactorHealth[reactorID]
+	if !exists {
+		state = &reactorProbeState{}
+		r.reactorHealth[reactorID] = state
+	}
+
+	flip := false
+	if success {
+		state.failures = 0
+		state.successes++
+		flip = !healthy && state.successes >= r.config.HealthyThreshold
+	} else {
+		state.successes = 0
+		state.failures++
+		flip = healthy && state.failures >= r.config.UnhealthyThreshold
+	}
+	if flip {
+		state.failures, state.successes = 0, 0
+	}
+	r.mu.Unlock()
+
+	if !flip || !r.router.SetHealthy(reactorID, !healthy) {
+		return
+	}
+	if healthy {
+		log.Printf("[router] Reactor %s marked unhealthy after %d failed health checks", reactorID, r.config.UnhealthyThreshold)
+	} else {
+		log.Printf("[router] Reactor %s marked healthy after %d successful health checks", reactorID, r.config.HealthyThreshold)
+	}
+}
+
+// collectiveTargets resolves the reactors a collective packet should reach.
+// All registered reactors are used unless a "targets" list is given; targets
+// that are unhealthy or unknown are returned in skipped with the reason.
+func (r *PacketFlowRuntime) collectiveTargets(data map[string]interface{}) ([]*Reactor, map[string]string) {
+	healthy := make([]*Reactor, 0)
+	skipped := make(map[string]string)
+
+	reactors := r.router.GetReactors()
+	if targetsVal, exists := data["targets"]; exists {
+		if targetsList, ok := targetsVal.([]interface{}); ok {
+			reactors = make([]*Reactor, 0, len(targetsList))
+			for _, target := range targetsList {
+				targetID := fmt.Sprintf("%v", target)
+				reactor, found := r.router.GetReactor(targetID)
+				if !found {
+					skipped[targetID] = "reactor not registered"
+					continue
+				}
+				reactors = append(reactors, reactor)
 			}
 		}
-		
-		result := map[string]interface{}{
-			"allocated": success,
-			"resource":  resource,
-			"amount":    amount,
-		}
-		
-		if success {
-			result["allocation_id"] = allocationID
-			result["expires_at"] = time.Now().Add(time.Duration(timeout) * time.Second).Unix()
+	}
+
+	for _, reactor := range reactors {
+		if !reactor.Healthy {
+			skipped[reactor.ID] = "reactor unhealthy"
+			continue
 		}
-		
-		log.Printf("[rm:allocate] %s allocation: %v units (success: %v)", resourceStr, amount, success)
-		
-		return result, nil
-	}, PacketMetadata{
-		Timeout:         60,
-		ComplianceLevel: 1,
-		Description:     "Resource allocation",
-	})
+		healthy = append(healthy, reactor)
+	}
 
-	// rm:cleanup - Resource cleanup
-	r.RegisterPacket("rm", "cleanup", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
-		force := false
-		if forceVal, exists := data["force"]; exists {
-			if forceBool, ok := forceVal.(bool); ok {
-				force = forceBool
-			}
+	return healthy, skipped
+}
+
+// atomFromPacket builds an atom template from a packet object in {g, e, v, d, t} form
+func (r *PacketFlowRuntime) atomFromPacket(packet interface{}) (*Atom, error) {
+	packetMap, ok := packet.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("packet must be an object")
+	}
+
+	atom := &Atom{Data: make(map[string]interface{})}
+	if group, ok := packetMap["g"].(string); ok {
+		atom.Group = group
+	}
+	if element, ok := packetMap["e"].(string); ok {
+		atom.Element = element
+	}
+	if atom.Group == "" || atom.Element == "" {
+		return nil, fmt.Errorf("packet requires g and e")
+	}
+	if variant, ok := packetMap["v"].(string); ok && variant != "" {
+		atom.Variant = &variant
+	}
+	if atomData, ok := packetMap["d"].(map[string]interface{}); ok {
+		atom.Data = atomData
+	}
+	if timeoutVal, exists := packetMap["t"]; exists {
+		if timeoutFloat, ok := r.utils.toFloat64(timeoutVal); ok {
+			timeout := int(timeoutFloat)
+			atom.Timeout = &timeout
 		}
-		
-		// Mock cleanup operations
-		operations := []string{}
-		spaceFeed := 0
-		
-		// Trigger garbage collection
-		runtime.GC()
-		operations = append(operations, "garbage_collection")
-		spaceFeed += 50 // Mock freed space
-		
-		if force {
-			operations = append(operations, "force_cleanup")
-			spaceFeed += 100
+	}
+
+	return atom, nil
+}
+
+// reactorTimeout returns the per-reactor timeout, honouring a "timeout" field in seconds
+func (r *PacketFlowRuntime) reactorTimeout(data map[string]interface{}) time.Duration {
+	timeout := float64(r.config.ReactorTimeout)
+	if timeoutVal, exists := data["timeout"]; exists {
+		if timeoutFloat, ok := r.utils.toFloat64(timeoutVal); ok && timeoutFloat > 0 {
+			timeout = timeoutFloat
 		}
-		
-		log.Printf("[rm:cleanup] Cleanup completed (force: %v)", force)
-		
-		return map[string]interface{}{
-			"cleanup_complete":  true,
-			"resources_cleaned": len(operations),
-			"space_freed":       spaceFeed,
-			"operations":        operations,
-		}, nil
-	}, PacketMetadata{
-		Timeout:         120,
-		ComplianceLevel: 1,
-		Description:     "Resource cleanup and garbage collection",
-	})
+	}
+	return time.Duration(timeout * float64(time.Second))
+}
+
+// ============================================================================
+// Web Server and WebSocket Handler
+// ============================================================================
+
+// PacketFlowServer provides HTTP and WebSocket endpoints
+type PacketFlowServer struct {
+	runtime        *PacketFlowRuntime
+	messageHandler *MessageHandler
+	router         *HashRouter
+	port           int
+	upgrader       websocket.Upgrader
+	authenticator  Authenticator
+	httpServer     *http.Server
+}
+
+// NewPacketFlowServer creates a new server. Authentication is enabled when
+// the runtime config lists API keys.
+func NewPacketFlowServer(runtime *PacketFlowRuntime, port int) *PacketFlowServer {
+	server := &PacketFlowServer{
+		runtime:        runtime,
+		messageHandler: NewMessageHandler(runtime),
+		router:         runtime.router,
+		port:           port,
+		httpServer:     &http.Server{Addr: fmt.Sprintf(":%d", port)},
+	}
+	server.upgrader = websocket.Upgrader{
+		CheckOrigin:       server.checkOrigin,
+		Subprotocols:      []string{"packetflow.msgpack", "packetflow.json"},
+		EnableCompression: runtime.config.Compression,
+	}
+
+	if len(runtime.config.APIKeys) > 0 {
+		server.authenticator = NewAPIKeyAuthenticator(runtime.config.APIKeys)
+	}
+
+	return server
+}
+
+// SetAuthenticator enables authentication for atom processing endpoints;
+// nil disables it
+func (s *PacketFlowServer) SetAuthenticator(authenticator Authenticator) {
+	s.authenticator = authenticator
+}
+
+// Handler returns the HTTP handler serving all PacketFlow endpoints
+func (s *PacketFlowServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/info", s.handleInfo)
+	mux.HandleFunc("/ready", s.handleReady)
+	mux.HandleFunc("/packetflow", s.requireAuth(s.handleWebSocket))
+	mux.HandleFunc("/packets/", s.requireAuth(s.handlePackets))
+	mux.HandleFunc("/stats", s.requireAuth(s.handleStats))
+	mux.HandleFunc("/slow", s.requireAuth(s.handleSlow))
+	mux.HandleFunc("/submit", s.requireAuth(s.handleSubmit))
+	return s.withCORS(mux)
 }
 
-// ============================================================================
-// Binary Message Protocol
-// ============================================================================
+// Start starts the HTTP server; after Shutdown it returns http.ErrServerClosed
+func (s *PacketFlowServer) Start() error {
+	s.httpServer.Handler = s.Handler()
 
-// MessageHandler handles binary protocol messages
-type MessageHandler struct {
-	runtime         *PacketFlowRuntime
-	sequenceCounter int64
-	mu              sync.Mutex
+	log.Printf("🌐 Starting PacketFlow server on port %d", s.port)
+	log.Printf("📡 WebSocket endpoint: ws://localhost:%d/packetflow", s.port)
+	log.Printf("🏥 Health endpoint: http://localhost:%d/health", s.port)
+	log.Printf("🚦 Readiness endpoint: http://localhost:%d/ready", s.port)
+	log.Printf("📊 Stats endpoint: http://localhost:%d/stats", s.port)
+	log.Printf("📨 Submit endpoint: http://localhost:%d/submit", s.port)
+	log.Printf("📖 Packets endpoint: http://localhost:%d/packets/{key}", s.port)
+
+	if s.authenticator != nil {
+		log.Printf("🔐 Authentication required for atom submission, stats and slow atoms")
+	}
+
+	return s.httpServer.ListenAndServe()
 }
 
-// NewMessageHandler creates a new message handler
-func NewMessageHandler(runtime *PacketFlowRuntime) *MessageHandler {
-	return &MessageHandler{
-		runtime: runtime,
+// Shutdown stops the server gracefully within ctx: the runtime drains so
+// /ready fails, the HTTP server stops accepting requests and waits for
+// in-flight ones, then the runtime is closed
+func (s *PacketFlowServer) Shutdown(ctx context.Context) error {
+	s.runtime.Drain()
+
+	httpErr := s.httpServer.Shutdown(ctx)
+	closeErr := s.runtime.Close(ctx)
+	if httpErr != nil {
+		return fmt.Errorf("stopping HTTP server: %w", httpErr)
 	}
+	return closeErr
 }
 
-// EncodeMessage encodes a message using MessagePack
-func (h *MessageHandler) EncodeMessage(msgType string, data interface{}, options map[string]interface{}) ([]byte, error) {
-	h.mu.Lock()
-	h.sequenceCounter++
-	sequence := h.sequenceCounter
-	h.mu.Unlock()
-	
-	message := Message{
-		Version:       1,
-		Type:          h.getMessageTypeCode(msgType),
-		Sequence:      sequence,
-		Timestamp:     time.Now().Unix(),
-		SourceID:      1,
-		DestinationID: 1,
-		Data:          data,
+// checkOrigin allows requests without an Origin header, same-origin requests,
+// and origins matching the configured allow-list
+func (s *PacketFlowServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || s.runtime.config.AllowAllOrigins {
+		return true
 	}
-	
-	// Add optional fields
-	if priority, exists := options["priority"]; exists {
-		if priorityInt, ok := priority.(int); ok && priorityInt != 5 {
-			message.Priority = &priorityInt
-		}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
 	}
-	
-	if ttl, exists := options["ttl"]; exists {
-		if ttlInt, ok := ttl.(int); ok && ttlInt != 30 {
-			message.TTL = &ttlInt
+
+	for _, pattern := range s.runtime.config.AllowedOrigins {
+		if matchOrigin(pattern, origin) {
+			return true
 		}
 	}
-	
-	if cid, exists := options["correlation_id"]; exists {
-		if cidStr, ok := cid.(string); ok {
-			message.CorrelationID = &cidStr
+	return false
+}
+
+// withCORS adds CORS headers for allowed cross-origin requests and answers
+// preflight requests; disallowed origins receive no CORS headers
+func (s *PacketFlowServer) withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Add("Vary", "Origin")
+			if !s.checkOrigin(r) {
+				if r.Method == "OPTIONS" {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
 		}
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// matchOrigin matches an origin against a pattern that may contain a single
+// "*" wildcard, e.g. "https://*.example.com"; "*" alone matches any origin
+func matchOrigin(pattern, origin string) bool {
+	pattern = strings.ToLower(pattern)
+	origin = strings.ToLower(origin)
+
+	prefix, suffix, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == origin
 	}
-	
-	return msgpack.Marshal(message)
+	return len(origin) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(origin, prefix) &&
+		strings.HasSuffix(origin, suffix)
 }
 
-// DecodeMessage decodes a MessagePack message
-func (h *MessageHandler) DecodeMessage(data []byte) (*Message, error) {
-	var message Message
-	err := msgpack.Unmarshal(data, &message)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode message: %v", err)
+// requireAuth rejects requests that fail authentication with 401 before
+// they reach the wrapped handler, attaching the authenticated caller to the
+// request context. It is a no-op when no authenticator is set.
+func (s *PacketFlowServer) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.authenticator != nil {
+			caller, err := s.authenticator.Authenticate(requestToken(r))
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="packetflow"`)
+				s.writeSubmitError(w, time.Now(), "E401", err.Error())
+				return
+			}
+			ctx := context.WithValue(r.Context(), callerContextKey{}, caller)
+			if s.runtime.isReactorToken(requestToken(r)) {
+				ctx = context.WithValue(ctx, reactorPeerContextKey{}, true)
+			}
+			r = r.WithContext(ctx)
+		}
+		next(w, r)
 	}
-	return &message, nil
 }
 
-func (h *MessageHandler) getMessageTypeCode(typeName string) int {
-	types := map[string]int{
-		"submit":       1,
-		"result":       2,
-		"error":        3,
-		"ping":         4,
-		"register":     5,
-		"batch_submit": 6,
+// handleHealth handles HTTP health check requests
+func (s *PacketFlowServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	if code, exists := types[typeName]; exists {
-		return code
+
+	stats := s.runtime.GetStats()
+	report := s.runtime.Health()
+
+	health := map[string]interface{}{
+		"ok":          report.Status != HealthUnhealthy,
+		"status":      report.Status,
+		"reasons":     report.Reasons,
+		"load":        report.Load,
+		"queue":       stats.QueueDepth,
+		"uptime":      stats.Uptime.Seconds(),
+		"version":     "1.0.0",
+		"connections": stats.ConnectionCount,
+		"processed":   stats.Processed,
+		"errors":      stats.Errors,
 	}
-	return 1
+
+	// Unhealthy is 503; degraded stays 200 unless ?strict=true, with the
+	// status also exposed as a header for load balancers
+	status := http.StatusOK
+	if report.Status == HealthUnhealthy || (report.Status == HealthDegraded && r.URL.Query().Get("strict") == "true") {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("X-Health-Status", report.Status)
+	s.writeJSON(w, status, health)
 }
 
-func (h *MessageHandler) getMessageTypeName(typeCode int) string {
-	names := map[int]string{
-		1: "submit",
-		2: "result",
-		3: "error",
-		4: "ping",
-		5: "register",
-		6: "batch_submit",
-	}
-	if name, exists := names[typeCode]; exists {
-		return name
+// handleReady is the readiness probe: 200 once the runtime is ready, 503
+// while it is starting or draining
+func (s *PacketFlowServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	return "unknown"
+
+	state := s.runtime.State()
+	status := http.StatusOK
+	if state != stateNames[StateReady] {
+		status = http.StatusServiceUnavailable
+	}
+	s.writeJSON(w, status, map[string]interface{}{
+		"ready": status == http.StatusOK,
+		"state": state,
+	})
 }
 
-// HandleMessage processes an incoming binary message
-func (h *MessageHandler) HandleMessage(data []byte) ([]byte, error) {
-	message, err := h.DecodeMessage(data)
-	if err != nil {
-		return h.createErrorResponse(0, "", "E400", err.Error())
+// handleInfo handles HTTP info requests
+func (s *PacketFlowServer) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	
-	switch h.getMessageTypeName(message.Type) {
-	case "submit":
-		return h.handleSubmit(message)
-	case "ping":
-		return h.handlePing(message)
-	default:
-		return h.createErrorResponse(message.Sequence, h.getCorrelationID(message), "E501", "Message type not implemented")
+
+	s.runtime.mu.RLock()
+	packets := make([]string, 0, len(s.runtime.packets))
+	for key := range s.runtime.packets {
+		packets = append(packets, key)
+	}
+	s.runtime.mu.RUnlock()
+
+	info := map[string]interface{}{
+		"name":             s.runtime.config.ReactorID,
+		"version":          "1.0.0",
+		"protocol_version": s.runtime.config.ProtocolVersion,
+		"types":            []string{"general", "cpu_bound", "memory_bound", "io_bound"},
+		"groups":           []string{"cf", "df", "ed", "co", "rm"},
+		"packets":          packets,
+		"capacity": map[string]interface{}{
+			"max_concurrent":   s.runtime.config.MaxConcurrent,
+			"max_queue_depth":  10000,
+			"max_message_size": s.runtime.config.MaxPacketSize,
+		},
+		"features": []string{"standard_library", "binary_protocol", "hash_routing"},
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
 }
 
-func (h *MessageHandler) handleSubmit(message *Message) ([]byte, error) {
-	// Convert message data to Atom
-	atomData, ok := message.Data.(map[string]interface{})
-	if !ok {
-		return h.createErrorResponse(message.Sequence, h.getCorrelationID(message), "E400", "Invalid atom data")
+// handlePackets serves GET /packets/{key} with the packet's description;
+// GET /packets/ lists every packet key
+func (s *PacketFlowServer) handlePackets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	
-	atom := &Atom{
-		ID:      h.getStringValue(atomData, "id"),
-		Group:   h.getStringValue(atomData, "g"),
-		Element: h.getStringValue(atomData, "e"),
-		Data:    h.getMapValue(atomData, "d"),
+
+	key := strings.TrimPrefix(r.URL.Path, "/packets/")
+	if key == "" {
+		s.runtime.mu.RLock()
+		keys := make([]string, 0, len(s.runtime.packets))
+		for packetKey := range s.runtime.packets {
+			keys = append(keys, packetKey)
+		}
+		s.runtime.mu.RUnlock()
+
+		sort.Strings(keys)
+		s.writeJSON(w, http.StatusOK, map[string]interface{}{"packets": keys})
+		return
 	}
-	
-	if variant := h.getStringValue(atomData, "v"); variant != "" {
-		atom.Variant = &variant
+
+	description, exists := s.runtime.DescribePacket(key)
+	if !exists {
+		s.writeSubmitError(w, time.Now(), "E404", fmt.Sprintf("packet not found: %s", key))
+		return
 	}
-	
-	if priority := h.getIntValue(atomData, "p"); priority != 0 {
-		atom.Priority = &priority
+	s.writeJSON(w, http.StatusOK, description)
+}
+
+// handleStats handles HTTP stats requests
+func (s *PacketFlowServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+
+	stats := s.runtime.GetStats()
 	
-	if timeout := h.getIntValue(atomData, "t"); timeout != 0 {
-		atom.Timeout = &timeout
+	// Add packet-level statistics
+	entries, other := s.runtime.PacketStatsReport()
+	packetStats := make(map[string]interface{}, len(entries)+1)
+	for key, entry := range entries {
+		packet := packetStatsJSON(entry.Stats)
+		packet["compliance_level"] = entry.ComplianceLevel
+		packetStats[key] = packet
 	}
-	
-	// Process atom
-	result := h.runtime.ProcessAtom(atom)
-	
-	if result.Success {
-		return h.createResultResponse(message.Sequence, h.getCorrelationID(message), result.Data)
-	} else {
-		return h.createErrorResponse(message.Sequence, h.getCorrelationID(message), result.Error.Code, result.Error.Message)
+	if other != nil {
+		merged := packetStatsJSON(other.Stats)
+		merged["packets"] = other.Packets
+		packetStats["other"] = merged
+	}
+
+	response := map[string]interface{}{
+		"runtime": map[string]interface{}{
+			"processed":          stats.Processed,
+			"errors":             stats.Errors,
+			"error_rate_percent": stats.ErrorRate(),
+			"throughput_per_sec": stats.ThroughputPerSec,
+			"error_rate_window":  stats.ErrorRateWindow,
+			"avg_latency_ms":     stats.AvgLatency.Milliseconds(),
+			"uptime_seconds":     stats.Uptime.Seconds(),
+			"memory_bytes":       stats.MemoryUsage,
+			"packets_total":      stats.PacketsTotal,
+			"connections":        stats.ConnectionCount,
+			"active_atoms":       stats.ActiveAtoms,
+			"queue_depth":        stats.QueueDepth,
+			"abandoned_handlers": stats.AbandonedHandlers,
+			"abandoned_total":    stats.AbandonedTotal,
+			"payload_sizes":      sizeSummary(stats.PayloadSizes),
+			"result_sizes":       sizeSummary(stats.ResultSizes),
+		},
+		"packets":      packetStats,
+		"connections":  s.runtime.GetConnectionStats(),
+		"reactor_pool": s.runtime.reactorClient.PoolStats(),
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-func (h *MessageHandler) handlePing(message *Message) ([]byte, error) {
-	pingData := make(map[string]interface{})
-	if data, ok := message.Data.(map[string]interface{}); ok {
-		pingData = data
+// packetStatsJSON is a packet's entry in /stats
+func packetStatsJSON(snapshot PacketStats) map[string]interface{} {
+	return map[string]interface{}{
+		"calls":        snapshot.Calls,
+		"avg_duration": snapshot.AvgDuration.Milliseconds(),
+		"errors":       snapshot.Errors,
+		"last_called":  snapshot.LastCalled.Unix(),
+		"p50_ms":       float64(snapshot.Latency.Percentile(50)) / float64(time.Millisecond),
+		"p95_ms":       float64(snapshot.Latency.Percentile(95)) / float64(time.Millisecond),
+		"p99_ms":       float64(snapshot.Latency.Percentile(99)) / float64(time.Millisecond),
 	}
-	
+}
+
+// handleSlow lists traces of the most recent slow atoms
+func (s *PacketFlowServer) handleSlow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	response := map[string]interface{}{
-		"echo":        h.getStringValueOrDefault(pingData, "echo", "pong"),
-		"server_time": time.Now().UnixMilli(),
+		"threshold_ms": s.runtime.config.SlowAtomThreshold,
+		"atoms":        s.runtime.SlowAtoms(),
 	}
-	
-	if clientTime := h.getInt64Value(pingData, "timestamp"); clientTime != 0 {
-		response["client_time"] = clientTime
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// sizeSummary reports a size histogram with its bucket bounds and percentiles
+func sizeSummary(h SizeHistogram) map[string]interface{} {
+	return map[string]interface{}{
+		"buckets":   sizeBuckets,
+		"counts":    h.Counts,
+		"total":     h.Total,
+		"p50_bytes": h.Percentile(50),
+		"p95_bytes": h.Percentile(95),
+		"p99_bytes": h.Percentile(99),
 	}
-	
-	return h.createResultResponse(message.Sequence, h.getCorrelationID(message), response)
 }
 
-func (h *MessageHandler) createResultResponse(sequence int64, correlationID string, data interface{}) ([]byte, error) {
-	options := make(map[string]interface{})
-	if correlationID != "" {
-		options["correlation_id"] = correlationID
+// handleSubmit handles JSON atom submission over HTTP. The body is either a
+// single atom or an array of atoms processed as a batch.
+func (s *PacketFlowServer) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start := time.Now()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.runtime.config.MaxPacketSize)))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.writeSubmitError(w, start, "E413", fmt.Sprintf("request body too large (max %d bytes)", maxBytesErr.Limit))
+			return
+		}
+		s.writeSubmitError(w, start, "E400", fmt.Sprintf("failed to read request body: %v", err))
+		return
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var atoms []*Atom
+		if err := json.Unmarshal(trimmed, &atoms); err != nil {
+			s.writeSubmitError(w, start, "E400", fmt.Sprintf("invalid JSON atom batch: %v", err))
+			return
+		}
+		for i, atom := range atoms {
+			if atom == nil {
+				continue
+			}
+			if err := s.runtime.checkClientAtomID(atom); err != nil {
+				s.writeSubmitError(w, start, "E400", fmt.Sprintf("atom %d: %v", i, err))
+				return
+			}
+			if err := s.runtime.bindCaller(atom, CallerFromContext(r.Context()), fromReactorPeer(r.Context())); err != nil {
+				s.writeSubmitError(w, start, "E401", fmt.Sprintf("atom %d: %v", i, err))
+				return
+			}
+			if err := unwrapAtomBinary(atom); err != nil {
+				s.writeSubmitError(w, start, "E400", fmt.Sprintf("atom %d: %v", i, err))
+				return
+			}
+		}
+
+		// Batches always succeed at the HTTP level; each result carries its own outcome
+		results := s.runtime.ProcessBatch(atoms)
+		for i, result := range results {
+			results[i] = wrapResultBinary(result)
+		}
+		s.writeJSON(w, http.StatusOK, results)
+		return
+	}
+
+	var atom Atom
+	if err := json.Unmarshal(trimmed, &atom); err != nil {
+		s.writeSubmitError(w, start, "E400", fmt.Sprintf("invalid JSON atom: %v", err))
+		return
+	}
+	if err := s.runtime.checkClientAtomID(&atom); err != nil {
+		s.writeSubmitError(w, start, "E400", err.Error())
+		return
+	}
+	if err := s.runtime.bindCaller(&atom, CallerFromContext(r.Context()), fromReactorPeer(r.Context())); err != nil {
+		s.writeSubmitError(w, start, "E401", err.Error())
+		return
+	}
+	if err := unwrapAtomBinary(&atom); err != nil {
+		s.writeSubmitError(w, start, "E400", err.Error())
+		return
+	}
+
+	result := wrapResultBinary(s.runtime.ProcessAtom(&atom))
+	if !result.Success {
+		// E403 also covers validation failures; only permission denials are 403
+		status := httpStatusForError(result.Error.Code)
+		if errors.Is(result.Error, ErrForbidden) {
+			status = http.StatusForbidden
+		}
+		s.writeJSON(w, status, result)
+		return
+	}
+
+	body, err = json.Marshal(result)
+	if err != nil {
+		s.writeSubmitError(w, start, "E500", fmt.Sprintf("failed to encode result: %v", err))
+		return
+	}
+	s.runtime.ObserveResultSize(len(body))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(body, '\n'))
+}
+
+func (s *PacketFlowServer) writeSubmitError(w http.ResponseWriter, start time.Time, code, message string) {
+	result := &AtomResult{
+		Success: false,
+		Error: &AtomError{
+			Code:      code,
+			Message:   message,
+			Permanent: s.messageHandler.isPermanentError(code),
+		},
+		Meta: s.runtime.createResponseMeta(start, ""),
+	}
+	s.writeJSON(w, httpStatusForError(code), result)
+}
+
+func (s *PacketFlowServer) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// httpStatusForError maps PacketFlow error codes to HTTP status codes
+func httpStatusForError(code string) int {
+	statuses := map[string]int{
+		"E400": http.StatusBadRequest,
+		"E401": http.StatusUnauthorized,
+		"E402": http.StatusBadRequest,
+		"E403": http.StatusUnprocessableEntity,
+		"E404": http.StatusNotFound,
+		"E408": http.StatusGatewayTimeout,
+		"E409": http.StatusConflict,
+		"E410": http.StatusGone,
+		"E413": http.StatusRequestEntityTooLarge,
+		"E422": http.StatusUnprocessableEntity,
+		"E429": http.StatusTooManyRequests,
+		"E500": http.StatusInternalServerError,
+		"E501": http.StatusNotImplemented,
+		"E503": http.StatusServiceUnavailable,
+		"E507": http.StatusInsufficientStorage,
 	}
-	
-	response := map[string]interface{}{
-		"sequence": sequence,
-		"data":     data,
-		"timestamp": time.Now().Unix(),
+	if status, exists := statuses[code]; exists {
+		return status
 	}
-	
-	return h.EncodeMessage("result", response, options)
+	return http.StatusInternalServerError
 }
 
-func (h *MessageHandler) createErrorResponse(sequence int64, correlationID, code, message string) ([]byte, error) {
-	options := make(map[string]interface{})
-	if correlationID != "" {
-		options["correlation_id"] = correlationID
-	}
-	
-	response := map[string]interface{}{
-		"sequence": sequence,
-		"error": map[string]interface{}{
-			"code":      code,
-			"message":   message,
-			"permanent": h.isPermanentError(code),
-		},
-		"timestamp": time.Now().Unix(),
+// ClientConnection tracks a WebSocket client and its per-connection state
+type ClientConnection struct {
+	ID          string
+	Conn        *websocket.Conn
+	ConnectedAt time.Time
+	limiter     *tokenBucket
+	received    int64
+	dropped     int64
+	overflowed  int64
+	send        chan outboundFrame
+	notices     chan outboundFrame
+	done        chan struct{}
+	writerDone  chan struct{}
+	// incoming holds received messages for the dispatcher
+	incoming     chan inboundFrame
+	dispatchDone chan struct{}
+}
+
+// ConnectionStats reports per-connection counters
+type ConnectionStats struct {
+	ID          string    `json:"id"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Received    int64     `json:"received"`
+	Dropped     int64     `json:"dropped"`
+	Overflowed  int64     `json:"overflowed"`
+	Queued      int       `json:"queued"`
+}
+
+// Stats returns a snapshot of the connection counters
+func (c *ClientConnection) Stats() ConnectionStats {
+	return ConnectionStats{
+		ID:          c.ID,
+		ConnectedAt: c.ConnectedAt,
+		Received:    atomic.LoadInt64(&c.received),
+		Dropped:     atomic.LoadInt64(&c.dropped),
+		Overflowed:  atomic.LoadInt64(&c.overflowed),
+		Queued:      len(c.send),
 	}
-	
-	return h.EncodeMessage("error", response, options)
 }
 
-func (h *MessageHandler) isPermanentError(code string) bool {
-	permanentCodes := []string{"E400", "E401", "E402", "E403", "E404", "E413"}
-	for _, pc := range permanentCodes {
-		if code == pc {
-			return true
-		}
+// allow records an incoming message and reports whether it is within the rate limit
+func (c *ClientConnection) allow() bool {
+	atomic.AddInt64(&c.received, 1)
+	if c.limiter == nil || c.limiter.Allow() {
+		return true
 	}
+	atomic.AddInt64(&c.dropped, 1)
 	return false
 }
 
-func (h *MessageHandler) getCorrelationID(message *Message) string {
-	if message.CorrelationID != nil {
-		return *message.CorrelationID
-	}
-	return ""
+// tokenBucket is a token-bucket rate limiter refilled continuously at rate tokens per second
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
 }
 
-func (h *MessageHandler) getStringValue(data map[string]interface{}, key string) string {
-	if val, exists := data[key]; exists {
-		if str, ok := val.(string); ok {
-			return str
-		}
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return newCostBucket(rate, float64(burst))
+}
+
+// newCostBucket creates a bucket with a fractional capacity, used for the
+// runtime's cost budget
+func newCostBucket(rate, capacity float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  capacity,
+		tokens: capacity,
+		last:   time.Now(),
 	}
-	return ""
 }
 
-func (h *MessageHandler) getStringValueOrDefault(data map[string]interface{}, key, defaultVal string) string {
-	if val := h.getStringValue(data, key); val != "" {
-		return val
+// Allow consumes a token if one is available
+func (b *tokenBucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN consumes n tokens if that many are available. A request larger than
+// the bucket's capacity is admitted once the bucket is full, so an expensive
+// packet is delayed rather than starved.
+func (b *tokenBucket) AllowN(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens < math.Min(n, b.burst) {
+		return false
 	}
-	return defaultVal
+	b.tokens -= n
+	return true
+}
+
+// Available returns the tokens currently in the bucket
+func (b *tokenBucket) Available() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return math.Max(b.tokens, 0)
 }
 
-func (h *MessageHandler) getIntValue(data map[string]interface{}, key string) int {
-	if val, exists := data[key]; exists {
-		if intVal, ok := val.(int); ok {
-			return intVal
+// refill adds tokens for the time since the last call; the caller must hold b.mu
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// handleWebSocket handles WebSocket connections
+func (s *PacketFlowServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	connectionID := uuid.New().String()
+	log.Printf("🔗 New WebSocket connection: %s", connectionID)
+
+	if s.runtime.config.Compression {
+		if err := conn.SetCompressionLevel(s.runtime.config.CompressionLevel); err != nil {
+			log.Printf("Invalid compression level %d: %v", s.runtime.config.CompressionLevel, err)
+		}
+	}
+
+	// The negotiated subprotocol selects the binary codec; msgpack is the
+	// default. Each connection gets its own handler to track its sequence.
+	codec := s.messageHandler.codec
+	if negotiated, ok := CodecByName(strings.TrimPrefix(conn.Subprotocol(), "packetflow.")); ok {
+		codec = negotiated
+	}
+	handler := s.messageHandler.WithCodec(codec)
+	handler.caller = CallerFromContext(r.Context())
+	handler.fromReactor = fromReactorPeer(r.Context())
+
+	client := &ClientConnection{
+		ID:          connectionID,
+		Conn:        conn,
+		ConnectedAt: time.Now(),
+		send:        make(chan outboundFrame, s.runtime.config.SendQueueSize),
+		notices:     make(chan outboundFrame, 1),
+		done:        make(chan struct{}),
+		writerDone:  make(chan struct{}),
+		// Received messages wait for processing in a queue as deep as the
+		// send queue, so one connection never has more work outstanding
+		incoming:     make(chan inboundFrame, s.runtime.config.SendQueueSize),
+		dispatchDone: make(chan struct{}),
+	}
+	if s.runtime.config.RateLimit > 0 {
+		client.limiter = newTokenBucket(s.runtime.config.RateLimit, s.runtime.config.RateBurst)
+	}
+
+	// Add connection to runtime tracking
+	s.runtime.connectionsMu.Lock()
+	s.runtime.connections[connectionID] = client
+	s.runtime.connectionsMu.Unlock()
+
+	// Remove connection on close
+	defer func() {
+		s.runtime.connectionsMu.Lock()
+		delete(s.runtime.connections, connectionID)
+		s.runtime.connectionsMu.Unlock()
+		log.Printf("🔌 WebSocket connection closed: %s", connectionID)
+	}()
+
+	// All writes go through the connection's writer goroutine
+	go s.writeLoop(client)
+	defer func() {
+		close(client.done)
+		<-client.writerDone
+	}()
+
+	// Messages are processed by the dispatcher, so a slow handler never
+	// stops the connection being read
+	go s.dispatchLoop(client, handler)
+	defer func() {
+		close(client.incoming)
+		<-client.dispatchDone
+	}()
+
+	// Handle messages
+	for {
+		messageType, data, err := readFrame(conn, s.runtime.config.MaxPacketSize)
+		if err != nil {
+			if errors.Is(err, errFrameTooLarge) {
+				s.closeOversized(client, handler, messageType)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("WebSocket error: %v", err)
+			}
+			break
+		}
+
+		if !client.allow() {
+			if !s.deliverError(client, handler, messageType, data, "E429", "Rate limit exceeded") {
+				break
+			}
+			continue
 		}
-		if floatVal, ok := val.(float64); ok {
-			return int(floatVal)
+
+		// Skip work whose response could not be queued, or that would wait
+		// behind a full backlog
+		if client.queueFull() || !client.enqueue(messageType, data) {
+			if !s.overflow(client, handler, messageType, data) {
+				break
+			}
+			continue
 		}
 	}
-	return 0
 }
 
-func (h *MessageHandler) getInt64Value(data map[string]interface{}, key string) int64 {
-	if val, exists := data[key]; exists {
-		if intVal, ok := val.(int64); ok {
-			return intVal
-		}
-		if floatVal, ok := val.(float64); ok {
-			return int64(floatVal)
+// inboundFrame is a received WebSocket message waiting for the dispatcher
+type inboundFrame struct {
+	messageType int
+	data        []byte
+}
+
+// enqueue hands a message to the dispatcher without blocking, reporting
+// false when the backlog is full
+func (c *ClientConnection) enqueue(messageType int, data []byte) bool {
+	select {
+	case c.incoming <- inboundFrame{messageType: messageType, data: data}:
+		return true
+	default:
+		return false
+	}
+}
+
+// dispatchLoop processes a connection's messages in arrival order until the
+// read loop closes incoming. Once delivery closes the connection, the rest
+// of the backlog is discarded.
+func (s *PacketFlowServer) dispatchLoop(client *ClientConnection, handler *MessageHandler) {
+	defer close(client.dispatchDone)
+
+	open := true
+	for frame := range client.incoming {
+		if open {
+			open = s.dispatch(client, handler, frame)
 		}
 	}
-	return 0
 }
 
-func (h *MessageHandler) getMapValue(data map[string]interface{}, key string) map[string]interface{} {
-	if val, exists := data[key]; exists {
-		if mapVal, ok := val.(map[string]interface{}); ok {
-			return mapVal
+// dispatch processes one message and queues its response, reporting whether
+// the connection should stay open
+func (s *PacketFlowServer) dispatch(client *ClientConnection, handler *MessageHandler, frame inboundFrame) bool {
+	switch frame.messageType {
+	case websocket.BinaryMessage:
+		// Handle binary protocol message
+		response, err := handler.HandleMessage(frame.data)
+		if err != nil {
+			log.Printf("Message handling error: %v", err)
+			return true
 		}
+		return s.deliver(client, handler, websocket.BinaryMessage, response)
+	case websocket.TextMessage:
+		// Handle JSON message for testing
+		return s.handleJSONMessage(client, handler, frame.data)
 	}
-	return make(map[string]interface{})
+	return true
 }
 
-// ============================================================================
-// Hash-Based Router
-// ============================================================================
+// websocketWriteTimeout bounds a single frame write to a slow client
+const websocketWriteTimeout = 10 * time.Second
 
-// HashRouter implements consistent hash-based routing
-type HashRouter struct {
-	reactors map[string]*Reactor
-	mu       sync.RWMutex
-}
+// Send queue overflow policies
+const (
+	// SendQueueReject drops the frame and tells the client with an E429
+	SendQueueReject = "reject"
+	// SendQueueClose closes the connection with status 1013 (try again later)
+	SendQueueClose = "close"
+)
 
-// Reactor represents a processing node
-type Reactor struct {
-	ID       string   `json:"id"`
-	Name     string   `json:"name"`
-	Endpoint string   `json:"endpoint"`
-	Types    []string `json:"types"`
-	Capacity int      `json:"capacity"`
-	Load     int      `json:"load"`
-	Healthy  bool     `json:"healthy"`
+// outboundFrame is a WebSocket message waiting in a connection's send queue
+type outboundFrame struct {
+	messageType int
+	data        []byte
 }
 
-// NewHashRouter creates a new hash router
-func NewHashRouter() *HashRouter {
-	return &HashRouter{
-		reactors: make(map[string]*Reactor),
+// Send queues a frame for the connection's writer without blocking,
+// reporting false when the send queue is full
+func (c *ClientConnection) Send(messageType int, data []byte) bool {
+	select {
+	case c.send <- outboundFrame{messageType: messageType, data: data}:
+		return true
+	default:
+		return false
 	}
 }
 
-// RegisterReactor registers a new reactor
-func (hr *HashRouter) RegisterReactor(reactor *Reactor) {
-	hr.mu.Lock()
-	defer hr.mu.Unlock()
-	hr.reactors[reactor.ID] = reactor
+func (c *ClientConnection) queueFull() bool {
+	return len(c.send) == cap(c.send)
 }
 
-// Route routes an atom to an appropriate reactor
-func (hr *HashRouter) Route(atom *Atom) *Reactor {
-	hr.mu.RLock()
-	defer hr.mu.RUnlock()
-	
-	// Get candidates for the atom group
-	candidates := hr.getCandidatesForGroup(atom.Group)
-	if len(candidates) == 0 {
-		return nil
+// writeLoop writes queued frames until the connection's read loop exits,
+// then flushes what is left. Overflow notices are written ahead of queued
+// frames. A failed write closes the connection, which ends the read loop.
+func (s *PacketFlowServer) writeLoop(client *ClientConnection) {
+	defer close(client.writerDone)
+
+	for {
+		var frame outboundFrame
+		select {
+		case frame = <-client.notices:
+		default:
+			select {
+			case frame = <-client.notices:
+			case frame = <-client.send:
+			case <-client.done:
+				s.flush(client)
+				return
+			}
+		}
+
+		if !s.writeFrame(client, frame, time.Now().Add(websocketWriteTimeout)) {
+			return
+		}
 	}
-	
-	// Use simple hash based on atom ID
-	hash := hr.simpleHash(atom.ID)
-	index := hash % len(candidates)
-	
-	return candidates[index]
 }
 
-func (hr *HashRouter) getCandidatesForGroup(group string) []*Reactor {
-	var candidates []*Reactor
-	
-	// Group to reactor type mapping
-	groupTypes := map[string][]string{
-		"cf": {"cpu_bound", "general"},
-		"df": {"memory_bound", "general"},
-		"ed": {"io_bound", "general"},
-		"co": {"network_bound", "general"},
-		"mc": {"cpu_bound", "general"},
-		"rm": {"general"},
-	}
-	
-	preferredTypes, exists := groupTypes[group]
-	if !exists {
-		preferredTypes = []string{"general"}
-	}
-	
-	for _, reactor := range hr.reactors {
-		if !reactor.Healthy {
-			continue
+// flush writes frames still queued when the read loop exits, such as the
+// error and close frames for an oversized message, within one write timeout
+func (s *PacketFlowServer) flush(client *ClientConnection) {
+	deadline := time.Now().Add(websocketWriteTimeout)
+	for {
+		var frame outboundFrame
+		select {
+		case frame = <-client.notices:
+		case frame = <-client.send:
+		default:
+			return
 		}
-		
-		// Check if reactor supports any of the preferred types
-		for _, reactorType := range reactor.Types {
-			for _, preferredType := range preferredTypes {
-				if reactorType == preferredType {
-					candidates = append(candidates, reactor)
-					goto nextReactor
-				}
-			}
+		if !s.writeFrame(client, frame, deadline) {
+			return
 		}
-		nextReactor:
 	}
-	
-	return candidates
 }
 
-func (hr *HashRouter) simpleHash(str string) int {
-	hash := fnv.New32a()
-	hash.Write([]byte(str))
-	return int(hash.Sum32())
+// writeFrame writes one frame, reporting whether the writer should continue
+func (s *PacketFlowServer) writeFrame(client *ClientConnection, frame outboundFrame, deadline time.Time) bool {
+	client.Conn.SetWriteDeadline(deadline)
+	if err := s.writeMessage(client.Conn, frame.messageType, frame.data); err != nil {
+		if !errors.Is(err, websocket.ErrCloseSent) && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Write error: %v", err)
+		}
+		client.Conn.Close()
+		return false
+	}
+	return frame.messageType != websocket.CloseMessage
 }
 
-// ============================================================================
-// Web Server and WebSocket Handler
-// ============================================================================
-
-// PacketFlowServer provides HTTP and WebSocket endpoints
-type PacketFlowServer struct {
-	runtime        *PacketFlowRuntime
-	messageHandler *MessageHandler
-	router         *HashRouter
-	port           int
-	upgrader       websocket.Upgrader
+// writeMessage writes a frame, compressing it only when permessage-deflate
+// was negotiated and the payload reaches the compression threshold
+func (s *PacketFlowServer) writeMessage(conn *websocket.Conn, messageType int, data []byte) error {
+	conn.EnableWriteCompression(len(data) >= s.runtime.config.CompressionThreshold)
+	return conn.WriteMessage(messageType, data)
 }
 
-// NewPacketFlowServer creates a new server
-func NewPacketFlowServer(runtime *PacketFlowRuntime, port int) *PacketFlowServer {
-	return &PacketFlowServer{
-		runtime:        runtime,
-		messageHandler: NewMessageHandler(runtime),
-		router:         NewHashRouter(),
-		port:           port,
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true // Allow all origins for demo
-			},
-		},
+// deliver queues a response, applying the overflow policy when the send
+// queue is full. It reports whether the connection should stay open.
+func (s *PacketFlowServer) deliver(client *ClientConnection, handler *MessageHandler, messageType int, data []byte) bool {
+	if client.Send(messageType, data) {
+		return true
 	}
+	return s.overflow(client, handler, messageType, data)
 }
 
-// Start starts the HTTP server
-func (s *PacketFlowServer) Start() error {
-	http.HandleFunc("/health", s.handleHealth)
-	http.HandleFunc("/info", s.handleInfo)
-	http.HandleFunc("/packetflow", s.handleWebSocket)
-	http.HandleFunc("/stats", s.handleStats)
+// overflow applies the send queue policy for a message that cannot be
+// answered. Rejections share one pending notice slot, so a client that keeps
+// sending while its queue is full gets a single E429 until it catches up.
+func (s *PacketFlowServer) overflow(client *ClientConnection, handler *MessageHandler, messageType int, data []byte) bool {
+	atomic.AddInt64(&client.overflowed, 1)
+
+	if s.runtime.config.SendQueuePolicy == SendQueueClose {
+		const reason = "send queue full"
+		log.Printf("WebSocket connection %s closed: %s", client.ID, reason)
+		// The close frame is best effort: the writer may be stuck on the
+		// slow client, so the socket is closed regardless
+		client.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason), time.Now().Add(time.Second))
+		client.Conn.Close()
+		return false
+	}
 
-	log.Printf("🌐 Starting PacketFlow server on port %d", s.port)
-	log.Printf("📡 WebSocket endpoint: ws://localhost:%d/packetflow", s.port)
-	log.Printf("🏥 Health endpoint: http://localhost:%d/health", s.port)
-	log.Printf("📊 Stats endpoint: http://localhost:%d/stats", s.port)
+	frameType, notice, err := s.errorFrame(handler, messageType, data, "E429", "Send queue full")
+	if err != nil {
+		log.Printf("Failed to encode send queue notice: %v", err)
+		return true
+	}
+	select {
+	case client.notices <- outboundFrame{messageType: frameType, data: notice}:
+	default:
+	}
+	return true
+}
+
+// errFrameTooLarge is returned by readFrame for messages over MaxPacketSize
+var errFrameTooLarge = errors.New("frame too large")
 
-	return http.ListenAndServe(fmt.Sprintf(":%d", s.port), nil)
+// readFrame reads the next message, consuming at most limit+1 bytes of it so
+// an oversized message is rejected without being buffered. The limit is
+// enforced here rather than with SetReadLimit, which would make the
+// connection send its own close frame before the E413 could be written.
+func readFrame(conn *websocket.Conn, limit int) (int, []byte, error) {
+	messageType, reader, err := conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return messageType, nil, err
+	}
+	if len(data) > limit {
+		return messageType, nil, errFrameTooLarge
+	}
+	return messageType, data, nil
 }
 
-// handleHealth handles HTTP health check requests
-func (s *PacketFlowServer) handleHealth(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// closeOversized answers an oversized message with an E413 in the client's
+// framing, then closes the connection with the message-too-big status
+func (s *PacketFlowServer) closeOversized(client *ClientConnection, handler *MessageHandler, messageType int) {
+	reason := fmt.Sprintf("message exceeds %d byte limit", s.runtime.config.MaxPacketSize)
+	log.Printf("WebSocket frame rejected: %s", reason)
+
+	if frameType, response, err := s.errorFrame(handler, messageType, nil, "E413", reason); err == nil {
+		client.Send(frameType, response)
 	}
+	client.Send(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, reason))
+}
 
-	stats := s.runtime.GetStats()
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
+// deliverError answers a message with an error in the same framing the
+// client used, without processing the message
+func (s *PacketFlowServer) deliverError(client *ClientConnection, handler *MessageHandler, messageType int, data []byte, code, reason string) bool {
+	frameType, response, err := s.errorFrame(handler, messageType, data, code, reason)
+	if err != nil {
+		log.Printf("Failed to encode %s response: %v", code, err)
+		return true
+	}
+	return s.deliver(client, handler, frameType, response)
+}
 
-	health := map[string]interface{}{
-		"ok":          true,
-		"load":        int(float64(m.HeapInuse) / float64(m.HeapSys) * 100),
-		"queue":       0, // Would implement actual queue depth
-		"uptime":      stats.Uptime.Seconds(),
-		"version":     "1.0.0",
-		"connections": stats.ConnectionCount,
-		"processed":   stats.Processed,
-		"errors":      stats.Errors,
+// errorFrame encodes an error reply to a message: a protocol error message
+// echoing the sequence and correlation ID for binary frames, or a JSON
+// AtomResult for text frames
+func (s *PacketFlowServer) errorFrame(handler *MessageHandler, messageType int, data []byte, code, reason string) (int, []byte, error) {
+	if messageType == websocket.BinaryMessage {
+		var request *Message
+		var correlationID string
+		if message, err := handler.DecodeMessage(data); err == nil {
+			request = message
+			correlationID = handler.getCorrelationID(message)
+		}
+
+		response, err := handler.createErrorResponse(request, correlationID, code, reason)
+		return websocket.BinaryMessage, response, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(health)
+	response, err := json.Marshal(&AtomResult{
+		Success: false,
+		Error: &AtomError{
+			Code:      code,
+			Message:   reason,
+			Permanent: handler.isPermanentError(code),
+		},
+		Meta: s.runtime.createResponseMeta(time.Now(), ""),
+	})
+	return websocket.TextMessage, response, err
 }
 
-// handleInfo handles HTTP info requests
-func (s *PacketFlowServer) handleInfo(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// handleJSONMessage handles JSON messages for testing purposes, reporting
+// whether the connection should stay open
+func (s *PacketFlowServer) handleJSONMessage(client *ClientConnection, handler *MessageHandler, data []byte) bool {
+	var atom Atom
+	if err := json.Unmarshal(data, &atom); err != nil {
+		log.Printf("JSON unmarshal error: %v", err)
+		return true
 	}
 
-	s.runtime.mu.RLock()
-	packets := make([]string, 0, len(s.runtime.packets))
-	for key := range s.runtime.packets {
-		packets = append(packets, key)
+	// Process atom
+	var result *AtomResult
+	err := s.runtime.checkClientAtomID(&atom)
+	if err == nil {
+		err = s.runtime.bindCaller(&atom, handler.caller, handler.fromReactor)
+	}
+	if err == nil {
+		err = unwrapAtomBinary(&atom)
+	}
+	if err != nil {
+		result = &AtomResult{
+			Success: false,
+			Error: &AtomError{
+				Code:      atomErrorCode(err),
+				Message:   err.Error(),
+				Permanent: true,
+			},
+			Meta: s.runtime.createResponseMeta(time.Now(), ""),
+		}
+	} else {
+		result = wrapResultBinary(s.runtime.ProcessAtom(&atom))
 	}
-	s.runtime.mu.RUnlock()
 
-	info := map[string]interface{}{
-		"name":             s.runtime.config.ReactorID,
-		"version":          "1.0.0",
-		"protocol_version": s.runtime.config.ProtocolVersion,
-		"types":            []string{"general", "cpu_bound", "memory_bound", "io_bound"},
-		"groups":           []string{"cf", "df", "ed", "co", "rm"},
-		"packets":          packets,
-		"capacity": map[string]interface{}{
-			"max_concurrent":   s.runtime.config.MaxConcurrent,
-			"max_queue_depth":  10000,
-			"max_message_size": s.runtime.config.MaxPacketSize,
-		},
-		"features": []string{"standard_library", "binary_protocol", "hash_routing"},
+	// Send JSON response
+	response, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("JSON marshal error: %v", err)
+		return true
+	}
+	if result.Success {
+		s.runtime.ObserveResultSize(len(response))
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(info)
+	return s.deliver(client, handler, websocket.TextMessage, response)
 }
 
-// handleStats handles HTTP stats requests
-func (s *PacketFlowServer) handleStats(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// BinaryWrapperKey marks binary values in JSON messages: {"$binary": "<base64>"}
+// in atom data is decoded to []byte, and []byte in result data is encoded
+// the same way, so JSON clients see binary as msgpack clients do
+const BinaryWrapperKey = "$binary"
 
-	stats := s.runtime.GetStats()
-	
-	// Add packet-level statistics
-	s.runtime.mu.RLock()
-	packetStats := make(map[string]interface{})
-	for key, packet := range s.runtime.packets {
-		packetStats[key] = map[string]interface{}{
-			"calls":         packet.Stats.Calls,
-			"avg_duration":  packet.Stats.AvgDuration.Milliseconds(),
-			"errors":        packet.Stats.Errors,
-			"last_called":   packet.Stats.LastCalled.Unix(),
-			"compliance_level": packet.Metadata.ComplianceLevel,
+// unwrapAtomBinary decodes $binary wrappers in atom.Data in place
+func unwrapAtomBinary(atom *Atom) error {
+	for key, value := range atom.Data {
+		decoded, err := unwrapBinary(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s value in field %s: %v", BinaryWrapperKey, key, err)
 		}
+		atom.Data[key] = decoded
 	}
-	s.runtime.mu.RUnlock()
+	return nil
+}
 
-	response := map[string]interface{}{
-		"runtime": map[string]interface{}{
-			"processed":       stats.Processed,
-			"errors":          stats.Errors,
-			"avg_latency_ms":  stats.AvgLatency.Milliseconds(),
-			"uptime_seconds":  stats.Uptime.Seconds(),
-			"memory_bytes":    stats.MemoryUsage,
-			"packets_total":   stats.PacketsTotal,
-			"connections":     stats.ConnectionCount,
-		},
-		"packets": packetStats,
+func unwrapBinary(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if encoded, ok := v[BinaryWrapperKey]; ok && len(v) == 1 {
+			text, ok := encoded.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a base64 string")
+			}
+			return base64.StdEncoding.DecodeString(text)
+		}
+		for key, item := range v {
+			decoded, err := unwrapBinary(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = decoded
+		}
+	case []interface{}:
+		for i, item := range v {
+			decoded, err := unwrapBinary(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = decoded
+		}
 	}
+	return value, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// wrapResultBinary returns a copy of the result with []byte values in maps
+// and slices of its data replaced by $binary wrappers. Cached results share
+// Data, so the original is left untouched.
+func wrapResultBinary(result *AtomResult) *AtomResult {
+	if result == nil || result.Data == nil {
+		return result
+	}
+	wrapped := *result
+	wrapped.Data = wrapBinary(result.Data)
+	return &wrapped
 }
 
-// handleWebSocket handles WebSocket connections
-func (s *PacketFlowServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := s.upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
-		return
+func wrapBinary(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return map[string]interface{}{BinaryWrapperKey: base64.StdEncoding.EncodeToString(v)}
+	case map[string]interface{}:
+		wrapped := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			wrapped[key] = wrapBinary(item)
+		}
+		return wrapped
+	case []interface{}:
+		wrapped := make([]interface{}, len(v))
+		for i, item := range v {
+			wrapped[i] = wrapBinary(item)
+		}
+		return wrapped
 	}
-	defer conn.Close()
+	return value
+}
 
-	connectionID := uuid.New().String()
-	log.Printf("🔗 New WebSocket connection: %s", connectionID)
+// ============================================================================
+// Authentication
+// ============================================================================
 
-	// Add connection to runtime tracking
-	s.runtime.connectionsMu.Lock()
-	s.runtime.connections[connectionID] = conn
-	s.runtime.connectionsMu.Unlock()
+// ErrInvalidToken is returned when a request token is missing or unknown
+var ErrInvalidToken = errors.New("invalid or missing API token")
 
-	// Remove connection on close
-	defer func() {
-		s.runtime.connectionsMu.Lock()
-		delete(s.runtime.connections, connectionID)
-		s.runtime.connectionsMu.Unlock()
-		log.Printf("🔌 WebSocket connection closed: %s", connectionID)
-	}()
+// Authenticator validates the token presented by an HTTP or WebSocket client
+// and returns the caller it identifies
+type Authenticator interface {
+	Authenticate(token string) (*Caller, error)
+}
 
-	// Handle messages
-	for {
-		messageType, data, err := conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
-			}
-			break
-		}
+// APIKeyAuthenticator accepts a fixed set of API keys, each granting its own
+// permissions
+type APIKeyAuthenticator struct {
+	keys    [][]byte
+	callers []*Caller
+}
 
-		if messageType == websocket.BinaryMessage {
-			// Handle binary protocol message
-			response, err := s.messageHandler.HandleMessage(data)
-			if err != nil {
-				log.Printf("Message handling error: %v", err)
-				continue
-			}
+// NewAPIKeyAuthenticator creates an authenticator for the given API keys.
+// Each entry is "key" or "key:perm1|perm2"; a bare key grants no permissions.
+func NewAPIKeyAuthenticator(keys []string) *APIKeyAuthenticator {
+	auth := &APIKeyAuthenticator{}
+	for _, entry := range keys {
+		key, grants, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
 
-			if err := conn.WriteMessage(websocket.BinaryMessage, response); err != nil {
-				log.Printf("Write error: %v", err)
-				break
+		var permissions []string
+		for _, permission := range strings.Split(grants, "|") {
+			if permission = strings.TrimSpace(permission); permission != "" {
+				permissions = append(permissions, permission)
 			}
-		} else if messageType == websocket.TextMessage {
-			// Handle JSON message for testing
-			s.handleJSONMessage(conn, data)
 		}
+
+		// Callers are named by a key fingerprint so logs never carry the key
+		sum := sha256.Sum256([]byte(key))
+		auth.keys = append(auth.keys, []byte(key))
+		auth.callers = append(auth.callers, &Caller{
+			ID:          "key-" + hex.EncodeToString(sum[:6]),
+			Permissions: permissions,
+		})
 	}
+	return auth
 }
 
-// handleJSONMessage handles JSON messages for testing purposes
-func (s *PacketFlowServer) handleJSONMessage(conn *websocket.Conn, data []byte) {
-	var atom Atom
-	if err := json.Unmarshal(data, &atom); err != nil {
-		log.Printf("JSON unmarshal error: %v", err)
-		return
+// Authenticate implements Authenticator using constant-time key comparison
+func (a *APIKeyAuthenticator) Authenticate(token string) (*Caller, error) {
+	if token == "" {
+		return nil, ErrInvalidToken
+	}
+	for i, key := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(token), key) == 1 {
+			return a.callers[i], nil
+		}
 	}
+	return nil, ErrInvalidToken
+}
 
-	// Process atom
-	result := s.runtime.ProcessAtom(&atom)
+type callerContextKey struct{}
 
-	// Send JSON response
-	response, err := json.Marshal(result)
-	if err != nil {
-		log.Printf("JSON marshal error: %v", err)
-		return
-	}
+// reactorPeerContextKey marks requests authenticated with ReactorToken
+type reactorPeerContextKey struct{}
+
+// CallerFromContext returns the caller requireAuth attached to a request
+// context, or nil when the request is unauthenticated
+func CallerFromContext(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerContextKey{}).(*Caller)
+	return caller
+}
+
+// fromReactorPeer reports whether requireAuth authenticated the request with
+// ReactorToken, so its atoms' caller assertions are honoured
+func fromReactorPeer(ctx context.Context) bool {
+	peer, _ := ctx.Value(reactorPeerContextKey{}).(bool)
+	return peer
+}
 
-	if err := conn.WriteMessage(websocket.TextMessage, response); err != nil {
-		log.Printf("Write error: %v", err)
+// requestToken extracts the client token from the Authorization header
+// (optionally with a Bearer prefix) or, for WebSocket clients that cannot set
+// headers, the "token" query parameter
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+			return strings.TrimSpace(header[7:])
+		}
+		return strings.TrimSpace(header)
 	}
+	return r.URL.Query().Get("token")
 }
 
 // ============================================================================
@@ -1977,17 +11917,29 @@ func (s *PacketFlowServer) handleJSONMessage(conn *websocket.Conn, data []byte)
 
 // PipelineEngine executes linear packet pipelines
 type PipelineEngine struct {
-	runtime *PacketFlowRuntime
-	mu      sync.RWMutex
-	active  map[string]*PipelineExecution
+	runtime       *PacketFlowRuntime
+	mu            sync.RWMutex
+	active        map[string]*PipelineExecution
+	store         PipelineStore
+	maxSteps      int
+	maxInputDepth int
 }
 
+// Default pipeline limits; see PipelineEngine.SetLimits
+const (
+	DefaultMaxPipelineSteps      = 100
+	DefaultMaxPipelineInputDepth = 32
+)
+
 // Pipeline represents a linear sequence of packet operations
 type Pipeline struct {
 	ID      string                   `json:"id"`
 	Steps   []PipelineStep           `json:"steps"`
 	Timeout int                      `json:"timeout"`
 	Meta    map[string]interface{}   `json:"meta"`
+	// Caller is the identity every step runs as; checkpoints persist it
+	// separately so it is never read from pipeline JSON
+	Caller *Caller `json:"-"`
 }
 
 // PipelineStep represents a single step in a pipeline
@@ -1996,15 +11948,35 @@ type PipelineStep struct {
 	Element string                 `json:"e"`
 	Variant string                 `json:"v,omitempty"`
 	Data    map[string]interface{} `json:"d"`
+	Timeout int                    `json:"t,omitempty"`
+
+	// InputMapping builds the step's data from the previous result: each key
+	// is a data field and each value a dotted path into the result (e.g.
+	// "user.email" or "items[0].id"; "" selects the whole result). When unset
+	// the previous result is passed through as data["input"].
+	InputMapping map[string]string `json:"input_mapping,omitempty"`
 }
 
 // PipelineExecution tracks an active pipeline execution
 type PipelineExecution struct {
-	ID          string    `json:"id"`
-	PipelineID  string    `json:"pipeline_id"`
-	Started     time.Time `json:"started"`
-	CurrentStep int       `json:"current_step"`
-	Trace       []StepTrace `json:"trace"`
+	ID            string      `json:"id"`
+	PipelineID    string      `json:"pipeline_id"`
+	CorrelationID string      `json:"correlation_id"`
+	Started       time.Time   `json:"started"`
+	CurrentStep   int         `json:"current_step"`
+	Trace         []StepTrace `json:"trace"`
+	Cancelled     bool        `json:"cancelled"`
+	cancel        chan struct{}
+	onStep        func(StepTrace)
+	// priorElapsed is the run time before the current run started at
+	// resumedAt; time spent stopped between a checkpoint and Resume is excluded
+	priorElapsed time.Duration
+	resumedAt    time.Time
+}
+
+// elapsed returns how long the execution has spent running
+func (e *PipelineExecution) elapsed() time.Duration {
+	return e.priorElapsed + time.Since(e.resumedAt)
 }
 
 // StepTrace records the execution of a pipeline step
@@ -2014,41 +11986,243 @@ type StepTrace struct {
 	Duration time.Duration `json:"duration"`
 	Success  bool          `json:"success"`
 	Error    string        `json:"error,omitempty"`
+	TimedOut bool          `json:"timed_out,omitempty"`
 }
 
 // PipelineResult represents the result of pipeline execution
 type PipelineResult struct {
-	Success        bool        `json:"success"`
-	Result         interface{} `json:"result,omitempty"`
-	Error          *AtomError  `json:"error,omitempty"`
-	CompletedSteps int         `json:"completed_steps"`
-	Trace          []StepTrace `json:"trace"`
+	Success        bool          `json:"success"`
+	Result         interface{}   `json:"result,omitempty"`
+	Error          *AtomError    `json:"error,omitempty"`
+	CompletedSteps int           `json:"completed_steps"`
+	Trace          []StepTrace   `json:"trace"`
 	TotalDuration  time.Duration `json:"total_duration"`
-	PipelineID     string      `json:"pipeline_id"`
-	ExecutionID    string      `json:"execution_id"`
+	PipelineID     string        `json:"pipeline_id"`
+	ExecutionID    string        `json:"execution_id"`
+	CorrelationID  string        `json:"correlation_id"`
+	Cancelled      bool          `json:"cancelled,omitempty"`
 }
 
 // NewPipelineEngine creates a new pipeline engine
 func NewPipelineEngine(runtime *PacketFlowRuntime) *PipelineEngine {
 	return &PipelineEngine{
-		runtime: runtime,
-		active:  make(map[string]*PipelineExecution),
+		runtime:       runtime,
+		active:        make(map[string]*PipelineExecution),
+		maxSteps:      DefaultMaxPipelineSteps,
+		maxInputDepth: DefaultMaxPipelineInputDepth,
+	}
+}
+
+// SetLimits bounds the number of steps in a pipeline and the nesting depth of
+// its input; non-positive values leave the current limit unchanged
+func (pe *PipelineEngine) SetLimits(maxSteps, maxInputDepth int) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	if maxSteps > 0 {
+		pe.maxSteps = maxSteps
+	}
+	if maxInputDepth > 0 {
+		pe.maxInputDepth = maxInputDepth
+	}
+}
+
+// checkLimits rejects pipelines with too many steps or too deeply nested input
+func (pe *PipelineEngine) checkLimits(steps int, input interface{}) error {
+	pe.mu.RLock()
+	maxSteps, maxInputDepth := pe.maxSteps, pe.maxInputDepth
+	pe.mu.RUnlock()
+
+	if steps > maxSteps {
+		return fmt.Errorf("pipeline has %d steps, exceeding the maximum of %d", steps, maxSteps)
+	}
+	if exceedsDepth(input, maxInputDepth) {
+		return fmt.Errorf("pipeline input is nested deeper than %d levels", maxInputDepth)
+	}
+	return nil
+}
+
+// exceedsDepth reports whether maps and slices in value nest deeper than limit
+func exceedsDepth(value interface{}, limit int) bool {
+	if limit < 0 {
+		return true
 	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, item := range v {
+			if exceedsDepth(item, limit-1) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if exceedsDepth(item, limit-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetStore enables checkpointing of executions to the given store; nil disables it
+func (pe *PipelineEngine) SetStore(store PipelineStore) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.store = store
 }
 
 // Execute executes a pipeline with the given input
 func (pe *PipelineEngine) Execute(pipeline *Pipeline, input interface{}) *PipelineResult {
-	executionID := uuid.New().String()
+	return pe.ExecuteWithCallback(pipeline, input, nil)
+}
+
+// PipelineStream reports an execution's steps as they finish. Steps is
+// closed when the execution ends; Result then returns its outcome.
+type PipelineStream struct {
+	Steps  <-chan StepTrace
+	done   chan struct{}
+	result *PipelineResult
+}
+
+// Result blocks until the execution ends and returns its result
+func (s *PipelineStream) Result() *PipelineResult {
+	<-s.done
+	return s.result
+}
+
+// ExecuteStream runs a pipeline in the background, sending each step's trace
+// on the returned stream. The channel holds every step, so a slow reader
+// never stalls the pipeline.
+func (pe *PipelineEngine) ExecuteStream(pipeline *Pipeline, input interface{}) *PipelineStream {
+	steps := make(chan StepTrace, len(pipeline.Steps))
+	stream := &PipelineStream{Steps: steps, done: make(chan struct{})}
+
+	go func() {
+		defer close(stream.done)
+		defer close(steps)
+		stream.result = pe.ExecuteWithCallback(pipeline, input, func(trace StepTrace) {
+			steps <- trace
+		})
+	}()
+	return stream
+}
+
+// ExecuteWithCallback executes a pipeline, calling onStep with each step's
+// trace as it finishes (including a failed or skipped step). onStep runs on
+// the executing goroutine and may be nil.
+func (pe *PipelineEngine) ExecuteWithCallback(pipeline *Pipeline, input interface{}, onStep func(StepTrace)) *PipelineResult {
+	if err := pe.checkLimits(len(pipeline.Steps), input); err != nil {
+		return &PipelineResult{
+			Success:    false,
+			Error:      &AtomError{Code: "E413", Message: err.Error(), Permanent: true},
+			Trace:      []StepTrace{},
+			PipelineID: pipeline.ID,
+		}
+	}
+
+	// Every step inherits the execution's correlation ID
+	correlationID, _ := pipeline.Meta["correlation_id"].(string)
+	if correlationID == "" {
+		correlationID = uuid.New().String()
+	}
+
+	now := time.Now()
+	execution := &PipelineExecution{
+		ID:            uuid.New().String(),
+		PipelineID:    pipeline.ID,
+		CorrelationID: correlationID,
+		Started:       now,
+		Trace:         make([]StepTrace, 0),
+		onStep:        onStep,
+		resumedAt:     now,
+	}
+	pe.activate(execution)
+
+	return pe.run(pipeline, execution, input)
+}
+
+// Resume continues a checkpointed execution from the step after the last
+// one that completed, using that step's output as input. The pipeline's
+// overall timeout counts only time spent running, not the time between the
+// checkpoint and the resume.
+func (pe *PipelineEngine) Resume(executionID string) *PipelineResult {
+	pe.mu.RLock()
+	store := pe.store
+	_, running := pe.active[executionID]
+	pe.mu.RUnlock()
+
+	failed := func(code, message string) *PipelineResult {
+		return &PipelineResult{
+			Success:     false,
+			Error:       &AtomError{Code: code, Message: message, Permanent: true},
+			Trace:       []StepTrace{},
+			ExecutionID: executionID,
+		}
+	}
+	alreadyRunning := func() *PipelineResult {
+		return failed("E409", fmt.Sprintf("execution %s is already running", executionID))
+	}
+
+	if store == nil {
+		return failed("E501", "pipeline persistence is not configured")
+	}
+	if running {
+		return alreadyRunning()
+	}
+
+	checkpoint, err := store.Load(executionID)
+	if err != nil {
+		return failed("E404", fmt.Sprintf("execution %s not found: %v", executionID, err))
+	}
+	checkpoint.Pipeline.Caller = checkpoint.Caller
+
 	execution := &PipelineExecution{
-		ID:         executionID,
-		PipelineID: pipeline.ID,
-		Started:    time.Now(),
-		Trace:      make([]StepTrace, 0),
+		ID:            checkpoint.ExecutionID,
+		PipelineID:    checkpoint.Pipeline.ID,
+		CorrelationID: checkpoint.CorrelationID,
+		Started:       checkpoint.Started,
+		CurrentStep:   checkpoint.CurrentStep,
+		Trace:         checkpoint.Trace,
+		priorElapsed:  checkpoint.Elapsed,
+		resumedAt:     time.Now(),
+	}
+	if execution.Trace == nil {
+		execution.Trace = make([]StepTrace, 0)
+	}
+
+	// A concurrent Resume may have claimed the execution while this one loaded
+	if !pe.activate(execution) {
+		return alreadyRunning()
 	}
 
+	log.Printf("[pipeline] Resuming execution %s at step %d", executionID, checkpoint.CurrentStep)
+	return pe.run(checkpoint.Pipeline, execution, checkpoint.Output)
+}
+
+// activate registers execution as running, reporting false when an
+// execution with the same ID already is
+func (pe *PipelineEngine) activate(execution *PipelineExecution) bool {
 	pe.mu.Lock()
-	pe.active[executionID] = execution
-	pe.mu.Unlock()
+	defer pe.mu.Unlock()
+
+	if _, running := pe.active[execution.ID]; running {
+		return false
+	}
+	execution.cancel = make(chan struct{})
+	pe.active[execution.ID] = execution
+	return true
+}
+
+// run executes the pipeline from execution.CurrentStep, checkpointing after
+// each successful step when a store is configured. The execution must have
+// been activated.
+func (pe *PipelineEngine) run(pipeline *Pipeline, execution *PipelineExecution, input interface{}) *PipelineResult {
+	executionID := execution.ID
+	correlationID := execution.CorrelationID
+
+	pe.mu.RLock()
+	store := pe.store
+	pe.mu.RUnlock()
 
 	defer func() {
 		pe.mu.Lock()
@@ -2056,10 +12230,80 @@ func (pe *PipelineEngine) Execute(pipeline *Pipeline, input interface{}) *Pipeli
 		pe.mu.Unlock()
 	}()
 
+	tracer := pe.runtime.config.Tracer
+	traceCtx := tracer.Extract(context.Background(), traceCarrier(pipeline.Meta))
+	traceCtx, pipelineSpan := tracer.Start(traceCtx, "pipeline:"+pipeline.ID, map[string]interface{}{
+		"pipeline_id":    pipeline.ID,
+		"execution_id":   executionID,
+		"correlation_id": correlationID,
+	})
+	defer pipelineSpan.End()
+
 	result := input
-	
-	for i, step := range pipeline.Steps {
+
+	for i := execution.CurrentStep; i < len(pipeline.Steps); i++ {
+		step := pipeline.Steps[i]
+
+		// Honour cancellation between steps
+		select {
+		case <-execution.cancel:
+			trace := pe.recordStep(execution, StepTrace{
+				Step:    i,
+				Packet:  fmt.Sprintf("%s:%s", step.Group, step.Element),
+				Success: false,
+				Error:   "cancelled before execution",
+			})
+			pe.clearCheckpoint(store, executionID)
+
+			log.Printf("[pipeline] Execution %s cancelled before step %d", executionID, i)
+			return &PipelineResult{
+				Success: false,
+				Error: &AtomError{
+					Code:      "E499",
+					Message:   "pipeline execution cancelled",
+					Permanent: true,
+				},
+				CompletedSteps: i,
+				Trace:          trace,
+				TotalDuration:  execution.elapsed(),
+				PipelineID:     pipeline.ID,
+				ExecutionID:    executionID,
+				CorrelationID:  correlationID,
+				Cancelled:      true,
+			}
+		default:
+		}
+
+		// Abort once the overall pipeline budget is spent
+		if pipeline.Timeout > 0 && execution.elapsed() > time.Duration(pipeline.Timeout)*time.Second {
+			trace := pe.recordStep(execution, StepTrace{
+				Step:     i,
+				Packet:   fmt.Sprintf("%s:%s", step.Group, step.Element),
+				Success:  false,
+				Error:    "pipeline timeout exceeded before execution",
+				TimedOut: true,
+			})
+			pe.clearCheckpoint(store, executionID)
+
+			return &PipelineResult{
+				Success: false,
+				Error: &AtomError{
+					Code:      "E408",
+					Message:   fmt.Sprintf("Pipeline timeout after %ds", pipeline.Timeout),
+					Permanent: false,
+				},
+				CompletedSteps: i,
+				Trace:          trace,
+				TotalDuration:  execution.elapsed(),
+				PipelineID:     pipeline.ID,
+				ExecutionID:    executionID,
+				CorrelationID:  correlationID,
+			}
+		}
+
+		pe.mu.Lock()
 		execution.CurrentStep = i
+		pe.mu.Unlock()
 		stepStart := time.Now()
 		
 		// Create atom for this step
@@ -2068,22 +12312,63 @@ func (pe *PipelineEngine) Execute(pipeline *Pipeline, input interface{}) *Pipeli
 			Group:   step.Group,
 			Element: step.Element,
 			Data:    make(map[string]interface{}),
+			Meta:    map[string]interface{}{"correlation_id": correlationID},
+			Caller:  pipeline.Caller,
+		}
+		if deadline, ok := pipeline.Meta[DeadlineMeta]; ok {
+			atom.Meta[DeadlineMeta] = deadline
 		}
 		
 		if step.Variant != "" {
 			atom.Variant = &step.Variant
 		}
 		
+		if step.Timeout > 0 {
+			stepTimeout := step.Timeout
+			atom.Timeout = &stepTimeout
+		}
+
 		// Merge step data with previous result as input
 		for k, v := range step.Data {
 			atom.Data[k] = v
 		}
-		atom.Data["input"] = result
-		
-		// Execute step
-		stepResult := pe.runtime.ProcessAtom(atom)
+
+		var stepResult *AtomResult
+		if len(step.InputMapping) == 0 {
+			atom.Data["input"] = result
+		} else if err := pe.mapInput(atom.Data, step.InputMapping, result); err != nil {
+			stepResult = &AtomResult{
+				Success: false,
+				Error: &AtomError{
+					Code:      "E400",
+					Message:   err.Error(),
+					Permanent: true,
+				},
+			}
+		}
+
+		// Execute step in a child span; the atom span continues it via Meta
+		stepCtx, stepSpan := tracer.Start(traceCtx, fmt.Sprintf("pipeline.step:%d", i), map[string]interface{}{
+			"step":   i,
+			"packet": fmt.Sprintf("%s:%s", step.Group, step.Element),
+		})
+		carrier := make(map[string]string)
+		tracer.Inject(stepCtx, carrier)
+		for k, v := range carrier {
+			atom.Meta[k] = v
+		}
+
+		if stepResult == nil {
+			stepResult = pe.runtime.ProcessAtom(atom)
+		}
 		stepDuration := time.Since(stepStart)
 		
+		stepSpan.SetAttribute("success", stepResult.Success)
+		if stepResult.Error != nil {
+			stepSpan.RecordError(fmt.Errorf("%s: %s", stepResult.Error.Code, stepResult.Error.Message))
+		}
+		stepSpan.End()
+
 		trace := StepTrace{
 			Step:     i,
 			Packet:   fmt.Sprintf("%s:%s", step.Group, step.Element),
@@ -2093,36 +12378,99 @@ func (pe *PipelineEngine) Execute(pipeline *Pipeline, input interface{}) *Pipeli
 		
 		if !stepResult.Success {
 			trace.Error = stepResult.Error.Message
-			execution.Trace = append(execution.Trace, trace)
-			
+			trace.TimedOut = stepResult.Error.Code == "E408"
+			fullTrace := pe.recordStep(execution, trace)
+			pe.clearCheckpoint(store, executionID)
+
 			return &PipelineResult{
 				Success:        false,
 				Error:          stepResult.Error,
 				CompletedSteps: i,
-				Trace:          execution.Trace,
-				TotalDuration:  time.Since(execution.Started),
+				Trace:          fullTrace,
+				TotalDuration:  execution.elapsed(),
 				PipelineID:     pipeline.ID,
 				ExecutionID:    executionID,
+				CorrelationID:  correlationID,
 			}
 		}
-		
-		execution.Trace = append(execution.Trace, trace)
+
+		fullTrace := pe.recordStep(execution, trace)
 		result = stepResult.Data
+
+		if store != nil {
+			checkpoint := &PipelineCheckpoint{
+				ExecutionID:   executionID,
+				Pipeline:      pipeline,
+				CorrelationID: correlationID,
+				CurrentStep:   i + 1,
+				Output:        result,
+				Trace:         fullTrace,
+				Started:       execution.Started,
+				Elapsed:       execution.elapsed(),
+				UpdatedAt:     time.Now(),
+				Caller:        pipeline.Caller,
+			}
+			if err := store.Save(checkpoint); err != nil {
+				log.Printf("[pipeline] Checkpoint failed for %s at step %d: %v", executionID, i, err)
+			}
+		}
 	}
-	
+
+	pe.clearCheckpoint(store, executionID)
+
 	return &PipelineResult{
 		Success:        true,
 		Result:         result,
 		CompletedSteps: len(pipeline.Steps),
 		Trace:          execution.Trace,
-		TotalDuration:  time.Since(execution.Started),
+		TotalDuration:  execution.elapsed(),
 		PipelineID:     pipeline.ID,
 		ExecutionID:    executionID,
+		CorrelationID:  correlationID,
+	}
+}
+
+// recordStep appends a step trace, reports it to the execution's step
+// callback and returns a copy of the full trace so far
+func (pe *PipelineEngine) recordStep(execution *PipelineExecution, trace StepTrace) []StepTrace {
+	pe.mu.Lock()
+	execution.Trace = append(execution.Trace, trace)
+	fullTrace := append([]StepTrace(nil), execution.Trace...)
+	pe.mu.Unlock()
+
+	if execution.onStep != nil {
+		execution.onStep(trace)
 	}
+	return fullTrace
 }
 
-// CreatePipeline creates a new pipeline
-func (pe *PipelineEngine) CreatePipeline(id string, steps []PipelineStep, options map[string]interface{}) *Pipeline {
+// mapInput copies the mapped paths of the previous result into the step data
+func (pe *PipelineEngine) mapInput(data map[string]interface{}, mapping map[string]string, result interface{}) error {
+	for field, path := range mapping {
+		value, found := pe.runtime.utils.ExtractPath(result, path)
+		if !found {
+			return fmt.Errorf("input mapping for %q: path %q not found in previous result", field, path)
+		}
+		data[field] = value
+	}
+	return nil
+}
+
+func (pe *PipelineEngine) clearCheckpoint(store PipelineStore, executionID string) {
+	if store == nil {
+		return
+	}
+	if err := store.Delete(executionID); err != nil {
+		log.Printf("[pipeline] Failed to delete checkpoint for %s: %v", executionID, err)
+	}
+}
+
+// CreatePipeline creates a new pipeline, rejecting one with too many steps
+func (pe *PipelineEngine) CreatePipeline(id string, steps []PipelineStep, options map[string]interface{}) (*Pipeline, error) {
+	if err := pe.checkLimits(len(steps), nil); err != nil {
+		return nil, err
+	}
+
 	pipeline := &Pipeline{
 		ID:      id,
 		Steps:   steps,
@@ -2142,7 +12490,42 @@ func (pe *PipelineEngine) CreatePipeline(id string, steps []PipelineStep, option
 		}
 	}
 	
-	return pipeline
+	return pipeline, nil
+}
+
+// GetExecution returns a snapshot of an active execution
+func (pe *PipelineEngine) GetExecution(id string) (*PipelineExecution, bool) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	execution, exists := pe.active[id]
+	if !exists {
+		return nil, false
+	}
+
+	snapshot := *execution
+	snapshot.Trace = append([]StepTrace(nil), execution.Trace...)
+	snapshot.cancel = nil
+	return &snapshot, true
+}
+
+// CancelExecution signals a running execution to stop before its next step.
+// The in-flight step, if any, is allowed to finish.
+func (pe *PipelineEngine) CancelExecution(id string) error {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+
+	execution, exists := pe.active[id]
+	if !exists {
+		return fmt.Errorf("execution %s not found", id)
+	}
+	if execution.Cancelled {
+		return nil
+	}
+
+	execution.Cancelled = true
+	close(execution.cancel)
+	return nil
 }
 
 // GetActiveExecutions returns currently active pipeline executions
@@ -2157,6 +12540,463 @@ func (pe *PipelineEngine) GetActiveExecutions() map[string]*PipelineExecution {
 	return result
 }
 
+// ============================================================================
+// Pipeline Persistence
+// ============================================================================
+
+// PipelineCheckpoint is the persisted state of an in-flight pipeline execution
+type PipelineCheckpoint struct {
+	ExecutionID   string      `json:"execution_id"`
+	Pipeline      *Pipeline   `json:"pipeline"`
+	CorrelationID string      `json:"correlation_id"`
+	CurrentStep   int         `json:"current_step"`
+	Output        interface{} `json:"output"`
+	Trace         []StepTrace `json:"trace"`
+	Started       time.Time   `json:"started"`
+	// Elapsed is the run time up to the checkpoint, excluding downtime
+	Elapsed   time.Duration `json:"elapsed"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	Caller    *Caller       `json:"caller,omitempty"`
+}
+
+// ErrCheckpointNotFound is returned when a store has no checkpoint for an execution
+var ErrCheckpointNotFound = errors.New("checkpoint not found")
+
+// PipelineStore persists pipeline checkpoints so executions survive restarts.
+// CurrentStep is the index of the next step to run and Output the result of
+// the last completed step.
+type PipelineStore interface {
+	Save(checkpoint *PipelineCheckpoint) error
+	Load(executionID string) (*PipelineCheckpoint, error)
+	Delete(executionID string) error
+	List() ([]string, error)
+}
+
+// MemoryPipelineStore keeps checkpoints in memory
+type MemoryPipelineStore struct {
+	mu          sync.RWMutex
+	checkpoints map[string]PipelineCheckpoint
+}
+
+// NewMemoryPipelineStore creates an empty in-memory store
+func NewMemoryPipelineStore() *MemoryPipelineStore {
+	return &MemoryPipelineStore{
+		checkpoints: make(map[string]PipelineCheckpoint),
+	}
+}
+
+// Save stores a copy of the checkpoint
+func (s *MemoryPipelineStore) Save(checkpoint *PipelineCheckpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := *checkpoint
+	saved.Trace = append([]StepTrace(nil), checkpoint.Trace...)
+	s.checkpoints[checkpoint.ExecutionID] = saved
+	return nil
+}
+
+// Load returns a copy of the stored checkpoint
+func (s *MemoryPipelineStore) Load(executionID string) (*PipelineCheckpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	checkpoint, exists := s.checkpoints[executionID]
+	if !exists {
+		return nil, ErrCheckpointNotFound
+	}
+	checkpoint.Trace = append([]StepTrace(nil), checkpoint.Trace...)
+	return &checkpoint, nil
+}
+
+// Delete removes a checkpoint; deleting a missing checkpoint is not an error
+func (s *MemoryPipelineStore) Delete(executionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.checkpoints, executionID)
+	return nil
+}
+
+// List returns the IDs of all checkpointed executions
+func (s *MemoryPipelineStore) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]string, 0, len(s.checkpoints))
+	for id := range s.checkpoints {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// FilePipelineStore keeps one JSON file per checkpoint in a directory
+type FilePipelineStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFilePipelineStore creates a store in dir, creating the directory if needed
+func NewFilePipelineStore(dir string) (*FilePipelineStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pipeline store directory: %v", err)
+	}
+	return &FilePipelineStore{dir: dir}, nil
+}
+
+func (s *FilePipelineStore) path(executionID string) string {
+	return filepath.Join(s.dir, url.PathEscape(executionID)+".json")
+}
+
+// Save writes the checkpoint atomically via a temporary file and rename
+func (s *FilePipelineStore) Save(checkpoint *PipelineCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.path(checkpoint.ExecutionID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load reads a checkpoint from disk
+func (s *FilePipelineStore) Load(executionID string) (*PipelineCheckpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path(executionID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrCheckpointNotFound
+		}
+		return nil, err
+	}
+
+	var checkpoint PipelineCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint: %v", err)
+	}
+	return &checkpoint, nil
+}
+
+// Delete removes a checkpoint file; deleting a missing checkpoint is not an error
+func (s *FilePipelineStore) Delete(executionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.path(executionID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns the IDs of all checkpointed executions
+func (s *FilePipelineStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if id, err := url.PathUnescape(strings.TrimSuffix(name, ".json")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// ============================================================================
+// Workflow Engine
+// ============================================================================
+
+// WorkflowEngine executes directed acyclic graphs of packet operations
+type WorkflowEngine struct {
+	runtime       *PacketFlowRuntime
+	maxConcurrent int
+}
+
+// Workflow is a DAG of nodes connected by dependency edges
+type Workflow struct {
+	ID    string                 `json:"id"`
+	Nodes []WorkflowNode         `json:"nodes"`
+	Meta  map[string]interface{} `json:"meta"`
+	// Caller is the identity every node runs as
+	Caller *Caller `json:"-"`
+}
+
+// WorkflowNode is a single packet operation in a workflow. Root nodes receive
+// the workflow input as data["input"]; other nodes receive their predecessors'
+// outputs keyed by node ID in data["inputs"], and data["input"] as well when
+// they have exactly one predecessor.
+type WorkflowNode struct {
+	ID        string                 `json:"id"`
+	Group     string                 `json:"g"`
+	Element   string                 `json:"e"`
+	Variant   string                 `json:"v,omitempty"`
+	Data      map[string]interface{} `json:"d"`
+	DependsOn []string               `json:"depends_on,omitempty"`
+	Timeout   int                    `json:"t,omitempty"`
+}
+
+// NodeResult records the outcome of a workflow node
+type NodeResult struct {
+	NodeID   string        `json:"node_id"`
+	Packet   string        `json:"packet"`
+	Success  bool          `json:"success"`
+	Skipped  bool          `json:"skipped,omitempty"`
+	Data     interface{}   `json:"data,omitempty"`
+	Error    *AtomError    `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// WorkflowResult represents the result of workflow execution
+type WorkflowResult struct {
+	Success       bool                   `json:"success"`
+	Error         *AtomError             `json:"error,omitempty"`
+	Nodes         map[string]*NodeResult `json:"nodes"`
+	Order         []string               `json:"order"`
+	TotalDuration time.Duration          `json:"total_duration"`
+	WorkflowID    string                 `json:"workflow_id"`
+	ExecutionID   string                 `json:"execution_id"`
+	CorrelationID string                 `json:"correlation_id"`
+}
+
+// NewWorkflowEngine creates a new workflow engine
+func NewWorkflowEngine(runtime *PacketFlowRuntime) *WorkflowEngine {
+	return &WorkflowEngine{
+		runtime:       runtime,
+		maxConcurrent: runtime.config.FanOutWorkers,
+	}
+}
+
+// SetMaxConcurrency bounds how many independent nodes run at once
+func (we *WorkflowEngine) SetMaxConcurrency(n int) {
+	if n > 0 {
+		we.maxConcurrent = n
+	}
+}
+
+// Validate checks node IDs, dependency references and acyclicity
+func (we *WorkflowEngine) Validate(workflow *Workflow) error {
+	if len(workflow.Nodes) == 0 {
+		return fmt.Errorf("workflow %s has no nodes", workflow.ID)
+	}
+
+	graph := make(map[string][]string, len(workflow.Nodes))
+	for _, node := range workflow.Nodes {
+		if node.ID == "" {
+			return fmt.Errorf("workflow node ID is required")
+		}
+		if _, exists := graph[node.ID]; exists {
+			return fmt.Errorf("duplicate workflow node: %s", node.ID)
+		}
+		graph[node.ID] = node.DependsOn
+	}
+
+	for _, node := range workflow.Nodes {
+		for _, dep := range node.DependsOn {
+			if _, exists := graph[dep]; !exists {
+				return fmt.Errorf("node %s depends on unknown node %s", node.ID, dep)
+			}
+		}
+	}
+
+	if cycle := findDependencyCycle(graph); cycle != nil {
+		return fmt.Errorf("workflow cycle detected: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// Execute runs the workflow in topological order, executing independent nodes
+// concurrently. Nodes downstream of a failed node are skipped; independent
+// branches continue.
+func (we *WorkflowEngine) Execute(workflow *Workflow, input interface{}) *WorkflowResult {
+	started := time.Now()
+
+	correlationID, _ := workflow.Meta["correlation_id"].(string)
+	if correlationID == "" {
+		correlationID = uuid.New().String()
+	}
+
+	result := &WorkflowResult{
+		Nodes:         make(map[string]*NodeResult),
+		Order:         make([]string, 0, len(workflow.Nodes)),
+		WorkflowID:    workflow.ID,
+		ExecutionID:   uuid.New().String(),
+		CorrelationID: correlationID,
+	}
+
+	if err := we.Validate(workflow); err != nil {
+		result.Error = &AtomError{Code: "E400", Message: err.Error(), Permanent: true}
+		result.TotalDuration = time.Since(started)
+		return result
+	}
+
+	nodes := make(map[string]*WorkflowNode, len(workflow.Nodes))
+	pending := make(map[string]int, len(workflow.Nodes))
+	dependents := make(map[string][]string)
+	ready := make([]string, 0)
+	for i := range workflow.Nodes {
+		node := &workflow.Nodes[i]
+		nodes[node.ID] = node
+		pending[node.ID] = len(node.DependsOn)
+		for _, dep := range node.DependsOn {
+			dependents[dep] = append(dependents[dep], node.ID)
+		}
+		if len(node.DependsOn) == 0 {
+			ready = append(ready, node.ID)
+		}
+	}
+
+	type completion struct {
+		id     string
+		result *NodeResult
+	}
+	completed := make(chan completion)
+	running := 0
+
+	finish := func(id string, nodeResult *NodeResult) {
+		result.Nodes[id] = nodeResult
+		result.Order = append(result.Order, id)
+		for _, dependent := range dependents[id] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	for len(result.Nodes) < len(nodes) {
+		for len(ready) > 0 && running < we.maxConcurrent {
+			id := ready[0]
+			ready = ready[1:]
+			node := nodes[id]
+
+			// Skip nodes whose predecessors did not all succeed
+			var failedDep string
+			inputs := make(map[string]interface{}, len(node.DependsOn))
+			for _, dep := range node.DependsOn {
+				if !result.Nodes[dep].Success {
+					failedDep = dep
+					break
+				}
+				inputs[dep] = result.Nodes[dep].Data
+			}
+			if failedDep != "" {
+				finish(id, &NodeResult{
+					NodeID:  id,
+					Packet:  we.nodePacket(node),
+					Success: false,
+					Skipped: true,
+					Error: &AtomError{
+						Code:      "E424",
+						Message:   fmt.Sprintf("dependency %s did not succeed", failedDep),
+						Permanent: true,
+					},
+				})
+				continue
+			}
+
+			running++
+			go func(node *WorkflowNode, inputs map[string]interface{}) {
+				completed <- completion{node.ID, we.runNode(workflow, result.ExecutionID, correlationID, node, input, inputs)}
+			}(node, inputs)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		c := <-completed
+		running--
+		finish(c.id, c.result)
+	}
+
+	result.Success = true
+	for _, nodeResult := range result.Nodes {
+		if !nodeResult.Success {
+			result.Success = false
+			break
+		}
+	}
+	if !result.Success {
+		result.Error = &AtomError{
+			Code:      "E500",
+			Message:   "one or more workflow nodes failed",
+			Permanent: false,
+		}
+	}
+
+	result.TotalDuration = time.Since(started)
+	return result
+}
+
+func (we *WorkflowEngine) runNode(workflow *Workflow, executionID, correlationID string, node *WorkflowNode, input interface{}, inputs map[string]interface{}) *NodeResult {
+	start := time.Now()
+
+	atom := &Atom{
+		ID:      fmt.Sprintf("%s_node_%s_%s", workflow.ID, node.ID, executionID),
+		Group:   node.Group,
+		Element: node.Element,
+		Data:    make(map[string]interface{}),
+		Meta:    map[string]interface{}{"correlation_id": correlationID},
+		Caller:  workflow.Caller,
+	}
+	if deadline, ok := workflow.Meta[DeadlineMeta]; ok {
+		atom.Meta[DeadlineMeta] = deadline
+	}
+	if node.Variant != "" {
+		atom.Variant = &node.Variant
+	}
+	if node.Timeout > 0 {
+		timeout := node.Timeout
+		atom.Timeout = &timeout
+	}
+
+	for k, v := range node.Data {
+		atom.Data[k] = v
+	}
+	switch len(node.DependsOn) {
+	case 0:
+		atom.Data["input"] = input
+	case 1:
+		atom.Data["input"] = inputs[node.DependsOn[0]]
+		atom.Data["inputs"] = inputs
+	default:
+		atom.Data["inputs"] = inputs
+	}
+
+	atomResult := we.runtime.ProcessAtom(atom)
+	return &NodeResult{
+		NodeID:   node.ID,
+		Packet:   we.nodePacket(node),
+		Success:  atomResult.Success,
+		Data:     atomResult.Data,
+		Error:    atomResult.Error,
+		Duration: time.Since(start),
+	}
+}
+
+func (we *WorkflowEngine) nodePacket(node *WorkflowNode) string {
+	return we.runtime.makePacketKey(node.Group, node.Element, node.Variant)
+}
+
 // ============================================================================
 // Demo and Testing Functions
 // ============================================================================
@@ -2322,10 +13162,14 @@ func demonstratePacketFlowGo() {
 		{Group: "df", Element: "transform", Data: map[string]interface{}{"operation": "lowercase"}},
 		{Group: "ed", Element: "signal", Data: map[string]interface{}{"event": "user.validated"}},
 	}
-	pipeline := pipelineEngine.CreatePipeline("user_onboarding", steps, nil)
-	pipelineResult := pipelineEngine.Execute(pipeline, "USER@EXAMPLE.COM")
-	fmt.Printf("✓ Pipeline execution result: Success=%v, Steps=%d, Duration=%v\n", 
-		pipelineResult.Success, pipelineResult.CompletedSteps, pipelineResult.TotalDuration)
+	pipeline, err := pipelineEngine.CreatePipeline("user_onboarding", steps, nil)
+	if err != nil {
+		fmt.Printf("✗ Pipeline creation failed: %v\n", err)
+	} else {
+		pipelineResult := pipelineEngine.Execute(pipeline, "USER@EXAMPLE.COM")
+		fmt.Printf("✓ Pipeline execution result: Success=%v, Steps=%d, Duration=%v\n",
+			pipelineResult.Success, pipelineResult.CompletedSteps, pipelineResult.TotalDuration)
+	}
 
 	fmt.Println()
 	fmt.Println("--- Testing Binary Message Handling ---")
@@ -2359,7 +13203,7 @@ func demonstratePacketFlowGo() {
 	fmt.Printf("Runtime Statistics:\n")
 	fmt.Printf("  Packets processed: %d\n", stats.Processed)
 	fmt.Printf("  Average latency: %v\n", stats.AvgLatency)
-	fmt.Printf("  Error rate: %.2f%%\n", float64(stats.Errors)/float64(stats.Processed)*100)
+	fmt.Printf("  Error rate: %.2f%%\n", stats.ErrorRate())
 	fmt.Printf("  Packets registered: %d\n", stats.PacketsTotal)
 	fmt.Printf("  Memory usage: %d bytes\n", stats.MemoryUsage)
 	fmt.Printf("  Uptime: %v\n", stats.Uptime)
@@ -2395,8 +13239,83 @@ func main() {
 		MaxConcurrent:   1000,
 	}
 	
+	// API_KEYS lists comma-separated "key" or "key:perm1|perm2" entries
+	if apiKeys := os.Getenv("API_KEYS"); apiKeys != "" {
+		config.APIKeys = strings.Split(apiKeys, ",")
+	}
+	// REACTOR_TOKEN authenticates this reactor to its peers
+	config.ReactorToken = os.Getenv("REACTOR_TOKEN")
+
+	if origins := os.Getenv("ALLOWED_ORIGINS"); origins != "" {
+		for _, origin := range strings.Split(origins, ",") {
+			config.AllowedOrigins = append(config.AllowedOrigins, strings.TrimSpace(origin))
+		}
+	}
+
+	config.PluginDir = os.Getenv("PLUGIN_DIR")
+	config.Compression = os.Getenv("WS_COMPRESSION") == "true"
+
+	// RANDOM_SEED makes transform randomness repeatable, for test runs only
+	if seedStr := os.Getenv("RANDOM_SEED"); seedStr != "" {
+		seed, err := strconv.ParseUint(seedStr, 10, 64)
+		if err != nil {
+			log.Fatalf("Invalid RANDOM_SEED: %v", err)
+		}
+		config.RandSource = NewSeededRandSource(seed)
+	}
+
 	runtime := NewPacketFlowRuntime(config)
-	
+
+	if recordPath := os.Getenv("RECORD_FILE"); recordPath != "" {
+		recorder, err := NewTrafficRecorder(recordPath, 0, 0)
+		if err != nil {
+			log.Fatalf("Recording failed to start: %v", err)
+		}
+		defer recorder.Close()
+		runtime.SetRecorder(recorder)
+	}
+
+	// STATS_FILE carries cumulative stats across restarts; it is rewritten
+	// every 30 seconds
+	if statsPath := os.Getenv("STATS_FILE"); statsPath != "" {
+		if saved, err := os.ReadFile(statsPath); err == nil {
+			if err := runtime.ImportStats(saved); err != nil {
+				log.Printf("⚠️  Ignoring saved stats: %v", err)
+			}
+		} else if !os.IsNotExist(err) {
+			log.Printf("⚠️  Reading saved stats failed: %v", err)
+		}
+		runtime.ScheduleEvery(30*time.Second, func() {
+			data, err := runtime.ExportStats()
+			if err == nil {
+				err = os.WriteFile(statsPath, data, 0644)
+			}
+			if err != nil {
+				log.Printf("⚠️  Saving stats failed: %v", err)
+			}
+		})
+	}
+
+	if registryURL := os.Getenv("REACTOR_REGISTRY_URL"); registryURL != "" {
+		runtime.WatchDiscovery(NewHTTPDiscovery(registryURL, DefaultDiscoveryInterval))
+	}
+
+	// SIGHUP re-scans the plugin directory
+	if config.PluginDir != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				count, err := runtime.ReloadPlugins()
+				if err != nil {
+					log.Printf("⚠️  Plugin reload failed: %v", err)
+					continue
+				}
+				log.Printf("🔄 Plugin reload registered %d packets", count)
+			}
+		}()
+	}
+
 	port := 8443
 	if portStr := os.Getenv("PORT"); portStr != "" {
 		if p, err := strconv.Atoi(portStr); err == nil {
@@ -2407,8 +13326,27 @@ func main() {
 	server := NewPacketFlowServer(runtime, port)
 	
 	log.Printf("🚀 PacketFlow v1.0 Go Server starting...")
-	if err := server.Start(); err != nil {
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Start()
+	}()
+
+	// SIGINT and SIGTERM drain the runtime, stop the HTTP server and close
+	// the runtime, waiting up to 30 seconds for in-flight work
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-served:
+		runtime.Close(context.Background())
 		log.Fatalf("Server failed to start: %v", err)
+	case sig := <-stop:
+		log.Printf("🛑 Received %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("⚠️  Shutdown incomplete: %v", err)
+		}
 	}
 }
 
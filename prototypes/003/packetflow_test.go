@@ -0,0 +1,9708 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"plugin"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestRuntime creates a runtime that is closed when the test ends
+func newTestRuntime(t *testing.T, config RuntimeConfig) *PacketFlowRuntime {
+	t.Helper()
+	if config.ReactorID == "" {
+		config.ReactorID = "test-reactor"
+	}
+	r := NewPacketFlowRuntime(config)
+	t.Cleanup(func() {
+		r.Close(context.Background())
+	})
+	return r
+}
+
+var testAtomSeq int64
+
+// runAtom processes a g:e atom with a fresh ID
+func runAtom(r *PacketFlowRuntime, group, element string, data map[string]interface{}) *AtomResult {
+	return r.ProcessAtom(&Atom{
+		ID:      newTestAtomID(),
+		Group:   group,
+		Element: element,
+		Data:    data,
+	})
+}
+
+func newTestAtomID() string {
+	return "test_" + strconv.FormatInt(atomic.AddInt64(&testAtomSeq, 1), 10)
+}
+
+// resultMap returns a successful result's data as a map
+func resultMap(t *testing.T, result *AtomResult) map[string]interface{} {
+	t.Helper()
+	if !result.Success {
+		t.Fatalf("atom failed: %+v", result.Error)
+	}
+	data, ok := result.Data.(map[string]interface{})
+	if !ok {
+		t.Fatalf("result data is %T, want map", result.Data)
+	}
+	return data
+}
+
+// newReactorServer starts an HTTP reactor answering each submitted atom with handle
+func newReactorServer(t *testing.T, handle func(atom *Atom) *AtomResult) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var atom Atom
+		if err := json.NewDecoder(req.Body).Decode(&atom); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(handle(&atom))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// mustRegister registers a packet, failing the test on error
+func mustRegister(t *testing.T, r *PacketFlowRuntime, group, element, variant string, handler PacketHandler, metadata PacketMetadata) {
+	t.Helper()
+	if err := r.RegisterPacket(group, element, variant, handler, metadata); err != nil {
+		t.Fatalf("registering %s:%s: %v", group, element, err)
+	}
+}
+
+// newTestServer serves a runtime's HTTP endpoints
+func newTestServer(t *testing.T, r *PacketFlowRuntime) (*PacketFlowServer, *httptest.Server) {
+	t.Helper()
+	server := NewPacketFlowServer(r, 0)
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+// postJSON posts body to url, decoding the JSON response into out
+func postJSON(t *testing.T, url, token, body string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decoding response: %v", err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func registerReactor(r *PacketFlowRuntime, id, endpoint string) {
+	r.router.RegisterReactor(&Reactor{ID: id, Endpoint: endpoint, Types: []string{"cf", "df", "ed", "co", "rm"}, Healthy: true})
+}
+
+// ============================================================================
+// Collective packets
+// ============================================================================
+
+func TestBroadcastFansOutToReactors(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+
+	var received int64
+	ok := newReactorServer(t, func(atom *Atom) *AtomResult {
+		atomic.AddInt64(&received, 1)
+		if atom.Group != "ed" || atom.Element != "signal" {
+			t.Errorf("reactor got %s:%s, want ed:signal", atom.Group, atom.Element)
+		}
+		if atom.Data["event"] != "deploy" || atom.Data["payload"] != "hello" {
+			t.Errorf("reactor got data %v", atom.Data)
+		}
+		return &AtomResult{Success: true, Data: "ack"}
+	})
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	registerReactor(r, "r1", ok.URL)
+	registerReactor(r, "r2", ok.URL)
+	registerReactor(r, "r3", failing.URL)
+	r.router.RegisterReactor(&Reactor{ID: "r4", Endpoint: ok.URL, Healthy: false})
+
+	data := resultMap(t, runAtom(r, "co", "broadcast", map[string]interface{}{"message": "hello", "event": "deploy"}))
+	summary := data["summary"].(map[string]interface{})
+	if summary["total"] != 4 || summary["successful"] != 2 || summary["failed"] != 2 || summary["skipped"] != 1 {
+		t.Fatalf("summary = %v", summary)
+	}
+	if received != 2 {
+		t.Fatalf("healthy reactors received %d atoms, want 2", received)
+	}
+
+	responses := data["responses"].(map[string]interface{})
+	if resp := responses["r1"].(map[string]interface{}); resp["success"] != true || resp["data"] != "ack" {
+		t.Errorf("r1 response = %v", resp)
+	}
+	if resp := responses["r3"].(map[string]interface{}); resp["success"] != false || resp["error"] == nil {
+		t.Errorf("failing reactor response = %v", resp)
+	}
+	if resp := responses["r4"].(map[string]interface{}); resp["success"] != false {
+		t.Errorf("unhealthy reactor response = %v", resp)
+	}
+}
+
+func TestBroadcastIsConcurrentWithPerReactorTimeout(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+
+	slow := newReactorServer(t, func(atom *Atom) *AtomResult {
+		time.Sleep(150 * time.Millisecond)
+		return &AtomResult{Success: true}
+	})
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	for _, id := range []string{"r1", "r2", "r3", "r4"} {
+		registerReactor(r, id, slow.URL)
+	}
+	registerReactor(r, "hung", hung.URL)
+
+	start := time.Now()
+	data := resultMap(t, runAtom(r, "co", "broadcast", map[string]interface{}{"message": "hi", "timeout": 0.4}))
+	elapsed := time.Since(start)
+
+	// Sequential delivery would take at least 4 x 150ms plus the timeout
+	if elapsed > time.Second {
+		t.Fatalf("broadcast took %v, want concurrent delivery", elapsed)
+	}
+	summary := data["summary"].(map[string]interface{})
+	if summary["successful"] != 4 || summary["failed"] != 1 {
+		t.Fatalf("summary = %v", summary)
+	}
+	resp := data["responses"].(map[string]interface{})["hung"].(map[string]interface{})
+	if code := resp["error"].(map[string]interface{})["code"]; code != "E408" {
+		t.Fatalf("hung reactor error code = %v, want E408", code)
+	}
+}
+
+func TestGatherCollectsFromAllReactors(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+
+	reactor := newReactorServer(t, func(atom *Atom) *AtomResult {
+		return &AtomResult{Success: true, Data: map[string]interface{}{"packet": atom.Group + ":" + atom.Element, "n": atom.Data["n"]}}
+	})
+	for _, id := range []string{"r1", "r2", "r3"} {
+		registerReactor(r, id, reactor.URL)
+	}
+
+	data := resultMap(t, runAtom(r, "co", "gather", map[string]interface{}{
+		"packet": map[string]interface{}{"g": "rm", "e": "monitor", "d": map[string]interface{}{"n": 7.0}},
+	}))
+	summary := data["summary"].(map[string]interface{})
+	if summary["total_sent"] != 3 || summary["successful"] != 3 || summary["cancelled"] != 0 {
+		t.Fatalf("summary = %v", summary)
+	}
+	results := data["results"].([]map[string]interface{})
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for _, result := range results {
+		payload := result["data"].(map[string]interface{})
+		if payload["packet"] != "rm:monitor" || payload["n"] != 7.0 {
+			t.Errorf("result = %v", result)
+		}
+	}
+}
+
+func TestGatherReturnsOnceQuorumIsMet(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+
+	fast := newReactorServer(t, func(atom *Atom) *AtomResult {
+		return &AtomResult{Success: true, Data: "fast"}
+	})
+	release := make(chan struct{})
+	straggler := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer straggler.Close()
+	defer close(release)
+
+	registerReactor(r, "a", fast.URL)
+	registerReactor(r, "b", fast.URL)
+	registerReactor(r, "slow", straggler.URL)
+
+	start := time.Now()
+	data := resultMap(t, runAtom(r, "co", "gather", map[string]interface{}{
+		"packet": map[string]interface{}{"g": "cf", "e": "ping"},
+		"quorum": 2,
+	}))
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("gather took %v, want early return at quorum", elapsed)
+	}
+	summary := data["summary"].(map[string]interface{})
+	if summary["successful"] != 2 || summary["quorum_met"] != true || summary["cancelled"] != 1 {
+		t.Fatalf("summary = %v", summary)
+	}
+}
+
+func TestScatterGatherMergeStrategies(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+
+	reactor := newReactorServer(t, func(atom *Atom) *AtomResult {
+		if atom.Data["fail"] == true {
+			return &AtomResult{Success: false, Error: &AtomError{Code: "E500", Message: "shard failed"}}
+		}
+		return &AtomResult{Success: true, Data: atom.Data["items"]}
+	})
+	registerReactor(r, "r1", reactor.URL)
+	registerReactor(r, "r2", reactor.URL)
+	registerReactor(r, "r3", reactor.URL)
+
+	shards := func() map[string]interface{} {
+		return map[string]interface{}{
+			"r1": map[string]interface{}{"g": "df", "e": "filter", "d": map[string]interface{}{"items": []interface{}{"a", "b"}}},
+			"r2": map[string]interface{}{"g": "df", "e": "filter", "d": map[string]interface{}{"items": []interface{}{"c"}}},
+			"r3": map[string]interface{}{"g": "df", "e": "filter", "d": map[string]interface{}{"fail": true}},
+		}
+	}
+
+	keyed := resultMap(t, runAtom(r, "co", "scatter_gather", map[string]interface{}{"shards": shards()}))
+	merged := keyed["merged"].(map[string]interface{})
+	if len(merged) != 2 || len(merged["r1"].([]interface{})) != 2 || len(merged["r2"].([]interface{})) != 1 {
+		t.Fatalf("keyed merge = %v", merged)
+	}
+	if summary := keyed["summary"].(map[string]interface{}); summary["successful"] != 2 || summary["failed"] != 1 {
+		t.Fatalf("summary = %v", summary)
+	}
+	failed := keyed["shards"].(map[string]interface{})["r3"].(map[string]interface{})
+	if failed["success"] != false {
+		t.Fatalf("failing shard = %v", failed)
+	}
+
+	concat := resultMap(t, runAtom(r, "co", "scatter_gather", map[string]interface{}{"shards": shards(), "merge": "concat"}))
+	items := concat["merged"].([]interface{})
+	if len(items) != 3 || items[0] != "a" || items[1] != "b" || items[2] != "c" {
+		t.Fatalf("concat merge = %v", items)
+	}
+
+	if result := runAtom(r, "co", "scatter_gather", map[string]interface{}{"shards": shards(), "merge": "zip"}); result.Success {
+		t.Fatal("unknown merge strategy was accepted")
+	}
+}
+
+// ============================================================================
+// Batch submission
+// ============================================================================
+
+func TestProcessBatchKeepsOrderAndIsolatesFailures(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "echo", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		if data["fail"] == true {
+			return nil, fmt.Errorf("validation failed: asked to fail")
+		}
+		return data["n"], nil
+	}, PacketMetadata{})
+
+	atoms := make([]*Atom, 6)
+	for i := range atoms {
+		atoms[i] = &Atom{ID: newTestAtomID(), Group: "tt", Element: "echo", Data: map[string]interface{}{"n": i, "fail": i%3 == 1}}
+	}
+	results := r.ProcessBatch(atoms)
+	if len(results) != len(atoms) {
+		t.Fatalf("got %d results, want %d", len(results), len(atoms))
+	}
+	for i, result := range results {
+		if i%3 == 1 {
+			if result.Success || result.Error == nil {
+				t.Errorf("atom %d succeeded, want failure", i)
+			}
+			continue
+		}
+		if !result.Success || result.Data != i {
+			t.Errorf("atom %d = %+v, want data %d", i, result, i)
+		}
+	}
+}
+
+func TestProcessBatchBoundsConcurrency(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 3})
+
+	var running, peak int64
+	mustRegister(t, r, "tt", "slow", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			old := atomic.LoadInt64(&peak)
+			if n <= old || atomic.CompareAndSwapInt64(&peak, old, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&running, -1)
+		return nil, nil
+	}, PacketMetadata{})
+
+	atoms := make([]*Atom, 12)
+	for i := range atoms {
+		atoms[i] = &Atom{ID: newTestAtomID(), Group: "tt", Element: "slow"}
+	}
+	for i, result := range r.ProcessBatch(atoms) {
+		if !result.Success {
+			t.Fatalf("atom %d failed: %+v", i, result.Error)
+		}
+	}
+	if peak > 3 || peak < 2 {
+		t.Fatalf("peak concurrency = %d, want 2-3", peak)
+	}
+}
+
+func TestBatchSubmitMessage(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+
+	request, err := handler.EncodeMessage("batch_submit", []interface{}{
+		map[string]interface{}{"id": "b1", "g": "cf", "e": "ping"},
+		map[string]interface{}{"id": "b2", "g": "cf", "e": "missing"},
+		map[string]interface{}{"id": "b3", "g": "df", "e": "transform", "d": map[string]interface{}{"input": "abc", "operation": "uppercase"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := handler.HandleMessage(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := handler.DecodeMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := handler.getMessageTypeName(message.Type); name != "result" {
+		t.Fatalf("response type = %s, want result", name)
+	}
+
+	results := message.Data.(map[string]interface{})["data"].([]interface{})
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	for i, want := range []bool{true, false, true} {
+		if got := results[i].(map[string]interface{})["success"]; got != want {
+			t.Errorf("result %d success = %v, want %v", i, got, want)
+		}
+	}
+	if data := results[2].(map[string]interface{})["data"].(map[string]interface{}); data["result"] != "ABC" {
+		t.Errorf("transform result = %v, want ABC", data)
+	}
+}
+
+// ============================================================================
+// HTTP submission
+// ============================================================================
+
+func TestSubmitEndpoint(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	_, server := newTestServer(t, r)
+
+	var result AtomResult
+	status := postJSON(t, server.URL+"/submit", "", `{"id":"h1","g":"df","e":"transform","d":{"input":"hi","operation":"uppercase"}}`, &result)
+	if status != http.StatusOK || !result.Success {
+		t.Fatalf("submit = %d %+v", status, result)
+	}
+	if data := result.Data.(map[string]interface{}); data["result"] != "HI" {
+		t.Fatalf("result data = %v", data)
+	}
+	if result.Meta["correlation_id"] == nil {
+		t.Fatal("result Meta has no correlation_id")
+	}
+
+	result = AtomResult{}
+	if status := postJSON(t, server.URL+"/submit", "", `{"id":"h2","g":"cf","e":"nope"}`, &result); status != http.StatusNotFound || result.Error.Code != "E404" {
+		t.Fatalf("unknown packet = %d %+v", status, result.Error)
+	}
+	result = AtomResult{}
+	if status := postJSON(t, server.URL+"/submit", "", `{"id":`, &result); status != http.StatusBadRequest || result.Error.Code != "E400" {
+		t.Fatalf("malformed body = %d %+v", status, result.Error)
+	}
+
+	var results []AtomResult
+	status = postJSON(t, server.URL+"/submit", "", `[{"id":"h3","g":"cf","e":"ping"},{"id":"h4","g":"cf","e":"nope"}]`, &results)
+	if status != http.StatusOK || len(results) != 2 || !results[0].Success || results[1].Success {
+		t.Fatalf("batch = %d %+v", status, results)
+	}
+
+	resp, err := http.Get(server.URL + "/submit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /submit = %d, want 405", resp.StatusCode)
+	}
+}
+
+// ============================================================================
+// Binary protocol
+// ============================================================================
+
+func TestChecksumDetectsFlippedByte(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for _, codec := range []Codec{MsgpackCodec{}, JSONCodec{}} {
+		handler := NewMessageHandler(r).WithCodec(codec)
+		frame, err := handler.EncodeMessage("ping", map[string]interface{}{"echo": "hello"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := handler.DecodeMessage(frame); err != nil {
+			t.Fatalf("%s: intact frame: %v", codec.Name(), err)
+		}
+
+		for _, i := range []int{len(frame) / 2, len(frame) - 1} {
+			corrupted := append([]byte(nil), frame...)
+			corrupted[i] ^= 0x01
+			if _, err := handler.DecodeMessage(corrupted); !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("%s: byte %d flipped: err = %v, want ErrChecksumMismatch", codec.Name(), i, err)
+			}
+		}
+
+		corrupted := append([]byte(nil), frame...)
+		corrupted[len(frame)/2] ^= 0x01
+		response, err := handler.HandleMessage(corrupted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := handler.DecodeMessage(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := message.Data.(map[string]interface{})["error"].(map[string]interface{})["code"]
+		if code != "E422" {
+			t.Errorf("%s: corrupted frame answered with %v, want E422", codec.Name(), code)
+		}
+	}
+}
+
+func TestVersion1PeersGetVersion1Replies(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+
+	request, err := handler.EncodeMessage("ping", map[string]interface{}{"echo": "v1"}, map[string]interface{}{"version": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := handler.HandleMessage(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A version 1 peer decodes the frame as-is, with no checksum trailer
+	var reply Message
+	if err := json.Unmarshal(response, &reply); err != nil {
+		t.Fatalf("v1 peer cannot decode reply: %v", err)
+	}
+	if reply.Version != 1 {
+		t.Fatalf("reply version = %d, want 1", reply.Version)
+	}
+
+	request, err = handler.EncodeMessage("ping", map[string]interface{}{"echo": "v2"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = handler.HandleMessage(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := handler.DecodeMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.Version != MessageVersion {
+		t.Fatalf("reply version = %d, want %d", message.Version, MessageVersion)
+	}
+	if json.Unmarshal(response, &reply) == nil {
+		t.Fatal("v2 reply has no checksum trailer")
+	}
+}
+
+// encodeFrame encodes message as a version 2 frame with its checksum trailer
+func encodeFrame(t *testing.T, codec Codec, message Message) []byte {
+	t.Helper()
+	message.Version = MessageVersion
+	encoded, err := codec.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.AppendUint32(encoded, crc32.ChecksumIEEE(encoded))
+}
+
+// replyError decodes a reply frame, returning its error code or "" for results
+func replyError(t *testing.T, handler *MessageHandler, response []byte) string {
+	t.Helper()
+	message, err := handler.DecodeMessage(response)
+	if err != nil {
+		t.Fatalf("decoding reply: %v", err)
+	}
+	if handler.getMessageTypeName(message.Type) == "result" {
+		return ""
+	}
+	errData := message.Data.(map[string]interface{})["error"].(map[string]interface{})
+	return errData["code"].(string)
+}
+
+func TestExpiredMessagesAreRejected(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ClockSkew: 2})
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+	ttl := 5
+
+	cases := []struct {
+		name string
+		age  time.Duration
+		want string
+	}{
+		{"fresh", 0, ""},
+		{"within skew", 6 * time.Second, ""},
+		{"expired", 10 * time.Second, "E410"},
+	}
+	for _, tc := range cases {
+		frame := encodeFrame(t, JSONCodec{}, Message{
+			Type:      handler.getMessageTypeCode("ping"),
+			Timestamp: time.Now().Add(-tc.age).Unix(),
+			TTL:       &ttl,
+			Data:      map[string]interface{}{},
+		})
+		response, err := handler.HandleMessage(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := replyError(t, handler, response); code != tc.want {
+			t.Errorf("%s: reply code = %q, want %q", tc.name, code, tc.want)
+		}
+	}
+}
+
+// ============================================================================
+// Priority scheduling
+// ============================================================================
+
+// waitFor polls cond until it holds or a second passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// registerGate registers tt:gate, which blocks until release is closed
+func registerGate(t *testing.T, r *PacketFlowRuntime) (release chan struct{}) {
+	release = make(chan struct{})
+	mustRegister(t, r, "tt", "gate", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		<-release
+		return nil, nil
+	}, PacketMetadata{})
+	return release
+}
+
+func TestHigherPriorityAtomsAreDequeuedFirst(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 1})
+	release := registerGate(t, r)
+
+	var mu sync.Mutex
+	var order []int
+	mustRegister(t, r, "tt", "record", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		mu.Lock()
+		order = append(order, DataAccessor(data).GetInt("priority", 0))
+		mu.Unlock()
+		return nil, nil
+	}, PacketMetadata{})
+
+	// Hold the only slot so every later atom queues
+	go runAtom(r, "tt", "gate", nil)
+	waitFor(t, "gate to start", func() bool { return r.GetStats().QueueDepth == 0 && r.currentLoad() >= 100 })
+
+	priorities := []int{9, 5, 1, 7, 3}
+	var wg sync.WaitGroup
+	for i, priority := range priorities {
+		priority := priority
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "record", Priority: &priority, Data: map[string]interface{}{"priority": priority}})
+		}()
+		waitFor(t, "atom to queue", func() bool { return r.GetStats().QueueDepth == i+1 })
+	}
+
+	close(release)
+	wg.Wait()
+	want := []int{1, 3, 5, 7, 9}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Fatalf("dequeue order = %v, want %v", order, want)
+	}
+}
+
+func TestQueuedAtomsHonourTheirDeadline(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 1})
+	release := registerGate(t, r)
+
+	go runAtom(r, "tt", "gate", nil)
+	waitFor(t, "gate to start", func() bool { return r.currentLoad() >= 100 })
+
+	start := time.Now()
+	result := r.ProcessAtom(&Atom{
+		ID:      newTestAtomID(),
+		Group:   "cf",
+		Element: "ping",
+		Meta:    map[string]interface{}{DeadlineMeta: time.Now().Add(100 * time.Millisecond).UnixMilli()},
+	})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("queued atom waited %v past its deadline", elapsed)
+	}
+	if result.Success || result.Error.Code != "E408" {
+		t.Fatalf("queued atom = %+v, want E408", result.Error)
+	}
+	if depth := r.GetStats().QueueDepth; depth != 0 {
+		t.Fatalf("queue depth = %d after timeout, want 0", depth)
+	}
+
+	// The slot still works once the gate releases it
+	close(release)
+	if result := runAtom(r, "cf", "ping", nil); !result.Success {
+		t.Fatalf("ping after release = %+v", result.Error)
+	}
+}
+
+func TestSlotAccountingSurvivesQueueTimeouts(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 2})
+	mustRegister(t, r, "tt", "work", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		time.Sleep(2 * time.Millisecond)
+		return nil, nil
+	}, PacketMetadata{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 60; i++ {
+		wait := time.Duration(i%7+1) * time.Millisecond
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.ProcessAtom(&Atom{
+				ID:      newTestAtomID(),
+				Group:   "tt",
+				Element: "work",
+				Meta:    map[string]interface{}{DeadlineMeta: time.Now().Add(wait).UnixMilli()},
+			})
+		}()
+	}
+	wg.Wait()
+
+	r.mu.RLock()
+	active, queued := r.activeAtoms, r.queue.Len()
+	r.mu.RUnlock()
+	if active != 0 || queued != 0 {
+		t.Fatalf("after all atoms finished: %d active, %d queued", active, queued)
+	}
+}
+
+// ============================================================================
+// Pipelines
+// ============================================================================
+
+// registerPassthrough registers tt:pass, which returns its input unchanged
+func registerPassthrough(t *testing.T, r *PacketFlowRuntime) {
+	mustRegister(t, r, "tt", "pass", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return data["input"], nil
+	}, PacketMetadata{})
+}
+
+func passSteps(n int) []PipelineStep {
+	steps := make([]PipelineStep, n)
+	for i := range steps {
+		steps[i] = PipelineStep{Group: "tt", Element: "pass"}
+	}
+	return steps
+}
+
+func TestPipelineStepsShareCorrelationID(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+
+	var mu sync.Mutex
+	var seen []string
+	r.OnAfterProcess(func(atom *Atom, result *AtomResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, atom.Meta["correlation_id"].(string), result.Meta["correlation_id"].(string))
+	})
+
+	engine := NewPipelineEngine(r)
+	for _, given := range []string{"client-cid-1", ""} {
+		seen = nil
+		options := map[string]interface{}{}
+		if given != "" {
+			options["correlation_id"] = given
+		}
+		pipeline, err := engine.CreatePipeline("cid", passSteps(3), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := engine.Execute(pipeline, "payload")
+		if !result.Success {
+			t.Fatalf("pipeline failed: %+v", result.Error)
+		}
+		if given != "" && result.CorrelationID != given {
+			t.Fatalf("result correlation ID = %q, want %q", result.CorrelationID, given)
+		}
+		if result.CorrelationID == "" {
+			t.Fatal("result has no correlation ID")
+		}
+		if len(seen) != 6 {
+			t.Fatalf("saw %d correlation IDs, want 6", len(seen))
+		}
+		for i, cid := range seen {
+			if cid != result.CorrelationID {
+				t.Errorf("step value %d correlation ID = %q, want %q", i, cid, result.CorrelationID)
+			}
+		}
+	}
+}
+
+// ============================================================================
+// Payload limits
+// ============================================================================
+
+func TestPayloadSizeLimitIsEnforcedBeforeTheHandler(t *testing.T) {
+	const limit = 64
+	r := newTestRuntime(t, RuntimeConfig{})
+	var calls int64
+	mustRegister(t, r, "tt", "small", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		return "ok", nil
+	}, PacketMetadata{MaxPayloadSize: limit})
+
+	// Find the largest string payload that encodes to exactly the limit
+	payload := func(n int) map[string]interface{} {
+		return map[string]interface{}{"s": strings.Repeat("x", n)}
+	}
+	n := 0
+	for {
+		encoded, err := msgpack.Marshal(payload(n + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded) > limit {
+			break
+		}
+		n++
+	}
+
+	if result := runAtom(r, "tt", "small", payload(n)); !result.Success {
+		t.Fatalf("payload at the limit rejected: %+v", result.Error)
+	}
+
+	result := runAtom(r, "tt", "small", payload(n+1))
+	if result.Success || result.Error.Code != "E413" || !result.Error.Permanent {
+		t.Fatalf("payload over the limit: got %+v, want permanent E413", result.Error)
+	}
+	if got := atomic.LoadInt64(&calls); got != 1 {
+		t.Fatalf("handler ran %d times, want 1", got)
+	}
+}
+
+// ============================================================================
+// Dependencies
+// ============================================================================
+
+func okHandler(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+	return "ok", nil
+}
+
+func TestRegisterRejectsMissingDependencies(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{CheckDependencies: true})
+
+	err := r.RegisterPacket("tt", "app", "", okHandler, PacketMetadata{Dependencies: []string{"tt:base", "tt:extra"}})
+	if err == nil || !strings.Contains(err.Error(), "tt:base, tt:extra") {
+		t.Fatalf("register with missing dependencies: got %v, want both listed", err)
+	}
+
+	mustRegister(t, r, "tt", "base", "", okHandler, PacketMetadata{})
+	mustRegister(t, r, "tt", "extra", "", okHandler, PacketMetadata{})
+	mustRegister(t, r, "tt", "app", "", okHandler, PacketMetadata{Dependencies: []string{"tt:base", "tt:extra"}})
+
+	graph := r.GetDependencyGraph()
+	if deps := graph["tt:app"]; len(deps) != 2 || deps[0] != "tt:base" || deps[1] != "tt:extra" {
+		t.Fatalf("graph[tt:app] = %v", deps)
+	}
+	if deps, ok := graph["tt:base"]; !ok || len(deps) != 0 {
+		t.Fatalf("graph[tt:base] = %v, %v; want an empty entry", deps, ok)
+	}
+	if err := r.ValidateDependencies(); err != nil {
+		t.Fatalf("ValidateDependencies: %v", err)
+	}
+}
+
+func TestValidateDependenciesReportsMissingPackets(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "app", "", okHandler, PacketMetadata{Dependencies: []string{"tt:base"}})
+
+	err := r.ValidateDependencies()
+	if err == nil || !strings.Contains(err.Error(), "tt:app requires tt:base") {
+		t.Fatalf("ValidateDependencies: got %v, want the missing dependency named", err)
+	}
+
+	// With the runtime check on, execution fails until the dependency appears
+	r.config.CheckDependencies = true
+	result := runAtom(r, "tt", "app", nil)
+	if result.Success || result.Error.Code != "E503" || result.Error.Permanent {
+		t.Fatalf("missing dependency at execution: got %+v, want transient E503", result.Error)
+	}
+
+	mustRegister(t, r, "tt", "base", "", okHandler, PacketMetadata{})
+	if result := runAtom(r, "tt", "app", nil); !result.Success {
+		t.Fatalf("execution with dependency present failed: %+v", result.Error)
+	}
+}
+
+func TestRegisterRejectsDependencyCycles(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "a", "", okHandler, PacketMetadata{Dependencies: []string{"tt:b"}})
+	mustRegister(t, r, "tt", "b", "", okHandler, PacketMetadata{Dependencies: []string{"tt:c"}})
+
+	err := r.RegisterPacket("tt", "c", "", okHandler, PacketMetadata{Dependencies: []string{"tt:a"}})
+	if err == nil || !strings.Contains(err.Error(), "dependency cycle") {
+		t.Fatalf("register closing a cycle: got %v, want a cycle error", err)
+	}
+	for _, key := range []string{"tt:a", "tt:b", "tt:c"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("cycle error %q does not name %s", err, key)
+		}
+	}
+	if _, exists := r.GetDependencyGraph()["tt:c"]; exists {
+		t.Fatal("rejected packet was registered")
+	}
+
+	// Self-dependencies are the shortest cycle
+	if err := r.RegisterPacket("tt", "self", "", okHandler, PacketMetadata{Dependencies: []string{"tt:self"}}); err == nil {
+		t.Fatal("self-dependency accepted")
+	}
+}
+
+// ============================================================================
+// Authorization
+// ============================================================================
+
+// registerGuarded registers tt:guarded, which requires read and write and
+// reports the caller it ran as
+func registerGuarded(t *testing.T, r *PacketFlowRuntime) {
+	mustRegister(t, r, "tt", "guarded", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		_, claimed := ctx.Atom.Meta["permissions"]
+		return map[string]interface{}{"caller": ctx.Caller.ID, "claimed": claimed}, nil
+	}, PacketMetadata{Permissions: []string{"read", "write"}})
+}
+
+func TestPermissionsComeFromTheAuthenticatedCaller(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerGuarded(t, r)
+
+	run := func(caller *Caller, meta map[string]interface{}) *AtomResult {
+		return r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "guarded", Meta: meta, Caller: caller})
+	}
+
+	if result := run(&Caller{ID: "alice", Permissions: []string{"read", "write"}}, nil); resultMap(t, result)["caller"] != "alice" {
+		t.Fatalf("caller with all permissions: %+v", result)
+	}
+
+	result := run(&Caller{ID: "bob", Permissions: []string{"read"}}, nil)
+	if result.Success || result.Error.Code != "E403" || !errors.Is(result.Error, ErrForbidden) {
+		t.Fatalf("caller missing write: got %+v, want E403", result.Error)
+	}
+	if !strings.Contains(result.Error.Message, "write") || strings.Contains(result.Error.Message, "read,") {
+		t.Errorf("denial %q should name only the missing permission", result.Error.Message)
+	}
+
+	// Permissions claimed in meta grant nothing
+	claimed := map[string]interface{}{"permissions": []interface{}{"read", "write"}}
+	if result := run(nil, claimed); result.Success || result.Error.Code != "E401" {
+		t.Fatalf("self-granted permissions: got %+v, want E401", result.Error)
+	}
+	if result := run(&Caller{ID: "bob", Permissions: []string{"read"}}, claimed); result.Success || result.Error.Code != "E403" {
+		t.Fatalf("self-granted extra permission: got %+v, want E403", result.Error)
+	}
+
+	// Packets without declared permissions stay open
+	registerPassthrough(t, r)
+	if result := runAtom(r, "tt", "pass", nil); !result.Success {
+		t.Fatalf("open packet rejected: %+v", result.Error)
+	}
+}
+
+func TestIngressStripsClaimedPermissions(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerGuarded(t, r)
+
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+	handler.caller = &Caller{ID: "alice", Permissions: []string{"read", "write"}}
+	frame := encodeFrame(t, JSONCodec{}, Message{
+		Type:      handler.getMessageTypeCode("submit"),
+		Timestamp: time.Now().Unix(),
+		Data: map[string]interface{}{
+			"id": newTestAtomID(), "g": "tt", "e": "guarded",
+			"m": map[string]interface{}{"permissions": []interface{}{"admin"}},
+		},
+	})
+	response, err := handler.HandleMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := handler.DecodeMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := message.Data.(map[string]interface{})
+	if data, _ := reply["data"].(map[string]interface{}); data["caller"] != "alice" || data["claimed"] != false {
+		t.Fatalf("binary submit ran with %v, want caller alice and no claimed permissions", message.Data)
+	}
+
+	// Over HTTP without authentication the claim is dropped and the packet denied
+	_, server := newTestServer(t, r)
+	var result AtomResult
+	body := `{"id": "` + newTestAtomID() + `", "g": "tt", "e": "guarded", "m": {"permissions": ["read", "write"]}}`
+	status := postJSON(t, server.URL+"/submit", "", body, &result)
+	if status != http.StatusUnauthorized || result.Error == nil || result.Error.Code != "E401" {
+		t.Fatalf("self-granted HTTP submit: status %d, error %+v; want 401 E401", status, result.Error)
+	}
+}
+
+type denyAll struct{}
+
+func (denyAll) Authorize(atom *Atom, packet *PacketInfo) error {
+	return fmt.Errorf("%w: %s is closed", ErrForbidden, packet.Key)
+}
+
+func TestSubmitReturns403ForPermissionDenials(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	r.SetAuthorizer(denyAll{})
+	_, server := newTestServer(t, r)
+
+	var result AtomResult
+	status := postJSON(t, server.URL+"/submit", "", `{"id": "`+newTestAtomID()+`", "g": "tt", "e": "pass"}`, &result)
+	if status != http.StatusForbidden || result.Error == nil || result.Error.Code != "E403" {
+		t.Fatalf("denied submit: status %d, error %+v; want 403 E403", status, result.Error)
+	}
+	if got := httpStatusForError("E403"); got != http.StatusUnprocessableEntity {
+		t.Fatalf("other E403 errors map to %d, want 422", got)
+	}
+}
+
+func TestPipelineAndWorkflowStepsRunAsTheCaller(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerGuarded(t, r)
+	caller := &Caller{ID: "alice", Permissions: []string{"read", "write"}}
+
+	engine := NewPipelineEngine(r)
+	pipeline, err := engine.CreatePipeline("guarded", []PipelineStep{{Group: "tt", Element: "guarded"}, {Group: "tt", Element: "guarded"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := engine.Execute(pipeline, nil); result.Success || result.Error.Code != "E401" {
+		t.Fatalf("pipeline without a caller: got %+v, want E401", result.Error)
+	}
+	pipeline.Caller = caller
+	result := engine.Execute(pipeline, nil)
+	if !result.Success {
+		t.Fatalf("pipeline with a caller failed: %+v", result.Error)
+	}
+	if data, _ := result.Result.(map[string]interface{}); data["caller"] != "alice" {
+		t.Fatalf("pipeline ran as %v, want alice", result.Result)
+	}
+
+	workflows := NewWorkflowEngine(r)
+	workflow := &Workflow{
+		ID: "guarded",
+		Nodes: []WorkflowNode{
+			{ID: "first", Group: "tt", Element: "guarded"},
+			{ID: "second", Group: "tt", Element: "guarded", DependsOn: []string{"first"}},
+		},
+		Caller: caller,
+	}
+	wfResult := workflows.Execute(workflow, nil)
+	if !wfResult.Success {
+		t.Fatalf("workflow with a caller failed: %+v", wfResult.Error)
+	}
+	for id, node := range wfResult.Nodes {
+		if data, _ := node.Data.(map[string]interface{}); data["caller"] != "alice" {
+			t.Errorf("node %s ran as %v, want alice", id, node.Data)
+		}
+	}
+}
+
+// ============================================================================
+// Authentication
+// ============================================================================
+
+// dialWebSocket opens a WebSocket to a test server's /packetflow endpoint
+func dialWebSocket(t *testing.T, server *httptest.Server, query string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/packetflow" + query
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func TestSubmitRequiresAValidAPIKey(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{APIKeys: []string{"secret"}})
+	registerPassthrough(t, r)
+	_, server := newTestServer(t, r)
+	body := `{"id": "auth_1", "g": "tt", "e": "pass", "d": {"input": "x"}}`
+
+	for _, token := range []string{"", "wrong"} {
+		var result AtomResult
+		if status := postJSON(t, server.URL+"/submit", token, body, &result); status != http.StatusUnauthorized || result.Error.Code != "E401" {
+			t.Fatalf("token %q: status %d, error %+v; want 401 E401", token, status, result.Error)
+		}
+	}
+
+	var result AtomResult
+	if status := postJSON(t, server.URL+"/submit", "secret", body, &result); status != http.StatusOK || !result.Success {
+		t.Fatalf("valid key: status %d, error %+v", status, result.Error)
+	}
+
+	// Endpoints outside atom processing stay open
+	resp, err := http.Get(server.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/health status %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestStatsRequiresAValidAPIKey(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{APIKeys: []string{"secret"}})
+	_, server := newTestServer(t, r)
+
+	for _, query := range []string{"", "?token=wrong"} {
+		var result AtomResult
+		if status := getJSON(t, server.URL+"/stats"+query, &result); status != http.StatusUnauthorized || result.Error.Code != "E401" {
+			t.Fatalf("/stats%s: status %d, error %+v; want 401 E401", query, status, result.Error)
+		}
+	}
+
+	var stats map[string]interface{}
+	if status := getJSON(t, server.URL+"/stats?token=secret", &stats); status != http.StatusOK || stats["runtime"] == nil {
+		t.Fatalf("/stats with a valid key: status %d, body %v", status, stats)
+	}
+}
+
+func TestAPIKeysGrantTheirConfiguredPermissions(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{APIKeys: []string{"admin-key:read|write", "reader-key:read", "bare-key"}})
+	registerGuarded(t, r)
+	_, server := newTestServer(t, r)
+
+	// Permissions claimed in meta are replaced by the key's own
+	body := `{"id": "%s", "g": "tt", "e": "guarded", "m": {"permissions": ["read", "write"]}}`
+	cases := []struct {
+		token  string
+		status int
+	}{
+		{"admin-key", http.StatusOK},
+		{"reader-key", http.StatusForbidden},
+		{"bare-key", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		var result AtomResult
+		status := postJSON(t, server.URL+"/submit", tc.token, fmt.Sprintf(body, newTestAtomID()), &result)
+		if status != tc.status {
+			t.Errorf("%s: status %d (%+v), want %d", tc.token, status, result.Error, tc.status)
+		}
+		if status == http.StatusOK {
+			data := result.Data.(map[string]interface{})
+			if caller, _ := data["caller"].(string); !strings.HasPrefix(caller, "key-") || strings.Contains(caller, "admin") {
+				t.Errorf("caller ID %q should be a key fingerprint", caller)
+			}
+			if data["claimed"] != false {
+				t.Error("handler saw client-claimed permissions")
+			}
+		}
+	}
+}
+
+func TestWebSocketUpgradeRequiresAValidAPIKey(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{APIKeys: []string{"admin-key:read|write"}})
+	registerGuarded(t, r)
+	_, server := newTestServer(t, r)
+
+	for _, query := range []string{"", "?token=wrong"} {
+		_, resp, err := dialWebSocket(t, server, query)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("upgrade with %q: err %v, want 401", query, err)
+		}
+	}
+
+	conn, _, err := dialWebSocket(t, server, "?token=admin-key")
+	if err != nil {
+		t.Fatalf("upgrade with a valid key: %v", err)
+	}
+	atom := map[string]interface{}{"id": newTestAtomID(), "g": "tt", "e": "guarded"}
+	if err := conn.WriteJSON(atom); err != nil {
+		t.Fatal(err)
+	}
+	var result AtomResult
+	if err := conn.ReadJSON(&result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success {
+		t.Fatalf("authenticated WebSocket atom failed: %+v", result.Error)
+	}
+}
+
+// ============================================================================
+// Origins
+// ============================================================================
+
+// dialWithOrigin attempts a WebSocket upgrade presenting origin
+func dialWithOrigin(t *testing.T, server *httptest.Server, origin string) int {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/packetflow"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": []string{origin}})
+	if conn != nil {
+		conn.Close()
+	}
+	if err != nil && resp == nil {
+		t.Fatalf("dialing with origin %s: %v", origin, err)
+	}
+	return resp.StatusCode
+}
+
+func TestWebSocketOriginChecks(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.trusted.io"}})
+	_, server := newTestServer(t, r)
+
+	cases := []struct {
+		origin string
+		status int
+	}{
+		{"https://app.example.com", http.StatusSwitchingProtocols},
+		{"https://eu.trusted.io", http.StatusSwitchingProtocols},
+		{"HTTPS://EU.TRUSTED.IO", http.StatusSwitchingProtocols},
+		{server.URL, http.StatusSwitchingProtocols}, // same origin
+		{"https://evil.example.com", http.StatusForbidden},
+		{"https://trusted.io.evil.com", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		if status := dialWithOrigin(t, server, tc.origin); status != tc.status {
+			t.Errorf("origin %s: status %d, want %d", tc.origin, status, tc.status)
+		}
+	}
+}
+
+func TestOriginsDefaultToSameOriginWithAnEscapeHatch(t *testing.T) {
+	closed := newTestRuntime(t, RuntimeConfig{})
+	_, closedServer := newTestServer(t, closed)
+	if status := dialWithOrigin(t, closedServer, "https://anywhere.example"); status != http.StatusForbidden {
+		t.Fatalf("cross origin with no list: status %d, want 403", status)
+	}
+
+	open := newTestRuntime(t, RuntimeConfig{AllowAllOrigins: true})
+	_, openServer := newTestServer(t, open)
+	if status := dialWithOrigin(t, openServer, "https://anywhere.example"); status != http.StatusSwitchingProtocols {
+		t.Fatalf("AllowAllOrigins: status %d, want 101", status)
+	}
+}
+
+func TestCORSHeadersFollowTheOriginList(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{AllowedOrigins: []string{"https://*.trusted.io"}})
+	_, server := newTestServer(t, r)
+
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest("OPTIONS", server.URL+"/submit", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("https://eu.trusted.io")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://eu.trusted.io" {
+		t.Fatalf("allowed preflight: status %d, allow-origin %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if !strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Errorf("allow-headers %q should include Authorization", resp.Header.Get("Access-Control-Allow-Headers"))
+	}
+
+	resp = preflight("https://evil.example.com")
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("disallowed preflight: status %d, allow-origin %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+}
+
+// ============================================================================
+// Rate limiting
+// ============================================================================
+
+func TestWebSocketRateLimitThrottlesBursts(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{RateLimit: 1, RateBurst: 3})
+	registerPassthrough(t, r)
+	_, server := newTestServer(t, r)
+
+	conn, _, err := dialWebSocket(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sent = 10
+	for i := 0; i < sent; i++ {
+		if err := conn.WriteJSON(map[string]interface{}{"id": newTestAtomID(), "g": "tt", "e": "pass"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ok, throttled int
+	for i := 0; i < sent; i++ {
+		var result AtomResult
+		if err := conn.ReadJSON(&result); err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case result.Success:
+			ok++
+		case result.Error.Code == "E429":
+			throttled++
+		default:
+			t.Fatalf("unexpected error %+v", result.Error)
+		}
+	}
+	// The burst passes, plus at most one token refilled during the test
+	if ok < 3 || ok > 4 || ok+throttled != sent {
+		t.Fatalf("%d processed and %d throttled, want the burst of 3 through", ok, throttled)
+	}
+
+	stats := r.GetConnectionStats()
+	if len(stats) != 1 {
+		t.Fatalf("tracking %d connections, want 1", len(stats))
+	}
+	for _, conn := range stats {
+		if conn.Received != sent || conn.Dropped != int64(throttled) {
+			t.Fatalf("connection stats %+v, want %d received and %d dropped", conn, sent, throttled)
+		}
+	}
+
+	// Limiter state goes away with the connection
+	conn.Close()
+	waitFor(t, "connection removal", func() bool { return len(r.GetConnectionStats()) == 0 })
+}
+
+// ============================================================================
+// Frame size limits
+// ============================================================================
+
+func TestOversizedFramesGetE413AndAClose(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxPacketSize: 1024})
+	registerPassthrough(t, r)
+	_, server := newTestServer(t, r)
+	handler := NewMessageHandler(r)
+
+	for _, messageType := range []int{websocket.TextMessage, websocket.BinaryMessage} {
+		conn, _, err := dialWebSocket(t, server, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		// A frame at the limit is still processed
+		atom := fmt.Sprintf(`{"id": "%s", "g": "tt", "e": "pass", "d": {"input": "%s"}}`, newTestAtomID(), "")
+		atom = atom[:len(atom)-3] + strings.Repeat("x", 1024-len(atom)) + `"}}`
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(atom)); err != nil {
+			t.Fatal(err)
+		}
+		var result AtomResult
+		if err := conn.ReadJSON(&result); err != nil || !result.Success {
+			t.Fatalf("frame at the limit: %v %+v", err, result.Error)
+		}
+
+		if err := conn.WriteMessage(messageType, make([]byte, 4096)); err != nil {
+			t.Fatal(err)
+		}
+		frameType, reply, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading the E413 reply: %v", err)
+		}
+		if frameType != messageType {
+			t.Fatalf("E413 sent as frame type %d, want %d", frameType, messageType)
+		}
+		if messageType == websocket.TextMessage {
+			var result AtomResult
+			if err := json.Unmarshal(reply, &result); err != nil || result.Error == nil || result.Error.Code != "E413" {
+				t.Fatalf("text reply %s, want a JSON E413", reply)
+			}
+		} else if code := replyError(t, handler, reply); code != "E413" {
+			t.Fatalf("binary reply code %q, want E413", code)
+		}
+
+		_, _, err = conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig || !strings.Contains(closeErr.Text, "1024 byte limit") {
+			t.Fatalf("after an oversized frame got %v, want a 1009 close with the limit", err)
+		}
+	}
+}
+
+// ============================================================================
+// Protocol extensions
+// ============================================================================
+
+func TestCustomMessageTypesAreDispatched(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+
+	var got *Message
+	err := handler.RegisterMessageType("heartbeat", 20, func(message *Message) ([]byte, error) {
+		got = message
+		return handler.EncodeMessage("result", map[string]interface{}{"alive": true}, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := encodeFrame(t, JSONCodec{}, Message{Type: 20, Timestamp: time.Now().Unix(), Data: "beat"})
+	response, err := handler.HandleMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Data != "beat" {
+		t.Fatalf("custom handler received %+v", got)
+	}
+	if code := replyError(t, handler, response); code != "" {
+		t.Fatalf("custom reply is error %s", code)
+	}
+
+	// Handlers for the same runtime share the registry
+	if code := NewMessageHandler(r).getMessageTypeCode("heartbeat"); code != 20 {
+		t.Fatalf("heartbeat code on another handler = %d, want 20", code)
+	}
+
+	// Unregistered codes are not implemented
+	frame = encodeFrame(t, JSONCodec{}, Message{Type: 21, Timestamp: time.Now().Unix()})
+	response, err = handler.HandleMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := replyError(t, handler, response); code != "E501" {
+		t.Fatalf("unknown type reply = %q, want E501", code)
+	}
+}
+
+func TestCustomMessageTypesCannotCollide(t *testing.T) {
+	handler := NewMessageHandler(newTestRuntime(t, RuntimeConfig{}))
+	noop := func(*Message) ([]byte, error) { return nil, nil }
+
+	if err := handler.RegisterMessageType("subscribe", 30, noop); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		code int
+	}{
+		{"submit", 31},     // built-in name
+		{"unsubscribe", 1}, // built-in code
+		{"subscribe", 32},  // registered name
+		{"other", 30},      // registered code
+	}
+	for _, tc := range cases {
+		if err := handler.RegisterMessageType(tc.name, tc.code, noop); err == nil {
+			t.Errorf("registering %s/%d succeeded, want a collision error", tc.name, tc.code)
+		}
+	}
+	if err := handler.RegisterMessageType("nohandler", 33, nil); err == nil {
+		t.Error("registering without a handler succeeded")
+	}
+}
+
+// ============================================================================
+// Codecs
+// ============================================================================
+
+func TestMessagesRoundTripThroughEveryCodec(t *testing.T) {
+	handler := NewMessageHandler(newTestRuntime(t, RuntimeConfig{}))
+	data := map[string]interface{}{
+		"g": "tt", "e": "pass",
+		"d": map[string]interface{}{"input": "hello", "flag": true, "tags": []interface{}{"a", "b"}},
+	}
+	options := map[string]interface{}{"priority": 7, "ttl": 60, "correlation_id": "cid-42"}
+
+	var decoded []*Message
+	for _, codec := range []Codec{MsgpackCodec{}, JSONCodec{}} {
+		encoded, err := handler.EncodeMessageWith(codec, "submit", data, options)
+		if err != nil {
+			t.Fatalf("%s encode: %v", codec.Name(), err)
+		}
+		message, err := handler.DecodeMessageWith(codec, encoded)
+		if err != nil {
+			t.Fatalf("%s decode: %v", codec.Name(), err)
+		}
+		if message.Type != handler.getMessageTypeCode("submit") || message.Version != MessageVersion ||
+			*message.Priority != 7 || *message.TTL != 60 || *message.CorrelationID != "cid-42" {
+			t.Fatalf("%s round trip lost fields: %+v", codec.Name(), message)
+		}
+		decoded = append(decoded, message)
+	}
+
+	// Both codecs decode to the same normalized data
+	msgpackData, _ := json.Marshal(decoded[0].Data)
+	jsonData, _ := json.Marshal(decoded[1].Data)
+	if string(msgpackData) != string(jsonData) {
+		t.Fatalf("codecs disagree:\n msgpack %s\n json    %s", msgpackData, jsonData)
+	}
+
+	// A frame in one codec does not decode in the other
+	encoded, _ := handler.EncodeMessageWith(JSONCodec{}, "ping", nil, nil)
+	if _, err := handler.DecodeMessageWith(MsgpackCodec{}, encoded); err == nil {
+		t.Fatal("JSON frame decoded as msgpack")
+	}
+}
+
+func TestWebSocketSubprotocolSelectsTheCodec(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	_, server := newTestServer(t, r)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"packetflow.json"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/packetflow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "packetflow.json" {
+		t.Fatalf("negotiated %q, want packetflow.json", conn.Subprotocol())
+	}
+
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+	frame := encodeFrame(t, JSONCodec{}, Message{
+		Type:      handler.getMessageTypeCode("submit"),
+		Timestamp: time.Now().Unix(),
+		Data:      map[string]interface{}{"id": newTestAtomID(), "g": "tt", "e": "pass", "d": map[string]interface{}{"input": "via json"}},
+	})
+	if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatal(err)
+	}
+	_, reply, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := handler.DecodeMessage(reply)
+	if err != nil {
+		t.Fatalf("reply is not a JSON-codec frame: %v", err)
+	}
+	if result := message.Data.(map[string]interface{}); result["data"] != "via json" {
+		t.Fatalf("reply data = %v", message.Data)
+	}
+}
+
+// ============================================================================
+// Pipeline persistence
+// ============================================================================
+
+// registerAppend registers tt:append, which appends suffix to its string input
+func registerAppend(t *testing.T, r *PacketFlowRuntime) {
+	mustRegister(t, r, "tt", "append", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return fmt.Sprint(data["input"]) + fmt.Sprint(data["suffix"]), nil
+	}, PacketMetadata{})
+}
+
+func appendStep(suffix string) PipelineStep {
+	return PipelineStep{Group: "tt", Element: "append", Data: map[string]interface{}{"suffix": suffix}}
+}
+
+func TestPipelineResumesAfterRestart(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerAppend(t, r)
+
+	// The first run of tt:crash hangs, standing in for a reactor crash mid-step
+	crash := make(chan struct{})
+	defer close(crash)
+	var crashCalls int64
+	mustRegister(t, r, "tt", "crash", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		if atomic.AddInt64(&crashCalls, 1) == 1 {
+			<-crash
+			return nil, errors.New("crashed")
+		}
+		return fmt.Sprint(data["input"]) + "b", nil
+	}, PacketMetadata{})
+
+	store, err := NewFilePipelineStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := NewPipelineEngine(r)
+	before.SetStore(store)
+	pipeline, err := before.CreatePipeline("resumable", []PipelineStep{appendStep("a"), {Group: "tt", Element: "crash"}, appendStep("c")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go before.Execute(pipeline, ">")
+
+	var executionID string
+	waitFor(t, "checkpoint after the first step", func() bool {
+		for id := range before.GetActiveExecutions() {
+			if checkpoint, err := store.Load(id); err == nil && checkpoint.CurrentStep == 1 {
+				executionID = id
+				return true
+			}
+		}
+		return false
+	})
+	// Resume only once the first run holds the hanging call, so it gets the
+	// second one
+	waitFor(t, "the first run to reach the crashing step", func() bool {
+		return atomic.LoadInt64(&crashCalls) == 1
+	})
+
+	// A new engine over the same store picks up at the crashed step
+	after := NewPipelineEngine(r)
+	after.SetStore(store)
+	result := after.Resume(executionID)
+	if !result.Success {
+		t.Fatalf("resume failed: %+v", result.Error)
+	}
+	if result.Result != ">abc" || result.ExecutionID != executionID {
+		t.Fatalf("resumed result %v for %s, want >abc for %s", result.Result, result.ExecutionID, executionID)
+	}
+	if len(result.Trace) != 3 {
+		t.Fatalf("trace has %d steps, want all 3 across both runs", len(result.Trace))
+	}
+	if _, err := store.Load(executionID); !errors.Is(err, ErrCheckpointNotFound) {
+		t.Fatalf("checkpoint after completion: %v, want it cleared", err)
+	}
+	if result := after.Resume(executionID); result.Success || result.Error.Code != "E404" {
+		t.Fatalf("resuming a finished execution: %+v, want E404", result.Error)
+	}
+}
+
+func TestResumeExcludesDowntimeFromThePipelineTimeout(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerAppend(t, r)
+	store := NewMemoryPipelineStore()
+	engine := NewPipelineEngine(r)
+	engine.SetStore(store)
+
+	pipeline := &Pipeline{ID: "timed", Steps: []PipelineStep{appendStep("a"), appendStep("b")}, Timeout: 1}
+	save := func(id string, elapsed time.Duration) {
+		err := store.Save(&PipelineCheckpoint{
+			ExecutionID: id,
+			Pipeline:    pipeline,
+			CurrentStep: 1,
+			Output:      "a",
+			Started:     time.Now().Add(-time.Hour), // stopped for an hour
+			Elapsed:     elapsed,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save("short", 100*time.Millisecond)
+	if result := engine.Resume("short"); !result.Success || result.Result != "ab" {
+		t.Fatalf("resume within the run budget: %+v %v", result.Error, result.Result)
+	}
+
+	save("spent", 2*time.Second)
+	if result := engine.Resume("spent"); result.Success || result.Error.Code != "E408" {
+		t.Fatalf("resume past the run budget: %+v, want E408", result.Error)
+	}
+}
+
+func TestConcurrentResumesRunOnce(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	release := registerGate(t, r)
+	var gateCalls int64
+	r.OnBeforeProcess(func(atom *Atom) {
+		if atom.Element == "gate" {
+			atomic.AddInt64(&gateCalls, 1)
+		}
+	})
+
+	store := NewMemoryPipelineStore()
+	engine := NewPipelineEngine(r)
+	engine.SetStore(store)
+	pipeline := &Pipeline{ID: "once", Steps: []PipelineStep{{Group: "tt", Element: "gate"}, {Group: "tt", Element: "gate"}}}
+	if err := store.Save(&PipelineCheckpoint{ExecutionID: "exec-1", Pipeline: pipeline, CurrentStep: 1, Started: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	const resumers = 8
+	results := make(chan *PipelineResult, resumers)
+	var start sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < resumers; i++ {
+		go func() {
+			start.Wait()
+			results <- engine.Resume("exec-1")
+		}()
+	}
+	start.Done()
+
+	// Every resume but the running one is turned away while it holds the gate
+	for i := 0; i < resumers-1; i++ {
+		if result := <-results; result.Success || result.Error.Code != "E409" {
+			t.Fatalf("concurrent resume: %+v, want E409", result.Error)
+		}
+	}
+	close(release)
+	if result := <-results; !result.Success {
+		t.Fatalf("winning resume failed: %+v", result.Error)
+	}
+	if calls := atomic.LoadInt64(&gateCalls); calls != 1 {
+		t.Fatalf("resumed step ran %d times, want 1", calls)
+	}
+}
+
+func TestCancelStopsAPipelineBeforeItsNextStep(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerAppend(t, r)
+	release := registerGate(t, r)
+	engine := NewPipelineEngine(r)
+
+	pipeline, err := engine.CreatePipeline("cancellable", []PipelineStep{appendStep("a"), {Group: "tt", Element: "gate"}, appendStep("c"), appendStep("d")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *PipelineResult, 1)
+	go func() { done <- engine.Execute(pipeline, "") }()
+
+	var executionID string
+	waitFor(t, "the gate step", func() bool {
+		for id := range engine.GetActiveExecutions() {
+			if execution, ok := engine.GetExecution(id); ok && execution.CurrentStep == 1 {
+				executionID = id
+				return true
+			}
+		}
+		return false
+	})
+	if execution, _ := engine.GetExecution(executionID); execution.PipelineID != "cancellable" || len(execution.Trace) != 1 {
+		t.Fatalf("running execution snapshot = %+v", execution)
+	}
+
+	if err := engine.CancelExecution(executionID); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.CancelExecution(executionID); err != nil {
+		t.Fatalf("cancelling twice: %v", err)
+	}
+	close(release)
+
+	result := <-done
+	if result.Success || !result.Cancelled || result.Error.Code != "E499" {
+		t.Fatalf("cancelled pipeline result: %+v", result.Error)
+	}
+	// The in-flight gate step finishes; the cancellation is traced at step 2
+	if result.CompletedSteps != 2 || len(result.Trace) != 3 {
+		t.Fatalf("completed %d steps with %d trace entries, want 2 and 3", result.CompletedSteps, len(result.Trace))
+	}
+	if last := result.Trace[2]; last.Step != 2 || last.Success || !strings.Contains(last.Error, "cancelled") {
+		t.Fatalf("last trace entry = %+v, want a cancellation at step 2", last)
+	}
+
+	if _, ok := engine.GetExecution(executionID); ok {
+		t.Fatal("finished execution is still reported")
+	}
+	if err := engine.CancelExecution(executionID); err == nil {
+		t.Fatal("cancelling a finished execution succeeded")
+	}
+}
+
+// registerSleep registers tt:sleep, which sleeps for data["ms"] milliseconds
+// or until its context ends, then returns its input
+func registerSleep(t *testing.T, r *PacketFlowRuntime) {
+	mustRegister(t, r, "tt", "sleep", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		select {
+		case <-time.After(time.Duration(DataAccessor(data).GetInt("ms", 0)) * time.Millisecond):
+			return data["input"], nil
+		case <-ctx.Context.Done():
+			return nil, ctx.Context.Err()
+		}
+	}, PacketMetadata{Timeout: 30})
+}
+
+func sleepStep(ms, timeout int) PipelineStep {
+	return PipelineStep{Group: "tt", Element: "sleep", Data: map[string]interface{}{"ms": ms}, Timeout: timeout}
+}
+
+func TestPipelineStepTimeout(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerSleep(t, r)
+	engine := NewPipelineEngine(r)
+
+	pipeline, err := engine.CreatePipeline("step-timeout", []PipelineStep{sleepStep(0, 1), sleepStep(5000, 1), sleepStep(0, 0)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	result := engine.Execute(pipeline, "x")
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("step ran %v despite its 1s timeout", elapsed)
+	}
+	if result.Success || result.Error.Code != "E408" || result.CompletedSteps != 1 {
+		t.Fatalf("result %+v after %d steps, want E408 after 1", result.Error, result.CompletedSteps)
+	}
+	if last := result.Trace[len(result.Trace)-1]; last.Step != 1 || !last.TimedOut {
+		t.Fatalf("trace %+v, want step 1 timed out", last)
+	}
+	if result.Trace[0].TimedOut {
+		t.Fatal("fast step marked as timed out")
+	}
+}
+
+func TestPipelineOverallTimeout(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerSleep(t, r)
+	engine := NewPipelineEngine(r)
+
+	// Each step is within its own budget but together they exceed the pipeline's
+	pipeline, err := engine.CreatePipeline("budget", []PipelineStep{sleepStep(600, 0), sleepStep(600, 0), sleepStep(0, 0)}, map[string]interface{}{"timeout": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := engine.Execute(pipeline, "x")
+	if result.Success || result.Error.Code != "E408" || result.CompletedSteps != 2 {
+		t.Fatalf("result %+v after %d steps, want E408 after 2", result.Error, result.CompletedSteps)
+	}
+	last := result.Trace[len(result.Trace)-1]
+	if last.Step != 2 || !last.TimedOut || !strings.Contains(last.Error, "pipeline timeout") {
+		t.Fatalf("trace %+v, want the budget exceeded before step 2", last)
+	}
+}
+
+func TestPipelineInputMapping(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "emit", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return map[string]interface{}{
+			"user":  map[string]interface{}{"email": "ada@example.com"},
+			"items": []interface{}{map[string]interface{}{"id": "first"}, map[string]interface{}{"id": "last"}},
+		}, nil
+	}, PacketMetadata{})
+	mustRegister(t, r, "tt", "echo", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return data, nil
+	}, PacketMetadata{})
+	engine := NewPipelineEngine(r)
+
+	mapped := PipelineStep{
+		Group: "tt", Element: "echo",
+		Data:         map[string]interface{}{"static": "kept"},
+		InputMapping: map[string]string{"input": "user.email", "first": "items.0.id", "last": "items[-1].id"},
+	}
+	pipeline, _ := engine.CreatePipeline("mapped", []PipelineStep{{Group: "tt", Element: "emit"}, mapped}, nil)
+	result := engine.Execute(pipeline, nil)
+	if !result.Success {
+		t.Fatalf("mapped pipeline failed: %+v", result.Error)
+	}
+	data := result.Result.(map[string]interface{})
+	want := map[string]interface{}{"input": "ada@example.com", "first": "first", "last": "last", "static": "kept"}
+	if len(data) != len(want) {
+		t.Fatalf("mapped data = %v, want %v", data, want)
+	}
+	for key, value := range want {
+		if data[key] != value {
+			t.Errorf("data[%s] = %v, want %v", key, data[key], value)
+		}
+	}
+
+	// Without a mapping the previous result passes through as input
+	pipeline, _ = engine.CreatePipeline("passthrough", []PipelineStep{{Group: "tt", Element: "emit"}, {Group: "tt", Element: "echo"}}, nil)
+	result = engine.Execute(pipeline, nil)
+	if input, _ := result.Result.(map[string]interface{})["input"].(map[string]interface{}); input["user"] == nil {
+		t.Fatalf("passthrough input = %v", result.Result)
+	}
+
+	// A path missing from the previous result fails the step
+	mapped.InputMapping = map[string]string{"input": "items.5.id"}
+	pipeline, _ = engine.CreatePipeline("missing", []PipelineStep{{Group: "tt", Element: "emit"}, mapped}, nil)
+	result = engine.Execute(pipeline, nil)
+	if result.Success || result.Error.Code != "E400" || !strings.Contains(result.Error.Message, "items.5.id") {
+		t.Fatalf("missing path: %+v, want E400 naming the path", result.Error)
+	}
+}
+
+// ============================================================================
+// Workflows
+// ============================================================================
+
+func TestWorkflowDiamondRunsBranchesConcurrently(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerAppend(t, r)
+
+	// Both branches must be in flight together to pass the rendezvous
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	mustRegister(t, r, "tt", "branch", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		arrived.Done()
+		waited := make(chan struct{})
+		go func() { arrived.Wait(); close(waited) }()
+		select {
+		case <-waited:
+		case <-time.After(2 * time.Second):
+			return nil, errors.New("sibling branch never started")
+		}
+		return fmt.Sprint(data["input"]) + fmt.Sprint(data["suffix"]), nil
+	}, PacketMetadata{})
+	mustRegister(t, r, "tt", "join", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		inputs := data["inputs"].(map[string]interface{})
+		return fmt.Sprintf("%v|%v", inputs["b"], inputs["c"]), nil
+	}, PacketMetadata{})
+
+	workflow := &Workflow{
+		ID: "diamond",
+		Nodes: []WorkflowNode{
+			{ID: "d", Group: "tt", Element: "join", DependsOn: []string{"b", "c"}},
+			{ID: "b", Group: "tt", Element: "branch", Data: map[string]interface{}{"suffix": "b"}, DependsOn: []string{"a"}},
+			{ID: "c", Group: "tt", Element: "branch", Data: map[string]interface{}{"suffix": "c"}, DependsOn: []string{"a"}},
+			{ID: "a", Group: "tt", Element: "append", Data: map[string]interface{}{"suffix": "a"}},
+		},
+	}
+	result := NewWorkflowEngine(r).Execute(workflow, ">")
+	if !result.Success {
+		t.Fatalf("diamond failed: %+v", result.Error)
+	}
+	if got := result.Nodes["d"].Data; got != ">ab|>ac" {
+		t.Fatalf("join result = %v, want >ab|>ac", got)
+	}
+	if len(result.Order) != 4 || result.Order[0] != "a" || result.Order[3] != "d" {
+		t.Fatalf("completion order = %v", result.Order)
+	}
+}
+
+func TestWorkflowConcurrencyIsBounded(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var inFlight, peak int64
+	mustRegister(t, r, "tt", "busy", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			old := atomic.LoadInt64(&peak)
+			if n <= old || atomic.CompareAndSwapInt64(&peak, old, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil, nil
+	}, PacketMetadata{})
+
+	workflow := &Workflow{ID: "wide"}
+	for i := 0; i < 6; i++ {
+		workflow.Nodes = append(workflow.Nodes, WorkflowNode{ID: fmt.Sprint("n", i), Group: "tt", Element: "busy"})
+	}
+	engine := NewWorkflowEngine(r)
+	engine.SetMaxConcurrency(2)
+	if result := engine.Execute(workflow, nil); !result.Success {
+		t.Fatalf("wide workflow failed: %+v", result.Error)
+	}
+	if peak != 2 {
+		t.Fatalf("peak concurrency %d, want 2", peak)
+	}
+}
+
+func TestWorkflowRejectsInvalidGraphs(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerAppend(t, r)
+	engine := NewWorkflowEngine(r)
+
+	cases := map[string][]WorkflowNode{
+		"cycle": {
+			{ID: "a", Group: "tt", Element: "append", DependsOn: []string{"c"}},
+			{ID: "b", Group: "tt", Element: "append", DependsOn: []string{"a"}},
+			{ID: "c", Group: "tt", Element: "append", DependsOn: []string{"b"}},
+		},
+		"unknown node": {
+			{ID: "a", Group: "tt", Element: "append", DependsOn: []string{"ghost"}},
+		},
+		"duplicate workflow node": {
+			{ID: "a", Group: "tt", Element: "append"},
+			{ID: "a", Group: "tt", Element: "append"},
+		},
+	}
+	for want, nodes := range cases {
+		workflow := &Workflow{ID: "bad", Nodes: nodes}
+		if err := engine.Validate(workflow); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate(%s) = %v", want, err)
+		}
+		result := engine.Execute(workflow, nil)
+		if result.Success || result.Error.Code != "E400" || len(result.Nodes) != 0 {
+			t.Errorf("Execute(%s) ran nodes or returned %+v", want, result.Error)
+		}
+	}
+}
+
+func TestWorkflowSkipsNodesDownstreamOfFailures(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerAppend(t, r)
+	workflow := &Workflow{
+		ID: "partial",
+		Nodes: []WorkflowNode{
+			{ID: "broken", Group: "tt", Element: "missing"},
+			{ID: "after", Group: "tt", Element: "append", DependsOn: []string{"broken"}},
+			{ID: "independent", Group: "tt", Element: "append"},
+		},
+	}
+	result := NewWorkflowEngine(r).Execute(workflow, "x")
+	if result.Success {
+		t.Fatal("workflow with a failed node succeeded")
+	}
+	if node := result.Nodes["after"]; !node.Skipped || node.Error.Code != "E424" {
+		t.Fatalf("downstream node = %+v, want skipped with E424", node)
+	}
+	if node := result.Nodes["independent"]; !node.Success {
+		t.Fatalf("independent branch = %+v, want success", node)
+	}
+}
+
+// ============================================================================
+// Dead letters
+// ============================================================================
+
+func TestOnlyPermanentFailuresAreDeadLettered(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	sink := NewMemoryDeadLetterSink(2)
+	r.SetDeadLetterSink(sink)
+	registerPassthrough(t, r)
+	mustRegister(t, r, "tt", "fail", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		code := DataAccessor(data).GetString("code", "")
+		return nil, &AtomError{Code: code, Message: "failed", Permanent: isPermanentCode(code)}
+	}, PacketMetadata{})
+
+	runAtom(r, "tt", "pass", nil)
+	runAtom(r, "tt", "fail", map[string]interface{}{"code": "E503"})
+	if letters := sink.GetDeadLetters(); len(letters) != 0 {
+		t.Fatalf("success and transient failure dead-lettered: %+v", letters)
+	}
+
+	runAtom(r, "tt", "fail", map[string]interface{}{"code": "E400"})
+	runAtom(r, "tt", "missing", nil)
+	letters := sink.GetDeadLetters()
+	if len(letters) != 2 || letters[0].Error.Code != "E400" || letters[1].Error.Code != "E404" {
+		t.Fatalf("dead letters = %+v, want E400 then E404", letters)
+	}
+	if letters[0].PacketKey != "tt:fail" || letters[0].Atom == nil || letters[0].FailedAt.IsZero() {
+		t.Fatalf("dead letter missing details: %+v", letters[0])
+	}
+
+	// The ring buffer keeps the most recent letters
+	runAtom(r, "tt", "fail", map[string]interface{}{"code": "E402"})
+	letters = sink.GetDeadLetters()
+	if len(letters) != 2 || letters[0].Error.Code != "E404" || letters[1].Error.Code != "E402" {
+		t.Fatalf("after overflow = %+v, want E404 then E402", letters)
+	}
+}
+
+func TestFileDeadLetterSinkWritesJSONLines(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	path := t.TempDir() + "/dead.jsonl"
+	sink, err := NewFileDeadLetterSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	r.SetDeadLetterSink(sink)
+
+	runAtom(r, "tt", "missing", nil)
+	runAtom(r, "tt", "absent", nil)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("file has %d lines, want 2:\n%s", len(lines), content)
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal([]byte(lines[1]), &letter); err != nil {
+		t.Fatal(err)
+	}
+	if letter.PacketKey != "tt:absent" || letter.Error.Code != "E404" {
+		t.Fatalf("second letter = %+v", letter)
+	}
+}
+
+// ============================================================================
+// Idempotency
+// ============================================================================
+
+// registerCounter registers tt:count, which returns how many times it has run
+// and fails when data["fail"] is set
+func registerCounter(t *testing.T, r *PacketFlowRuntime, element string, calls *int64) {
+	mustRegister(t, r, "tt", element, "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		n := atomic.AddInt64(calls, 1)
+		if data["fail"] == true {
+			return nil, &AtomError{Code: "E400", Message: "bad input", Permanent: true}
+		}
+		return n, nil
+	}, PacketMetadata{})
+}
+
+func TestDuplicateSubmissionsReplayTheCachedResult(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{IdempotencyEnabled: true})
+	var calls int64
+	registerCounter(t, r, "count", &calls)
+
+	submit := func(id string, data map[string]interface{}) *AtomResult {
+		return r.ProcessAtom(&Atom{ID: id, Group: "tt", Element: "count", Data: data})
+	}
+	first := submit("order-1", nil)
+	second := submit("order-1", nil)
+	if !second.Success || second.Data != first.Data || second.Meta["idempotent_replay"] != true {
+		t.Fatalf("duplicate = %+v, want a replay of %v", second, first.Data)
+	}
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+	if result := submit("order-2", nil); result.Meta["idempotent_replay"] != nil || calls != 2 {
+		t.Fatal("a new ID was replayed")
+	}
+
+	// Failures run again unless failure caching is on
+	submit("bad-1", map[string]interface{}{"fail": true})
+	if result := submit("bad-1", map[string]interface{}{"fail": true}); result.Meta["idempotent_replay"] != nil || calls != 4 {
+		t.Fatalf("failed atom replayed (%d calls)", calls)
+	}
+	r.config.IdempotencyCacheFailures = true
+	submit("bad-2", map[string]interface{}{"fail": true})
+	if result := submit("bad-2", map[string]interface{}{"fail": true}); result.Meta["idempotent_replay"] != true || result.Error.Code != "E400" {
+		t.Fatalf("cached failure not replayed: %+v", result)
+	}
+}
+
+func TestIdempotentReplaysAreNotShared(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{IdempotencyEnabled: true})
+	mustRegister(t, r, "tt", "order", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return map[string]interface{}{"lines": []interface{}{"a"}, "rows": []map[string]interface{}{{"n": 1.0}}}, nil
+	}, PacketMetadata{})
+
+	submit := func() *AtomResult {
+		return r.ProcessAtom(&Atom{ID: "order-1", Group: "tt", Element: "order"})
+	}
+	mutate := func(result *AtomResult) {
+		data := resultMap(t, result)
+		data["extra"] = true
+		data["lines"].([]interface{})[0] = "changed"
+		data["rows"].([]map[string]interface{})[0]["n"] = 2.0
+	}
+	want := map[string]interface{}{"lines": []interface{}{"a"}, "rows": []map[string]interface{}{{"n": 1.0}}}
+
+	// Neither the first caller nor a replayed one can alter later replays
+	mutate(submit())
+	replay := submit()
+	if replay.Meta["idempotent_replay"] != true || !reflect.DeepEqual(replay.Data, want) {
+		t.Fatalf("first replay = %v, want an unaltered result", replay.Data)
+	}
+	mutate(replay)
+	if again := submit(); !reflect.DeepEqual(again.Data, want) {
+		t.Fatalf("second replay = %v, want an unaltered result", again.Data)
+	}
+}
+
+func TestIdempotencyIsScopedToCallerAndPacket(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{IdempotencyEnabled: true})
+	var calls int64
+	registerCounter(t, r, "count", &calls)
+	registerCounter(t, r, "other", &calls)
+	registerGuarded(t, r)
+
+	submit := func(element string, caller *Caller) *AtomResult {
+		return r.ProcessAtom(&Atom{ID: "shared-id", Group: "tt", Element: element, Caller: caller})
+	}
+	alice := &Caller{ID: "alice", Permissions: []string{"read", "write"}}
+	bob := &Caller{ID: "bob", Permissions: []string{"read", "write"}}
+
+	submit("count", alice)
+	if result := submit("count", bob); result.Meta["idempotent_replay"] != nil {
+		t.Fatal("bob was served alice's result")
+	}
+	if result := submit("other", alice); result.Meta["idempotent_replay"] != nil {
+		t.Fatal("an ID reused for another packet was replayed")
+	}
+	if calls != 3 {
+		t.Fatalf("handler ran %d times, want 3", calls)
+	}
+
+	// Authorization runs before any replay
+	if result := submit("guarded", alice); !result.Success {
+		t.Fatalf("guarded: %+v", result.Error)
+	}
+	revoked := &Caller{ID: "alice", Permissions: []string{"read"}}
+	if result := submit("guarded", revoked); result.Success || result.Error.Code != "E403" {
+		t.Fatalf("replay after losing a permission: %+v, want E403", result)
+	}
+}
+
+func TestConcurrentDuplicatesRunTheHandlerOnce(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{IdempotencyEnabled: true})
+	release := registerGate(t, r)
+	var calls int64
+	r.Use(func(next PacketHandler) PacketHandler {
+		return func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+			atomic.AddInt64(&calls, 1)
+			return next(data, ctx)
+		}
+	})
+
+	const duplicates = 6
+	results := make(chan *AtomResult, duplicates)
+	for i := 0; i < duplicates; i++ {
+		go func() {
+			results <- r.ProcessAtom(&Atom{ID: "dup", Group: "tt", Element: "gate"})
+		}()
+	}
+	waitFor(t, "the first submission", func() bool { return atomic.LoadInt64(&calls) == 1 })
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	replays := 0
+	for i := 0; i < duplicates; i++ {
+		result := <-results
+		if !result.Success {
+			t.Fatalf("duplicate failed: %+v", result.Error)
+		}
+		if result.Meta["idempotent_replay"] == true {
+			replays++
+		}
+	}
+	if calls != 1 || replays != duplicates-1 {
+		t.Fatalf("handler ran %d times with %d replays, want 1 and %d", calls, replays, duplicates-1)
+	}
+}
+
+// ============================================================================
+// Result cache
+// ============================================================================
+
+func TestCacheablePacketsReplayIdenticalInput(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var calls int64
+	mustRegister(t, r, "tt", "pure", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return atomic.AddInt64(&calls, 1), nil
+	}, PacketMetadata{Cacheable: true})
+
+	run := func(data map[string]interface{}) *AtomResult {
+		return r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "pure", Data: data})
+	}
+	first := run(map[string]interface{}{"a": 1, "b": "x"})
+	if first.Meta["cached"] != nil {
+		t.Fatal("first call reported a cache hit")
+	}
+	// Same data built in a different order hashes to the same key
+	second := run(map[string]interface{}{"b": "x", "a": 1})
+	if second.Meta["cached"] != true || second.Data != first.Data {
+		t.Fatalf("second call = %+v, want a cache hit", second)
+	}
+	if third := run(map[string]interface{}{"a": 2, "b": "x"}); third.Meta["cached"] != nil {
+		t.Fatal("different input hit the cache")
+	}
+	if calls != 2 {
+		t.Fatalf("handler ran %d times, want 2", calls)
+	}
+	if stats := r.GetStats(); stats.CacheHits != 1 || stats.CacheMisses != 2 {
+		t.Fatalf("cache stats = %d hits / %d misses, want 1 / 2", stats.CacheHits, stats.CacheMisses)
+	}
+}
+
+func TestCachedResultsAreNotShared(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "pure", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return map[string]interface{}{"items": []interface{}{"a"}, "nested": map[string]interface{}{"n": 1.0}}, nil
+	}, PacketMetadata{Cacheable: true})
+
+	mutate := func(result *AtomResult) {
+		data := resultMap(t, result)
+		data["extra"] = true
+		data["items"].([]interface{})[0] = "changed"
+		data["nested"].(map[string]interface{})["n"] = 2.0
+	}
+	want := map[string]interface{}{"items": []interface{}{"a"}, "nested": map[string]interface{}{"n": 1.0}}
+
+	// Neither the caller that filled the cache nor one served from it can
+	// alter what later hits see
+	mutate(runAtom(r, "tt", "pure", nil))
+	hit := runAtom(r, "tt", "pure", nil)
+	if hit.Meta["cached"] != true || !reflect.DeepEqual(hit.Data, want) {
+		t.Fatalf("first hit = %v, want an unaltered cached result", hit.Data)
+	}
+	mutate(hit)
+	if again := runAtom(r, "tt", "pure", nil); !reflect.DeepEqual(again.Data, want) {
+		t.Fatalf("second hit = %v, want an unaltered cached result", again.Data)
+	}
+}
+
+func TestCacheKeysKeepBinaryDistinctFromStrings(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "kind", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return describeType(data["blob"]), nil
+	}, PacketMetadata{Cacheable: true})
+
+	blob := []byte("hello")
+	run := func(value interface{}) *AtomResult {
+		return r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "kind", Data: map[string]interface{}{"blob": value}})
+	}
+	binary := run(blob)
+	text := run(base64.StdEncoding.EncodeToString(blob))
+	if text.Meta["cached"] != nil || text.Data == binary.Data {
+		t.Fatalf("base64 string = %+v, want its own run rather than the []byte result %v", text, binary.Data)
+	}
+	if again := run([]byte("hello")); again.Meta["cached"] != true || again.Data != binary.Data {
+		t.Fatalf("repeated []byte = %+v, want a cache hit", again)
+	}
+}
+
+func TestUncacheablePacketsAlwaysRun(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var calls int64
+	mustRegister(t, r, "tt", "impure", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return atomic.AddInt64(&calls, 1), nil
+	}, PacketMetadata{})
+
+	for i := 0; i < 3; i++ {
+		if result := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "impure"}); result.Meta["cached"] != nil {
+			t.Fatal("uncacheable packet served from cache")
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("handler ran %d times, want 3", calls)
+	}
+}
+
+func TestResultCacheExpiresAndEvicts(t *testing.T) {
+	cache := newLRUCache(2)
+	cache.Set("short", 1, 20*time.Millisecond)
+	if _, hit := cache.Get("short"); !hit {
+		t.Fatal("fresh entry missed")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, hit := cache.Get("short"); hit {
+		t.Fatal("expired entry was returned")
+	}
+
+	cache.Set("a", 1, time.Minute)
+	cache.Set("b", 2, time.Minute)
+	cache.Get("a")
+	cache.Set("c", 3, time.Minute)
+	if _, hit := cache.Get("b"); hit {
+		t.Fatal("least recently used entry survived eviction")
+	}
+	if _, hit := cache.Get("a"); !hit || cache.Len() != 2 {
+		t.Fatalf("recently used entry evicted (len %d)", cache.Len())
+	}
+}
+
+// ============================================================================
+// Tracing
+// ============================================================================
+
+type recordedSpan struct {
+	id         string
+	parent     string
+	name       string
+	attributes map[string]interface{}
+	errors     []error
+	ended      bool
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+func (s *recordedSpan) RecordError(err error)                      { s.errors = append(s.errors, err) }
+func (s *recordedSpan) End()                                       { s.ended = true }
+
+type spanContextKey struct{}
+
+// spanRecorder is an in-memory Tracer propagating span IDs through a
+// "traceparent" carrier entry
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *spanRecorder) Start(ctx context.Context, name string, attributes map[string]interface{}) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &recordedSpan{id: strconv.Itoa(len(t.spans) + 1), name: name, attributes: map[string]interface{}{}}
+	for k, v := range attributes {
+		span.attributes[k] = v
+	}
+	if parent, ok := ctx.Value(spanContextKey{}).(string); ok {
+		span.parent = parent
+	}
+	t.spans = append(t.spans, span)
+	return context.WithValue(ctx, spanContextKey{}, span.id), span
+}
+
+func (t *spanRecorder) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if parent, ok := carrier["traceparent"]; ok {
+		return context.WithValue(ctx, spanContextKey{}, parent)
+	}
+	return ctx
+}
+
+func (t *spanRecorder) Inject(ctx context.Context, carrier map[string]string) {
+	if id, ok := ctx.Value(spanContextKey{}).(string); ok {
+		carrier["traceparent"] = id
+	}
+}
+
+func (t *spanRecorder) named(name string) []*recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var matched []*recordedSpan
+	for _, span := range t.spans {
+		if span.name == name {
+			matched = append(matched, span)
+		}
+	}
+	return matched
+}
+
+func TestAtomSpansCarryPacketAttributes(t *testing.T) {
+	tracer := &spanRecorder{}
+	r := newTestRuntime(t, RuntimeConfig{Tracer: tracer})
+	registerPassthrough(t, r)
+
+	r.ProcessAtom(&Atom{ID: "a1", Group: "tt", Element: "pass", Meta: map[string]interface{}{"traceparent": "remote"}})
+	r.ProcessAtom(&Atom{ID: "a2", Group: "tt", Element: "missing"})
+
+	spans := tracer.named("tt:pass")
+	if len(spans) != 1 {
+		t.Fatalf("got %d tt:pass spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if !span.ended || span.parent != "remote" {
+		t.Fatalf("span ended=%v parent=%q, want ended with parent remote", span.ended, span.parent)
+	}
+	for _, attribute := range []string{"group", "element", "request_id", "duration_ms"} {
+		if _, ok := span.attributes[attribute]; !ok {
+			t.Errorf("span missing attribute %q", attribute)
+		}
+	}
+	if span.attributes["success"] != true {
+		t.Errorf("success attribute = %v", span.attributes["success"])
+	}
+
+	failed := tracer.named("tt:missing")
+	if len(failed) != 1 || len(failed[0].errors) != 1 || failed[0].attributes["success"] != false {
+		t.Fatalf("failed atom span = %+v, want one recorded error", failed)
+	}
+}
+
+func TestPipelineStepSpansNestUnderThePipeline(t *testing.T) {
+	tracer := &spanRecorder{}
+	r := newTestRuntime(t, RuntimeConfig{Tracer: tracer})
+	registerPassthrough(t, r)
+
+	engine := NewPipelineEngine(r)
+	pipeline, err := engine.CreatePipeline("traced", passSteps(2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := engine.Execute(pipeline, "payload"); !result.Success {
+		t.Fatalf("pipeline failed: %+v", result.Error)
+	}
+
+	pipelineSpans := tracer.named("pipeline:" + pipeline.ID)
+	if len(pipelineSpans) != 1 {
+		t.Fatalf("got %d pipeline spans, want 1", len(pipelineSpans))
+	}
+	for i := 0; i < 2; i++ {
+		steps := tracer.named(fmt.Sprintf("pipeline.step:%d", i))
+		if len(steps) != 1 || steps[0].parent != pipelineSpans[0].id {
+			t.Fatalf("step %d spans = %+v, want one child of the pipeline span", i, steps)
+		}
+	}
+
+	// Each atom span continues its step span
+	atoms := tracer.named("tt:pass")
+	if len(atoms) != 2 {
+		t.Fatalf("got %d atom spans, want 2", len(atoms))
+	}
+	for i, atom := range atoms {
+		if step := tracer.named(fmt.Sprintf("pipeline.step:%d", i))[0]; atom.parent != step.id {
+			t.Errorf("atom span %d parent = %q, want step span %q", i, atom.parent, step.id)
+		}
+	}
+}
+
+// ============================================================================
+// Middleware
+// ============================================================================
+
+func TestMiddlewaresWrapHandlersInRegistrationOrder(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var order []string
+	mustRegister(t, r, "tt", "traced", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		order = append(order, "handler")
+		return ctx.Context.Value(spanContextKey{}), nil
+	}, PacketMetadata{})
+
+	trace := func(name string) Middleware {
+		return func(next PacketHandler) PacketHandler {
+			return func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+				if ctx.PacketKey != "tt:traced" || ctx.Atom == nil {
+					t.Errorf("%s got context %+v", name, ctx)
+				}
+				order = append(order, name+" before")
+				result, err := next(data, ctx)
+				order = append(order, name+" after")
+				return result, err
+			}
+		}
+	}
+	r.Use(trace("outer"))
+	r.Use(trace("inner"))
+	// Middleware may enrich the context seen by the handler
+	r.Use(func(next PacketHandler) PacketHandler {
+		return func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+			ctx.Context = context.WithValue(ctx.Context, spanContextKey{}, "enriched")
+			return next(data, ctx)
+		}
+	})
+
+	result := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "traced"})
+	if !result.Success || result.Data != "enriched" {
+		t.Fatalf("result = %+v, want the enriched context value", result)
+	}
+	want := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+}
+
+func TestMiddlewareCanShortCircuit(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	called := false
+	mustRegister(t, r, "tt", "blocked", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		called = true
+		return nil, nil
+	}, PacketMetadata{})
+	r.Use(func(next PacketHandler) PacketHandler {
+		return func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+			if data["valid"] != true {
+				return nil, &AtomError{Code: "E422", Message: "rejected by middleware"}
+			}
+			return next(data, ctx)
+		}
+	})
+
+	result := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "blocked"})
+	if result.Success || result.Error.Code != "E422" || called {
+		t.Fatalf("result = %+v (handler called %v), want E422 without the handler", result, called)
+	}
+	result = r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "blocked", Data: map[string]interface{}{"valid": true}})
+	if !result.Success || !called {
+		t.Fatalf("valid atom = %+v, want the handler to run", result)
+	}
+}
+
+// ============================================================================
+// Lifecycle hooks
+// ============================================================================
+
+func TestProcessHooksFireInOrderOnSuccessAndFailure(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+
+	var events []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		r.OnBeforeProcess(func(atom *Atom) {
+			events = append(events, name+" before "+atom.ID)
+		})
+		r.OnAfterProcess(func(atom *Atom, result *AtomResult) {
+			code := "ok"
+			if result.Error != nil {
+				code = result.Error.Code
+			}
+			events = append(events, name+" after "+atom.ID+" "+code)
+		})
+	}
+
+	r.ProcessAtom(&Atom{ID: "good", Group: "tt", Element: "pass"})
+	r.ProcessAtom(&Atom{ID: "bad", Group: "tt", Element: "missing"})
+
+	want := []string{
+		"first before good", "second before good", "first after good ok", "second after good ok",
+		"first before bad", "second before bad", "first after bad E404", "second after bad E404",
+	}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+}
+
+func TestAfterHooksCannotAlterTheResult(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	r.OnAfterProcess(func(atom *Atom, result *AtomResult) {
+		result.Success = false
+		result.Error = &AtomError{Code: "E500", Message: "tampered"}
+		result.Meta["request_id"] = "tampered"
+	})
+
+	result := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "pass"})
+	if !result.Success || result.Error != nil || result.Meta["request_id"] == "tampered" {
+		t.Fatalf("after-hook changed the response: %+v", result)
+	}
+}
+
+func TestAfterHooksCannotAlterTheResultData(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "report", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return map[string]interface{}{"items": []interface{}{"a"}}, nil
+	}, PacketMetadata{})
+	r.OnAfterProcess(func(atom *Atom, result *AtomResult) {
+		data := result.Data.(map[string]interface{})
+		data["x"] = "tampered"
+		data["items"].([]interface{})[0] = "tampered"
+	})
+
+	result := runAtom(r, "tt", "report", nil)
+	if want := map[string]interface{}{"items": []interface{}{"a"}}; !reflect.DeepEqual(result.Data, want) {
+		t.Fatalf("after-hook changed the response data: %v", result.Data)
+	}
+}
+
+func TestBeforeHooksCannotAlterTheAtom(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	registerGuarded(t, r)
+	r.OnBeforeProcess(func(atom *Atom) {
+		atom.Element = "guarded"
+		atom.Data["input"] = "tampered"
+		atom.Meta["permissions"] = []interface{}{"read", "write"}
+		if atom.Caller != nil {
+			atom.Caller.Permissions = append(atom.Caller.Permissions, "write")
+		}
+	})
+
+	atom := &Atom{
+		ID:      newTestAtomID(),
+		Group:   "tt",
+		Element: "pass",
+		Data:    map[string]interface{}{"input": "original"},
+		Meta:    map[string]interface{}{},
+	}
+	if result := r.ProcessAtom(atom); !result.Success || result.Data != "original" {
+		t.Fatalf("before-hook changed the atom: %+v", result)
+	}
+	if atom.Element != "pass" || atom.Meta["permissions"] != nil {
+		t.Fatalf("before-hook changed the caller's atom: %+v", atom)
+	}
+
+	reader := &Caller{ID: "bob", Permissions: []string{"read"}}
+	guarded := &Atom{ID: newTestAtomID(), Group: "tt", Element: "guarded", Data: map[string]interface{}{}, Meta: map[string]interface{}{}, Caller: reader}
+	if result := r.ProcessAtom(guarded); result.Success || result.Error.Code != "E403" {
+		t.Fatalf("before-hook granted a permission: %+v", result)
+	}
+}
+
+// ============================================================================
+// Plugins
+// ============================================================================
+
+func packetCalls(r *PacketFlowRuntime, key string) int64 {
+	entries, _ := r.PacketStatsReport()
+	return entries[key].Stats.Calls
+}
+
+func TestReRegisteringAPacketKeepsItsStats(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	for i := 0; i < 3; i++ {
+		r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "pass"})
+	}
+
+	registerPassthrough(t, r)
+	r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "pass"})
+	if calls := packetCalls(r, "tt:pass"); calls != 4 {
+		t.Fatalf("calls after re-registering = %d, want 4", calls)
+	}
+}
+
+func TestLatestPluginVersionsKeepsTheNewestPerName(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Now().Add(-time.Hour)
+	for i, name := range []string{"transforms-1.so", "transforms-v3.so", "transforms-2.so", "my-tools.so", "extras.so"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, base, base.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := latestPluginVersions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	// transforms-2.so was deployed last
+	if got, want := strings.Join(names, ","), "extras.so,my-tools.so,transforms-2.so"; got != want {
+		t.Fatalf("selected %s, want %s", got, want)
+	}
+}
+
+// buildTestPlugin compiles a plugin whose tt:plugged packet returns version,
+// skipping the test where plugins cannot be built or loaded
+func buildTestPlugin(t *testing.T, dir, name, version string) string {
+	t.Helper()
+	src := t.TempDir()
+	source := `package main
+
+var Packets = map[string]func(data map[string]interface{}) (interface{}, error){
+	"tt:plugged": func(data map[string]interface{}) (interface{}, error) { return "` + version + `", nil },
+}
+
+var Metadata = map[string]string{"tt:plugged": ` + "`" + `{"description": "test plugin"}` + "`" + `}
+`
+	if err := os.WriteFile(filepath.Join(src, "main.go"), []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "go.mod"), []byte("module testplugin/"+strings.TrimSuffix(name, ".so")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, name)
+	cmd := exec.Command("go", "build", "-buildmode=plugin", "-o", path, ".")
+	cmd.Dir = src
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("cannot build plugins here: %v\n%s", err, output)
+	}
+	return path
+}
+
+func TestReloadPluginsLoadsNewVersions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds plugins")
+	}
+	dir := t.TempDir()
+	first := buildTestPlugin(t, dir, "plugged-1.so", "v1")
+	if _, err := plugin.Open(first); err != nil {
+		t.Skipf("cannot load plugins here: %v", err)
+	}
+
+	r := newTestRuntime(t, RuntimeConfig{PluginDir: dir})
+	run := func() interface{} {
+		result := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "plugged"})
+		if !result.Success {
+			t.Fatalf("plugin packet failed: %+v", result.Error)
+		}
+		return result.Data
+	}
+	// The runtime loads the plugin directory at startup
+	if data := run(); data != "v1" {
+		t.Fatalf("plugin returned %v, want v1", data)
+	}
+	if count, _ := r.ReloadPlugins(); count != 0 {
+		t.Fatalf("unchanged reload registered %d packets", count)
+	}
+
+	second := buildTestPlugin(t, dir, "plugged-2.so", "v2")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(second, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := r.ReloadPlugins(); err != nil || count != 1 {
+		t.Fatalf("upgrade reload = %d, %v; want 1 packet", count, err)
+	}
+	if data := run(); data != "v2" {
+		t.Fatalf("plugin returned %v after upgrade, want v2", data)
+	}
+	if calls := packetCalls(r, "tt:plugged"); calls != 2 {
+		t.Fatalf("calls across versions = %d, want 2", calls)
+	}
+}
+
+// ============================================================================
+// Expressions
+// ============================================================================
+
+func TestEvalPacketComputesOverInput(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	input := map[string]interface{}{
+		"price": 12.5,
+		"qty":   4,
+		"user":  map[string]interface{}{"name": "ada"},
+		"huge":  1e300,
+		"tiny":  -1e300,
+	}
+	cases := map[string]interface{}{
+		"price * qty + 1":                           51.0,
+		"(1 + 2) * 3 - 4 / 2":                       7.0,
+		"price * qty > 40 && qty <= 4":              true,
+		`upper(user.name) == "ADA"`:                 true,
+		`concat(user.name, "-", str(qty))`:          "ada-4",
+		`substr("lovelace", 4)`:                     "lace",
+		`substr("lovelace", 0, 4)`:                  "love",
+		`substr("abc", 0, huge)`:                    "abc",
+		`substr("abc", huge)`:                       "",
+		`substr("abc", tiny, 2)`:                    "ab",
+		`if(contains(user.name, "d"), "yes", "no")`: "yes",
+	}
+	for expression, want := range cases {
+		data := resultMap(t, runAtom(r, "df", "eval", map[string]interface{}{"expression": expression, "input": input}))
+		if data["result"] != want {
+			t.Errorf("%s = %v (%T), want %v", expression, data["result"], data["result"], want)
+		}
+	}
+}
+
+func TestEvalRejectsNonFiniteSubstrBounds(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	input := map[string]interface{}{"nan": math.NaN(), "inf": math.Inf(1)}
+	for _, expression := range []string{`substr("abc", nan)`, `substr("abc", 0, nan)`, `substr("abc", inf)`, `substr("abc", 0, inf)`} {
+		_, _, err := r.utils.EvaluateExpression(expression, input, 0)
+		if err == nil || !strings.Contains(err.Error(), "finite") {
+			t.Errorf("%s: err = %v, want a finite-number error", expression, err)
+		}
+	}
+}
+
+func TestEvalEnforcesTheStepLimit(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	expression := "1" + strings.Repeat(" + 1", 50)
+
+	data := resultMap(t, runAtom(r, "df", "eval", map[string]interface{}{"expression": expression}))
+	if data["result"] != 51.0 {
+		t.Fatalf("result = %v, want 51", data["result"])
+	}
+	result := runAtom(r, "df", "eval", map[string]interface{}{"expression": expression, "max_steps": 10})
+	if result.Success || !strings.Contains(result.Error.Message, "evaluation steps") {
+		t.Fatalf("result = %+v, want a step-limit error", result)
+	}
+	if _, _, err := r.utils.EvaluateExpression(strings.Repeat("a", MaxExpressionLength+1), nil, 0); err == nil {
+		t.Fatal("oversized expression was evaluated")
+	}
+}
+
+// ============================================================================
+// Version negotiation
+// ============================================================================
+
+func containsString(items []string, want string) bool {
+	for _, item := range items {
+		if item == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVersionReflectsEnabledFeatures(t *testing.T) {
+	plain := resultMap(t, runAtom(newTestRuntime(t, RuntimeConfig{}), "cf", "version", nil))
+	features := plain["features"].([]string)
+	for _, feature := range []string{"authentication", "idempotency", "tracing", "rate_limiting"} {
+		if containsString(features, feature) {
+			t.Errorf("default runtime advertises %q", feature)
+		}
+	}
+	if _, exists := plain["min_client_version"]; exists {
+		t.Error("min_client_version advertised without being configured")
+	}
+	codecNames := plain["codecs"].([]string)
+	if !containsString(codecNames, "json") || !containsString(codecNames, "msgpack") {
+		t.Errorf("codecs = %v, want json and msgpack", codecNames)
+	}
+	if codes := plain["message_types"].(map[string]int); len(codes) == 0 {
+		t.Error("no message types advertised")
+	}
+
+	r := newTestRuntime(t, RuntimeConfig{
+		APIKeys:            []string{"secret"},
+		IdempotencyEnabled: true,
+		RateLimit:          10,
+		Tracer:             &spanRecorder{},
+		MinClientVersion:   "1.2.0",
+	})
+	configured := resultMap(t, runAtom(r, "cf", "version", map[string]interface{}{"client_version": "1.1.9"}))
+	features = configured["features"].([]string)
+	for _, feature := range []string{"authentication", "idempotency", "tracing", "rate_limiting"} {
+		if !containsString(features, feature) {
+			t.Errorf("features %v missing %q", features, feature)
+		}
+	}
+	if configured["min_client_version"] != "1.2.0" || configured["compatible"] != false {
+		t.Errorf("min_client_version = %v, compatible = %v; want 1.2.0 and false", configured["min_client_version"], configured["compatible"])
+	}
+	if upgraded := resultMap(t, runAtom(r, "cf", "version", map[string]interface{}{"client_version": "1.10.0"})); upgraded["compatible"] != true {
+		t.Error("client 1.10.0 reported incompatible with minimum 1.2.0")
+	}
+}
+
+// ============================================================================
+// Introspection
+// ============================================================================
+
+// getJSON fetches url, decoding the response into out
+func getJSON(t *testing.T, url string, out interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func TestDescribeReturnsMetadataStatsAndSchema(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "custom", "", okHandler, PacketMetadata{
+		Description: "custom packet",
+		InputSchema: Schema{"name": {Type: "string", Required: true}},
+	})
+	runAtom(r, "tt", "custom", map[string]interface{}{"name": "ada"})
+
+	builtin := resultMap(t, runAtom(r, "cf", "describe", map[string]interface{}{"packet": "df:transform"}))
+	if builtin["key"] != "df:transform" || builtin["metadata"].(PacketMetadata).ComplianceLevel == 0 {
+		t.Fatalf("df:transform description = %+v", builtin)
+	}
+	if result := runAtom(r, "cf", "describe", map[string]interface{}{"packet": "tt:missing"}); result.Success {
+		t.Fatal("described a missing packet")
+	}
+
+	_, server := newTestServer(t, r)
+	var custom struct {
+		Key          string         `json:"key"`
+		Metadata     PacketMetadata `json:"metadata"`
+		Stats        PacketStats    `json:"stats"`
+		RegisteredAt time.Time      `json:"registered_at"`
+		InputSchema  Schema         `json:"input_schema"`
+	}
+	if status := getJSON(t, server.URL+"/packets/tt:custom", &custom); status != http.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if custom.Metadata.Description != "custom packet" || custom.Stats.Calls != 1 || custom.RegisteredAt.IsZero() {
+		t.Fatalf("tt:custom description = %+v", custom)
+	}
+	if field, ok := custom.InputSchema["name"]; !ok || field.Type != "string" || !field.Required {
+		t.Fatalf("input schema = %+v", custom.InputSchema)
+	}
+
+	var missing map[string]interface{}
+	if status := getJSON(t, server.URL+"/packets/tt:missing", &missing); status != http.StatusNotFound {
+		t.Fatalf("missing packet status = %d, want 404", status)
+	}
+	var listing struct {
+		Packets []string `json:"packets"`
+	}
+	getJSON(t, server.URL+"/packets/", &listing)
+	if !containsString(listing.Packets, "tt:custom") || !containsString(listing.Packets, "df:transform") {
+		t.Fatalf("listing = %v", listing.Packets)
+	}
+}
+
+// ============================================================================
+// Versioned variants
+// ============================================================================
+
+func TestVersionVariantsResolveLatestAndFallBack(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	packetKey := func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return ctx.PacketKey, nil
+	}
+	for _, variant := range []string{"", "v1", "v2", "v2.1", "v10"} {
+		mustRegister(t, r, "tt", "calc", variant, packetKey, PacketMetadata{})
+	}
+
+	run := func(variant string) *AtomResult {
+		return r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "calc", Variant: &variant})
+	}
+	cases := map[string]string{
+		"v2":     "tt:calc:v2",
+		"latest": "tt:calc:v10",
+		"v2.5":   "tt:calc:v2.1",
+		"v1.3":   "tt:calc:v1",
+		"v3":     "tt:calc",
+	}
+	for variant, want := range cases {
+		if result := run(variant); !result.Success || result.Data != want {
+			t.Errorf("variant %s resolved to %v, want %s", variant, result.Data, want)
+		}
+	}
+	if result := run("beta"); result.Success || result.Error.Code != "E404" {
+		t.Errorf("non-version variant = %+v, want E404", result)
+	}
+
+	// Without a base packet a missing version has nowhere to fall back to
+	mustRegister(t, r, "tt", "only", "v1", packetKey, PacketMetadata{})
+	v2 := "v2"
+	if result := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "only", Variant: &v2}); result.Success {
+		t.Errorf("v2 of a v1-only packet resolved to %v", result.Data)
+	}
+}
+
+// ============================================================================
+// Handler panics
+// ============================================================================
+
+func TestHandlerPanicsBecomeE500(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "panic", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		panic("boom")
+	}, PacketMetadata{})
+	registerPassthrough(t, r)
+
+	result := runAtom(r, "tt", "panic", nil)
+	if result.Success || result.Error.Code != "E500" || !strings.Contains(result.Error.Message, "boom") {
+		t.Fatalf("result = %+v, want an E500 naming the panic", result)
+	}
+	details, _ := result.Error.Details.(map[string]interface{})
+	if stack, _ := details["stack"].(string); !strings.Contains(stack, "goroutine") {
+		t.Errorf("details carry no stack: %v", result.Error.Details)
+	}
+	if errorCount := r.GetStats().Errors; errorCount != 1 {
+		t.Errorf("error count = %d, want 1", errorCount)
+	}
+	if calls := packetCalls(r, "tt:panic"); calls != 1 {
+		t.Errorf("packet calls = %d, want 1", calls)
+	}
+
+	// The runtime keeps serving
+	if result := runAtom(r, "tt", "pass", map[string]interface{}{"input": "still up"}); result.Data != "still up" {
+		t.Fatalf("atom after panic = %+v", result)
+	}
+}
+
+// ============================================================================
+// Abandoned handlers
+// ============================================================================
+
+// waitForGoroutines waits for the goroutine count to settle back to within
+// slack of baseline
+func waitForGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	const slack = 5
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline+slack {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines, baseline %d:\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// timeOutAtoms runs n atoms against element with a 30ms deadline, expecting
+// every one to time out
+func timeOutAtoms(t *testing.T, r *PacketFlowRuntime, element string, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	var failed int64
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deadline := time.Now().Add(30 * time.Millisecond).UnixMilli()
+			result := r.ProcessAtom(&Atom{
+				ID:      newTestAtomID(),
+				Group:   "tt",
+				Element: element,
+				Data:    map[string]interface{}{"ms": 60000},
+				Meta:    map[string]interface{}{DeadlineMeta: deadline},
+			})
+			if result.Success || result.Error.Code != "E408" {
+				atomic.AddInt64(&failed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed > 0 {
+		t.Fatalf("%d of %d atoms did not time out", failed, n)
+	}
+}
+
+func TestTimedOutHandlersDoNotLeakGoroutines(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 500, WorkerPoolSize: -1})
+	registerSleep(t, r)
+	release := registerGate(t, r)
+
+	baseline := runtime.NumGoroutine()
+
+	// Handlers honouring cancellation stop as soon as their atom times out
+	for round := 0; round < 3; round++ {
+		timeOutAtoms(t, r, "sleep", 100)
+		waitForGoroutines(t, baseline)
+	}
+	waitFor(t, "cancelled handlers to finish", func() bool { return r.GetStats().AbandonedHandlers == 0 })
+
+	// Handlers ignoring cancellation are tracked until they return
+	timeOutAtoms(t, r, "gate", 50)
+	if stats := r.GetStats(); stats.AbandonedHandlers != 50 || stats.AbandonedTotal < 50 {
+		t.Fatalf("abandoned = %d (total %d), want 50", stats.AbandonedHandlers, stats.AbandonedTotal)
+	}
+	close(release)
+	waitFor(t, "abandoned handlers to return", func() bool { return r.GetStats().AbandonedHandlers == 0 })
+	waitForGoroutines(t, baseline)
+}
+
+// ============================================================================
+// Concurrent stats
+// ============================================================================
+
+func TestConcurrentAtomsCountStatsExactly(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 100})
+	mustRegister(t, r, "tt", "flaky", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		if data["fail"] == true {
+			return nil, fmt.Errorf("failed")
+		}
+		return nil, nil
+	}, PacketMetadata{})
+
+	const workers, perWorker = 20, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				runAtom(r, "tt", "flaky", map[string]interface{}{"fail": i%5 == 0})
+				// Readers run alongside the writers
+				if i%10 == 0 {
+					r.GetStats()
+					r.PacketStatsReport()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	entries, _ := r.PacketStatsReport()
+	stats := entries["tt:flaky"].Stats
+	if stats.Calls != workers*perWorker || stats.Errors != workers*perWorker/5 {
+		t.Fatalf("packet stats = %d calls / %d errors, want %d / %d", stats.Calls, stats.Errors, workers*perWorker, workers*perWorker/5)
+	}
+	if runtimeStats := r.GetStats(); runtimeStats.Processed != workers*perWorker || runtimeStats.Errors != workers*perWorker/5 {
+		t.Fatalf("runtime stats = %d processed / %d errors", runtimeStats.Processed, runtimeStats.Errors)
+	}
+}
+
+// ============================================================================
+// Error rate
+// ============================================================================
+
+func TestErrorRateWithNothingProcessed(t *testing.T) {
+	if rate := (RuntimeStats{}).ErrorRate(); rate != 0 {
+		t.Fatalf("ErrorRate() = %v, want 0", rate)
+	}
+	if rate := (RuntimeStats{Processed: 4, Errors: 1}).ErrorRate(); rate != 25 {
+		t.Fatalf("ErrorRate() = %v, want 25", rate)
+	}
+
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	mustRegister(t, r, "tt", "fail", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return nil, fmt.Errorf("failed")
+	}, PacketMetadata{})
+	if stats := r.GetStats(); stats.AvgLatency != 0 || stats.ErrorRate() != 0 {
+		t.Fatalf("fresh runtime avg latency %v, error rate %v", stats.AvgLatency, stats.ErrorRate())
+	}
+	if description, _ := r.DescribePacket("tt:pass"); description["stats"].(PacketStats).AvgDuration != 0 {
+		t.Fatal("uncalled packet has an average duration")
+	}
+
+	_, server := newTestServer(t, r)
+	var stats struct {
+		Runtime map[string]interface{} `json:"runtime"`
+	}
+	if status := getJSON(t, server.URL+"/stats", &stats); status != http.StatusOK {
+		t.Fatalf("stats status = %d", status)
+	}
+	if stats.Runtime["error_rate_percent"] != 0.0 {
+		t.Fatalf("error_rate_percent = %v, want 0", stats.Runtime["error_rate_percent"])
+	}
+
+	runAtom(r, "tt", "pass", nil)
+	runAtom(r, "tt", "fail", nil)
+	getJSON(t, server.URL+"/stats", &stats)
+	if stats.Runtime["error_rate_percent"] != 50.0 {
+		t.Fatalf("error_rate_percent = %v, want 50", stats.Runtime["error_rate_percent"])
+	}
+}
+
+// ============================================================================
+// Atom ID validation
+// ============================================================================
+
+func TestUUIDIDsAreRequiredAtIngressOnly(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{RequireUUIDIDs: true, AutoGenerateAtomID: true})
+	registerPassthrough(t, r)
+	_, server := newTestServer(t, r)
+
+	var result AtomResult
+	body := `{"id": "not-a-uuid", "g": "tt", "e": "pass"}`
+	if status := postJSON(t, server.URL+"/submit", "", body, &result); status != http.StatusBadRequest || result.Error.Code != "E400" {
+		t.Fatalf("non-UUID submit: status %d, error %+v; want 400 E400", status, result.Error)
+	}
+	body = `[{"id": "` + uuid.New().String() + `", "g": "tt", "e": "pass"}, {"id": "bad", "g": "tt", "e": "pass"}]`
+	if status := postJSON(t, server.URL+"/submit", "", body, nil); status != http.StatusBadRequest {
+		t.Fatalf("batch with a non-UUID ID: status %d, want 400", status)
+	}
+	body = `{"id": "` + uuid.New().String() + `", "g": "tt", "e": "pass", "d": {"input": "ok"}}`
+	if status := postJSON(t, server.URL+"/submit", "", body, nil); status != http.StatusOK {
+		t.Fatalf("UUID submit: status %d, want 200", status)
+	}
+	if status := postJSON(t, server.URL+"/submit", "", `{"g": "tt", "e": "pass"}`, nil); status != http.StatusOK {
+		t.Fatalf("submit with a generated ID: status %d, want 200", status)
+	}
+
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+	frame := encodeFrame(t, JSONCodec{}, Message{
+		Type:      handler.getMessageTypeCode("submit"),
+		Timestamp: time.Now().Unix(),
+		Data:      map[string]interface{}{"id": "not-a-uuid", "g": "tt", "e": "pass"},
+	})
+	response, err := handler.HandleMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := replyError(t, handler, response); code != "E400" {
+		t.Fatalf("binary submit reply code %q, want E400", code)
+	}
+
+	conn, _, err := dialWebSocket(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"id": "not-a-uuid", "g": "tt", "e": "pass"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&result); err != nil || result.Success || result.Error.Code != "E400" {
+		t.Fatalf("WebSocket JSON submit: %v %+v, want E400", err, result.Error)
+	}
+
+	// Atoms the runtime creates for pipeline steps are not client atoms
+	engine := NewPipelineEngine(r)
+	pipeline, err := engine.CreatePipeline("internal-ids", passSteps(2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := engine.Execute(pipeline, "payload"); !result.Success {
+		t.Fatalf("pipeline under RequireUUIDIDs failed: %+v", result.Error)
+	}
+}
+
+func TestDuplicateInFlightIDsAreRejected(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{RejectDuplicateInFlight: true})
+	release := registerGate(t, r)
+	registerPassthrough(t, r)
+
+	first := make(chan *AtomResult, 1)
+	go func() {
+		first <- r.ProcessAtom(&Atom{ID: "busy", Group: "tt", Element: "gate"})
+	}()
+	waitFor(t, "the first atom to start", func() bool { return r.GetStats().ActiveAtoms == 1 })
+
+	if result := r.ProcessAtom(&Atom{ID: "busy", Group: "tt", Element: "pass"}); result.Success || result.Error.Code != "E409" {
+		t.Fatalf("duplicate in flight = %+v, want E409", result)
+	}
+	if result := r.ProcessAtom(&Atom{ID: "other", Group: "tt", Element: "pass"}); !result.Success {
+		t.Fatalf("distinct ID failed: %+v", result.Error)
+	}
+
+	close(release)
+	if result := <-first; !result.Success {
+		t.Fatalf("first atom failed: %+v", result.Error)
+	}
+	if result := r.ProcessAtom(&Atom{ID: "busy", Group: "tt", Element: "pass"}); !result.Success {
+		t.Fatalf("ID reused after completion: %+v", result.Error)
+	}
+}
+
+// ============================================================================
+// Group validation
+// ============================================================================
+
+func TestGroupValidation(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ValidateGroups: true})
+	cases := []struct {
+		group, code, message string
+	}{
+		{"df", "", ""},
+		{"xx", "E400", `unknown group "xx"`},
+		{"dfx", "E400", "group must be 2 characters"},
+	}
+	for _, tc := range cases {
+		result := runAtom(r, tc.group, "transform", map[string]interface{}{"input": "abc", "operation": "uppercase"})
+		if tc.code == "" {
+			if !result.Success {
+				t.Errorf("group %s: %+v", tc.group, result.Error)
+			}
+			continue
+		}
+		if result.Success || result.Error.Code != tc.code || !strings.Contains(result.Error.Message, tc.message) {
+			t.Errorf("group %s = %+v, want %s containing %q", tc.group, result.Error, tc.code, tc.message)
+		}
+	}
+
+	// An allowed group without the packet is an unknown packet, not group
+	if result := runAtom(r, "mc", "nothing", nil); result.Success || result.Error.Code != "E404" {
+		t.Errorf("unknown packet in an allowed group = %+v, want E404", result.Error)
+	}
+	// Without validation an unknown group falls through to packet lookup
+	if result := runAtom(newTestRuntime(t, RuntimeConfig{}), "xx", "transform", nil); result.Success || result.Error.Code != "E404" {
+		t.Errorf("unvalidated unknown group = %+v, want E404", result.Error)
+	}
+
+	custom := newTestRuntime(t, RuntimeConfig{ValidateGroups: true, AllowedGroups: []string{"tt"}})
+	registerPassthrough(t, custom)
+	if result := runAtom(custom, "tt", "pass", nil); !result.Success {
+		t.Errorf("custom allowed group: %+v", result.Error)
+	}
+	if result := runAtom(custom, "df", "transform", nil); result.Success || !strings.Contains(result.Error.Message, "allowed: tt") {
+		t.Errorf("group outside the custom set = %+v", result.Error)
+	}
+}
+
+// ============================================================================
+// Pipeline limits
+// ============================================================================
+
+// nestedInput builds a value nested depth maps deep
+func nestedInput(depth int) interface{} {
+	var value interface{} = "leaf"
+	for i := 0; i < depth; i++ {
+		value = map[string]interface{}{"next": value}
+	}
+	return value
+}
+
+func TestPipelineLimitsRejectOversizedWork(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	engine := NewPipelineEngine(r)
+	engine.SetLimits(3, 4)
+
+	if _, err := engine.CreatePipeline("too-long", passSteps(4), nil); err == nil || !strings.Contains(err.Error(), "exceeding the maximum of 3") {
+		t.Fatalf("CreatePipeline with 4 steps: %v, want a step limit error", err)
+	}
+	pipeline, err := engine.CreatePipeline("at-limit", passSteps(3), nil)
+	if err != nil {
+		t.Fatalf("CreatePipeline at the limit: %v", err)
+	}
+	if result := engine.Execute(pipeline, nestedInput(3)); !result.Success {
+		t.Fatalf("pipeline at the limits failed: %+v", result.Error)
+	}
+
+	// Pipelines built without CreatePipeline are checked on execution
+	oversized := &Pipeline{ID: "built", Steps: passSteps(5), Meta: map[string]interface{}{}}
+	if result := engine.Execute(oversized, nil); result.Success || result.Error.Code != "E413" {
+		t.Fatalf("oversized pipeline = %+v, want E413", result.Error)
+	}
+	if result := engine.Execute(pipeline, nestedInput(6)); result.Success || result.Error.Code != "E413" || !strings.Contains(result.Error.Message, "nested deeper") {
+		t.Fatalf("deeply nested input = %+v, want E413", result.Error)
+	}
+
+	// Non-positive limits leave the current ones in place
+	engine.SetLimits(0, -1)
+	if _, err := engine.CreatePipeline("still-too-long", passSteps(4), nil); err == nil {
+		t.Fatal("SetLimits(0, -1) lifted the step limit")
+	}
+}
+
+// ============================================================================
+// Windowed aggregation
+// ============================================================================
+
+func TestWindowMatchesHandComputedAggregates(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	numbers := []interface{}{1, 2, 3, 4, 5}
+	objects := []interface{}{
+		map[string]interface{}{"v": 1}, map[string]interface{}{"v": 2}, map[string]interface{}{"v": 3},
+		map[string]interface{}{"v": 4}, map[string]interface{}{"v": 5},
+	}
+	cases := []struct {
+		name       string
+		data       map[string]interface{}
+		want       string
+		startIndex int
+	}{
+		{"trailing moving average", map[string]interface{}{"window": 3}, "[1 1.5 2 3 4]", 0},
+		{"trailing sum dropping edges", map[string]interface{}{"window": 3, "operation": "sum", "edges": "drop"}, "[6 9 12]", 2},
+		{"centered average with null edges", map[string]interface{}{"window": 3, "align": "centered", "edges": "null"}, "[<nil> 2 3 4 <nil>]", 0},
+		{"centered even window max", map[string]interface{}{"window": 4, "align": "centered", "operation": "max"}, "[3 4 5 5 5]", 0},
+		{"field minimum", map[string]interface{}{"window": 2, "operation": "min", "field": "v", "input": objects}, "[1 1 2 3 4]", 0},
+	}
+	for _, tc := range cases {
+		if _, exists := tc.data["input"]; !exists {
+			tc.data["input"] = numbers
+		}
+		data := resultMap(t, runAtom(r, "df", "window", tc.data))
+		if got := fmt.Sprint(data["values"]); got != tc.want {
+			t.Errorf("%s: values = %s, want %s", tc.name, got, tc.want)
+		}
+		if data["start_index"] != tc.startIndex {
+			t.Errorf("%s: start_index = %v, want %d", tc.name, data["start_index"], tc.startIndex)
+		}
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"input": numbers, "window": 0},
+		{"input": numbers, "window": 2, "operation": "median"},
+		{"input": numbers, "window": 2, "edges": "wrap"},
+		{"input": "not an array", "window": 2},
+	} {
+		if result := runAtom(r, "df", "window", invalid); result.Success {
+			t.Errorf("invalid window request %v succeeded", invalid)
+		}
+	}
+}
+
+// ============================================================================
+// Parsing transforms
+// ============================================================================
+
+func TestParsingTransforms(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	european := map[string]interface{}{"decimal_separator": ","}
+	cases := []struct {
+		operation string
+		input     interface{}
+		params    map[string]interface{}
+		want      interface{}
+	}{
+		{"parse_int", "1,234", nil, int64(1234)},
+		{"parse_int", "1.234", european, int64(1234)},
+		{"parse_int", "12 345", nil, int64(12345)},
+		{"parse_int", 42.0, nil, int64(42)},
+		{"parse_float", "1,234.56", nil, 1234.56},
+		{"parse_float", "1.234,56", european, 1234.56},
+		{"parse_float", "1'234.5", nil, 1234.5},
+		{"parse_float", "1 234,5", map[string]interface{}{"decimal_separator": ",", "thousands_separator": " "}, 1234.5},
+		{"parse_date", "2024-01-15", nil, int64(1705276800)},
+		{"parse_date", "2024-01-15T10:30:00+02:00", nil, int64(1705307400)},
+		{"parse_date", "Jan 15, 2024", nil, int64(1705276800)},
+		{"parse_date", "15/01/2024", map[string]interface{}{"layout": "02/01/2006"}, int64(1705276800)},
+		{"format_date", 1705276800, nil, "2024-01-15T00:00:00Z"},
+		{"format_date", "1705276800", map[string]interface{}{"layout": "2006-01-02 15:04", "timezone": "America/New_York"}, "2024-01-14 19:00"},
+	}
+	for _, tc := range cases {
+		got, err := r.utils.TransformWithParams(tc.input, tc.operation, tc.params)
+		if err != nil || got != tc.want {
+			t.Errorf("%s(%v, %v) = %v (%T), %v; want %v", tc.operation, tc.input, tc.params, got, got, err, tc.want)
+		}
+	}
+
+	invalid := []struct {
+		operation string
+		input     interface{}
+		params    map[string]interface{}
+		message   string
+	}{
+		{"parse_int", "12.5", nil, `invalid integer "12.5"`},
+		{"parse_int", 12.5, nil, "not an integer"},
+		{"parse_float", "twelve", nil, `invalid number "twelve"`},
+		{"parse_date", "yesterday", nil, `unrecognised date "yesterday"`},
+		{"parse_date", "2024-01-15", map[string]interface{}{"layout": "02/01/2006"}, "unrecognised date"},
+		{"format_date", "soon", nil, "unix timestamp"},
+		{"format_date", 0, map[string]interface{}{"timezone": "Mars/Olympus"}, "unknown timezone"},
+	}
+	for _, tc := range invalid {
+		if _, err := r.utils.TransformWithParams(tc.input, tc.operation, tc.params); err == nil || !strings.Contains(err.Error(), tc.message) {
+			t.Errorf("%s(%v): err = %v, want %q", tc.operation, tc.input, err, tc.message)
+		}
+	}
+
+	// The packet passes params through
+	data := resultMap(t, runAtom(r, "df", "transform", map[string]interface{}{
+		"input": "1.234,5", "operation": "parse_float", "params": european,
+	}))
+	if data["result"] != 1234.5 {
+		t.Fatalf("df:transform parse_float = %v, want 1234.5", data["result"])
+	}
+}
+
+// ============================================================================
+// Aggregate statistics
+// ============================================================================
+
+func TestAggregateStatisticsMatchCalculateStatistics(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	values := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	input := make([]interface{}, len(values))
+	for i, v := range values {
+		input[i] = map[string]interface{}{"m": v, "s": v, "v": v}
+	}
+	// A row without the fields is ignored
+	input = append(input, map[string]interface{}{"other": 1})
+
+	data := resultMap(t, runAtom(r, "df", "aggregate", map[string]interface{}{
+		"input":      input,
+		"operations": map[string]interface{}{"m": "median", "s": "stddev", "v": "variance"},
+	}))
+	aggregated := data["aggregated"].([]map[string]interface{})[0]
+
+	statistics := r.utils.CalculateStatistics(values)
+	want := map[string]interface{}{
+		"m": statistics["median"],
+		"s": statistics["standard_deviation"],
+		"v": statistics["variance"],
+	}
+	for field, expected := range want {
+		if aggregated[field] != expected {
+			t.Errorf("%s = %v, want %v", field, aggregated[field], expected)
+		}
+	}
+	// Hand-computed: mean 5, variance 4
+	if aggregated["m"] != 4.5 || aggregated["s"] != 2.0 || aggregated["v"] != 4.0 {
+		t.Errorf("aggregated = %v, want median 4.5, stddev 2, variance 4", aggregated)
+	}
+
+	empty := resultMap(t, runAtom(r, "df", "aggregate", map[string]interface{}{
+		"input":      []interface{}{},
+		"operations": map[string]interface{}{"m": "median"},
+	}))
+	if _, exists := empty["aggregated"].([]map[string]interface{})[0]["m"]; exists {
+		t.Error("median of no values was reported")
+	}
+}
+
+// ============================================================================
+// Resource quotas
+// ============================================================================
+
+func TestAllocateUntilQuotaExhausted(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ResourceQuotas: map[string]float64{"gpu": 4}})
+
+	allocate := func(amount float64) *AtomResult {
+		return runAtom(r, "rm", "allocate", map[string]interface{}{"resource": "gpu", "amount": amount})
+	}
+	for i := 0; i < 2; i++ {
+		if data := resultMap(t, allocate(2)); data["allocation_id"] == "" {
+			t.Fatalf("allocation %d has no ID", i)
+		}
+	}
+	if result := allocate(1); result.Success || result.Error.Code != "E507" {
+		t.Fatalf("allocation past the quota = %+v, want E507", result.Error)
+	}
+	if result := runAtom(r, "rm", "allocate", map[string]interface{}{"resource": "tpu", "amount": 1}); result.Success {
+		t.Fatal("allocated an unconfigured resource")
+	}
+
+	report := resultMap(t, runAtom(r, "rm", "quota", nil))["quotas"].(map[string]interface{})["gpu"].(map[string]interface{})
+	if report["limit"] != 4.0 || report["used"] != 4.0 || report["available"] != 0.0 || report["allocations"] != 2 {
+		t.Fatalf("gpu report = %v, want 4 of 4 used by 2 allocations", report)
+	}
+
+	// Forced cleanup returns every reservation
+	if data := resultMap(t, runAtom(r, "rm", "cleanup", map[string]interface{}{"force": true})); data["allocations_released"] != 2 {
+		t.Fatalf("forced cleanup released %v allocations, want 2", data["allocations_released"])
+	}
+	if result := allocate(4); !result.Success {
+		t.Fatalf("allocation after cleanup: %+v", result.Error)
+	}
+}
+
+func TestExpiredAllocationsReturnTheirQuota(t *testing.T) {
+	quotas := NewQuotaManager(map[string]float64{"memory": 10})
+	if _, err := quotas.Allocate("memory", 8, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := quotas.Allocate("memory", 5, time.Minute); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("over-quota allocation: %v, want ErrQuotaExceeded", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	// Allocate releases expired reservations before checking availability
+	if _, err := quotas.Allocate("memory", 5, time.Minute); err != nil {
+		t.Fatalf("allocation after expiry: %v", err)
+	}
+	if used := quotas.Report()["memory"].(map[string]interface{})["used"]; used != 5.0 {
+		t.Fatalf("used = %v, want 5", used)
+	}
+}
+
+// ============================================================================
+// Allocation reaper
+// ============================================================================
+
+// outstandingAllocations counts allocations without the lazy expiry of Report
+func outstandingAllocations(q *QuotaManager) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.allocations)
+}
+
+func TestReaperReleasesExpiredAllocations(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ReapInterval: 5})
+	if _, err := r.quotas.Allocate("memory", 100, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	kept, err := r.quotas.Allocate("memory", 50, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the reaper to release the expired allocation", func() bool { return outstandingAllocations(r.quotas) == 1 })
+
+	data := resultMap(t, runAtom(r, "rm", "release", map[string]interface{}{"allocation_id": kept.ID}))
+	if data["released"] != true || data["amount"] != 50.0 {
+		t.Fatalf("release = %v", data)
+	}
+	if outstandingAllocations(r.quotas) != 0 {
+		t.Fatal("released allocation is still outstanding")
+	}
+	if result := runAtom(r, "rm", "release", map[string]interface{}{"allocation_id": kept.ID}); result.Success || result.Error.Code != "E404" {
+		t.Fatalf("second release = %+v, want E404", result.Error)
+	}
+}
+
+func TestReaperIntervalDefaultsAndStops(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	for _, interval := range []int{0, -5} {
+		r := NewPacketFlowRuntime(RuntimeConfig{ReactorID: "test-reactor", ReapInterval: interval})
+		if r.config.ReapInterval != 1000 {
+			t.Errorf("ReapInterval %d became %d, want the 1000ms default", interval, r.config.ReapInterval)
+		}
+		r.StopBackground()
+		r.Close(context.Background())
+	}
+	waitForGoroutines(t, baseline)
+}
+
+// ============================================================================
+// System metrics
+// ============================================================================
+
+func TestMonitorReportsRealDiskAndNetworkOnLinux(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("real disk and network metrics are Linux only")
+	}
+	r := newTestRuntime(t, RuntimeConfig{MonitorDiskPath: os.TempDir()})
+	resources := resultMap(t, runAtom(r, "rm", "monitor", map[string]interface{}{
+		"resources": []interface{}{"disk", "network"},
+	}))["resources"].(map[string]interface{})
+	if len(resources) != 2 {
+		t.Fatalf("resources = %v, want only disk and network", resources)
+	}
+
+	disk := resources["disk"].(map[string]interface{})
+	if disk["mock"] != nil || disk["path"] != os.TempDir() {
+		t.Fatalf("disk = %v, want real usage of %s", disk, os.TempDir())
+	}
+	if total, _ := disk["total"].(float64); total <= 0 {
+		t.Fatalf("disk total = %v, want a positive size", disk["total"])
+	}
+	if percent := disk["usage_percent"].(int); percent < 0 || percent > 100 {
+		t.Fatalf("disk usage_percent = %d", percent)
+	}
+
+	network := resources["network"].(map[string]interface{})
+	if network["mock"] != nil {
+		t.Fatalf("network = %v, want real counters", network)
+	}
+	interfaces := network["interfaces"].(map[string]netCounters)
+	if _, ok := interfaces["lo"]; !ok {
+		t.Fatalf("interfaces %v missing lo", interfaces)
+	}
+}
+
+func TestDiskMetricsFallBackToMockValues(t *testing.T) {
+	disk := diskMetrics(filepath.Join(t.TempDir(), "missing"))
+	if disk["mock"] != true || disk["total"] != 100 {
+		t.Fatalf("disk metrics for a missing path = %v, want the mock values", disk)
+	}
+}
+
+// burnCPU keeps the current goroutine busy for d
+func burnCPU(d time.Duration) {
+	x := 0.0
+	for end := time.Now().Add(d); time.Now().Before(end); {
+		for i := 0; i < 1000; i++ {
+			x += math.Sqrt(float64(i))
+		}
+	}
+	_ = x
+}
+
+func TestCPUSamplerReportsAPlausiblePercentage(t *testing.T) {
+	if _, ok := processCPUTime(); !ok {
+		t.Skip("process CPU time is unsupported on this platform")
+	}
+	sampler := newCPUSampler(50 * time.Millisecond)
+	if percent := sampler.Percent(); percent != 0 {
+		t.Fatalf("reading inside the first interval = %v, want 0", percent)
+	}
+
+	burnCPU(100 * time.Millisecond)
+	percent := sampler.Percent()
+	if percent <= 0 || percent > float64(100*runtime.NumCPU()) {
+		t.Fatalf("busy reading = %v, want within (0, %d]", percent, 100*runtime.NumCPU())
+	}
+	// Readings are cached for the interval
+	if cached := sampler.Percent(); cached != percent {
+		t.Fatalf("cached reading = %v, want %v", cached, percent)
+	}
+
+	r := newTestRuntime(t, RuntimeConfig{CPUSampleInterval: 10})
+	burnCPU(20 * time.Millisecond)
+	details := resultMap(t, runAtom(r, "cf", "health", map[string]interface{}{"detail": true}))["details"].(map[string]interface{})
+	if cpu := details["cpu_percent"].(float64); cpu < 0 || cpu > float64(100*runtime.NumCPU()) {
+		t.Fatalf("cf:health cpu_percent = %v", cpu)
+	}
+}
+
+// ============================================================================
+// Health thresholds
+// ============================================================================
+
+// healthStatus fetches /health, returning the HTTP status and reported status
+func healthStatus(t *testing.T, server *httptest.Server, query string) (int, string) {
+	t.Helper()
+	var health map[string]interface{}
+	code := getJSON(t, server.URL+"/health"+query, &health)
+	status, _ := health["status"].(string)
+	return code, status
+}
+
+func TestHealthDegradesWithErrorRate(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{Health: HealthThresholds{DegradedErrorRate: 20, UnhealthyErrorRate: 50}})
+	registerPassthrough(t, r)
+	mustRegister(t, r, "tt", "fail", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return nil, fmt.Errorf("failed")
+	}, PacketMetadata{})
+	_, server := newTestServer(t, r)
+
+	for i := 0; i < 6; i++ {
+		runAtom(r, "tt", "pass", nil)
+	}
+	runAtom(r, "tt", "fail", nil)
+	if code, status := healthStatus(t, server, ""); code != http.StatusOK || status != HealthHealthy {
+		t.Fatalf("1/7 errors: %d %s, want 200 healthy", code, status)
+	}
+
+	runAtom(r, "tt", "fail", nil)
+	if code, status := healthStatus(t, server, ""); code != http.StatusOK || status != HealthDegraded {
+		t.Fatalf("2/8 errors: %d %s, want 200 degraded", code, status)
+	}
+	if code, _ := healthStatus(t, server, "?strict=true"); code != http.StatusServiceUnavailable {
+		t.Fatalf("strict degraded: %d, want 503", code)
+	}
+	if data := resultMap(t, runAtom(r, "cf", "health", nil)); data["status"] != HealthDegraded || data["reasons"] == nil {
+		t.Fatalf("cf:health = %v, want degraded with reasons", data)
+	}
+
+	for i := 0; i < 6; i++ {
+		runAtom(r, "tt", "fail", nil)
+	}
+	if code, status := healthStatus(t, server, ""); code != http.StatusServiceUnavailable || status != HealthUnhealthy {
+		t.Fatalf("8/14 errors: %d %s, want 503 unhealthy", code, status)
+	}
+}
+
+func TestHealthDegradesWithQueueDepth(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 1, Health: HealthThresholds{DegradedQueueDepth: 1, UnhealthyQueueDepth: 3}})
+	release := registerGate(t, r)
+	registerPassthrough(t, r)
+
+	go runAtom(r, "tt", "gate", nil)
+	waitFor(t, "gate to start", func() bool { return r.currentLoad() >= 100 })
+	if status := r.Health().Status; status != HealthHealthy {
+		t.Fatalf("empty queue: %s, want healthy", status)
+	}
+
+	var wg sync.WaitGroup
+	want := []string{HealthDegraded, HealthDegraded, HealthUnhealthy}
+	for i, status := range want {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runAtom(r, "tt", "pass", nil)
+		}()
+		waitFor(t, "atom to queue", func() bool { return r.GetStats().QueueDepth == i+1 })
+		if got := r.Health().Status; got != status {
+			t.Fatalf("queue depth %d: %s, want %s", i+1, got, status)
+		}
+	}
+
+	close(release)
+	wg.Wait()
+	if status := r.Health().Status; status != HealthHealthy {
+		t.Fatalf("drained queue: %s, want healthy", status)
+	}
+}
+
+// ============================================================================
+// Graceful shutdown
+// ============================================================================
+
+func TestReadyReflectsLifecycleState(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	_, server := newTestServer(t, r)
+	ready := func() (int, string) {
+		var body map[string]interface{}
+		code := getJSON(t, server.URL+"/ready", &body)
+		state, _ := body["state"].(string)
+		return code, state
+	}
+
+	if code, state := ready(); code != http.StatusOK || state != "ready" {
+		t.Fatalf("after startup: %d %s, want 200 ready", code, state)
+	}
+
+	// A runtime stays starting until its dependencies resolve
+	atomic.StoreInt32(&r.state, StateStarting)
+	mustRegister(t, r, "tt", "app", "", okHandler, PacketMetadata{Dependencies: []string{"tt:base"}})
+	if err := r.MarkReady(); err == nil {
+		t.Fatal("MarkReady succeeded with a missing dependency")
+	}
+	if code, state := ready(); code != http.StatusServiceUnavailable || state != "starting" {
+		t.Fatalf("missing dependency: %d %s, want 503 starting", code, state)
+	}
+	mustRegister(t, r, "tt", "base", "", okHandler, PacketMetadata{})
+	if err := r.MarkReady(); err != nil {
+		t.Fatal(err)
+	}
+	if code, state := ready(); code != http.StatusOK || state != "ready" {
+		t.Fatalf("dependencies resolved: %d %s, want 200 ready", code, state)
+	}
+
+	r.Drain()
+	if code, state := ready(); code != http.StatusServiceUnavailable || state != "draining" {
+		t.Fatalf("draining: %d %s, want 503 draining", code, state)
+	}
+	// Liveness is unaffected by draining
+	if code, _ := healthStatus(t, server, ""); code != http.StatusOK {
+		t.Fatalf("/health while draining = %d, want 200", code)
+	}
+	r.Close(context.Background())
+	if code, state := ready(); code != http.StatusServiceUnavailable || state != "closed" {
+		t.Fatalf("closed: %d %s, want 503 closed", code, state)
+	}
+}
+
+func TestShutdownDrainsServesInFlightAndCloses(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	release := registerGate(t, r)
+	server := NewPacketFlowServer(r, 0)
+	server.httpServer.Handler = server.Handler()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.httpServer.Serve(listener)
+	}()
+
+	url := "http://" + listener.Addr().String()
+	inFlight := make(chan int, 1)
+	go func() {
+		inFlight <- postJSON(t, url+"/submit", "", `{"id": "slow", "g": "tt", "e": "gate"}`, nil)
+	}()
+	waitFor(t, "the request to start", func() bool { return r.GetStats().ActiveAtoms == 1 })
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	waitFor(t, "the runtime to drain", func() bool { return r.State() == "draining" })
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a request in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if status := <-inFlight; status != http.StatusOK {
+		t.Fatalf("in-flight request finished with %d, want 200", status)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("Serve returned %v, want http.ErrServerClosed", err)
+	}
+	if r.State() != "closed" {
+		t.Fatalf("state after shutdown = %s, want closed", r.State())
+	}
+	if result := runAtom(r, "cf", "ping", nil); result.Success || result.Error.Code != "E503" {
+		t.Fatalf("atom after shutdown = %+v, want E503", result.Error)
+	}
+}
+
+// ============================================================================
+// Latency histogram
+// ============================================================================
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	var h LatencyHistogram
+	if h.Percentile(99) != 0 {
+		t.Fatal("empty histogram reported a percentile")
+	}
+
+	// 90 fast calls, 8 medium and 2 slow ones
+	for i := 0; i < 90; i++ {
+		h.Observe(800 * time.Microsecond)
+	}
+	for i := 0; i < 8; i++ {
+		h.Observe(40 * time.Millisecond)
+	}
+	h.Observe(2 * time.Second)
+	h.Observe(2 * time.Second)
+
+	for _, tc := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{50, time.Millisecond},
+		{90, time.Millisecond},
+		{95, 50 * time.Millisecond},
+		{98, 50 * time.Millisecond},
+		{99, 2500 * time.Millisecond},
+		{100, 2500 * time.Millisecond},
+	} {
+		if got := h.Percentile(tc.p); got != tc.want {
+			t.Errorf("p%v = %v, want %v", tc.p, got, tc.want)
+		}
+	}
+
+	// Durations past the last bound land in the overflow bucket
+	var overflow LatencyHistogram
+	overflow.Observe(time.Hour)
+	if overflow.Counts[len(latencyBuckets)] != 1 || overflow.Percentile(50) != time.Minute {
+		t.Fatalf("overflow counts %v, p50 %v", overflow.Counts, overflow.Percentile(50))
+	}
+
+	var merged LatencyHistogram
+	merged.Merge(h)
+	merged.Merge(overflow)
+	if merged.Total != 101 || merged.Counts[len(latencyBuckets)] != 1 {
+		t.Fatalf("merged total %d, counts %v", merged.Total, merged.Counts)
+	}
+}
+
+func TestStatsReportPacketPercentiles(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+
+	r.mu.RLock()
+	packet := r.packets["tt:pass"]
+	r.mu.RUnlock()
+	for i := 0; i < 95; i++ {
+		r.updatePacketStats(packet, 3*time.Millisecond, true)
+	}
+	for i := 0; i < 5; i++ {
+		r.updatePacketStats(packet, 400*time.Millisecond, true)
+	}
+
+	_, server := newTestServer(t, r)
+	var stats struct {
+		Packets map[string]map[string]interface{} `json:"packets"`
+	}
+	getJSON(t, server.URL+"/stats", &stats)
+	entry := stats.Packets["tt:pass"]
+	if entry["p50_ms"] != 5.0 || entry["p95_ms"] != 5.0 || entry["p99_ms"] != 500.0 {
+		t.Fatalf("percentiles = %v / %v / %v, want 5 / 5 / 500", entry["p50_ms"], entry["p95_ms"], entry["p99_ms"])
+	}
+}
+
+// ============================================================================
+// Throughput window
+// ============================================================================
+
+func TestSlidingWindowRates(t *testing.T) {
+	w := newSlidingWindow(10)
+	started := time.Unix(1000, 0)
+
+	// 20 atoms a second for 10 seconds, one in ten failing
+	for second := int64(0); second < 10; second++ {
+		now := started.Add(time.Duration(second) * time.Second)
+		for i := 0; i < 20; i++ {
+			w.Record(now, i%10 != 0)
+		}
+	}
+	now := started.Add(9 * time.Second)
+	throughput, errorRate := w.Rates(now, started.Add(-time.Hour))
+	if throughput != 20 || errorRate != 10 {
+		t.Fatalf("rates = %v/s, %v%%, want 20/s, 10%%", throughput, errorRate)
+	}
+
+	// While younger than the window, the rate averages over the uptime
+	young := newSlidingWindow(10)
+	for i := 0; i < 30; i++ {
+		young.Record(started, true)
+	}
+	if throughput, _ := young.Rates(started.Add(1500*time.Millisecond), started); throughput != 15 {
+		t.Fatalf("young throughput = %v, want 15", throughput)
+	}
+
+	// Buckets older than the window drop out, and reused buckets reset
+	later := now.Add(5 * time.Second)
+	w.Record(later, false)
+	throughput, errorRate = w.Rates(later, started.Add(-time.Hour))
+	if want := (5*20 + 1) / 10.0; throughput != want {
+		t.Fatalf("throughput after sliding = %v, want %v", throughput, want)
+	}
+	if want := float64(5*2+1) / float64(5*20+1) * 100; errorRate != want {
+		t.Fatalf("error rate after sliding = %v, want %v", errorRate, want)
+	}
+
+	if throughput, errorRate := w.Rates(later.Add(time.Hour), started); throughput != 0 || errorRate != 0 {
+		t.Fatalf("idle window rates = %v, %v", throughput, errorRate)
+	}
+}
+
+func TestSlidingWindowIsConcurrencySafe(t *testing.T) {
+	w := newSlidingWindow(60)
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				w.Record(now, true)
+				w.Rates(now, now.Add(-time.Hour))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if throughput, _ := w.Rates(now, now.Add(-time.Hour)); throughput != 8*500/60.0 {
+		t.Fatalf("throughput = %v, want %v", throughput, 8*500/60.0)
+	}
+}
+
+func TestStatsReportWindowedThroughput(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ThroughputWindow: 5})
+	registerPassthrough(t, r)
+	mustRegister(t, r, "tt", "fail", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return nil, fmt.Errorf("failed")
+	}, PacketMetadata{})
+
+	for i := 0; i < 3; i++ {
+		runAtom(r, "tt", "pass", nil)
+	}
+	runAtom(r, "tt", "fail", nil)
+
+	_, server := newTestServer(t, r)
+	var stats struct {
+		Runtime map[string]interface{} `json:"runtime"`
+	}
+	getJSON(t, server.URL+"/stats", &stats)
+	if throughput := stats.Runtime["throughput_per_sec"].(float64); throughput <= 0 || throughput > 4 {
+		t.Fatalf("throughput_per_sec = %v, want in (0, 4]", throughput)
+	}
+	if stats.Runtime["error_rate_window"] != 25.0 {
+		t.Fatalf("error_rate_window = %v, want 25", stats.Runtime["error_rate_window"])
+	}
+}
+
+// ============================================================================
+// Reactor health checks
+// ============================================================================
+
+func TestReactorHealthFlapsWithThresholds(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ReactorHealthInterval: -1, UnhealthyThreshold: 3, HealthyThreshold: 2})
+
+	var up atomic.Bool
+	up.Store(true)
+	var pings int64
+	reactor := newReactorServer(t, func(atom *Atom) *AtomResult {
+		atomic.AddInt64(&pings, 1)
+		if atom.Group != "cf" || atom.Element != "ping" {
+			t.Errorf("probe sent %s:%s, want cf:ping", atom.Group, atom.Element)
+		}
+		if !up.Load() {
+			return &AtomResult{Success: false, Error: &AtomError{Code: "E500", Message: "down"}}
+		}
+		return &AtomResult{Success: true, Data: "pong"}
+	})
+	r.router.RegisterReactor(&Reactor{ID: "flappy", Endpoint: reactor.URL, Types: []string{"general"}, Healthy: true})
+	routed := func() bool {
+		return r.router.Route(&Atom{ID: newTestAtomID(), Group: "cf", Element: "ping"}) != nil
+	}
+	if !routed() {
+		t.Fatal("healthy reactor not routed")
+	}
+
+	healthy := func() bool {
+		snapshot, _ := r.router.GetReactor("flappy")
+		return snapshot.Healthy
+	}
+	probe := func(n int) {
+		for i := 0; i < n; i++ {
+			r.probeReactors()
+		}
+	}
+
+	up.Store(false)
+	probe(2)
+	if !healthy() {
+		t.Fatal("marked unhealthy before reaching the failure threshold")
+	}
+	probe(1)
+	if healthy() {
+		t.Fatal("still healthy after 3 consecutive failures")
+	}
+	if routed() {
+		t.Fatal("unhealthy reactor still routed")
+	}
+
+	// A success resets the streak, so one success, one failure and one
+	// success do not restore it
+	up.Store(true)
+	probe(1)
+	up.Store(false)
+	probe(1)
+	up.Store(true)
+	probe(1)
+	if healthy() {
+		t.Fatal("marked healthy without 2 consecutive successes")
+	}
+	probe(1)
+	if !healthy() || !routed() {
+		t.Fatal("still unhealthy after 2 consecutive successes")
+	}
+
+	// Interleaved failures while healthy never reach the threshold
+	for i := 0; i < 3; i++ {
+		up.Store(false)
+		probe(2)
+		up.Store(true)
+		probe(1)
+	}
+	if !healthy() {
+		t.Fatal("non-consecutive failures marked the reactor unhealthy")
+	}
+	if pinged := atomic.LoadInt64(&pings); pinged != 16 {
+		t.Fatalf("reactor pinged %d times, want 16", pinged)
+	}
+}
+
+func TestReactorHealthLoopProbesAndStops(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	r := NewPacketFlowRuntime(RuntimeConfig{ReactorID: "test-reactor", ReactorHealthInterval: 10, UnhealthyThreshold: 1})
+
+	var pings int64
+	reactor := newReactorServer(t, func(atom *Atom) *AtomResult {
+		atomic.AddInt64(&pings, 1)
+		return &AtomResult{Success: false, Error: &AtomError{Code: "E500", Message: "down"}}
+	})
+	registerReactor(r, "down", reactor.URL)
+
+	waitFor(t, "the loop to mark the reactor unhealthy", func() bool {
+		snapshot, _ := r.router.GetReactor("down")
+		return !snapshot.Healthy
+	})
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stopped := atomic.LoadInt64(&pings)
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt64(&pings); after != stopped {
+		t.Fatalf("reactor pinged %d more times after Close", after-stopped)
+	}
+	waitForGoroutines(t, baseline)
+}
+
+// ============================================================================
+// Service discovery
+// ============================================================================
+
+// fakeDiscovery sends whatever membership lists the test pushes
+type fakeDiscovery struct {
+	updates chan []*Reactor
+}
+
+func (fd *fakeDiscovery) Watch(ctx context.Context) <-chan []*Reactor {
+	return fd.updates
+}
+
+func generalReactors(ids ...string) []*Reactor {
+	reactors := make([]*Reactor, len(ids))
+	for i, id := range ids {
+		reactors[i] = &Reactor{ID: id, Endpoint: "http://" + id, Types: []string{"general"}}
+	}
+	return reactors
+}
+
+func reactorIDs(r *PacketFlowRuntime) []string {
+	var ids []string
+	for _, reactor := range r.router.GetReactors() {
+		ids = append(ids, reactor.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestDiscoveryReconcilesReactorsOverTime(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ReactorHealthInterval: -1})
+	discovery := &fakeDiscovery{updates: make(chan []*Reactor)}
+	r.WatchDiscovery(discovery)
+
+	discovery.updates <- generalReactors("a", "b", "c")
+	waitFor(t, "a, b and c", func() bool { return strings.Join(reactorIDs(r), ",") == "a,b,c" })
+
+	// Health survives reconciliation of a reactor that is still present
+	r.router.SetHealthy("b", false)
+	discovery.updates <- generalReactors("b", "c", "d")
+	waitFor(t, "b, c and d", func() bool { return strings.Join(reactorIDs(r), ",") == "b,c,d" })
+	if b, _ := r.router.GetReactor("b"); b.Healthy {
+		t.Fatal("reconciliation reset b's health")
+	}
+	if d, _ := r.router.GetReactor("d"); !d.Healthy {
+		t.Fatal("discovered reactor d did not start healthy")
+	}
+
+	discovery.updates <- nil
+	waitFor(t, "an empty table", func() bool { return len(reactorIDs(r)) == 0 })
+}
+
+func TestReconcileMovesOnlyAffectedAtoms(t *testing.T) {
+	router := NewHashRouter()
+	router.Reconcile(generalReactors("a", "b", "c", "d"))
+
+	const atoms = 2000
+	route := func() map[string]string {
+		placement := make(map[string]string, atoms)
+		for i := 0; i < atoms; i++ {
+			id := fmt.Sprintf("atom-%d", i)
+			placement[id] = router.Route(&Atom{ID: id, Group: "cf"}).ID
+		}
+		return placement
+	}
+	before := route()
+
+	// Removing d moves only d's atoms
+	if added, removed := router.Reconcile(generalReactors("a", "b", "c")); len(added) != 0 || strings.Join(removed, ",") != "d" {
+		t.Fatalf("reconcile = added %v, removed %v", added, removed)
+	}
+	afterRemove := route()
+	for id, reactor := range before {
+		if reactor != "d" && afterRemove[id] != reactor {
+			t.Fatalf("%s moved from %s to %s when d left", id, reactor, afterRemove[id])
+		}
+	}
+
+	// Adding e moves atoms only onto e, roughly a quarter of them
+	if added, _ := router.Reconcile(generalReactors("a", "b", "c", "e")); strings.Join(added, ",") != "e" {
+		t.Fatalf("added = %v, want [e]", added)
+	}
+	moved := 0
+	for id, reactor := range route() {
+		if reactor != afterRemove[id] {
+			if reactor != "e" {
+				t.Fatalf("%s moved from %s to %s when e joined", id, afterRemove[id], reactor)
+			}
+			moved++
+		}
+	}
+	if moved < atoms/8 || moved > atoms*3/8 {
+		t.Fatalf("%d of %d atoms moved to e, want about a quarter", moved, atoms)
+	}
+}
+
+func TestHTTPDiscoveryPollsTheRegistry(t *testing.T) {
+	var mu sync.Mutex
+	members := []string{"a", "b"}
+	failing := false
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(generalReactors(members...))
+	}))
+	defer registry.Close()
+
+	r := newTestRuntime(t, RuntimeConfig{ReactorHealthInterval: -1})
+	r.WatchDiscovery(NewHTTPDiscovery(registry.URL, 10*time.Millisecond))
+	waitFor(t, "a and b", func() bool { return strings.Join(reactorIDs(r), ",") == "a,b" })
+
+	// A registry outage keeps the last known membership
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	if ids := strings.Join(reactorIDs(r), ","); ids != "a,b" {
+		t.Fatalf("membership during outage = %s, want a,b", ids)
+	}
+
+	mu.Lock()
+	failing = false
+	members = []string{"b", "c"}
+	mu.Unlock()
+	waitFor(t, "b and c", func() bool { return strings.Join(reactorIDs(r), ",") == "b,c" })
+}
+
+func TestStaticDiscoveryAndWatchStopOnClose(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	r := NewPacketFlowRuntime(RuntimeConfig{ReactorID: "test-reactor", ReactorHealthInterval: -1})
+	r.WatchDiscovery(NewStaticDiscovery(generalReactors("x", "y")))
+	waitFor(t, "x and y", func() bool { return strings.Join(reactorIDs(r), ",") == "x,y" })
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitForGoroutines(t, baseline)
+}
+
+// ============================================================================
+// Forwarding
+// ============================================================================
+
+// forwardingRuntime returns a runtime that forwards unknown packets to peer
+func forwardingRuntime(t *testing.T, token, peerID, endpoint string) *PacketFlowRuntime {
+	r := newTestRuntime(t, RuntimeConfig{ForwardUnknown: true, ReactorToken: token, ReactorHealthInterval: -1})
+	r.router.RegisterReactor(&Reactor{ID: peerID, Endpoint: endpoint, Types: []string{"general"}, Healthy: true})
+	return r
+}
+
+func TestForwardingReachesAnAuthenticatedPeer(t *testing.T) {
+	peer := newTestRuntime(t, RuntimeConfig{ReactorID: "peer", APIKeys: []string{"peer-key"}})
+	registerPassthrough(t, peer)
+	_, peerServer := newTestServer(t, peer)
+	wsEndpoint := "ws" + strings.TrimPrefix(peerServer.URL, "http") + "/packetflow"
+
+	for _, endpoint := range []string{wsEndpoint, peerServer.URL + "/submit"} {
+		r := forwardingRuntime(t, "peer-key", "peer", endpoint)
+		result := runAtom(r, "tt", "pass", map[string]interface{}{"input": "hello"})
+		if !result.Success || result.Data != "hello" {
+			t.Fatalf("forwarding to %s = %+v / %+v", endpoint, result.Data, result.Error)
+		}
+		if result.Meta["forwarded_to"] != "peer" {
+			t.Fatalf("forwarded_to = %v, want peer", result.Meta["forwarded_to"])
+		}
+	}
+
+	// Without the token the peer rejects the forwarded atom
+	for _, endpoint := range []string{wsEndpoint, peerServer.URL + "/submit"} {
+		r := forwardingRuntime(t, "", "peer", endpoint)
+		if result := runAtom(r, "tt", "pass", nil); result.Success {
+			t.Fatalf("unauthenticated forward to %s succeeded", endpoint)
+		}
+	}
+	if calls := packetCalls(peer, "tt:pass"); calls != 2 {
+		t.Fatalf("peer ran tt:pass %d times, want 2", calls)
+	}
+}
+
+// guardedPeer serves tt:guarded from a peer that grants the shared reactor
+// token every permission and a client key none
+func guardedPeer(t *testing.T) (*PacketFlowRuntime, *httptest.Server) {
+	peer := newTestRuntime(t, RuntimeConfig{
+		ReactorID:    "peer",
+		APIKeys:      []string{"reactor-token:read|write", "client-key"},
+		ReactorToken: "reactor-token",
+	})
+	registerGuarded(t, peer)
+	_, server := newTestServer(t, peer)
+	return peer, server
+}
+
+func TestForwardedAtomsRunAsTheOriginatingCaller(t *testing.T) {
+	_, peerServer := guardedPeer(t)
+	wsEndpoint := "ws" + strings.TrimPrefix(peerServer.URL, "http") + "/packetflow"
+
+	for _, endpoint := range []string{wsEndpoint, peerServer.URL + "/submit"} {
+		r := forwardingRuntime(t, "reactor-token", "peer", endpoint)
+		forward := func(caller *Caller) *AtomResult {
+			return r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "guarded", Caller: caller})
+		}
+
+		// The reactor token's permissions never stand in for the caller's
+		if result := forward(&Caller{ID: "bob"}); result.Success || result.Error.Code != "E403" {
+			t.Fatalf("%s: caller without permissions = %+v, want E403", endpoint, result)
+		}
+		if result := forward(nil); result.Success || result.Error.Code != "E401" {
+			t.Fatalf("%s: anonymous caller = %+v, want E401", endpoint, result)
+		}
+		result := forward(&Caller{ID: "alice", Permissions: []string{"read", "write"}})
+		if data, _ := result.Data.(map[string]interface{}); !result.Success || data["caller"] != "alice" {
+			t.Fatalf("%s: permitted caller = %+v / %+v, want it to run as alice", endpoint, result.Data, result.Error)
+		}
+	}
+}
+
+func TestCollectiveRelaysRunAsTheOriginatingCaller(t *testing.T) {
+	_, peerServer := guardedPeer(t)
+	r := forwardingRuntime(t, "reactor-token", "peer", peerServer.URL+"/submit")
+	bob := &Caller{ID: "bob"}
+	guarded := map[string]interface{}{"g": "tt", "e": "guarded"}
+
+	gather := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "co", Element: "gather", Data: map[string]interface{}{"packet": guarded}, Caller: bob})
+	results := resultMap(t, gather)["results"].([]map[string]interface{})
+	if len(results) != 1 || results[0]["error"].(*AtomError).Code != "E403" {
+		t.Fatalf("gather of a guarded packet = %v, want E403", results)
+	}
+
+	scatter := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "co", Element: "scatter_gather", Data: map[string]interface{}{"shards": map[string]interface{}{"peer": guarded}}, Caller: bob})
+	shard := resultMap(t, scatter)["shards"].(map[string]interface{})["peer"].(map[string]interface{})
+	if shard["success"] != false || shard["error"].(*AtomError).Code != "E403" {
+		t.Fatalf("scatter_gather of a guarded packet = %v, want E403", shard)
+	}
+}
+
+func TestCallerAssertionsNeedTheReactorToken(t *testing.T) {
+	_, peerServer := guardedPeer(t)
+	r := forwardingRuntime(t, "reactor-token", "peer", peerServer.URL+"/submit")
+	atom := &Atom{ID: newTestAtomID(), Group: "tt", Element: "guarded"}
+	r.assertCaller(atom, &Caller{ID: "alice", Permissions: []string{"read", "write"}})
+	body, err := json.Marshal(atom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client key replaying a valid assertion still runs as itself
+	var result AtomResult
+	if status := postJSON(t, peerServer.URL+"/submit", "client-key", string(body), &result); status != http.StatusForbidden || result.Error.Code != "E403" {
+		t.Fatalf("replayed assertion: status %d, error %+v; want 403 E403", status, result.Error)
+	}
+
+	// An assertion moved to another atom is rejected
+	atom.ID = newTestAtomID()
+	body, _ = json.Marshal(atom)
+	if status := postJSON(t, peerServer.URL+"/submit", "reactor-token", string(body), &result); status != http.StatusUnauthorized || result.Error.Code != "E401" {
+		t.Fatalf("assertion for another atom: status %d, error %+v; want 401 E401", status, result.Error)
+	}
+}
+
+func TestForwardedAtomsCarryTheTokenButNotClaimedPermissions(t *testing.T) {
+	var mu sync.Mutex
+	var authorization string
+	var meta map[string]interface{}
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var atom Atom
+		json.NewDecoder(req.Body).Decode(&atom)
+		mu.Lock()
+		authorization, meta = req.Header.Get("Authorization"), atom.Meta
+		mu.Unlock()
+		json.NewEncoder(w).Encode(&AtomResult{Success: true, Data: "ok"})
+	}))
+	defer peer.Close()
+
+	r := forwardingRuntime(t, "peer-key", "peer", peer.URL)
+	result := r.ProcessAtom(&Atom{
+		ID:      newTestAtomID(),
+		Group:   "tt",
+		Element: "elsewhere",
+		Meta:    map[string]interface{}{"permissions": []interface{}{"admin"}, "trace": "keep"},
+	})
+	if !result.Success {
+		t.Fatalf("forward failed: %+v", result.Error)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if authorization != "Bearer peer-key" {
+		t.Fatalf("Authorization = %q, want the reactor token", authorization)
+	}
+	if _, claimed := meta["permissions"]; claimed {
+		t.Fatalf("forwarded meta kept client permissions: %v", meta)
+	}
+	if meta["trace"] != "keep" || meta[ForwardCountMeta] != 1.0 {
+		t.Fatalf("forwarded meta = %v", meta)
+	}
+}
+
+func TestForwardingStopsAtTheHopLimit(t *testing.T) {
+	var received int64
+	peer := newReactorServer(t, func(atom *Atom) *AtomResult {
+		atomic.AddInt64(&received, 1)
+		return &AtomResult{Success: true}
+	})
+
+	r := forwardingRuntime(t, "", "peer", peer.URL)
+	result := r.ProcessAtom(&Atom{
+		ID:      newTestAtomID(),
+		Group:   "tt",
+		Element: "elsewhere",
+		Meta:    map[string]interface{}{ForwardCountMeta: 3},
+	})
+	if result.Success || result.Error.Code != "E404" {
+		t.Fatalf("atom at the hop limit = %+v, want E404", result.Error)
+	}
+
+	// A reactor never forwards to itself
+	self := forwardingRuntime(t, "", "test-reactor", peer.URL)
+	if result := runAtom(self, "tt", "elsewhere", nil); result.Success || result.Error.Code != "E404" {
+		t.Fatalf("self-routed atom = %+v, want E404", result.Error)
+	}
+	if n := atomic.LoadInt64(&received); n != 0 {
+		t.Fatalf("peer received %d atoms", n)
+	}
+}
+
+// ============================================================================
+// Connection pool
+// ============================================================================
+
+// newCountingWebSocketPeer serves a runtime's WebSocket endpoint, counting
+// upgrade requests
+func newCountingWebSocketPeer(t *testing.T) (endpoint string, upgrades *int64) {
+	peer := newTestRuntime(t, RuntimeConfig{ReactorID: "peer"})
+	server := NewPacketFlowServer(peer, 0)
+	handler := server.Handler()
+	upgrades = new(int64)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/packetflow" {
+			atomic.AddInt64(upgrades, 1)
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	t.Cleanup(httpServer.Close)
+	return "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/packetflow", upgrades
+}
+
+func TestBroadcastsReuseWebSocketConnections(t *testing.T) {
+	endpoint, upgrades := newCountingWebSocketPeer(t)
+	r := newTestRuntime(t, RuntimeConfig{ReactorHealthInterval: -1})
+	registerReactor(r, "peer", endpoint)
+
+	for i := 0; i < 5; i++ {
+		summary := resultMap(t, runAtom(r, "co", "broadcast", map[string]interface{}{"message": "hi"}))["summary"].(map[string]interface{})
+		if summary["successful"] != 1 {
+			t.Fatalf("broadcast %d summary = %v", i, summary)
+		}
+	}
+
+	if n := atomic.LoadInt64(upgrades); n != 1 {
+		t.Fatalf("peer saw %d WebSocket handshakes, want 1", n)
+	}
+	stats := r.reactorClient.PoolStats()
+	if stats.Created != 1 || stats.Reused != 4 {
+		t.Fatalf("pool created %d, reused %d; want 1 and 4", stats.Created, stats.Reused)
+	}
+	if host := stats.Hosts[endpoint]; host.Open != 1 || host.Idle != 1 || host.InUse != 0 {
+		t.Fatalf("host stats = %+v", host)
+	}
+}
+
+func TestConnPoolBoundsHostsAndEvictsIdle(t *testing.T) {
+	endpoint, upgrades := newCountingWebSocketPeer(t)
+	client := NewReactorClient(2, 30*time.Millisecond, "")
+	defer client.Close()
+
+	first, err := client.pool.Acquire(context.Background(), endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.pool.Acquire(context.Background(), endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A third connection waits for a free slot
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := client.pool.Acquire(ctx, endpoint, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire past the host limit = %v, want a deadline error", err)
+	}
+
+	// A connection that failed mid-exchange is closed, not pooled
+	client.pool.Release(first, true)
+	client.pool.Release(second, false)
+	if host := client.PoolStats().Hosts[endpoint]; host.Open != 1 || host.Idle != 1 {
+		t.Fatalf("after release host stats = %+v", host)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	client.EvictIdle()
+	stats := client.PoolStats()
+	if stats.Evicted != 1 || stats.Hosts[endpoint].Open != 0 {
+		t.Fatalf("after eviction stats = %+v", stats)
+	}
+	if n := atomic.LoadInt64(upgrades); n != 2 {
+		t.Fatalf("peer saw %d handshakes, want 2", n)
+	}
+}
+
+func TestConnPoolReplacesDeadIdleConnections(t *testing.T) {
+	endpoint, upgrades := newCountingWebSocketPeer(t)
+	client := NewReactorClient(1, time.Minute, "")
+	defer client.Close()
+
+	pc, err := client.pool.Acquire(context.Background(), endpoint, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.conn.Close()
+	client.pool.Release(pc, true)
+
+	// The closed connection fails its ping and a fresh one is dialled
+	reactor := &Reactor{ID: "peer", Endpoint: endpoint}
+	result, err := client.Send(context.Background(), reactor, &Atom{ID: newTestAtomID(), Group: "cf", Element: "ping"})
+	if err != nil || !result.Success {
+		t.Fatalf("send after a dead idle connection = %+v, %v", result, err)
+	}
+	if n := atomic.LoadInt64(upgrades); n != 2 {
+		t.Fatalf("peer saw %d handshakes, want 2", n)
+	}
+	if stats := client.PoolStats(); stats.Created != 2 || stats.Hosts[endpoint].Open != 1 {
+		t.Fatalf("pool stats = %+v", stats)
+	}
+}
+
+// ============================================================================
+// Routing trace
+// ============================================================================
+
+func TestTraceSelectsTheReactorRouteWould(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ReactorHealthInterval: -1})
+	for _, reactor := range []*Reactor{
+		{ID: "cpu-1", Types: []string{"cpu_bound"}, Healthy: true},
+		{ID: "cpu-2", Types: []string{"cpu_bound"}, Healthy: true},
+		{ID: "gen-1", Types: []string{"general"}, Healthy: true},
+		{ID: "io-1", Types: []string{"io_bound"}, Healthy: true},
+		{ID: "cpu-down", Types: []string{"cpu_bound"}, Healthy: false},
+	} {
+		r.router.RegisterReactor(reactor)
+	}
+
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("trace-%d", i)
+		trace := resultMap(t, runAtom(r, "cf", "trace", map[string]interface{}{"atom": map[string]interface{}{"id": id, "g": "cf", "e": "compute"}}))
+		want := r.router.Route(&Atom{ID: id, Group: "cf", Element: "compute"})
+		if trace["atom_id"] != id || trace["selected"] != want.ID {
+			t.Fatalf("trace for %s selected %v, Route chose %s", id, trace["selected"], want.ID)
+		}
+
+		var ids []string
+		for _, candidate := range trace["candidates"].([]*Reactor) {
+			ids = append(ids, candidate.ID)
+		}
+		sort.Strings(ids)
+		if strings.Join(ids, ",") != "cpu-1,cpu-2,gen-1" {
+			t.Fatalf("candidates = %v, want the healthy cpu_bound and general reactors", ids)
+		}
+	}
+}
+
+func TestTraceDoesNotExecuteAndReportsTheTimeout(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ReactorHealthInterval: -1, DefaultTimeout: 30, ForwardUnknown: true, ReactorTimeout: 7})
+	var calls int64
+	registerCounter(t, r, "count", &calls)
+	r.router.RegisterReactor(&Reactor{ID: "peer", Types: []string{"general"}, Healthy: true})
+
+	trace := func(spec map[string]interface{}) map[string]interface{} {
+		return resultMap(t, runAtom(r, "cf", "trace", map[string]interface{}{"atom": spec}))
+	}
+
+	local := trace(map[string]interface{}{"g": "tt", "e": "count"})
+	if local["local"] != true || local["resolved_packet"] != "tt:count" || local["timeout_source"] != "default" || local["timeout_seconds"] != 30 {
+		t.Fatalf("local trace = %v", local)
+	}
+	if _, generated := local["atom_id"].(string); !generated {
+		t.Fatalf("trace without an id reported atom_id %v", local["atom_id"])
+	}
+	if override := trace(map[string]interface{}{"g": "tt", "e": "count", "t": 4}); override["timeout_source"] != "atom" || override["timeout_seconds"] != 4 {
+		t.Fatalf("atom timeout trace = %v", override)
+	}
+	if atomic.LoadInt64(&calls) != 0 {
+		t.Fatal("cf:trace executed the traced packet")
+	}
+
+	remote := trace(map[string]interface{}{"g": "tt", "e": "elsewhere"})
+	if remote["local"] != false || remote["forward_to"] != "peer" || remote["timeout_source"] != "reactor" || remote["timeout_seconds"] != 7 {
+		t.Fatalf("forwarded trace = %v", remote)
+	}
+}
+
+// ============================================================================
+// Multi-message frames
+// ============================================================================
+
+func TestDecodeMessagesReturnsBatchesInOrder(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for _, codec := range []Codec{MsgpackCodec{}, JSONCodec{}} {
+		handler := NewMessageHandler(r).WithCodec(codec)
+
+		var frame []byte
+		for i, options := range []map[string]interface{}{nil, {"version": 1}, {"correlation_id": "third"}} {
+			encoded, err := handler.EncodeMessage("ping", map[string]interface{}{"echo": i}, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frame = append(frame, encoded...)
+		}
+
+		messages, err := handler.DecodeMessages(frame)
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		if len(messages) != 3 {
+			t.Fatalf("%s: decoded %d messages, want 3", codec.Name(), len(messages))
+		}
+		for i, message := range messages {
+			if echo := message.Data.(map[string]interface{})["echo"]; fmt.Sprint(echo) != strconv.Itoa(i) {
+				t.Errorf("%s: message %d echoes %v", codec.Name(), i, echo)
+			}
+			if i > 0 && message.Sequence != messages[i-1].Sequence+1 {
+				t.Errorf("%s: message %d sequence %d out of order", codec.Name(), i, message.Sequence)
+			}
+		}
+		if messages[1].Version != 1 || handler.getCorrelationID(messages[2]) != "third" {
+			t.Errorf("%s: version %d, correlation %q", codec.Name(), messages[1].Version, handler.getCorrelationID(messages[2]))
+		}
+
+		// Truncated and trailing bytes fail the whole frame
+		if _, err := handler.DecodeMessages(frame[:len(frame)-2]); err == nil || !strings.Contains(err.Error(), "truncated") {
+			t.Errorf("%s: truncated frame err = %v", codec.Name(), err)
+		}
+		if _, err := handler.DecodeMessages(append(append([]byte(nil), frame...), 0xc1)); err == nil || !strings.Contains(err.Error(), "message 3") {
+			t.Errorf("%s: trailing byte err = %v", codec.Name(), err)
+		}
+		if _, err := handler.DecodeMessages(nil); err == nil {
+			t.Errorf("%s: empty frame decoded", codec.Name())
+		}
+	}
+}
+
+func TestDecodeMessagesChecksEachTrailer(t *testing.T) {
+	handler := NewMessageHandler(nil)
+	first, _ := handler.EncodeMessage("ping", map[string]interface{}{"echo": "a"}, nil)
+	second, _ := handler.EncodeMessage("ping", map[string]interface{}{"echo": "b"}, nil)
+
+	corrupted := append([]byte(nil), second...)
+	corrupted[len(corrupted)-1] ^= 0x01
+	if _, err := handler.DecodeMessages(append(append([]byte(nil), first...), corrupted...)); !errors.Is(err, ErrChecksumMismatch) || !strings.Contains(err.Error(), "message 1") {
+		t.Fatalf("err = %v, want a checksum mismatch on message 1", err)
+	}
+}
+
+func TestBatchedFrameGetsBatchedReplies(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	handler := NewMessageHandler(r)
+
+	var frame []byte
+	for _, echo := range []string{"one", "two", "three"} {
+		encoded, err := handler.EncodeMessage("ping", map[string]interface{}{"echo": echo}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame = append(frame, encoded...)
+	}
+
+	response, err := handler.HandleMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replies, err := handler.DecodeMessages(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("got %d replies, want 3", len(replies))
+	}
+	for i, echo := range []string{"one", "two", "three"} {
+		if data := fmt.Sprint(replies[i].Data); !strings.Contains(data, echo) {
+			t.Errorf("reply %d = %s, want it to echo %q", i, data, echo)
+		}
+	}
+}
+
+// ============================================================================
+// WebSocket compression
+// ============================================================================
+
+// countingConn counts the bytes read from the underlying connection
+type countingConn struct {
+	net.Conn
+	read *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+// dialCompressed dials the server offering permessage-deflate, returning the
+// connection, the negotiated extensions and a counter of bytes received
+func dialCompressed(t *testing.T, server *httptest.Server) (*websocket.Conn, string, *int64) {
+	t.Helper()
+	read := new(int64)
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, read: read}, nil
+		},
+	}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/packetflow", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, resp.Header.Get("Sec-WebSocket-Extensions"), read
+}
+
+// echoOver sends input through tt:pass, returning the bytes read for the reply
+func echoOver(t *testing.T, conn *websocket.Conn, read *int64, input string) int64 {
+	t.Helper()
+	before := atomic.LoadInt64(read)
+	if err := conn.WriteJSON(map[string]interface{}{"id": newTestAtomID(), "g": "tt", "e": "pass", "d": map[string]interface{}{"input": input}}); err != nil {
+		t.Fatal(err)
+	}
+	var result AtomResult
+	if err := conn.ReadJSON(&result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success || result.Data != input {
+		t.Fatalf("echo of %d bytes came back changed: %+v", len(input), result.Error)
+	}
+	return atomic.LoadInt64(read) - before
+}
+
+func TestCompressionIsNegotiatedAndRoundTrips(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{Compression: true, CompressionThreshold: 2048})
+	registerPassthrough(t, r)
+	_, server := newTestServer(t, r)
+
+	conn, extensions, read := dialCompressed(t, server)
+	if !strings.Contains(extensions, "permessage-deflate") {
+		t.Fatalf("negotiated extensions %q, want permessage-deflate", extensions)
+	}
+
+	large := strings.Repeat("packetflow ", 20000)
+	if n := echoOver(t, conn, read, large); n > int64(len(large)/10) {
+		t.Fatalf("%d byte reply took %d bytes on the wire, want it compressed", len(large), n)
+	}
+
+	// Replies below the threshold go out uncompressed
+	small := strings.Repeat("a", 1000)
+	if n := echoOver(t, conn, read, small); n < int64(len(small)) {
+		t.Fatalf("%d byte reply took only %d bytes on the wire, want it uncompressed", len(small), n)
+	}
+}
+
+func TestCompressionIsOffByDefault(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	_, server := newTestServer(t, r)
+
+	conn, extensions, read := dialCompressed(t, server)
+	if extensions != "" {
+		t.Fatalf("negotiated extensions %q with compression disabled", extensions)
+	}
+	large := strings.Repeat("packetflow ", 20000)
+	if n := echoOver(t, conn, read, large); n < int64(len(large)) {
+		t.Fatalf("%d byte reply took only %d bytes on the wire", len(large), n)
+	}
+}
+
+// ============================================================================
+// WebSocket send queue
+// ============================================================================
+
+func TestSlowHandlersDoNotStopTheReadLoop(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{SendQueueSize: 2})
+	release := registerGate(t, r)
+	_, server := newTestServer(t, r)
+
+	conn, _, err := dialWebSocket(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	send := func(id string) {
+		if err := conn.WriteJSON(map[string]interface{}{"id": id, "g": "tt", "e": "gate"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send("gate-0")
+	waitFor(t, "the first atom to start", func() bool { return r.GetStats().ActiveAtoms == 1 })
+	for i := 1; i <= 4; i++ {
+		send(fmt.Sprintf("gate-%d", i))
+	}
+
+	// The backlog holds two atoms, so the rest are rejected while the first
+	// is still running
+	var notice AtomResult
+	if err := conn.ReadJSON(&notice); err != nil {
+		t.Fatal(err)
+	}
+	if notice.Success || notice.Error.Code != "E429" {
+		t.Fatalf("first reply = %+v, want an E429 while the handler is blocked", notice.Error)
+	}
+
+	// Rejections share one notice, so the second may not get its own
+	close(release)
+	for succeeded := 0; succeeded < 3; {
+		var result AtomResult
+		if err := conn.ReadJSON(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Success {
+			succeeded++
+		} else if result.Error.Code != "E429" {
+			t.Fatalf("reply = %+v, want success or E429", result.Error)
+		}
+	}
+	if calls := packetCalls(r, "tt:gate"); calls != 3 {
+		t.Fatalf("tt:gate ran %d times, want 3", calls)
+	}
+}
+
+// floodWithoutReading sends large atoms without reading replies until the
+// server's send queue overflows. Filling the socket buffers can take a while
+// under the race detector, so it allows more than waitFor's second.
+func floodWithoutReading(t *testing.T, policy string) (*websocket.Conn, *PacketFlowRuntime) {
+	r := newTestRuntime(t, RuntimeConfig{SendQueueSize: 2, SendQueuePolicy: policy})
+	registerPassthrough(t, r)
+	_, server := newTestServer(t, r)
+
+	conn, _, err := dialWebSocket(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overflowed := func() bool {
+		for _, stats := range r.GetConnectionStats() {
+			if stats.Overflowed > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	payload := strings.Repeat("x", 256<<10)
+	deadline := time.Now().Add(10 * time.Second)
+	for !overflowed() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the send queue to overflow")
+		}
+		conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		conn.WriteJSON(map[string]interface{}{"id": newTestAtomID(), "g": "tt", "e": "pass", "d": map[string]interface{}{"input": payload}})
+	}
+	return conn, r
+}
+
+func TestSlowReaderGetsSendQueueRejections(t *testing.T) {
+	conn, _ := floodWithoutReading(t, SendQueueReject)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	rejected := false
+	for !rejected {
+		var result AtomResult
+		if err := conn.ReadJSON(&result); err != nil {
+			t.Fatalf("reading replies: %v", err)
+		}
+		if !result.Success {
+			if result.Error.Code != "E429" {
+				t.Fatalf("rejection = %+v, want E429", result.Error)
+			}
+			rejected = true
+		}
+	}
+
+	// The connection stays usable once the client catches up. The queue may
+	// still be full when an atom arrives, which rejects or silently drops it,
+	// so send another after each reply until one gets through.
+	conn.SetWriteDeadline(time.Time{})
+	send := func() {
+		if err := conn.WriteJSON(map[string]interface{}{"id": newTestAtomID(), "g": "tt", "e": "pass", "d": map[string]interface{}{"input": "ok"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send()
+	for {
+		var result AtomResult
+		if err := conn.ReadJSON(&result); err != nil {
+			t.Fatalf("reading replies: %v", err)
+		}
+		if result.Success && result.Data == "ok" {
+			break
+		}
+		send()
+	}
+}
+
+func TestSlowReaderIsDisconnectedUnderTheClosePolicy(t *testing.T) {
+	conn, r := floodWithoutReading(t, SendQueueClose)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var closeErr *websocket.CloseError
+			// The close frame is best effort, so the socket may just drop
+			if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseTryAgainLater && closeErr.Code != websocket.CloseAbnormalClosure {
+				t.Fatalf("closed with %d, want %d", closeErr.Code, websocket.CloseTryAgainLater)
+			}
+			break
+		}
+	}
+	waitFor(t, "the connection to be dropped", func() bool { return len(r.GetConnectionStats()) == 0 })
+}
+
+// ============================================================================
+// Input schemas
+// ============================================================================
+
+func TestInputSchemaRejectsBadFieldsBeforeTheHandler(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var calls int64
+	mustRegister(t, r, "tt", "typed", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		atomic.AddInt64(&calls, 1)
+		return data["name"], nil
+	}, PacketMetadata{InputSchema: Schema{
+		"name":  {Type: "string", Required: true},
+		"count": {Type: "integer"},
+		"ratio": {Type: "number"},
+		"tags":  {Type: "array"},
+		"opts":  {Type: "object"},
+		"flag":  {Type: "boolean"},
+		"email": {Type: "string", Format: "email"},
+		"extra": {Type: "any", Required: true},
+	}})
+
+	result := runAtom(r, "tt", "typed", map[string]interface{}{
+		"count": 1.5,
+		"ratio": "0.5",
+		"tags":  "a,b",
+		"opts":  []interface{}{},
+		"flag":  "true",
+		"email": "not-an-email",
+	})
+	if result.Success || result.Error.Code != "E400" || !result.Error.Permanent {
+		t.Fatalf("invalid input = %+v, want a permanent E400", result.Error)
+	}
+	fieldErrors := result.Error.Details.(map[string]interface{})["fields"].([]FieldError)
+	var got []string
+	for _, fieldError := range fieldErrors {
+		got = append(got, fieldError.Field+" "+fieldError.Message)
+	}
+	want := []string{
+		"count must be integer, got number",
+		"email must be a valid email",
+		"extra is required",
+		"flag must be boolean, got string",
+		"name is required",
+		"opts must be object, got array",
+		"ratio must be number, got string",
+		"tags must be array, got string",
+	}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Fatalf("field errors =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if atomic.LoadInt64(&calls) != 0 {
+		t.Fatal("handler ran despite invalid input")
+	}
+
+	// Valid input, with fields the schema does not mention, reaches the handler
+	result = runAtom(r, "tt", "typed", map[string]interface{}{
+		"name":      "ok",
+		"count":     3.0,
+		"ratio":     0.5,
+		"tags":      []interface{}{"a"},
+		"opts":      map[string]interface{}{},
+		"flag":      true,
+		"email":     "a@example.com",
+		"extra":     false,
+		"unchecked": 42,
+	})
+	if !result.Success || result.Data != "ok" {
+		t.Fatalf("valid input = %+v", result.Error)
+	}
+}
+
+func TestInputSchemaIsCheckedAtRegistration(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for _, schema := range []Schema{
+		{"x": {Type: "strng"}},
+		{"x": {Type: "string", Format: "nonsense"}},
+	} {
+		if err := r.RegisterPacket("tt", "bad", "", okHandler, PacketMetadata{InputSchema: schema}); err == nil {
+			t.Errorf("registered with schema %+v", schema)
+		}
+	}
+}
+
+func TestInputSchemaRejectsOverHTTP(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "typed", "", okHandler, PacketMetadata{InputSchema: Schema{"n": {Type: "number", Required: true}}})
+	_, server := newTestServer(t, r)
+
+	var result struct {
+		Success bool `json:"success"`
+		Error   struct {
+			Code    string `json:"code"`
+			Details struct {
+				Fields []FieldError `json:"fields"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	postJSON(t, server.URL+"/submit", "", `{"id": "schema_1", "g": "tt", "e": "typed", "d": {"n": "seven"}}`, &result)
+	if result.Success || result.Error.Code != "E400" || len(result.Error.Details.Fields) != 1 || result.Error.Details.Fields[0].Field != "n" {
+		t.Fatalf("HTTP result = %+v", result)
+	}
+}
+
+// ============================================================================
+// Output schemas
+// ============================================================================
+
+func registerOutput(t *testing.T, r *PacketFlowRuntime, element string, output interface{}) {
+	mustRegister(t, r, "tt", element, "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return output, nil
+	}, PacketMetadata{OutputSchema: Schema{
+		"id":   {Type: "string", Required: true},
+		"size": {Type: "integer"},
+	}})
+}
+
+func TestOutputSchemaStripsUndeclaredFields(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerOutput(t, r, "object", map[string]interface{}{"id": "a", "size": 3, "password_hash": "secret"})
+	registerOutput(t, r, "list", []map[string]interface{}{
+		{"id": "a", "internal": true},
+		{"id": "b", "size": 2, "internal": true},
+	})
+
+	result := runAtom(r, "tt", "object", nil)
+	if data := resultMap(t, result); len(data) != 2 || data["id"] != "a" || data["size"] != 3 {
+		t.Fatalf("sanitized object = %v", data)
+	}
+
+	result = runAtom(r, "tt", "list", nil)
+	if !result.Success {
+		t.Fatalf("list output failed: %+v", result.Error)
+	}
+	items := result.Data.([]interface{})
+	if len(items) != 2 {
+		t.Fatalf("sanitized list = %v", items)
+	}
+	for i, item := range items {
+		object := item.(map[string]interface{})
+		if _, leaked := object["internal"]; leaked || object["id"] == nil {
+			t.Fatalf("item %d = %v", i, object)
+		}
+	}
+}
+
+func TestOutputSchemaViolationsFailWithE500(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerOutput(t, r, "missing", map[string]interface{}{"size": 1})
+	registerOutput(t, r, "wrongtype", map[string]interface{}{"id": "a", "size": "big"})
+	registerOutput(t, r, "badlist", []interface{}{map[string]interface{}{"id": "a"}, "scalar", map[string]interface{}{}})
+	registerOutput(t, r, "scalar", "just a string")
+
+	for element, wantFields := range map[string]string{
+		"missing":   "id",
+		"wrongtype": "size",
+		"badlist":   "[1],[2].id",
+		"scalar":    "",
+	} {
+		result := runAtom(r, "tt", element, nil)
+		if result.Success || result.Error.Code != "E500" || result.Error.Permanent {
+			t.Fatalf("%s: result = %+v, want a transient E500", element, result.Error)
+		}
+		var fields []string
+		for _, fieldError := range result.Error.Details.(map[string]interface{})["fields"].([]FieldError) {
+			fields = append(fields, fieldError.Field)
+		}
+		if strings.Join(fields, ",") != wantFields {
+			t.Errorf("%s: failing fields %v, want %s", element, fields, wantFields)
+		}
+	}
+
+	entries, _ := r.PacketStatsReport()
+	if stats := entries["tt:missing"].Stats; stats.Errors != 1 {
+		t.Fatalf("tt:missing errors = %d, want 1", stats.Errors)
+	}
+}
+
+// ============================================================================
+// Manifests
+// ============================================================================
+
+func manifestHandlers() map[string]PacketHandler {
+	return map[string]PacketHandler{
+		"ok": okHandler,
+		"echo": func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+			return data["input"], nil
+		},
+	}
+}
+
+func TestRegisterFromManifest(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	manifest := `{"packets": [
+		{"group": "mf", "element": "echo", "handler": "echo", "metadata": {"timeout": 12, "description": "Echo input"}},
+		{"group": "mf", "element": "echo", "variant": "fast", "handler": "echo"},
+		{"group": "mf", "element": "ok", "handler": "ok", "metadata": {"input_schema": {"n": {"type": "number", "required": true}}}}
+	]}`
+	if err := r.RegisterFromManifest(strings.NewReader(manifest), manifestHandlers()); err != nil {
+		t.Fatal(err)
+	}
+
+	if result := runAtom(r, "mf", "echo", map[string]interface{}{"input": "hi"}); !result.Success || result.Data != "hi" {
+		t.Fatalf("mf:echo = %+v", result.Error)
+	}
+	description, ok := r.DescribePacket("mf:echo")
+	if !ok {
+		t.Fatal("mf:echo not registered")
+	}
+	if metadata := description["metadata"].(PacketMetadata); metadata.Timeout != 12 || metadata.Description != "Echo input" {
+		t.Fatalf("mf:echo metadata = %+v", metadata)
+	}
+	if _, ok := r.DescribePacket("mf:echo:fast"); !ok {
+		t.Fatal("variant not registered")
+	}
+	if result := runAtom(r, "mf", "ok", nil); result.Success || result.Error.Code != "E400" {
+		t.Fatalf("manifest input schema not applied: %+v", result.Error)
+	}
+}
+
+func TestInvalidManifestsRegisterNothing(t *testing.T) {
+	for name, tc := range map[string]struct {
+		manifest string
+		want     []string
+	}{
+		"malformed json": {`{"packets": [`, []string{"invalid manifest"}},
+		"unknown field":  {`{"packets": [{"group": "mf", "element": "a", "handler": "ok", "hander": "ok"}]}`, []string{"unknown field"}},
+		"empty":          {`{"packets": []}`, []string{"no packets"}},
+		"aggregated": {`{"packets": [
+			{"group": "mf", "element": "a", "handler": "ok"},
+			{"element": "b", "handler": "ok"},
+			{"group": "mf", "element": "c"},
+			{"group": "mf", "element": "d", "handler": "missing"},
+			{"group": "mf", "element": "a", "handler": "echo"}
+		]}`, []string{
+			"packet 1: group and element are required",
+			"packet 2: handler is required",
+			`packet 3: unknown handler "missing"`,
+			"packet 4: mf:a already declared by packet 0",
+		}},
+	} {
+		r := newTestRuntime(t, RuntimeConfig{})
+		err := r.RegisterFromManifest(strings.NewReader(tc.manifest), manifestHandlers())
+		if err == nil {
+			t.Fatalf("%s: manifest accepted", name)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q does not mention %q", name, err, want)
+			}
+		}
+		for _, key := range []string{"mf:a", "mf:c", "mf:d"} {
+			if _, ok := r.DescribePacket(key); ok {
+				t.Errorf("%s: %s registered from an invalid manifest", name, key)
+			}
+		}
+	}
+}
+
+func TestManifestRegistrationErrorsDoNotStopOtherPackets(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	manifest := `{"packets": [
+		{"group": "mf", "element": "good", "handler": "ok"},
+		{"group": "mf", "element": "bad", "handler": "ok", "metadata": {"input_schema": {"x": {"type": "strng"}}}}
+	]}`
+	err := r.RegisterFromManifest(strings.NewReader(manifest), manifestHandlers())
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 manifest packets failed") {
+		t.Fatalf("err = %v", err)
+	}
+	if _, ok := r.DescribePacket("mf:good"); !ok {
+		t.Fatal("valid packet not registered")
+	}
+	if _, ok := r.DescribePacket("mf:bad"); ok {
+		t.Fatal("packet with an invalid schema registered")
+	}
+}
+
+// ============================================================================
+// Diff
+// ============================================================================
+
+// decodeJSONObject decodes a JSON object literal for packet input
+func decodeJSONObject(t *testing.T, text string) map[string]interface{} {
+	t.Helper()
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &object); err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
+
+// diffPaths flattens a df:diff result to "added path" style lines
+func diffPaths(t *testing.T, result *AtomResult) []string {
+	t.Helper()
+	data := resultMap(t, result)
+	var lines []string
+	for _, entry := range data["added"].([]DiffEntry) {
+		lines = append(lines, fmt.Sprintf("+ %s %v", entry.Path, entry.Value))
+	}
+	for _, entry := range data["removed"].([]DiffEntry) {
+		lines = append(lines, fmt.Sprintf("- %s %v", entry.Path, entry.Value))
+	}
+	for _, change := range data["changed"].([]DiffChange) {
+		lines = append(lines, fmt.Sprintf("~ %s %v -> %v", change.Path, change.Old, change.New))
+	}
+	return lines
+}
+
+func TestDiffReportsNestedChangesByPath(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	left := decodeJSONObject(t, `{"name": "a", "age": 30, "address": {"city": "Oslo", "zip": "0150"}, "tags": ["x", "y", "z"], "gone": true}`)
+	right := decodeJSONObject(t, `{"name": "a", "age": 31, "address": {"city": "Bergen", "country": "NO"}, "tags": ["x", "q"], "new": null}`)
+
+	got := diffPaths(t, runAtom(r, "df", "diff", map[string]interface{}{"left": left, "right": right}))
+	want := []string{
+		"+ address.country NO",
+		"+ new <nil>",
+		"- address.zip 0150",
+		"- gone true",
+		"- tags.2 z",
+		"~ address.city Oslo -> Bergen",
+		"~ age 30 -> 31",
+		"~ tags.1 y -> q",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("diff =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDiffMatchesArraysByKey(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	left := decodeJSONObject(t, `{"items": [{"id": 1, "qty": 2}, {"id": 2, "qty": 5}, {"id": 3, "qty": 1}]}`)
+	right := decodeJSONObject(t, `{"items": [{"id": 3, "qty": 1}, {"id": 1, "qty": 4}, {"id": 4, "qty": 9}]}`)
+
+	got := diffPaths(t, runAtom(r, "df", "diff", map[string]interface{}{"left": left, "right": right, "array_key": "id"}))
+	want := []string{
+		"+ items[id=4] map[id:4 qty:9]",
+		"- items[id=2] map[id:2 qty:5]",
+		"~ items[id=1].qty 2 -> 4",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("keyed diff =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Without a key, reordering shows up as element-wise changes
+	if indexed := diffPaths(t, runAtom(r, "df", "diff", map[string]interface{}{"left": left, "right": right})); len(indexed) != 6 {
+		t.Fatalf("indexed diff = %v, want 6 changes", indexed)
+	}
+}
+
+func TestDiffFallsBackToIndexesForAmbiguousKeys(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for name, items := range map[string][2]string{
+		"duplicate": {`[{"id": 1, "qty": 2}, {"id": 1, "qty": 3}]`, `[{"id": 1, "qty": 2}, {"id": 1, "qty": 5}]`},
+		"mixed":     {`[{"id": "1", "qty": 2}, {"id": 2, "qty": 3}]`, `[{"id": 1, "qty": 2}, {"id": 2, "qty": 5}]`},
+	} {
+		left := decodeJSONObject(t, `{"items": `+items[0]+`}`)
+		right := decodeJSONObject(t, `{"items": `+items[1]+`}`)
+		got := diffPaths(t, runAtom(r, "df", "diff", map[string]interface{}{"left": left, "right": right, "array_key": "id"}))
+		want := []string{"~ items.1.qty 3 -> 5"}
+		if name == "mixed" {
+			want = []string{"~ items.0.id 1 -> 1", "~ items.1.qty 3 -> 5"}
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s keys: diff =\n%s\nwant\n%s", name, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestDiffComparesNumbersByValue(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	left := map[string]interface{}{"a": 1, "b": int64(2), "c": 3.0, "d": "4", "e": []interface{}{1, 2}}
+	right := map[string]interface{}{"a": 1.0, "b": 2.0, "c": 3, "d": 4.0, "e": []interface{}{1.0, int64(2)}}
+
+	data := resultMap(t, runAtom(r, "df", "diff", map[string]interface{}{"left": left, "right": right}))
+	changed := data["changed"].([]DiffChange)
+	if len(changed) != 1 || changed[0].Path != "d" {
+		t.Fatalf("changed = %+v, want only the string-to-number field d", changed)
+	}
+	if data["equal"] != false {
+		t.Fatal("diff with a change reported equal")
+	}
+
+	same := decodeJSONObject(t, `{"a": {"b": [1, {"c": null}]}}`)
+	if data := resultMap(t, runAtom(r, "df", "diff", map[string]interface{}{"left": same, "right": same})); data["equal"] != true {
+		t.Fatalf("identical objects diff = %v", data)
+	}
+}
+
+// ============================================================================
+// Merge
+// ============================================================================
+
+func mergeJSON(t *testing.T, r *PacketFlowRuntime, strategy string, inputs ...string) string {
+	t.Helper()
+	objects := make([]interface{}, len(inputs))
+	for i, input := range inputs {
+		objects[i] = decodeJSONObject(t, input)
+	}
+	data := map[string]interface{}{"inputs": objects}
+	if strategy != "" {
+		data["array_strategy"] = strategy
+	}
+	merged, err := json.Marshal(resultMap(t, runAtom(r, "df", "merge", data))["result"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(merged)
+}
+
+func TestMergeDeepMergesInOrder(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	got := mergeJSON(t, r, "",
+		`{"db": {"host": "localhost", "port": 5432, "pool": {"min": 1, "max": 5}}, "debug": true}`,
+		`{"db": {"host": "db.internal", "pool": {"max": 20}}, "name": "svc"}`,
+		`{"db": {"pool": {"min": 2}}, "debug": false}`,
+	)
+	want := `{"db":{"host":"db.internal","pool":{"max":20,"min":2},"port":5432},"debug":false,"name":"svc"}`
+	if got != want {
+		t.Fatalf("merged = %s\nwant     %s", got, want)
+	}
+}
+
+func TestMergeArrayStrategies(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	first, second := `{"tags": ["a", "b", {"k": 1}]}`, `{"tags": ["b", "c", {"k": 1.0}]}`
+
+	for strategy, want := range map[string]string{
+		"":        `{"tags":["b","c",{"k":1}]}`,
+		"replace": `{"tags":["b","c",{"k":1}]}`,
+		"concat":  `{"tags":["a","b",{"k":1},"b","c",{"k":1}]}`,
+		"union":   `{"tags":["a","b",{"k":1},"c"]}`,
+	} {
+		if got := mergeJSON(t, r, strategy, first, second); got != want {
+			t.Errorf("%q strategy: merged = %s, want %s", strategy, got, want)
+		}
+	}
+
+	result := runAtom(r, "df", "merge", map[string]interface{}{"inputs": []interface{}{map[string]interface{}{}}, "array_strategy": "zip"})
+	if result.Success || !strings.Contains(result.Error.Message, "unsupported array strategy") {
+		t.Fatalf("unknown strategy = %+v", result.Error)
+	}
+}
+
+func TestMergeTypeConflictsAreLastWins(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	got := mergeJSON(t, r, "union",
+		`{"a": {"x": 1}, "b": [1, 2], "c": "text", "d": {"keep": true}}`,
+		`{"a": [1], "b": {"y": 2}, "c": {"z": 3}, "d": null}`,
+	)
+	want := `{"a":[1],"b":{"y":2},"c":{"z":3},"d":null}`
+	if got != want {
+		t.Fatalf("merged = %s\nwant     %s", got, want)
+	}
+}
+
+func TestMergeDoesNotModifyItsInputs(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	first := decodeJSONObject(t, `{"nested": {"list": [1]}}`)
+	second := decodeJSONObject(t, `{"nested": {"list": [2], "extra": {"deep": 1}}}`)
+
+	merged := resultMap(t, runAtom(r, "df", "merge", map[string]interface{}{
+		"inputs":         []interface{}{first, second},
+		"array_strategy": "concat",
+	}))["result"].(map[string]interface{})
+	merged["nested"].(map[string]interface{})["extra"].(map[string]interface{})["deep"] = 99
+
+	before, _ := json.Marshal([]interface{}{first, second})
+	if string(before) != `[{"nested":{"list":[1]}},{"nested":{"extra":{"deep":1},"list":[2]}}]` {
+		t.Fatalf("inputs changed to %s", before)
+	}
+
+	result := runAtom(r, "df", "merge", map[string]interface{}{"inputs": []interface{}{first, "scalar"}})
+	if result.Success || !strings.Contains(result.Error.Message, "inputs[1] must be an object") {
+		t.Fatalf("non-object input = %+v", result.Error)
+	}
+}
+
+// ============================================================================
+// Data accessor
+// ============================================================================
+
+func TestDataAccessorCoercion(t *testing.T) {
+	var decoded map[string]interface{}
+	json.Unmarshal([]byte(`{"whole": 42, "fraction": 1.5, "negative": -3, "text": "7", "flag": true, "null": null, "list": [1], "object": {"a": 1}}`), &decoded)
+	data := DataAccessor(decoded)
+	for key, value := range map[string]interface{}{
+		"i8": int8(-8), "u16": uint16(16), "i32": int32(32), "i64": int64(1 << 40), "u64": uint64(64), "f32": float32(2),
+		"huge": uint64(math.MaxUint64), "bigfloat": 1e20, "nan": math.NaN(),
+	} {
+		data[key] = value
+	}
+
+	for key, want := range map[string]int{
+		"whole": 42, "negative": -3, "i8": -8, "u16": 16, "i32": 32, "u64": 64, "f32": 2,
+		// Fractions, strings, non-numbers and out-of-range values fall back
+		"fraction": -1, "text": -1, "flag": -1, "null": -1, "missing": -1, "huge": -1, "bigfloat": -1, "nan": -1,
+	} {
+		if got := data.GetInt(key, -1); got != want {
+			t.Errorf("GetInt(%s) = %d, want %d", key, got, want)
+		}
+	}
+	if got := data.GetInt64("i64", 0); got != 1<<40 {
+		t.Errorf("GetInt64(i64) = %d", got)
+	}
+
+	for key, want := range map[string]float64{"whole": 42, "fraction": 1.5, "i8": -8, "u64": 64, "f32": 2, "text": -1, "flag": -1, "missing": -1} {
+		if got := data.GetFloat(key, -1); got != want {
+			t.Errorf("GetFloat(%s) = %v, want %v", key, got, want)
+		}
+	}
+
+	if data.GetString("text", "") != "7" || data.GetString("whole", "def") != "def" {
+		t.Error("GetString coerced a number or missed a string")
+	}
+	if !data.GetBool("flag", false) || data.GetBool("text", true) != true || data.GetBool("null", true) != true {
+		t.Error("GetBool mishandled a value")
+	}
+	if data.GetMap("object", nil)["a"] != 1.0 || data.GetMap("list", nil) != nil {
+		t.Error("GetMap mishandled a value")
+	}
+	if len(data.GetSlice("list", nil)) != 1 || data.GetSlice("object", nil) != nil {
+		t.Error("GetSlice mishandled a value")
+	}
+}
+
+func TestDataAccessorLookupDistinguishesZeroFromMissing(t *testing.T) {
+	data := DataAccessor{"zero": 0.0, "null": nil, "text": "0"}
+
+	if value, ok := data.LookupInt("zero"); !ok || value != 0 {
+		t.Fatalf("LookupInt(zero) = %d, %v; want 0, true", value, ok)
+	}
+	for _, key := range []string{"null", "text", "missing"} {
+		if _, ok := data.LookupInt(key); ok {
+			t.Errorf("LookupInt(%s) reported a value", key)
+		}
+		if _, ok := data.LookupInt64(key); ok {
+			t.Errorf("LookupInt64(%s) reported a value", key)
+		}
+	}
+	if data.GetInt("zero", 5) != 0 {
+		t.Fatal("GetInt replaced an explicit 0 with the default")
+	}
+
+	// A nil accessor reads as empty
+	var empty DataAccessor
+	if empty.GetInt("x", 9) != 9 || empty.GetString("x", "d") != "d" {
+		t.Fatal("nil accessor did not return defaults")
+	}
+}
+
+func TestBinarySubmitReadsMsgpackIntegers(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var got int64
+	mustRegister(t, r, "tt", "int", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		atomic.StoreInt64(&got, DataAccessor(data).GetInt64("n", -1))
+		return nil, nil
+	}, PacketMetadata{})
+	handler := NewMessageHandler(r)
+
+	// msgpack decodes small integers as int8 and large ones as int64
+	for _, n := range []int64{3, 1 << 40} {
+		frame, err := handler.EncodeMessage("submit", map[string]interface{}{
+			"id": newTestAtomID(), "g": "tt", "e": "int", "d": map[string]interface{}{"n": n}, "t": 5, "p": 2,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := handler.HandleMessage(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := replyError(t, handler, response); code != "" {
+			t.Fatalf("submit failed with %s", code)
+		}
+		if read := atomic.LoadInt64(&got); read != n {
+			t.Fatalf("handler read n = %d, want %d", read, n)
+		}
+	}
+}
+
+// ============================================================================
+// Explicit zero values
+// ============================================================================
+
+func TestBinarySubmitHonoursExplicitZeroes(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	handler := NewMessageHandler(r)
+
+	atom, err := handler.decodeAtom(map[string]interface{}{"id": "zero", "g": "tt", "e": "pass", "p": int8(0), "t": int8(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atom.Priority == nil || *atom.Priority != 0 || atom.Timeout == nil || *atom.Timeout != 0 {
+		t.Fatalf("priority %v, timeout %v; want explicit zeroes", atom.Priority, atom.Timeout)
+	}
+	if r.atomPriority(atom) != 0 {
+		t.Fatalf("atom priority = %d, want 0", r.atomPriority(atom))
+	}
+
+	atom, _ = handler.decodeAtom(map[string]interface{}{"id": "absent", "g": "tt", "e": "pass"})
+	if atom.Priority != nil || atom.Timeout != nil || r.atomPriority(atom) != DefaultPriority {
+		t.Fatalf("absent fields decoded as priority %v, timeout %v", atom.Priority, atom.Timeout)
+	}
+
+	// An explicit zero timeout runs without one; only negatives are rejected
+	registerPassthrough(t, r)
+	for timeout, want := range map[int]string{0: "", -1: "E400"} {
+		frame, err := handler.EncodeMessage("submit", map[string]interface{}{"id": newTestAtomID(), "g": "tt", "e": "pass", "t": timeout}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := handler.HandleMessage(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := replyError(t, handler, response); code != want {
+			t.Fatalf("binary submit with t=%d = %q, want %q", timeout, code, want)
+		}
+	}
+}
+
+func TestExplicitZeroTimeoutRunsUnbounded(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "nap", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		select {
+		case <-time.After(1500 * time.Millisecond):
+			return "rested", nil
+		case <-ctx.Context.Done():
+			return nil, ctx.Context.Err()
+		}
+	}, PacketMetadata{Timeout: 1})
+
+	// Without an override the packet's 1s timeout applies
+	if result := runAtom(r, "tt", "nap", nil); result.Success || result.Error.Message != "Packet timeout after 1s" {
+		t.Fatalf("nap without a timeout override = %+v, want the 1s packet timeout", result)
+	}
+
+	zero := 0
+	atom := &Atom{ID: newTestAtomID(), Group: "tt", Element: "nap", Timeout: &zero}
+	if result := r.ProcessAtom(atom); !result.Success || result.Data != "rested" {
+		t.Fatalf("nap with t=0 = %+v, want it to outlast the packet timeout", result)
+	}
+
+	// A deadline still bounds an unlimited atom
+	atom = deadlineAtom("nap", time.Now().Add(100*time.Millisecond), &zero)
+	if result := r.ProcessAtom(atom); result.Success || !strings.Contains(result.Error.Message, "atom deadline exceeded") {
+		t.Fatalf("nap with t=0 and a 100ms deadline = %+v, want a deadline E408", result)
+	}
+
+	trace := resultMap(t, runAtom(r, "cf", "trace", map[string]interface{}{"atom": map[string]interface{}{"g": "tt", "e": "nap", "t": 0}}))
+	if trace["timeout_source"] != "atom" || trace["timeout_seconds"] != 0 {
+		t.Fatalf("trace = %v, want an unbounded atom timeout", trace)
+	}
+}
+
+func TestHTTPSubmitHonoursExplicitZeroes(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 1})
+	release := registerGate(t, r)
+	var mu sync.Mutex
+	var order []string
+	mustRegister(t, r, "tt", "record", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		mu.Lock()
+		order = append(order, DataAccessor(data).GetString("name", ""))
+		mu.Unlock()
+		return nil, nil
+	}, PacketMetadata{})
+	_, server := newTestServer(t, r)
+
+	var result AtomResult
+	if status := postJSON(t, server.URL+"/submit", "", `{"id": "t0", "g": "tt", "e": "record", "t": 0}`, &result); status != http.StatusOK || !result.Success {
+		t.Fatalf("t=0 status = %d (%+v), want 200", status, result.Error)
+	}
+	if status := postJSON(t, server.URL+"/submit", "", `{"id": "t-1", "g": "tt", "e": "record", "t": -1}`, nil); status != http.StatusBadRequest {
+		t.Fatalf("t=-1 status = %d, want 400", status)
+	}
+	order = nil
+
+	// With the only slot held, a priority 0 atom queued last runs first
+	go runAtom(r, "tt", "gate", nil)
+	waitFor(t, "the gate to hold the slot", func() bool { return r.GetStats().ActiveAtoms == 1 })
+	var wg sync.WaitGroup
+	for i, atom := range []string{
+		`{"id": "p1", "g": "tt", "e": "record", "p": 1, "d": {"name": "one"}}`,
+		`{"id": "p0", "g": "tt", "e": "record", "p": 0, "d": {"name": "zero"}}`,
+	} {
+		wg.Add(1)
+		go func(atom string) {
+			defer wg.Done()
+			if resp, err := http.Post(server.URL+"/submit", "application/json", strings.NewReader(atom)); err == nil {
+				resp.Body.Close()
+			}
+		}(atom)
+		waitFor(t, "the atom to queue", func() bool { return r.GetStats().QueueDepth == i+1 })
+	}
+	close(release)
+	wg.Wait()
+
+	if strings.Join(order, ",") != "zero,one" {
+		t.Fatalf("run order = %v, want the priority 0 atom first", order)
+	}
+}
+
+// ============================================================================
+// Atom ID generation
+// ============================================================================
+
+func TestIDGeneratorsProduceValidUniqueIDs(t *testing.T) {
+	ulid := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+	timestamp := regexp.MustCompile(`^[0-9a-f]{16}-[0-9a-f]{8}$`)
+	utils := NewPacketUtils(nil)
+
+	for name, tc := range map[string]struct {
+		generator IDGenerator
+		valid     func(string) bool
+		sortable  bool
+	}{
+		"uuid":      {UUIDGenerator{}, func(id string) bool { return utils.uuidRegex.MatchString(id) }, false},
+		"ulid":      {NewULIDGenerator(), ulid.MatchString, true},
+		"timestamp": {NewTimestampIDGenerator(), timestamp.MatchString, true},
+	} {
+		const n = 5000
+		seen := make(map[string]bool, n)
+		previous := ""
+		for i := 0; i < n; i++ {
+			id := tc.generator.NewID()
+			if !tc.valid(id) {
+				t.Fatalf("%s: invalid ID %q", name, id)
+			}
+			if seen[id] {
+				t.Fatalf("%s: duplicate ID %q after %d", name, id, i)
+			}
+			seen[id] = true
+			if tc.sortable && id <= previous {
+				t.Fatalf("%s: %q does not sort after %q", name, id, previous)
+			}
+			previous = id
+		}
+	}
+}
+
+func TestULIDEncodesItsTimestamp(t *testing.T) {
+	before := time.Now().UnixMilli()
+	id := NewULIDGenerator().NewID()
+	after := time.Now().UnixMilli()
+
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	if ms < before || ms > after {
+		t.Fatalf("ULID %s encodes %d, want within [%d, %d]", id, ms, before, after)
+	}
+
+	var raw [16]byte
+	for i := range raw {
+		raw[i] = 0xff
+	}
+	if encoded := encodeULID(raw); encoded != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Fatalf("max ULID = %s", encoded)
+	}
+}
+
+func TestGeneratorsAreSafeForConcurrentUse(t *testing.T) {
+	for _, generator := range []IDGenerator{NewULIDGenerator(), NewTimestampIDGenerator()} {
+		var mu sync.Mutex
+		seen := make(map[string]bool)
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					id := generator.NewID()
+					mu.Lock()
+					seen[id] = true
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(seen) != 8*500 {
+			t.Fatalf("%T produced %d unique IDs, want %d", generator, len(seen), 8*500)
+		}
+	}
+}
+
+func TestAtomsWithoutIDsGetGeneratedOnes(t *testing.T) {
+	var got string
+	handler := func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		got = ctx.Atom.ID
+		return nil, nil
+	}
+
+	strict := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, strict, "tt", "id", "", handler, PacketMetadata{})
+	if result := strict.ProcessAtom(&Atom{Group: "tt", Element: "id"}); result.Success || result.Error.Code != "E400" {
+		t.Fatalf("atom without an ID = %+v, want E400", result.Error)
+	}
+
+	generating := newTestRuntime(t, RuntimeConfig{AutoGenerateAtomID: true, IDGenerator: NewULIDGenerator(), RequireUUIDIDs: true})
+	mustRegister(t, generating, "tt", "id", "", handler, PacketMetadata{})
+	if result := generating.ProcessAtom(&Atom{Group: "tt", Element: "id"}); !result.Success {
+		t.Fatalf("atom without an ID = %+v", result.Error)
+	}
+	if len(got) != 26 {
+		t.Fatalf("generated ID = %q, want a ULID", got)
+	}
+
+	// Client-supplied IDs are kept, and generated IDs skip the UUID ingress check
+	_, server := newTestServer(t, generating)
+	var result AtomResult
+	if status := postJSON(t, server.URL+"/submit", "", `{"g": "tt", "e": "id"}`, &result); status != http.StatusOK || len(got) != 26 {
+		t.Fatalf("HTTP submit without an ID = %d, id %q", status, got)
+	}
+	id := uuid.New().String()
+	postJSON(t, server.URL+"/submit", "", `{"id": "`+id+`", "g": "tt", "e": "id"}`, &result)
+	if got != id {
+		t.Fatalf("client ID replaced with %q", got)
+	}
+}
+
+// ============================================================================
+// MessagePack extension types
+// ============================================================================
+
+func TestMsgpackRoundTripsTimesAndBytes(t *testing.T) {
+	handler := NewMessageHandler(nil)
+	times := map[string]time.Time{
+		"ts32": time.Unix(1700000000, 0).UTC(),
+		"ts64": time.Unix(1700000000, 123456789).UTC(),
+		"ts96": time.Date(1969, 7, 20, 20, 17, 40, 5, time.UTC),
+		"far":  time.Date(2600, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	blob := []byte{0x00, 0xff, 0x10, 0x80}
+	data := map[string]interface{}{
+		"blob":   blob,
+		"nested": map[string]interface{}{"at": times["ts64"], "parts": []interface{}{blob, times["ts32"]}},
+	}
+	for key, value := range times {
+		data[key] = value
+	}
+
+	frame, err := handler.EncodeMessage("result", data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := handler.DecodeMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := DataAccessor(message.Data.(map[string]interface{}))
+
+	for key, want := range times {
+		got, ok := decoded[key].(time.Time)
+		if !ok || !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("%s decoded as %#v, want %v in UTC", key, decoded[key], want)
+		}
+	}
+	if got := decoded.GetBytes("blob", nil); string(got) != string(blob) {
+		t.Errorf("blob decoded as %#v", decoded["blob"])
+	}
+	nested := DataAccessor(decoded.GetMap("nested", nil))
+	if !nested.GetTime("at", time.Time{}).Equal(times["ts64"]) {
+		t.Errorf("nested time decoded as %#v", nested["at"])
+	}
+	parts := nested.GetSlice("parts", nil)
+	if len(parts) != 2 || string(parts[0].([]byte)) != string(blob) || !parts[1].(time.Time).Equal(times["ts32"]) {
+		t.Errorf("nested parts decoded as %#v", parts)
+	}
+}
+
+func TestTimestampExtensionUsesTheSmallestLayout(t *testing.T) {
+	for _, tc := range []struct {
+		at     time.Time
+		header []byte
+		size   int
+	}{
+		{time.Unix(1700000000, 0), []byte{0xd6, 0xff}, 4},
+		{time.Unix(1700000000, 1), []byte{0xd7, 0xff}, 8},
+		{time.Unix(-1, 0), []byte{0xc7, 12, 0xff}, 12},
+	} {
+		encoded, err := msgpack.Marshal(tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded[:len(tc.header)]) != string(tc.header) || len(encoded) != len(tc.header)+tc.size {
+			t.Errorf("%v encoded as % x, want header % x and %d bytes of payload", tc.at, encoded, tc.header, tc.size)
+		}
+	}
+}
+
+func TestBinarySubmitDeliversTimesAndBytesToHandlers(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var gotTime time.Time
+	var gotBytes []byte
+	mustRegister(t, r, "tt", "typed", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		gotTime = DataAccessor(data).GetTime("at", time.Time{})
+		gotBytes = DataAccessor(data).GetBytes("blob", nil)
+		return map[string]interface{}{"at": gotTime, "blob": gotBytes}, nil
+	}, PacketMetadata{})
+	handler := NewMessageHandler(r)
+
+	at := time.Date(2024, 2, 29, 12, 0, 0, 500, time.UTC)
+	frame, err := handler.EncodeMessage("submit", map[string]interface{}{
+		"id": newTestAtomID(), "g": "tt", "e": "typed", "d": map[string]interface{}{"at": at, "blob": []byte("raw\x00bytes")},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := handler.HandleMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotTime.Equal(at) || string(gotBytes) != "raw\x00bytes" {
+		t.Fatalf("handler got time %v, bytes %q", gotTime, gotBytes)
+	}
+
+	reply, err := handler.DecodeMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := DataAccessor(DataAccessor(reply.Data.(map[string]interface{})).GetMap("data", nil))
+	if !result.GetTime("at", time.Time{}).Equal(at) || string(result.GetBytes("blob", nil)) != "raw\x00bytes" {
+		t.Fatalf("reply data = %#v", reply.Data)
+	}
+}
+
+// ============================================================================
+// Cost budget
+// ============================================================================
+
+func registerCosted(t *testing.T, r *PacketFlowRuntime) {
+	t.Helper()
+	mustRegister(t, r, "tt", "cheap", "", okHandler, PacketMetadata{Cost: 1})
+	mustRegister(t, r, "tt", "heavy", "", okHandler, PacketMetadata{Cost: 5})
+	mustRegister(t, r, "tt", "huge", "", okHandler, PacketMetadata{Cost: 20})
+	mustRegister(t, r, "tt", "default", "", okHandler, PacketMetadata{})
+}
+
+func TestCostBudgetWeightsHeavyPackets(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{CostBudget: 10, CostRefillRate: 0.001})
+	registerCosted(t, r)
+
+	for i := 0; i < 2; i++ {
+		if result := runAtom(r, "tt", "heavy", nil); !result.Success {
+			t.Fatalf("heavy atom %d rejected: %+v", i, result.Error)
+		}
+	}
+	result := runAtom(r, "tt", "cheap", nil)
+	if result.Success || result.Error.Code != "E429" || result.Error.Permanent {
+		t.Fatalf("cheap atom after two heavy ones = %+v, want a retryable E429", result.Error)
+	}
+
+	stats := r.GetStats()
+	if stats.BudgetRejected != 1 || stats.CostBudgetRemaining == nil || *stats.CostBudgetRemaining > 0.01 {
+		t.Fatalf("stats budget_rejected=%d remaining=%v", stats.BudgetRejected, stats.CostBudgetRemaining)
+	}
+}
+
+func TestCostBudgetAdmitsMoreCheapThanHeavyPackets(t *testing.T) {
+	admitted := func(element string) int {
+		r := newTestRuntime(t, RuntimeConfig{CostBudget: 10, CostRefillRate: 0.001})
+		registerCosted(t, r)
+		count := 0
+		for i := 0; i < 20; i++ {
+			if runAtom(r, "tt", element, nil).Success {
+				count++
+			}
+		}
+		return count
+	}
+
+	if cheap, heavy, plain := admitted("cheap"), admitted("heavy"), admitted("default"); cheap != 10 || heavy != 2 || plain != 10 {
+		t.Fatalf("admitted cheap=%d heavy=%d default=%d, want 10, 2 and 10", cheap, heavy, plain)
+	}
+}
+
+func TestCostBudgetRefillsOverTime(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{CostBudget: 5, CostRefillRate: 100})
+	registerCosted(t, r)
+
+	if !runAtom(r, "tt", "heavy", nil).Success {
+		t.Fatal("first heavy atom rejected")
+	}
+	waitFor(t, "the budget to refill", func() bool {
+		return runAtom(r, "tt", "heavy", nil).Success
+	})
+	if remaining := *r.GetStats().CostBudgetRemaining; remaining > 5 {
+		t.Fatalf("remaining budget %g exceeds its capacity", remaining)
+	}
+}
+
+func TestCostBudgetAdmitsOversizedPacketsOnlyWhenFull(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{CostBudget: 10, CostRefillRate: 0.001})
+	registerCosted(t, r)
+
+	if result := runAtom(r, "tt", "huge", nil); !result.Success {
+		t.Fatalf("oversized atom rejected on a full budget: %+v", result.Error)
+	}
+	// The overdraft is repaid before anything else runs
+	if result := runAtom(r, "tt", "cheap", nil); result.Success || result.Error.Code != "E429" {
+		t.Fatalf("cheap atom after an overdraft = %+v, want E429", result.Error)
+	}
+
+	r = newTestRuntime(t, RuntimeConfig{CostBudget: 10, CostRefillRate: 0.001})
+	registerCosted(t, r)
+	runAtom(r, "tt", "cheap", nil)
+	if result := runAtom(r, "tt", "huge", nil); result.Success {
+		t.Fatal("oversized atom admitted on a partially spent budget")
+	}
+}
+
+func TestCostBudgetIsOffByDefault(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerCosted(t, r)
+	for i := 0; i < 50; i++ {
+		if result := runAtom(r, "tt", "huge", nil); !result.Success {
+			t.Fatalf("atom %d rejected without a budget: %+v", i, result.Error)
+		}
+	}
+	if stats := r.GetStats(); stats.CostBudgetRemaining != nil || stats.BudgetRejected != 0 {
+		t.Fatalf("stats report a budget that is not configured: %+v", stats)
+	}
+}
+
+// ============================================================================
+// Load shedding
+// ============================================================================
+
+func runAtPriority(r *PacketFlowRuntime, element string, priority int) *AtomResult {
+	return r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: element, Priority: &priority})
+}
+
+// pinMemoryLoad fixes the sampled heap usage so currentLoad does not resample
+// it during the test
+func pinMemoryLoad(r *PacketFlowRuntime, percent float64) {
+	r.memLoadMu.Lock()
+	r.memLoad = percent
+	r.memSampledAt = time.Now().Add(time.Hour)
+	r.memLoadMu.Unlock()
+}
+
+func TestMemoryPressureShedsLowPriorityAtoms(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ShedLoadThreshold: 90})
+	mustRegister(t, r, "tt", "ok", "", okHandler, PacketMetadata{})
+
+	pinMemoryLoad(r, 95)
+	for _, priority := range []int{0, 3, DefaultPriority} {
+		if result := runAtPriority(r, "ok", priority); !result.Success {
+			t.Errorf("priority %d atom shed under load: %+v", priority, result.Error)
+		}
+	}
+	for _, priority := range []int{DefaultPriority + 1, 9} {
+		result := runAtPriority(r, "ok", priority)
+		if result.Success || result.Error.Code != "E503" || result.Error.Permanent {
+			t.Errorf("priority %d atom under load = %+v, want a retryable E503", priority, result.Error)
+		}
+	}
+	if shed := r.GetStats().Shed; shed != 2 {
+		t.Fatalf("shed = %d, want 2", shed)
+	}
+
+	pinMemoryLoad(r, 50)
+	if result := runAtPriority(r, "ok", 9); !result.Success {
+		t.Fatalf("low-priority atom shed below the threshold: %+v", result.Error)
+	}
+}
+
+func TestSaturatedSlotsShedLowPriorityAtoms(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 2, ShedLoadThreshold: 150, ShedPriorityCutoff: 2})
+	release := registerGate(t, r)
+	mustRegister(t, r, "tt", "ok", "", okHandler, PacketMetadata{})
+	pinMemoryLoad(r, 0)
+
+	// Two running atoms and one queued put the reactor at 150%
+	var wg sync.WaitGroup
+	results := make(chan *AtomResult, 4)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- runAtom(r, "tt", "gate", nil)
+		}()
+	}
+	waitFor(t, "the reactor to saturate", func() bool { return r.currentLoad() >= 150 })
+
+	if result := runAtPriority(r, "ok", 3); result.Success || result.Error.Code != "E503" {
+		t.Fatalf("low-priority atom at full load = %+v, want E503", result.Error)
+	}
+	// High-priority atoms still queue for a slot rather than being shed
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results <- runAtPriority(r, "ok", 1)
+	}()
+	waitFor(t, "the urgent atom to queue", func() bool { return r.GetStats().QueueDepth == 2 })
+
+	close(release)
+	wg.Wait()
+	close(results)
+	for result := range results {
+		if !result.Success {
+			t.Errorf("admitted atom failed: %+v", result.Error)
+		}
+	}
+	if result := runAtPriority(r, "ok", 3); !result.Success {
+		t.Fatalf("low-priority atom shed once load dropped: %+v", result.Error)
+	}
+}
+
+func TestLoadSheddingIsOffByDefault(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "ok", "", okHandler, PacketMetadata{})
+	pinMemoryLoad(r, 100)
+	if result := runAtPriority(r, "ok", 9); !result.Success {
+		t.Fatalf("atom shed without a threshold: %+v", result.Error)
+	}
+}
+
+// ============================================================================
+// Traffic recording and replay
+// ============================================================================
+
+func registerReplayPackets(t *testing.T, r *PacketFlowRuntime, suffix string) {
+	t.Helper()
+	registerPassthrough(t, r)
+	mustRegister(t, r, "tt", "greet", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return map[string]interface{}{"greeting": "hello " + DataAccessor(data).GetString("name", "") + suffix}, nil
+	}, PacketMetadata{})
+	mustRegister(t, r, "tt", "fail", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return nil, &AtomError{Code: "E422", Message: "always fails", Permanent: true}
+	}, PacketMetadata{})
+}
+
+func recordTraffic(t *testing.T, path string) {
+	t.Helper()
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerReplayPackets(t, r, "")
+	recorder, err := NewTrafficRecorder(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetRecorder(recorder)
+
+	runAtom(r, "tt", "pass", map[string]interface{}{"input": map[string]interface{}{"n": 1, "list": []interface{}{"a", true}}})
+	runAtom(r, "tt", "greet", map[string]interface{}{"name": "ada"})
+	runAtom(r, "tt", "fail", nil)
+	runAtom(r, "tt", "missing", nil)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordedTrafficReplaysWithEquivalentResults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	recordTraffic(t, path)
+
+	lines, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(string(lines), "\n"); count != 4 {
+		t.Fatalf("recorded %d lines, want 4:\n%s", count, lines)
+	}
+
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerReplayPackets(t, r, "")
+	report, err := r.ReplayFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 4 || report.Matched != 4 || len(report.Mismatches) != 0 {
+		t.Fatalf("replay report = %+v", report)
+	}
+}
+
+func TestReplayReportsChangedResults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	recordTraffic(t, path)
+
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerReplayPackets(t, r, "!")
+	report, err := r.ReplayFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 4 || report.Matched != 3 || len(report.Mismatches) != 1 {
+		t.Fatalf("replay report = %+v", report)
+	}
+	mismatch := report.Mismatches[0]
+	if got := mismatch.Replayed.Data.(map[string]interface{})["greeting"]; got != "hello ada!" {
+		t.Fatalf("mismatch = %+v", mismatch)
+	}
+}
+
+func TestReplayScalesRecordedGaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	start := time.Now()
+	var lines []string
+	for i := 0; i < 3; i++ {
+		line, _ := json.Marshal(AtomRecord{
+			Time:   start.Add(time.Duration(i) * 200 * time.Millisecond),
+			Atom:   &Atom{ID: newTestAtomID(), Group: "tt", Element: "pass"},
+			Result: &AtomResult{Success: true},
+		})
+		lines = append(lines, string(line))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	report, err := r.ReplayFile(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 400ms of recorded gaps at 4x speed
+	if report.Duration < 100*time.Millisecond || report.Duration >= 400*time.Millisecond {
+		t.Fatalf("replay at rate 4 took %v, want about 100ms", report.Duration)
+	}
+	if report.Matched != 3 {
+		t.Fatalf("replay report = %+v", report)
+	}
+
+	report, err = r.ReplayFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Duration >= 100*time.Millisecond {
+		t.Fatalf("unpaced replay took %v", report.Duration)
+	}
+}
+
+func TestReplayRejectsInvalidRecords(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"garbage":   "{\"atom\": {\"id\": \"a\"}}\nnot json\n",
+		"no-atom":   "{\"time\": \"2024-01-01T00:00:00Z\"}\n",
+		"truncated": "{\"atom\": {",
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0644)
+		r := newTestRuntime(t, RuntimeConfig{})
+		if _, err := r.ReplayFile(path, 0); err == nil {
+			t.Errorf("%s: replay succeeded", name)
+		}
+	}
+	if _, err := newTestRuntime(t, RuntimeConfig{}).ReplayFile(filepath.Join(dir, "absent"), 0); err == nil {
+		t.Error("replaying a missing file succeeded")
+	}
+}
+
+func TestRecorderRotatesAtItsSizeCap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	recorder, err := NewTrafficRecorder(path, 600, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atom := &Atom{ID: "atom", Group: "tt", Element: "pass", Data: map[string]interface{}{"pad": strings.Repeat("x", 200)}}
+	for i := 0; i < 20; i++ {
+		if err := recorder.Record(atom, &AtomResult{Success: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("missing %s: %v", filepath.Base(name), err)
+		}
+		if info.Size() > 600 {
+			t.Errorf("%s is %d bytes, over the 600 byte cap", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("kept more than 2 rotated files: %v", err)
+	}
+	if err := recorder.Record(atom, &AtomResult{Success: true}); err == nil {
+		t.Fatal("closed recorder accepted a record")
+	}
+}
+
+func TestRecordingIsOptIn(t *testing.T) {
+	dir := t.TempDir()
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	runAtom(r, "tt", "pass", nil)
+
+	path := filepath.Join(dir, "traffic.jsonl")
+	recorder, err := NewTrafficRecorder(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetRecorder(recorder)
+	runAtom(r, "tt", "pass", nil)
+	r.SetRecorder(nil)
+	runAtom(r, "tt", "pass", nil)
+	recorder.Close()
+
+	lines, _ := os.ReadFile(path)
+	if count := strings.Count(string(lines), "\n"); count != 1 {
+		t.Fatalf("recorded %d atoms, want only the one processed while recording", count)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("recording created %d files", len(entries))
+	}
+}
+
+// ============================================================================
+// Deterministic randomness
+// ============================================================================
+
+func uuidSequence(t *testing.T, utils *PacketUtils, n int) []string {
+	t.Helper()
+	ids := make([]string, n)
+	for i := range ids {
+		id, err := utils.Transform(nil, "uuid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id.(string)
+	}
+	return ids
+}
+
+func TestSeededUUIDTransformIsRepeatable(t *testing.T) {
+	first := uuidSequence(t, NewPacketUtils(NewSeededRandSource(42)), 5)
+	again := uuidSequence(t, NewPacketUtils(NewSeededRandSource(42)), 5)
+	other := uuidSequence(t, NewPacketUtils(NewSeededRandSource(43)), 5)
+
+	seen := map[string]bool{}
+	for i, id := range first {
+		if id != again[i] {
+			t.Fatalf("uuid %d differs between runs with the same seed: %s != %s", i, id, again[i])
+		}
+		if id == other[i] {
+			t.Fatalf("uuid %d is the same for different seeds", i)
+		}
+		if !NewPacketUtils(nil).uuidRegex.MatchString(id) {
+			t.Fatalf("seeded uuid %q is not a v4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("seeded sequence repeated %s", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestUnseededUUIDTransformIsRandom(t *testing.T) {
+	first := uuidSequence(t, NewPacketUtils(nil), 3)
+	second := uuidSequence(t, NewPacketUtils(nil), 3)
+	for i := range first {
+		if first[i] == second[i] {
+			t.Fatalf("crypto/rand produced the same uuid twice: %s", first[i])
+		}
+	}
+}
+
+func TestSeededRandSourceIsIndependentOfReadSizes(t *testing.T) {
+	whole := make([]byte, 32)
+	NewSeededRandSource(7).Read(whole)
+
+	source := NewSeededRandSource(7)
+	var chunked []byte
+	for i := 0; i < 4; i++ {
+		chunk := make([]byte, 8)
+		source.Read(chunk)
+		chunked = append(chunked, chunk...)
+	}
+	if !bytes.Equal(whole, chunked) {
+		t.Fatalf("32 bytes at once % x != four 8 byte reads % x", whole, chunked)
+	}
+	if bytes.Equal(whole[:8], whole[8:16]) {
+		t.Fatalf("seeded source repeats its first word")
+	}
+}
+
+func TestRuntimeRandSourceReachesTransformPackets(t *testing.T) {
+	transformUUIDs := func() []string {
+		r := newTestRuntime(t, RuntimeConfig{RandSource: NewSeededRandSource(99)})
+		var ids []string
+		for i := 0; i < 3; i++ {
+			result := runAtom(r, "df", "transform", map[string]interface{}{"input": "", "operation": "uuid"})
+			if !result.Success {
+				t.Fatalf("uuid transform failed: %+v", result.Error)
+			}
+			ids = append(ids, resultMap(t, result)["result"].(string))
+		}
+		return ids
+	}
+
+	first, second := transformUUIDs(), transformUUIDs()
+	if strings.Join(first, ",") != strings.Join(second, ",") {
+		t.Fatalf("seeded runtimes produced %v and %v", first, second)
+	}
+	if want := uuidSequence(t, NewPacketUtils(NewSeededRandSource(99)), 3); strings.Join(first, ",") != strings.Join(want, ",") {
+		t.Fatalf("runtime uuids %v, want the seeded sequence %v", first, want)
+	}
+}
+
+// ============================================================================
+// cf:echo_binary
+// ============================================================================
+
+func TestEchoBinaryRoundTripsMixedPayloads(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	handler := NewMessageHandler(r)
+	at := time.Date(2024, 5, 6, 7, 8, 9, 123, time.UTC)
+	payload := map[string]interface{}{
+		"small":    3,
+		"negative": -129,
+		"large":    int64(1) << 40,
+		"unsigned": uint64(1) << 63,
+		"float":    3.25,
+		"text":     "héllo ✓",
+		"empty":    "",
+		"flag":     true,
+		"none":     nil,
+		"blob":     []byte{0, 1, 2, 0xff},
+		"at":       at,
+		"list":     []interface{}{1, "two", 3.5, false, nil, []interface{}{}},
+		"nested": map[string]interface{}{
+			"deeper": map[string]interface{}{"n": -1, "items": []interface{}{map[string]interface{}{"k": "v"}}},
+			"empty":  map[string]interface{}{},
+		},
+	}
+
+	frame, err := handler.EncodeMessage("submit", map[string]interface{}{
+		"id": newTestAtomID(), "g": "cf", "e": "echo_binary", "d": payload,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, err := handler.DecodeMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := handler.HandleMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := replyError(t, handler, response); code != "" {
+		t.Fatalf("echo failed with %s", code)
+	}
+	reply, err := handler.DecodeMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := sent.Data.(map[string]interface{})["d"]
+	got := reply.Data.(map[string]interface{})["data"]
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("echo changed the payload:\n got %#v\nwant %#v", got, want)
+	}
+
+	echoed := DataAccessor(got.(map[string]interface{}))
+	if echoed.GetInt64("large", 0) != 1<<40 || echoed.GetInt("negative", 0) != -129 || echoed.GetFloat("float", 0) != 3.25 {
+		t.Errorf("numbers echoed as %v, %v, %v", echoed["large"], echoed["negative"], echoed["float"])
+	}
+	if !bytes.Equal(echoed.GetBytes("blob", nil), payload["blob"].([]byte)) || !echoed.GetTime("at", time.Time{}).Equal(at) {
+		t.Errorf("extension types echoed as %#v and %#v", echoed["blob"], echoed["at"])
+	}
+	if echoed.GetString("text", "") != "héllo ✓" || echoed["none"] != nil || echoed["flag"] != true {
+		t.Errorf("scalars echoed as %#v", echoed)
+	}
+}
+
+func TestEchoBinaryIsDescribed(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	result := runAtom(r, "cf", "echo_binary", map[string]interface{}{"a": []interface{}{1.0, "b"}})
+	if !result.Success || !reflect.DeepEqual(result.Data, map[string]interface{}{"a": []interface{}{1.0, "b"}}) {
+		t.Fatalf("echo_binary = %+v", result)
+	}
+	if description, ok := r.DescribePacket("cf:echo_binary"); !ok || description["metadata"].(PacketMetadata).Description == "" {
+		t.Fatalf("cf:echo_binary is not described: %v", description)
+	}
+}
+
+// ============================================================================
+// Inbound sequence checking
+// ============================================================================
+
+func sequencedPing(t *testing.T, handler *MessageHandler, sequence int64) []byte {
+	t.Helper()
+	return encodeFrame(t, handler.codec, Message{
+		Type:      handler.getMessageTypeCode("ping"),
+		Sequence:  sequence,
+		Timestamp: time.Now().Unix(),
+		Data:      map[string]interface{}{},
+	})
+}
+
+// captureLog collects log output written while fn runs
+func captureLog(fn func()) string {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(io.Discard)
+	fn()
+	return buf.String()
+}
+
+func TestSequenceGapsAreWarned(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	handler := NewMessageHandler(r)
+
+	var codes []string
+	logged := captureLog(func() {
+		for _, sequence := range []int64{1, 2, 5, 3, 6, 0} {
+			response, err := handler.HandleMessage(sequencedPing(t, handler, sequence))
+			if err != nil {
+				t.Fatal(err)
+			}
+			codes = append(codes, replyError(t, handler, response))
+		}
+	})
+
+	if strings.Join(codes, "") != "" {
+		t.Fatalf("warn mode rejected messages: %q", codes)
+	}
+	for _, want := range []string{"sequence gap: expected 3, got 5 (2 missing)", "sequence out of order: expected 6, got 3"} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("log is missing %q:\n%s", want, logged)
+		}
+	}
+	if count := strings.Count(logged, "sequence"); count != 2 {
+		t.Fatalf("logged %d sequence problems, want 2:\n%s", count, logged)
+	}
+}
+
+func TestSequenceGapsAreRejectedWithTheExpectedSequence(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{SequenceCheck: SequenceCheckReject})
+	handler := NewMessageHandler(r)
+
+	cases := []struct {
+		sequence int64
+		want     string
+	}{
+		{1, ""},
+		{2, ""},
+		{4, "E409"},
+		{4, "E409"},
+		{1, "E409"},
+		// The rejected messages did not advance the expected sequence
+		{3, ""},
+		{4, ""},
+	}
+	for _, tc := range cases {
+		response, err := handler.HandleMessage(sequencedPing(t, handler, tc.sequence))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code := replyError(t, handler, response); code != tc.want {
+			t.Fatalf("sequence %d: reply code %q, want %q", tc.sequence, code, tc.want)
+		}
+		if tc.want == "" {
+			continue
+		}
+		nack, _ := handler.DecodeMessage(response)
+		message := nack.Data.(map[string]interface{})["error"].(map[string]interface{})["message"].(string)
+		if !strings.Contains(message, "expected 3") {
+			t.Fatalf("NACK %q does not name the expected sequence", message)
+		}
+	}
+}
+
+func TestSequenceCheckCanBeDisabled(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{SequenceCheck: SequenceCheckOff})
+	handler := NewMessageHandler(r)
+	logged := captureLog(func() {
+		for _, sequence := range []int64{5, 1, 9} {
+			response, _ := handler.HandleMessage(sequencedPing(t, handler, sequence))
+			if code := replyError(t, handler, response); code != "" {
+				t.Fatalf("sequence %d rejected with checking off: %s", sequence, code)
+			}
+		}
+	})
+	if strings.Contains(logged, "sequence") {
+		t.Fatalf("checking off still logged:\n%s", logged)
+	}
+}
+
+func TestSequencesAreTrackedPerConnection(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{SequenceCheck: SequenceCheckReject})
+	_, server := newTestServer(t, r)
+	handler := NewMessageHandler(r)
+
+	exchange := func(conn *websocket.Conn, sequence int64) string {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.BinaryMessage, sequencedPing(t, handler, sequence)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, response, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return replyError(t, handler, response)
+	}
+
+	first, _, err := dialWebSocket(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := dialWebSocket(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interleaved connections each count from their own first message
+	for _, step := range []struct {
+		conn     *websocket.Conn
+		sequence int64
+	}{{first, 1}, {second, 100}, {first, 2}, {second, 101}, {first, 3}} {
+		if code := exchange(step.conn, step.sequence); code != "" {
+			t.Fatalf("sequence %d rejected with %s", step.sequence, code)
+		}
+	}
+	if code := exchange(second, 103); code != "E409" {
+		t.Fatalf("gap on the second connection = %q, want E409", code)
+	}
+	if code := exchange(first, 4); code != "" {
+		t.Fatalf("first connection affected by the second's gap: %s", code)
+	}
+}
+
+// ============================================================================
+// Worker pool
+// ============================================================================
+
+// registerTracked registers tt:tracked, which holds until release closes and
+// records the most handlers ever running at once
+func registerTracked(t *testing.T, r *PacketFlowRuntime) (release chan struct{}, running, peak *int64) {
+	release = make(chan struct{})
+	running, peak = new(int64), new(int64)
+	mustRegister(t, r, "tt", "tracked", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		now := atomic.AddInt64(running, 1)
+		defer atomic.AddInt64(running, -1)
+		for {
+			seen := atomic.LoadInt64(peak)
+			if now <= seen || atomic.CompareAndSwapInt64(peak, seen, now) {
+				break
+			}
+		}
+		<-release
+		return "done", nil
+	}, PacketMetadata{})
+	return release, running, peak
+}
+
+func TestWorkerPoolBoundsConcurrentHandlers(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{WorkerPoolSize: 4})
+	release, running, peak := registerTracked(t, r)
+
+	const n = 40
+	var failed int64
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !runAtom(r, "tt", "tracked", nil).Success {
+				atomic.AddInt64(&failed, 1)
+			}
+		}()
+	}
+	waitFor(t, "the pool to fill", func() bool { return atomic.LoadInt64(running) == 4 })
+	time.Sleep(20 * time.Millisecond)
+	if workers := r.GetStats().Workers; workers != 4 {
+		t.Fatalf("pool grew to %d workers, want 4", workers)
+	}
+
+	close(release)
+	wg.Wait()
+	if failed := atomic.LoadInt64(&failed); failed != 0 {
+		t.Fatalf("%d of %d atoms failed", failed, n)
+	}
+	if peak := atomic.LoadInt64(peak); peak != 4 {
+		t.Fatalf("%d handlers ran at once, want 4", peak)
+	}
+}
+
+func TestWorkerPoolReusesWorkers(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{WorkerPoolSize: 8})
+	registerPassthrough(t, r)
+
+	for i := 0; i < 100; i++ {
+		result := runAtom(r, "tt", "pass", map[string]interface{}{"input": i})
+		if !result.Success || result.Data != i {
+			t.Fatalf("atom %d = %+v", i, result)
+		}
+	}
+	if workers := r.GetStats().Workers; workers != 1 {
+		t.Fatalf("sequential atoms started %d workers, want 1", workers)
+	}
+}
+
+func TestElasticWorkersExitWhenIdle(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{WorkerPoolSize: 4, ElasticWorkers: true})
+	r.workers = newWorkerPool(4, true, 20*time.Millisecond)
+	release, running, _ := registerTracked(t, r)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runAtom(r, "tt", "tracked", nil)
+		}()
+	}
+	waitFor(t, "four workers", func() bool { return atomic.LoadInt64(running) == 4 })
+	close(release)
+	wg.Wait()
+	waitFor(t, "idle workers to exit", func() bool { return r.GetStats().Workers == 0 })
+
+	if result := runAtom(r, "tt", "tracked", nil); !result.Success {
+		t.Fatalf("atom after the pool drained = %+v", result.Error)
+	}
+}
+
+func TestAtomTimesOutWaitingForAWorker(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{WorkerPoolSize: 1})
+	release, running, _ := registerTracked(t, r)
+	defer close(release)
+	registerPassthrough(t, r)
+
+	go runAtom(r, "tt", "tracked", nil)
+	waitFor(t, "the only worker to be busy", func() bool { return atomic.LoadInt64(running) == 1 })
+
+	timeout := 1
+	result := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "pass", Timeout: &timeout})
+	if result.Success || result.Error.Code != "E408" || !strings.Contains(result.Error.Message, "waiting for a worker") {
+		t.Fatalf("atom queued behind a busy pool = %+v, want E408 waiting for a worker", result.Error)
+	}
+}
+
+func TestWorkerPoolShutdownWaitsForBusyWorkers(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{WorkerPoolSize: 2})
+	release, running, _ := registerTracked(t, r)
+	registerPassthrough(t, r)
+
+	done := make(chan *AtomResult, 1)
+	go func() { done <- runAtom(r, "tt", "tracked", nil) }()
+	waitFor(t, "a busy worker", func() bool { return atomic.LoadInt64(running) == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.ShutdownWorkers(ctx); err == nil {
+		t.Fatal("shutdown returned while a handler was running")
+	}
+
+	close(release)
+	if result := <-done; !result.Success {
+		t.Fatalf("running atom failed during shutdown: %+v", result.Error)
+	}
+	if err := r.ShutdownWorkers(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if workers := r.GetStats().Workers; workers != 0 {
+		t.Fatalf("%d workers left after shutdown", workers)
+	}
+	// Atoms submitted after shutdown run on their own goroutines
+	if result := runAtom(r, "tt", "pass", map[string]interface{}{"input": "late"}); !result.Success || result.Data != "late" {
+		t.Fatalf("atom after shutdown = %+v", result)
+	}
+}
+
+func TestWorkerPoolSubmitRacesShutdown(t *testing.T) {
+	for round := 0; round < 200; round++ {
+		pool := newWorkerPool(8, false, 0)
+		var ran int64
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pool.Submit(context.Background(), func() {
+					time.Sleep(time.Millisecond)
+					atomic.AddInt64(&ran, 1)
+				})
+			}()
+		}
+		if err := pool.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		// No worker may start once Shutdown has drained the pool
+		if size := pool.Size(); size != 0 {
+			t.Fatalf("round %d: %d workers running after shutdown", round, size)
+		}
+		wg.Wait()
+		if size := pool.Size(); size != 0 {
+			t.Fatalf("round %d: %d workers started after shutdown", round, size)
+		}
+		// Tasks submitted during or after shutdown still run, unpooled
+		waitFor(t, "every task to run", func() bool { return atomic.LoadInt64(&ran) == 16 })
+	}
+}
+
+// benchmarkExecutor runs a cheap packet from many goroutines at once so the
+// cost of starting handler goroutines dominates
+func benchmarkExecutor(b *testing.B, poolSize int) {
+	log.SetOutput(io.Discard)
+	r := NewPacketFlowRuntime(RuntimeConfig{ReactorID: "bench", MaxConcurrent: 256, WorkerPoolSize: poolSize})
+	defer r.Close(context.Background())
+	r.RegisterPacket("tt", "sum", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		total := 0
+		for i := 0; i < 64; i++ {
+			total += i
+		}
+		return total, nil
+	}, PacketMetadata{})
+
+	b.SetParallelism(64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if result := runAtom(r, "tt", "sum", nil); !result.Success {
+				b.Errorf("atom failed: %+v", result.Error)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkGoroutinePerAtom(b *testing.B) {
+	benchmarkExecutor(b, -1)
+}
+
+func BenchmarkWorkerPool(b *testing.B) {
+	benchmarkExecutor(b, 256)
+}
+
+// ============================================================================
+// Payload size metrics
+// ============================================================================
+
+func TestSizeHistogramBucketsAndPercentiles(t *testing.T) {
+	var h SizeHistogram
+	if h.Percentile(50) != 0 {
+		t.Fatal("empty histogram reported a percentile")
+	}
+	for _, size := range []int{0, 64, 65, 1000, 5000, 100 << 20} {
+		h.Observe(size)
+	}
+	// Bounds are inclusive; anything past the last bound overflows
+	want := [len(sizeBuckets) + 1]int64{2, 1, 1, 0, 1, 0, 0, 0, 0, 0, 1}
+	if h.Counts != want || h.Total != 6 {
+		t.Fatalf("counts = %v (total %d), want %v", h.Counts, h.Total, want)
+	}
+	for _, tc := range []struct {
+		p    float64
+		want int
+	}{{0, 64}, {50, 256}, {60, 1 << 10}, {80, 16 << 10}, {100, 16 << 20}} {
+		if got := h.Percentile(tc.p); got != tc.want {
+			t.Errorf("p%g = %d, want %d", tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestPayloadAndResultSizesArePopulated(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	mustRegister(t, r, "tt", "limited", "", okHandler, PacketMetadata{MaxPayloadSize: 100})
+	_, server := newTestServer(t, r)
+
+	for _, size := range []int{10, 500, 3000, 50000} {
+		body := fmt.Sprintf(`{"id": %q, "g": "tt", "e": "pass", "d": {"input": %q}}`, newTestAtomID(), strings.Repeat("x", size))
+		if status := postJSON(t, server.URL+"/submit", "", body, nil); status != http.StatusOK {
+			t.Fatalf("submit of %d bytes returned %d", size, status)
+		}
+	}
+	// Oversized payloads are measured even though they are rejected
+	if result := runAtom(r, "tt", "limited", map[string]interface{}{"pad": strings.Repeat("x", 1000)}); result.Success {
+		t.Fatal("oversized payload accepted")
+	}
+
+	stats := r.GetStats()
+	// The rejected payload lands in the 1KB bucket with the 500 byte one
+	payloads := stats.PayloadSizes
+	if want := [len(sizeBuckets) + 1]int64{1, 0, 2, 1, 0, 1}; payloads.Counts != want || payloads.Total != 5 {
+		t.Fatalf("payload sizes = %+v, want counts %v", payloads, want)
+	}
+	if stats.ResultSizes.Total != 4 || stats.ResultSizes.Percentile(100) < 64<<10 {
+		t.Fatalf("result sizes = %+v", stats.ResultSizes)
+	}
+
+	var body struct {
+		Runtime struct {
+			PayloadSizes struct {
+				Buckets []int   `json:"buckets"`
+				Counts  []int64 `json:"counts"`
+				Total   int64   `json:"total"`
+				P99     int     `json:"p99_bytes"`
+			} `json:"payload_sizes"`
+			ResultSizes struct {
+				Total int64 `json:"total"`
+			} `json:"result_sizes"`
+		} `json:"runtime"`
+	}
+	getJSON(t, server.URL+"/stats", &body)
+	summary := body.Runtime.PayloadSizes
+	if summary.Total != 5 || len(summary.Buckets) != len(sizeBuckets) || len(summary.Counts) != len(sizeBuckets)+1 || summary.P99 != 64<<10 {
+		t.Fatalf("/stats payload_sizes = %+v", summary)
+	}
+	if body.Runtime.ResultSizes.Total != 4 {
+		t.Fatalf("/stats result_sizes total = %d", body.Runtime.ResultSizes.Total)
+	}
+}
+
+func TestBinaryResultSizesAreRecorded(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	handler := NewMessageHandler(r)
+
+	frame, err := handler.EncodeMessage("submit", map[string]interface{}{
+		"id": newTestAtomID(), "g": "tt", "e": "pass", "d": map[string]interface{}{"input": strings.Repeat("y", 2000)},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := handler.HandleMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := r.GetStats().ResultSizes
+	if sizes.Total != 1 || sizes.Counts[sort.SearchInts(sizeBuckets[:], len(response))] != 1 {
+		t.Fatalf("result sizes = %+v for a %d byte reply", sizes, len(response))
+	}
+}
+
+func TestLargePayloadsAreSampledToTheLog(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{LargePayloadLogSize: 1000, LargePayloadSampleEvery: 3})
+	registerPassthrough(t, r)
+
+	logged := captureLog(func() {
+		for i := 0; i < 7; i++ {
+			runAtom(r, "tt", "pass", map[string]interface{}{"input": strings.Repeat("z", 2000), "extra": i})
+		}
+		runAtom(r, "tt", "pass", map[string]interface{}{"input": "small"})
+	})
+
+	// Large atoms 1, 4 and 7 are sampled; small ones never are
+	if count := strings.Count(logged, "Large payload"); count != 3 {
+		t.Fatalf("logged %d large payloads, want 3:\n%s", count, logged)
+	}
+	if !strings.Contains(logged, "tt:pass") || !strings.Contains(logged, "(fields: extra, input)") {
+		t.Fatalf("sample does not name the packet and fields:\n%s", logged)
+	}
+}
+
+// ============================================================================
+// Stats cardinality
+// ============================================================================
+
+// registerVariants registers tt:v with n variants, v0 to v(n-1), failing
+// atoms whose data sets fail
+func registerVariants(t *testing.T, r *PacketFlowRuntime, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		mustRegister(t, r, "tt", "v", fmt.Sprintf("v%d", i), func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+			if data["fail"] == true {
+				return nil, fmt.Errorf("failed")
+			}
+			return nil, nil
+		}, PacketMetadata{})
+	}
+}
+
+func callVariant(r *PacketFlowRuntime, variant string, times int, fail bool) {
+	for i := 0; i < times; i++ {
+		r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "tt", Element: "v", Variant: &variant, Data: map[string]interface{}{"fail": fail}})
+	}
+}
+
+func TestStatsCardinalityMergesQuietVariants(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{StatsCardinality: 5})
+	registerVariants(t, r, 50)
+	for i := 0; i < 5; i++ {
+		callVariant(r, fmt.Sprintf("v%d", i), 6-i, false)
+	}
+	callVariant(r, "v10", 1, true)
+	callVariant(r, "v20", 1, false)
+
+	entries, other := r.PacketStatsReport()
+	var reported []string
+	for key := range entries {
+		if strings.HasPrefix(key, "tt:v:") {
+			reported = append(reported, key)
+		}
+	}
+	sort.Strings(reported)
+	if strings.Join(reported, ",") != "tt:v:v0,tt:v:v1,tt:v:v2,tt:v:v3,tt:v:v4" {
+		t.Fatalf("reported variants %v, want the five busiest", reported)
+	}
+	if _, ok := entries["cf:ping"]; !ok {
+		t.Fatal("packets without a variant are not reported individually")
+	}
+	if other == nil || other.Packets != 45 || other.Stats.Calls != 2 || other.Stats.Errors != 1 || other.Stats.Latency.Total != 2 {
+		t.Fatalf("other = %+v, want 45 packets with 2 calls and 1 error", other)
+	}
+	if entries["tt:v:v0"].Stats.Calls != 6 {
+		t.Fatalf("v0 stats = %+v", entries["tt:v:v0"].Stats)
+	}
+}
+
+func TestStatsCardinalityBreaksTiesByRecency(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{StatsCardinality: 1})
+	registerVariants(t, r, 3)
+	callVariant(r, "v0", 1, false)
+	time.Sleep(time.Millisecond)
+	callVariant(r, "v2", 1, false)
+
+	entries, other := r.PacketStatsReport()
+	if _, ok := entries["tt:v:v2"]; !ok {
+		t.Fatalf("the most recently called variant is not reported: %v", entries)
+	}
+	if other.Packets != 2 || other.Stats.Calls != 1 {
+		t.Fatalf("other = %+v", other)
+	}
+}
+
+func TestStatsEndpointStaysBounded(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{StatsCardinality: 10})
+	registerVariants(t, r, 500)
+	for i := 0; i < 500; i += 7 {
+		callVariant(r, fmt.Sprintf("v%d", i), 1+i%3, false)
+	}
+	_, server := newTestServer(t, r)
+
+	var body struct {
+		Packets map[string]map[string]interface{} `json:"packets"`
+	}
+	getJSON(t, server.URL+"/stats", &body)
+
+	variants := 0
+	for key := range body.Packets {
+		if strings.HasPrefix(key, "tt:v:") {
+			variants++
+		}
+	}
+	other, ok := body.Packets["other"]
+	if variants != 10 || !ok || other["packets"] != float64(490) {
+		t.Fatalf("/stats reported %d variants and other %v, want 10 and 490 merged", variants, other)
+	}
+	if entries, _ := r.PacketStatsReport(); len(body.Packets) != len(entries)+1 || len(entries) >= 500 {
+		t.Fatalf("/stats reported %d packets for %d entries", len(body.Packets), len(entries))
+	}
+}
+
+func TestStatsCardinalityIsOffByDefault(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerVariants(t, r, 30)
+	entries, other := r.PacketStatsReport()
+	if other != nil {
+		t.Fatalf("stats merged without a cap: %+v", other)
+	}
+	if _, ok := entries["tt:v:v29"]; !ok || len(entries) < 30 {
+		t.Fatalf("reported %d packets without a cap", len(entries))
+	}
+}
+
+// ============================================================================
+// Pipeline streaming
+// ============================================================================
+
+func collectSteps(stream *PipelineStream) []StepTrace {
+	var steps []StepTrace
+	for trace := range stream.Steps {
+		steps = append(steps, trace)
+	}
+	return steps
+}
+
+func stepSummary(steps []StepTrace) string {
+	parts := make([]string, len(steps))
+	for i, step := range steps {
+		parts[i] = fmt.Sprintf("%d:%s:%t", step.Step, step.Packet, step.Success)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestExecuteStreamEmitsEachStepInOrder(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	engine := NewPipelineEngine(r)
+	pipeline, err := engine.CreatePipeline("stream", passSteps(3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := engine.ExecuteStream(pipeline, "payload")
+	steps := collectSteps(stream)
+	if got := stepSummary(steps); got != "0:tt:pass:true 1:tt:pass:true 2:tt:pass:true" {
+		t.Fatalf("streamed steps %q", got)
+	}
+
+	result := stream.Result()
+	if !result.Success || result.Result != "payload" || result.CompletedSteps != 3 {
+		t.Fatalf("stream result = %+v", result)
+	}
+	if !reflect.DeepEqual(result.Trace, steps) {
+		t.Fatalf("result trace %v differs from the streamed steps %v", result.Trace, steps)
+	}
+}
+
+func TestExecuteStreamClosesAfterAFailedStep(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	mustRegister(t, r, "tt", "fail", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return nil, fmt.Errorf("step failed")
+	}, PacketMetadata{})
+	engine := NewPipelineEngine(r)
+	steps := passSteps(3)
+	steps[1].Element = "fail"
+	pipeline, err := engine.CreatePipeline("stream", steps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := engine.ExecuteStream(pipeline, "payload")
+	streamed := collectSteps(stream)
+	if got := stepSummary(streamed); got != "0:tt:pass:true 1:tt:fail:false" {
+		t.Fatalf("streamed steps %q", got)
+	}
+	if !strings.Contains(streamed[1].Error, "step failed") {
+		t.Fatalf("failed step error = %q", streamed[1].Error)
+	}
+	if result := stream.Result(); result.Success || result.CompletedSteps != 1 {
+		t.Fatalf("stream result = %+v", result)
+	}
+}
+
+func TestExecuteStreamReportsProgressBeforeCompletion(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	release := registerGate(t, r)
+	engine := NewPipelineEngine(r)
+	steps := passSteps(2)
+	steps[1].Element = "gate"
+	pipeline, err := engine.CreatePipeline("stream", steps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := engine.ExecuteStream(pipeline, "payload")
+	select {
+	case trace := <-stream.Steps:
+		if trace.Step != 0 || !trace.Success {
+			t.Fatalf("first event = %+v", trace)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no step event while the pipeline was still running")
+	}
+
+	close(release)
+	if rest := collectSteps(stream); stepSummary(rest) != "1:tt:gate:true" {
+		t.Fatalf("remaining steps %q", stepSummary(rest))
+	}
+	if !stream.Result().Success {
+		t.Fatalf("stream result = %+v", stream.Result())
+	}
+}
+
+func TestExecuteStreamClosesWhenAPacketIsMissing(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	engine := NewPipelineEngine(r)
+	stream := engine.ExecuteStream(&Pipeline{ID: "unknown", Steps: []PipelineStep{{Group: "tt", Element: "missing"}}}, nil)
+
+	if steps := collectSteps(stream); len(steps) != 1 || steps[0].Success {
+		t.Fatalf("streamed steps %v, want one failed step", steps)
+	}
+	if stream.Result().Success {
+		t.Fatal("pipeline with a missing packet succeeded")
+	}
+}
+
+func TestExecuteWithCallbackMatchesExecute(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	engine := NewPipelineEngine(r)
+	pipeline, err := engine.CreatePipeline("callback", passSteps(4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen []StepTrace
+	result := engine.ExecuteWithCallback(pipeline, 7.0, func(trace StepTrace) {
+		seen = append(seen, trace)
+	})
+	plain := engine.Execute(pipeline, 7.0)
+	if !result.Success || !plain.Success || result.Result != plain.Result {
+		t.Fatalf("callback result %+v, plain result %+v", result, plain)
+	}
+	if len(seen) != 4 || stepSummary(seen) != stepSummary(plain.Trace) {
+		t.Fatalf("callback saw %q, trace is %q", stepSummary(seen), stepSummary(plain.Trace))
+	}
+}
+
+// ============================================================================
+// Type coercion
+// ============================================================================
+
+// filterIDs runs df:filter over items and returns the ids of the matches
+func filterIDs(t *testing.T, r *PacketFlowRuntime, items []interface{}, condition map[string]interface{}) string {
+	t.Helper()
+	result := runAtom(r, "df", "filter", map[string]interface{}{"input": items, "condition": condition})
+	if !result.Success {
+		t.Fatalf("filter failed: %+v", result.Error)
+	}
+	var ids []string
+	for _, item := range resultMap(t, result)["results"].([]map[string]interface{}) {
+		ids = append(ids, fmt.Sprint(item["id"]))
+	}
+	return strings.Join(ids, ",")
+}
+
+func coercionItems() []interface{} {
+	return []interface{}{
+		map[string]interface{}{"id": "a", "age": 20, "active": true},
+		map[string]interface{}{"id": "b", "age": "25", "active": "true"},
+		map[string]interface{}{"id": "c", "age": 15.0, "active": false},
+		map[string]interface{}{"id": "d", "age": "old", "active": "no"},
+		map[string]interface{}{"id": "e", "age": int64(20), "active": "false"},
+	}
+}
+
+func TestFilterCoercesStringsAndNumbersInBothDirections(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{CoerceTypes: true})
+	items := coercionItems()
+
+	for _, tc := range []struct {
+		condition map[string]interface{}
+		want      string
+	}{
+		{map[string]interface{}{"age": "20"}, "a,e"},
+		{map[string]interface{}{"age": 25}, "b"},
+		{map[string]interface{}{"age": map[string]interface{}{"$gt": "18"}}, "a,b,e"},
+		{map[string]interface{}{"age": map[string]interface{}{"$lte": 20}}, "a,c,e"},
+		{map[string]interface{}{"age": map[string]interface{}{"$ne": "20"}}, "b,c,d"},
+		{map[string]interface{}{"active": true}, "a,b"},
+		{map[string]interface{}{"active": "false"}, "c,e"},
+		// Non-numeric strings never equal numbers
+		{map[string]interface{}{"age": "old"}, "d"},
+	} {
+		if got := filterIDs(t, r, items, tc.condition); got != tc.want {
+			t.Errorf("filter %v matched %q, want %q", tc.condition, got, tc.want)
+		}
+	}
+}
+
+func TestFilterWithoutCoercionKeepsTypesDistinct(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	items := coercionItems()
+
+	for _, tc := range []struct {
+		condition map[string]interface{}
+		want      string
+	}{
+		// Numbers still compare by value across Go types
+		{map[string]interface{}{"age": 20}, "a,e"},
+		{map[string]interface{}{"age": "20"}, ""},
+		{map[string]interface{}{"age": "25"}, "b"},
+		{map[string]interface{}{"active": true}, "a"},
+		{map[string]interface{}{"age": map[string]interface{}{"$ne": 20}}, "b,c,d"},
+	} {
+		if got := filterIDs(t, r, items, tc.condition); got != tc.want {
+			t.Errorf("filter %v matched %q, want %q", tc.condition, got, tc.want)
+		}
+	}
+}
+
+func TestFilterPagesWithJSONNumbers(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	condition := map[string]interface{}{"age": map[string]interface{}{"$ne": 20}}
+
+	for _, tc := range []struct {
+		offset, limit float64
+		want          string
+	}{
+		{1, 1, "c"},
+		{0, 2, "b,c"},
+		{2, 0, "d"},
+		{5, 1, ""},
+	} {
+		result := runAtom(r, "df", "filter", map[string]interface{}{"input": coercionItems(), "condition": condition, "offset": tc.offset, "limit": tc.limit})
+		data := resultMap(t, result)
+		var ids []string
+		for _, item := range data["results"].([]map[string]interface{}) {
+			ids = append(ids, fmt.Sprint(item["id"]))
+		}
+		if got := strings.Join(ids, ","); got != tc.want || data["total_matches"] != 3 {
+			t.Errorf("offset %v limit %v = %q of %v, want %q of 3", tc.offset, tc.limit, got, data["total_matches"], tc.want)
+		}
+	}
+}
+
+func TestValidateCoercesTypedAndStringValues(t *testing.T) {
+	coercing := NewPacketUtils(nil)
+	coercing.coerceTypes = true
+	plain := NewPacketUtils(nil)
+
+	for _, tc := range []struct {
+		value          interface{}
+		schema         string
+		coerced, plain bool
+	}{
+		{"42", "integer", true, true},
+		{42, "integer", true, true},
+		{"4e1", "integer", true, false},
+		{int64(1) << 40, "integer", true, true},
+		{"42.5", "integer", false, false},
+		{42.5, "float", true, true},
+		{"4.25", "float", true, true},
+		{"abc", "float", false, false},
+		{true, "boolean", true, true},
+		{"false", "boolean", true, true},
+		{"yes", "boolean", false, false},
+		{1, "boolean", false, true},
+	} {
+		if got, _ := coercing.Validate(tc.value, tc.schema); got != tc.coerced {
+			t.Errorf("coercing Validate(%#v, %s) = %t, want %t", tc.value, tc.schema, got, tc.coerced)
+		}
+		if got, _ := plain.Validate(tc.value, tc.schema); got != tc.plain {
+			t.Errorf("plain Validate(%#v, %s) = %t, want %t", tc.value, tc.schema, got, tc.plain)
+		}
+	}
+}
+
+func TestValidatePacketUsesTheRuntimeCoercionMode(t *testing.T) {
+	record := map[string]interface{}{"age": "3e1", "score": 7.5, "member": "true"}
+	schema := map[string]interface{}{"age": "integer", "score": "float", "member": "boolean"}
+
+	r := newTestRuntime(t, RuntimeConfig{CoerceTypes: true})
+	result := runAtom(r, "df", "validate", map[string]interface{}{"data": record, "schema": schema})
+	if !result.Success || resultMap(t, result)["valid"] != true {
+		t.Fatalf("coercing validate = %+v", result)
+	}
+
+	r = newTestRuntime(t, RuntimeConfig{})
+	result = runAtom(r, "df", "validate", map[string]interface{}{"data": record, "schema": schema})
+	if !result.Success || resultMap(t, result)["valid"] != false {
+		t.Fatalf("plain validate accepted a float string as an integer: %+v", result)
+	}
+}
+
+func TestCoercePairOnlyConvertsMixedScalars(t *testing.T) {
+	u := NewPacketUtils(nil)
+	for _, tc := range []struct {
+		a, b, wantA, wantB interface{}
+	}{
+		{"42", 42, 42.0, 42},
+		{7, "7.5", 7, 7.5},
+		{"true", false, true, false},
+		{"x", 1, "x", 1},
+		{"1", "2", "1", "2"},
+		{3, 4, 3, 4},
+		{"1", nil, "1", nil},
+		{"yes", true, "yes", true},
+	} {
+		a, b := u.CoercePair(tc.a, tc.b)
+		if a != tc.wantA || b != tc.wantB {
+			t.Errorf("CoercePair(%#v, %#v) = %#v, %#v; want %#v, %#v", tc.a, tc.b, a, b, tc.wantA, tc.wantB)
+		}
+	}
+}
+
+// ============================================================================
+// Capability checks
+// ============================================================================
+
+func TestCheckCapabilitiesSplitsSupportedAndMissing(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{CostBudget: 10})
+	registerVariants(t, r, 2)
+	handler := NewMessageHandler(r)
+	if err := handler.RegisterMessageType("subscribe", 30, func(message *Message) ([]byte, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	report := r.CheckCapabilities(CapabilityRequirements{
+		Packets:      []string{"cf:ping", "tt:v:v1", "tt:v:latest", "tt:v:v9", "df:nope"},
+		MessageTypes: []string{"submit", "subscribe", "teleport"},
+		Features:     []string{"cost_budget", "load_shedding"},
+	})
+
+	want := CapabilityReport{
+		Satisfied: false,
+		Supported: CapabilityRequirements{
+			Packets:      []string{"cf:ping", "tt:v:v1", "tt:v:latest"},
+			MessageTypes: []string{"submit", "subscribe"},
+			Features:     []string{"cost_budget"},
+		},
+		Missing: CapabilityRequirements{
+			Packets:      []string{"tt:v:v9", "df:nope"},
+			MessageTypes: []string{"teleport"},
+			Features:     []string{"load_shedding"},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("report = %+v\nwant %+v", report, want)
+	}
+}
+
+func TestCheckCapabilitiesIsSatisfiedWhenNothingIsMissing(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	report := r.CheckCapabilities(CapabilityRequirements{Packets: []string{"df:transform"}, MessageTypes: []string{"ping"}})
+	if !report.Satisfied || len(report.Missing.Packets)+len(report.Missing.MessageTypes)+len(report.Missing.Features) != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+	if empty := r.CheckCapabilities(CapabilityRequirements{}); !empty.Satisfied {
+		t.Fatalf("empty requirements unsatisfied: %+v", empty)
+	}
+}
+
+func TestCapabilitiesPacketOverHTTP(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	_, server := newTestServer(t, r)
+
+	var result struct {
+		Success bool             `json:"success"`
+		Data    CapabilityReport `json:"data"`
+		Error   *AtomError       `json:"error"`
+	}
+	body := `{"id": "caps_1", "g": "cf", "e": "capabilities", "d": {"packets": ["cf:ping", "zz:missing"], "features": ["load_shedding"]}}`
+	if status := postJSON(t, server.URL+"/submit", "", body, &result); status != http.StatusOK || !result.Success {
+		t.Fatalf("capabilities returned %d: %+v", status, result.Error)
+	}
+	if result.Data.Satisfied || strings.Join(result.Data.Missing.Packets, ",") != "zz:missing" ||
+		strings.Join(result.Data.Supported.Packets, ",") != "cf:ping" || strings.Join(result.Data.Missing.Features, ",") != "load_shedding" {
+		t.Fatalf("report = %+v", result.Data)
+	}
+
+	invalid := runAtom(r, "cf", "capabilities", map[string]interface{}{"packets": []interface{}{"cf:ping", 7}})
+	if invalid.Success || !strings.Contains(invalid.Error.Message, "packets[1] must be a string") {
+		t.Fatalf("non-string requirement = %+v", invalid)
+	}
+}
+
+// ============================================================================
+// Per-group timeouts
+// ============================================================================
+
+func TestTimeoutResolutionPrecedence(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{DefaultTimeout: 11, GroupTimeouts: map[string]int{"tt": 3, "uu": 0}})
+	mustRegister(t, r, "tt", "timed", "", okHandler, PacketMetadata{Timeout: 7})
+	mustRegister(t, r, "tt", "untimed", "", okHandler, PacketMetadata{})
+	mustRegister(t, r, "uu", "untimed", "", okHandler, PacketMetadata{})
+	mustRegister(t, r, "vv", "untimed", "", okHandler, PacketMetadata{})
+
+	override, zero := 2, 0
+	for _, tc := range []struct {
+		name       string
+		atom       *Atom
+		packet     string
+		want       int
+		wantSource string
+	}{
+		{"atom override", &Atom{Group: "tt", Element: "timed", Timeout: &override}, "tt:timed", 2, "atom"},
+		{"zero atom override", &Atom{Group: "tt", Element: "timed", Timeout: &zero}, "tt:timed", 0, "atom"},
+		{"packet metadata", &Atom{Group: "tt", Element: "timed"}, "tt:timed", 7, "packet"},
+		{"group default", &Atom{Group: "tt", Element: "untimed"}, "tt:untimed", 3, "group"},
+		{"zero group default", &Atom{Group: "uu", Element: "untimed"}, "uu:untimed", 11, "default"},
+		{"no group default", &Atom{Group: "vv", Element: "untimed"}, "vv:untimed", 11, "default"},
+		{"remote atom", &Atom{Group: "tt", Element: "remote"}, "", 3, "group"},
+	} {
+		var packet *PacketInfo
+		if tc.packet != "" {
+			packet = r.packets[tc.packet]
+		}
+		timeout, source := r.resolveTimeout(tc.atom, packet)
+		if timeout != tc.want || source != tc.wantSource {
+			t.Errorf("%s: timeout %d from %s, want %d from %s", tc.name, timeout, source, tc.want, tc.wantSource)
+		}
+	}
+}
+
+func TestGroupTimeoutIsEnforced(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{DefaultTimeout: 30, GroupTimeouts: map[string]int{"tt": 1}})
+	mustRegister(t, r, "tt", "slow", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		<-ctx.Context.Done()
+		return nil, ctx.Context.Err()
+	}, PacketMetadata{})
+
+	start := time.Now()
+	result := runAtom(r, "tt", "slow", nil)
+	if result.Success || result.Error.Code != "E408" {
+		t.Fatalf("slow atom = %+v, want E408", result.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the 1s group timeout took %v", elapsed)
+	}
+}
+
+func TestTraceReportsGroupTimeouts(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{DefaultTimeout: 30, GroupTimeouts: map[string]int{"tt": 9}})
+	mustRegister(t, r, "tt", "untimed", "", okHandler, PacketMetadata{})
+
+	trace := resultMap(t, runAtom(r, "cf", "trace", map[string]interface{}{"atom": map[string]interface{}{"g": "tt", "e": "untimed"}}))
+	if trace["timeout_source"] != "group" || trace["timeout_seconds"] != 9 {
+		t.Fatalf("trace = %v, want a 9s group timeout", trace)
+	}
+}
+
+// ============================================================================
+// Absolute deadlines
+// ============================================================================
+
+func deadlineAtom(element string, deadline time.Time, timeout *int) *Atom {
+	return &Atom{
+		ID:      newTestAtomID(),
+		Group:   "tt",
+		Element: element,
+		Timeout: timeout,
+		Meta:    map[string]interface{}{DeadlineMeta: deadline.UnixMilli()},
+	}
+}
+
+func TestExpiredDeadlineFailsWithoutRunningTheHandler(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var calls int64
+	registerCounter(t, r, "count", &calls)
+
+	result := r.ProcessAtom(deadlineAtom("count", time.Now().Add(-time.Second), nil))
+	if result.Success || result.Error.Code != "E408" || !result.Error.Permanent || !strings.Contains(result.Error.Message, "already passed") {
+		t.Fatalf("expired deadline = %+v, want a permanent E408", result.Error)
+	}
+	if atomic.LoadInt64(&calls) != 0 {
+		t.Fatal("handler ran after its deadline")
+	}
+	if stats := r.GetStats(); stats.Errors != 1 {
+		t.Fatalf("expired atom not counted as an error: %+v", stats)
+	}
+}
+
+func TestNearDeadlineShortensTheTimeout(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerSleep(t, r)
+
+	atom := deadlineAtom("sleep", time.Now().Add(100*time.Millisecond), nil)
+	atom.Data = map[string]interface{}{"ms": 5000}
+	start := time.Now()
+	result := r.ProcessAtom(atom)
+	elapsed := time.Since(start)
+
+	if result.Success || result.Error.Code != "E408" || result.Error.Permanent || !strings.Contains(result.Error.Message, "atom deadline exceeded") {
+		t.Fatalf("near deadline = %+v, want a retryable deadline E408", result.Error)
+	}
+	if elapsed < 80*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("atom with 100ms left ran for %v", elapsed)
+	}
+
+	// A deadline in time lets the handler finish
+	atom = deadlineAtom("sleep", time.Now().Add(2*time.Second), nil)
+	atom.Data = map[string]interface{}{"ms": 10, "input": "made it"}
+	if result := r.ProcessAtom(atom); !result.Success || result.Data != "made it" {
+		t.Fatalf("atom within its deadline = %+v", result)
+	}
+}
+
+func TestRelativeTimeoutWinsWhenShorterThanTheDeadline(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerSleep(t, r)
+
+	timeout := 1
+	atom := deadlineAtom("sleep", time.Now().Add(time.Hour), &timeout)
+	atom.Data = map[string]interface{}{"ms": 5000}
+	result := r.ProcessAtom(atom)
+	if result.Success || result.Error.Message != "Packet timeout after 1s" {
+		t.Fatalf("1s timeout with an hour's deadline = %+v", result.Error)
+	}
+}
+
+func TestDeadlinesTravelWithForwardedAtoms(t *testing.T) {
+	peer := newTestRuntime(t, RuntimeConfig{ReactorID: "peer"})
+	seen := make(chan interface{}, 1)
+	mustRegister(t, peer, "tt", "remote", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		seen <- ctx.Atom.Meta[DeadlineMeta]
+		return nil, nil
+	}, PacketMetadata{})
+	_, peerServer := newTestServer(t, peer)
+	r := forwardingRuntime(t, "", "peer", peerServer.URL+"/submit")
+
+	deadline := time.Now().Add(10 * time.Second)
+	if result := r.ProcessAtom(deadlineAtom("remote", deadline, nil)); !result.Success {
+		t.Fatalf("forwarded atom failed: %+v", result.Error)
+	}
+	if got, _ := NewPacketUtils(nil).toFloat64(<-seen); int64(got) != deadline.UnixMilli() {
+		t.Fatalf("peer saw deadline %v, want %d", got, deadline.UnixMilli())
+	}
+
+	result := r.ProcessAtom(deadlineAtom("remote", time.Now().Add(-time.Millisecond), nil))
+	if result.Success || result.Error.Code != "E408" {
+		t.Fatalf("expired forwarded atom = %+v, want E408", result.Error)
+	}
+	if calls := packetCalls(peer, "tt:remote"); calls != 1 {
+		t.Fatalf("peer ran %d atoms, want only the one within its deadline", calls)
+	}
+}
+
+func TestDeadlinesReachPipelineStepsAndWorkflowNodes(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerSleep(t, r)
+
+	pipeline := &Pipeline{
+		ID:    "deadlined",
+		Steps: []PipelineStep{{Group: "tt", Element: "sleep", Data: map[string]interface{}{"ms": 5000}}},
+		Meta:  map[string]interface{}{DeadlineMeta: time.Now().Add(100 * time.Millisecond).UnixMilli()},
+	}
+	start := time.Now()
+	result := NewPipelineEngine(r).Execute(pipeline, nil)
+	if result.Success || result.Error.Code != "E408" || !strings.Contains(result.Error.Message, "atom deadline exceeded") {
+		t.Fatalf("pipeline near its deadline = %+v, want a deadline E408", result.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("step with 100ms left ran for %v", elapsed)
+	}
+
+	workflow := &Workflow{
+		ID:    "deadlined",
+		Nodes: []WorkflowNode{{ID: "only", Group: "tt", Element: "sleep", Data: map[string]interface{}{"ms": 5000}}},
+		Meta:  map[string]interface{}{DeadlineMeta: time.Now().Add(-time.Second).UnixMilli()},
+	}
+	node := NewWorkflowEngine(r).Execute(workflow, nil).Nodes["only"]
+	if node.Success || node.Error.Code != "E408" || !strings.Contains(node.Error.Message, "already passed") {
+		t.Fatalf("node past its deadline = %+v, want E408", node.Error)
+	}
+}
+
+func TestTraceReportsTheDeadline(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{DefaultTimeout: 30})
+	registerPassthrough(t, r)
+
+	trace := resultMap(t, runAtom(r, "cf", "trace", map[string]interface{}{"atom": map[string]interface{}{
+		"g": "tt", "e": "pass", "m": map[string]interface{}{DeadlineMeta: float64(time.Now().Add(2500 * time.Millisecond).UnixMilli())},
+	}}))
+	if trace["timeout_source"] != "deadline" || trace["timeout_seconds"] != 3 {
+		t.Fatalf("trace = %v, want a 3s deadline", trace)
+	}
+}
+
+// ============================================================================
+// Stats export and import
+// ============================================================================
+
+func registerFlaky(t *testing.T, r *PacketFlowRuntime) {
+	t.Helper()
+	mustRegister(t, r, "tt", "flaky", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		if data["fail"] == true {
+			return nil, fmt.Errorf("failed")
+		}
+		return nil, nil
+	}, PacketMetadata{})
+}
+
+func TestStatsSurviveARestart(t *testing.T) {
+	before := newTestRuntime(t, RuntimeConfig{})
+	registerFlaky(t, before)
+	registerPassthrough(t, before)
+	for i := 0; i < 5; i++ {
+		runAtom(before, "tt", "flaky", map[string]interface{}{"fail": i < 2})
+	}
+	runAtom(before, "tt", "pass", nil)
+	saved, err := before.ExportStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	beforeStats := before.GetStats()
+
+	after := newTestRuntime(t, RuntimeConfig{})
+	registerFlaky(t, after)
+	registerPassthrough(t, after)
+	runAtom(after, "tt", "flaky", map[string]interface{}{"fail": true})
+	if err := after.ImportStats(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// Import adds to what the new runtime has already counted
+	stats := after.GetStats()
+	if stats.Processed != beforeStats.Processed+1 || stats.Errors != beforeStats.Errors+1 {
+		t.Fatalf("processed %d, errors %d; want %d and %d", stats.Processed, stats.Errors, beforeStats.Processed+1, beforeStats.Errors+1)
+	}
+	if stats.Uptime > time.Since(after.startTime) {
+		t.Fatalf("uptime %v was carried over", stats.Uptime)
+	}
+
+	flaky := after.packets["tt:flaky"].StatsSnapshot()
+	if flaky.Calls != 6 || flaky.Errors != 3 || flaky.Latency.Total != 6 {
+		t.Fatalf("tt:flaky stats = %+v, want 6 calls and 3 errors", flaky)
+	}
+	if flaky.AvgDuration != flaky.TotalDuration/6 {
+		t.Fatalf("average %v not recomputed from total %v", flaky.AvgDuration, flaky.TotalDuration)
+	}
+	if pass := after.packets["tt:pass"].StatsSnapshot(); pass.Calls != 1 {
+		t.Fatalf("tt:pass stats = %+v", pass)
+	}
+}
+
+func TestImportedStatsWaitForTheirPacket(t *testing.T) {
+	before := newTestRuntime(t, RuntimeConfig{})
+	registerFlaky(t, before)
+	runAtom(before, "tt", "flaky", nil)
+	runAtom(before, "tt", "flaky", map[string]interface{}{"fail": true})
+	saved, _ := before.ExportStats()
+
+	after := newTestRuntime(t, RuntimeConfig{})
+	if err := after.ImportStats(saved); err != nil {
+		t.Fatal(err)
+	}
+	// Unregistered packets' stats are kept through a further export
+	resaved, err := after.ExportStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot SavedStats
+	json.Unmarshal(resaved, &snapshot)
+	if snapshot.Packets["tt:flaky"].Calls != 2 {
+		t.Fatalf("re-exported pending stats = %+v", snapshot.Packets["tt:flaky"])
+	}
+
+	registerFlaky(t, after)
+	runAtom(after, "tt", "flaky", nil)
+	if stats := after.packets["tt:flaky"].StatsSnapshot(); stats.Calls != 3 || stats.Errors != 1 {
+		t.Fatalf("stats after registering = %+v, want 3 calls and 1 error", stats)
+	}
+}
+
+func TestImportStatsRejectsInvalidSnapshots(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	if err := r.ImportStats([]byte("{not json")); err == nil {
+		t.Fatal("invalid snapshot imported")
+	}
+	if stats := r.GetStats(); stats.Processed != 0 {
+		t.Fatalf("failed import changed stats: %+v", stats)
+	}
+}
+
+// ============================================================================
+// Slow atom sampling
+// ============================================================================
+
+var slowSink []byte
+
+func registerSlowAndFast(t *testing.T, r *PacketFlowRuntime) {
+	t.Helper()
+	mustRegister(t, r, "tt", "slow", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		slowSink = make([]byte, 1<<20)
+		time.Sleep(60 * time.Millisecond)
+		if data["fail"] == true {
+			return nil, &AtomError{Code: "E422", Message: "slow failure", Permanent: true}
+		}
+		return nil, nil
+	}, PacketMetadata{})
+	mustRegister(t, r, "tt", "fast", "", okHandler, PacketMetadata{})
+}
+
+func TestSlowAtomsAreTracedAndFastOnesAreNot(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{SlowAtomThreshold: 30})
+	registerSlowAndFast(t, r)
+
+	for i := 0; i < 5; i++ {
+		runAtom(r, "tt", "fast", nil)
+	}
+	slow := &Atom{ID: "slow_1", Group: "tt", Element: "slow", Data: map[string]interface{}{"pad": strings.Repeat("x", 500)}}
+	r.ProcessAtom(slow)
+	runAtom(r, "tt", "slow", map[string]interface{}{"fail": true})
+
+	traces := r.SlowAtoms()
+	if len(traces) != 2 {
+		t.Fatalf("traced %d atoms, want only the 2 slow ones: %+v", len(traces), traces)
+	}
+	first := traces[0]
+	if first.AtomID != "slow_1" || first.PacketKey != "tt:slow" || !first.Success || first.CorrelationID == "" {
+		t.Fatalf("slow trace = %+v", first)
+	}
+	if first.Duration < 60*time.Millisecond || first.InputSize < 500 || first.InputSize > 600 {
+		t.Fatalf("slow trace duration %v, input size %d", first.Duration, first.InputSize)
+	}
+	if first.ProcessAllocated < 1<<20 {
+		t.Fatalf("process allocation %d is below the 1MB the handler allocated", first.ProcessAllocated)
+	}
+	if second := traces[1]; second.Success || second.ErrorCode != "E422" {
+		t.Fatalf("failed slow trace = %+v", second)
+	}
+}
+
+func TestSlowAtomBufferKeepsTheMostRecent(t *testing.T) {
+	buffer := newSlowAtomBuffer(3)
+	for i := 1; i <= 5; i++ {
+		buffer.add(SlowAtomTrace{AtomID: strconv.Itoa(i)})
+	}
+	var ids []string
+	for _, trace := range buffer.list() {
+		ids = append(ids, trace.AtomID)
+	}
+	if strings.Join(ids, ",") != "3,4,5" {
+		t.Fatalf("buffer holds %v, want the last three oldest first", ids)
+	}
+	if len(newSlowAtomBuffer(0).traces) != 100 {
+		t.Fatal("default buffer size is not 100")
+	}
+}
+
+func TestSlowEndpointListsTraces(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{SlowAtomThreshold: 30, SlowAtomBufferSize: 5})
+	registerSlowAndFast(t, r)
+	_, server := newTestServer(t, r)
+	runAtom(r, "tt", "slow", nil)
+	runAtom(r, "tt", "fast", nil)
+
+	var body struct {
+		ThresholdMS int             `json:"threshold_ms"`
+		Atoms       []SlowAtomTrace `json:"atoms"`
+	}
+	if status := getJSON(t, server.URL+"/slow", &body); status != http.StatusOK {
+		t.Fatalf("/slow returned %d", status)
+	}
+	if body.ThresholdMS != 30 || len(body.Atoms) != 1 || body.Atoms[0].PacketKey != "tt:slow" {
+		t.Fatalf("/slow = %+v", body)
+	}
+
+	resp, err := http.Post(server.URL+"/slow", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /slow returned %d", resp.StatusCode)
+	}
+}
+
+func TestSlowEndpointRequiresAValidAPIKey(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{APIKeys: []string{"secret"}, SlowAtomThreshold: 30})
+	registerSlowAndFast(t, r)
+	_, server := newTestServer(t, r)
+	runAtom(r, "tt", "slow", nil)
+
+	for _, query := range []string{"", "?token=wrong"} {
+		var result AtomResult
+		if status := getJSON(t, server.URL+"/slow"+query, &result); status != http.StatusUnauthorized || result.Error.Code != "E401" {
+			t.Fatalf("/slow%s: status %d, error %+v; want 401 E401", query, status, result.Error)
+		}
+	}
+
+	var body struct {
+		Atoms []SlowAtomTrace `json:"atoms"`
+	}
+	if status := getJSON(t, server.URL+"/slow?token=secret", &body); status != http.StatusOK || len(body.Atoms) != 1 {
+		t.Fatalf("/slow with a valid key: status %d, body %+v", status, body)
+	}
+}
+
+func TestSlowAtomSamplingIsOffByDefault(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerSlowAndFast(t, r)
+	runAtom(r, "tt", "slow", nil)
+	if traces := r.SlowAtoms(); len(traces) != 0 {
+		t.Fatalf("traced %d atoms without a threshold", len(traces))
+	}
+}
+
+// ============================================================================
+// $binary wrappers on the JSON path
+// ============================================================================
+
+// registerBinaryEcho registers tt:bytes, which reports the Go types it
+// received and returns its data with the blob reversed
+func registerBinaryEcho(t *testing.T, r *PacketFlowRuntime) {
+	t.Helper()
+	mustRegister(t, r, "tt", "bytes", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		blob, ok := data["blob"].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("blob arrived as %T", data["blob"])
+		}
+		nested, ok := data["nested"].(map[string]interface{})["parts"].([]interface{})[0].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("nested blob did not arrive as []byte")
+		}
+		reversed := make([]byte, len(blob))
+		for i, b := range blob {
+			reversed[len(blob)-1-i] = b
+		}
+		return map[string]interface{}{"reversed": reversed, "nested": []interface{}{nested}, "label": data["label"]}, nil
+	}, PacketMetadata{})
+}
+
+func binaryWrapper(data []byte) string {
+	return fmt.Sprintf(`{"$binary": %q}`, base64.StdEncoding.EncodeToString(data))
+}
+
+func binaryAtomJSON() string {
+	return fmt.Sprintf(`{"id": %q, "g": "tt", "e": "bytes", "d": {"blob": %s, "nested": {"parts": [%s]}, "label": {"$binary": "bm90", "other": 1}}}`,
+		newTestAtomID(), binaryWrapper([]byte{0, 1, 2, 0xff}), binaryWrapper([]byte("inner")))
+}
+
+// checkBinaryResult asserts a decoded JSON result carries the reversed and
+// nested blobs as $binary wrappers
+func checkBinaryResult(t *testing.T, data map[string]interface{}) {
+	t.Helper()
+	reversed, _ := base64.StdEncoding.DecodeString(data["reversed"].(map[string]interface{})[BinaryWrapperKey].(string))
+	if !bytes.Equal(reversed, []byte{0xff, 2, 1, 0}) {
+		t.Fatalf("reversed = %v", data["reversed"])
+	}
+	inner, _ := base64.StdEncoding.DecodeString(data["nested"].([]interface{})[0].(map[string]interface{})[BinaryWrapperKey].(string))
+	if string(inner) != "inner" {
+		t.Fatalf("nested = %v", data["nested"])
+	}
+	// Objects with keys besides $binary are ordinary data
+	if label := data["label"].(map[string]interface{}); label[BinaryWrapperKey] != "bm90" || label["other"] != float64(1) {
+		t.Fatalf("label = %v", data["label"])
+	}
+}
+
+func TestBinaryWrappersRoundTripOverHTTP(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerBinaryEcho(t, r)
+	_, server := newTestServer(t, r)
+
+	var result struct {
+		Success bool                   `json:"success"`
+		Data    map[string]interface{} `json:"data"`
+		Error   *AtomError             `json:"error"`
+	}
+	if status := postJSON(t, server.URL+"/submit", "", binaryAtomJSON(), &result); status != http.StatusOK || !result.Success {
+		t.Fatalf("submit returned %d: %+v", status, result.Error)
+	}
+	checkBinaryResult(t, result.Data)
+
+	var batch []struct {
+		Success bool                   `json:"success"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	if status := postJSON(t, server.URL+"/submit", "", "["+binaryAtomJSON()+","+binaryAtomJSON()+"]", &batch); status != http.StatusOK || len(batch) != 2 {
+		t.Fatalf("batch returned %d: %+v", status, batch)
+	}
+	for _, item := range batch {
+		if !item.Success {
+			t.Fatal("batch atom failed")
+		}
+		checkBinaryResult(t, item.Data)
+	}
+}
+
+func TestBinaryWrappersRoundTripOverWebSocketJSON(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerBinaryEcho(t, r)
+	_, server := newTestServer(t, r)
+	conn, _, err := dialWebSocket(t, server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(binaryAtomJSON())); err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Success bool                   `json:"success"`
+		Data    map[string]interface{} `json:"data"`
+		Error   *AtomError             `json:"error"`
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success {
+		t.Fatalf("websocket atom failed: %+v", result.Error)
+	}
+	checkBinaryResult(t, result.Data)
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"id": "bad_b64", "g": "tt", "e": "bytes", "d": {"blob": {"$binary": "!!"}}}`))
+	if err := conn.ReadJSON(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Success || result.Error.Code != "E400" {
+		t.Fatalf("invalid base64 over websocket = %+v", result.Error)
+	}
+}
+
+func TestInvalidBinaryWrappersAreRejected(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerBinaryEcho(t, r)
+	_, server := newTestServer(t, r)
+
+	for _, body := range []string{
+		`{"id": "b1", "g": "tt", "e": "bytes", "d": {"blob": {"$binary": "not base64!"}}}`,
+		`{"id": "b2", "g": "tt", "e": "bytes", "d": {"blob": {"$binary": 42}}}`,
+		`[{"id": "b3", "g": "tt", "e": "bytes", "d": {"list": [{"$binary": "%%%"}]}}]`,
+	} {
+		var result struct {
+			Error *AtomError `json:"error"`
+		}
+		if status := postJSON(t, server.URL+"/submit", "", body, &result); status != http.StatusBadRequest || result.Error == nil || result.Error.Code != "E400" {
+			t.Errorf("%s: status %d, error %+v; want 400 E400", body, status, result.Error)
+		}
+	}
+	if calls := packetCalls(r, "tt:bytes"); calls != 0 {
+		t.Fatalf("handler ran %d times for invalid payloads", calls)
+	}
+}
+
+func TestWrapResultBinaryLeavesTheOriginalUntouched(t *testing.T) {
+	original := &AtomResult{Success: true, Data: map[string]interface{}{"blob": []byte("x"), "n": 1}}
+	wrapped := wrapResultBinary(original)
+
+	if _, still := original.Data.(map[string]interface{})["blob"].([]byte); !still {
+		t.Fatal("wrapping mutated the original result")
+	}
+	want := map[string]interface{}{"blob": map[string]interface{}{BinaryWrapperKey: "eA=="}, "n": 1}
+	if !reflect.DeepEqual(wrapped.Data, want) {
+		t.Fatalf("wrapped data = %#v", wrapped.Data)
+	}
+	if plain := wrapResultBinary(&AtomResult{Success: true, Data: []byte("y")}); !reflect.DeepEqual(plain.Data, map[string]interface{}{BinaryWrapperKey: "eQ=="}) {
+		t.Fatalf("top-level bytes wrapped as %#v", plain.Data)
+	}
+}
+
+// ============================================================================
+// Packet aliases
+// ============================================================================
+
+func TestAliasInjectsDefaultsBeforeDispatch(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	if err := r.RegisterAlias("df:uppercase", "df:transform", map[string]interface{}{"operation": "uppercase"}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := runAtom(r, "df", "uppercase", map[string]interface{}{"input": "shout"})
+	if !result.Success || resultMap(t, result)["result"] != "SHOUT" {
+		t.Fatalf("aliased atom = %+v", result)
+	}
+	if result.Meta["resolved_packet"] != "df:transform" {
+		t.Fatalf("resolved_packet = %v, want df:transform", result.Meta["resolved_packet"])
+	}
+
+	// Fields the client sets win over the alias defaults
+	result = runAtom(r, "df", "uppercase", map[string]interface{}{"input": "QUIET", "operation": "lowercase"})
+	if !result.Success || resultMap(t, result)["result"] != "quiet" {
+		t.Fatalf("overridden default = %+v", result)
+	}
+	if packetCalls(r, "df:transform") != 2 {
+		t.Fatal("aliased atoms were not counted against the target packet")
+	}
+}
+
+func TestAliasChainsApplyTheNearestDefaultsFirst(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var seen map[string]interface{}
+	mustRegister(t, r, "tt", "target", "v2", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		seen = data
+		return nil, nil
+	}, PacketMetadata{})
+	if err := r.RegisterAlias("tt:middle", "tt:target:v2", map[string]interface{}{"mode": "middle", "depth": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterAlias("tt:outer", "tt:middle", map[string]interface{}{"mode": "outer"}); err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]interface{}{"input": 1}
+	if result := runAtom(r, "tt", "outer", data); !result.Success {
+		t.Fatalf("chained alias = %+v", result.Error)
+	}
+	if want := map[string]interface{}{"input": 1, "mode": "outer", "depth": 2}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("handler saw %v, want %v", seen, want)
+	}
+	if len(data) != 1 {
+		t.Fatalf("alias defaults were written into the caller's data: %v", data)
+	}
+}
+
+func TestAliasDefaultsAreNotShared(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var lengths []int
+	mustRegister(t, r, "tt", "append", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		options := data["options"].(map[string]interface{})
+		options["seen"] = append(DataAccessor(options).GetSlice("seen", nil), "x")
+		lengths = append(lengths, len(options["seen"].([]interface{})))
+		return nil, nil
+	}, PacketMetadata{})
+	defaults := map[string]interface{}{"options": map[string]interface{}{"seen": []interface{}{}}}
+	if err := r.RegisterAlias("tt:short", "tt:append", defaults); err != nil {
+		t.Fatal(err)
+	}
+	defaults["options"].(map[string]interface{})["seen"] = []interface{}{"a", "b", "c"}
+
+	runAtom(r, "tt", "short", nil)
+	runAtom(r, "tt", "short", nil)
+	if fmt.Sprint(lengths) != "[1 1]" {
+		t.Fatalf("handlers saw option lengths %v, want each call to start from the registered defaults", lengths)
+	}
+}
+
+func TestAliasRegistrationRejectsCyclesAndConflicts(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	for _, tc := range []struct{ alias, target string }{
+		{"tt:a", "tt:b"},
+		{"tt:b", "tt:c"},
+	} {
+		if err := r.RegisterAlias(tc.alias, tc.target, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct{ alias, target, want string }{
+		{"tt:c", "tt:a", "cycle"},
+		{"tt:self", "tt:self", "cycle"},
+		{"tt:pass", "tt:a", "conflicts"},
+		{"nocolon", "tt:pass", "packet keys"},
+		{"tt:x", "nocolon", "packet keys"},
+	} {
+		err := r.RegisterAlias(tc.alias, tc.target, nil)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("RegisterAlias(%s, %s) = %v, want an error mentioning %q", tc.alias, tc.target, err, tc.want)
+		}
+	}
+
+	// The chain ends at an unregistered packet until it is registered
+	if result := runAtom(r, "tt", "a", nil); result.Success || result.Error.Code != "E404" {
+		t.Fatalf("alias to a missing packet = %+v, want E404", result.Error)
+	}
+	mustRegister(t, r, "tt", "c", "", okHandler, PacketMetadata{})
+	if result := runAtom(r, "tt", "a", nil); !result.Success || result.Meta["resolved_packet"] != "tt:c" {
+		t.Fatalf("alias to a later registered packet = %+v", result)
+	}
+}
+
+func TestTraceFollowsAliases(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	if err := r.RegisterAlias("df:upper", "df:transform", map[string]interface{}{"operation": "uppercase"}); err != nil {
+		t.Fatal(err)
+	}
+	trace := resultMap(t, runAtom(r, "cf", "trace", map[string]interface{}{"atom": map[string]interface{}{"g": "df", "e": "upper"}}))
+	if trace["local"] != true || trace["resolved_packet"] != "df:transform" {
+		t.Fatalf("trace = %v", trace)
+	}
+}
+
+// ============================================================================
+// Catch-all packets
+// ============================================================================
+
+// registerCatchAll registers a handler reporting which packet ran and the
+// element and variant the atom asked for
+func registerCatchAll(t *testing.T, r *PacketFlowRuntime, group, element, variant string) {
+	t.Helper()
+	mustRegister(t, r, group, element, variant, func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return map[string]interface{}{
+			"packet":  ctx.PacketKey,
+			"element": ctx.RequestedElement,
+			"variant": ctx.RequestedVariant,
+		}, nil
+	}, PacketMetadata{})
+}
+
+func TestCatchAllPrecedence(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerCatchAll(t, r, "tt", "exact", "")
+	registerCatchAll(t, r, "tt", "versioned", "v1")
+	registerCatchAll(t, r, "tt", Wildcard, "")
+	registerCatchAll(t, r, Wildcard, Wildcard, "")
+
+	for _, tc := range []struct {
+		group, element, variant string
+		wantPacket              string
+	}{
+		{"tt", "exact", "", "tt:exact"},
+		{"tt", "versioned", "latest", "tt:versioned:v1"},
+		{"tt", "versioned", "v1.4", "tt:versioned:v1"},
+		{"tt", "unknown", "", "tt:*"},
+		{"tt", "unknown", "v3", "tt:*"},
+		{"zz", "anything", "", "*:*"},
+		{"df", "no_such_packet", "", "*:*"},
+		// Registered packets in other groups still win over the global catch-all
+		{"df", "transform", "", "df:transform"},
+	} {
+		var variant *string
+		if tc.variant != "" {
+			variant = &tc.variant
+		}
+		result := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: tc.group, Element: tc.element, Variant: variant, Data: map[string]interface{}{"input": "x", "operation": "uppercase"}})
+		if !result.Success {
+			t.Errorf("%s:%s:%s failed: %+v", tc.group, tc.element, tc.variant, result.Error)
+			continue
+		}
+		got := resultMap(t, result)
+		if tc.wantPacket == "df:transform" {
+			if got["result"] != "X" {
+				t.Errorf("df:transform = %v", got)
+			}
+			continue
+		}
+		if got["packet"] != tc.wantPacket || got["element"] != tc.element || got["variant"] != tc.variant {
+			t.Errorf("%s:%s:%s ran %v, want %s", tc.group, tc.element, tc.variant, got, tc.wantPacket)
+		}
+	}
+}
+
+func TestCatchAllFallbackIsReported(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerCatchAll(t, r, "tt", Wildcard, "")
+
+	result := runAtom(r, "tt", "proxied", nil)
+	if !result.Success || result.Meta["resolved_packet"] != "tt:*" {
+		t.Fatalf("catch-all result = %+v", result)
+	}
+	if calls := packetCalls(r, "tt:*"); calls != 1 {
+		t.Fatalf("catch-all stats count %d calls", calls)
+	}
+	if result := runAtom(r, "uu", "proxied", nil); result.Success || result.Error.Code != "E404" {
+		t.Fatalf("atom outside the wildcard's group = %+v, want E404", result.Error)
+	}
+}
+
+func TestCapabilitiesCountCatchAllPackets(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerCatchAll(t, r, "tt", Wildcard, "")
+	report := r.CheckCapabilities(CapabilityRequirements{Packets: []string{"tt:anything", "uu:anything"}})
+	if strings.Join(report.Supported.Packets, ",") != "tt:anything" || strings.Join(report.Missing.Packets, ",") != "uu:anything" {
+		t.Fatalf("report = %+v", report)
+	}
+}
+
+// ============================================================================
+// df:template_render
+// ============================================================================
+
+func renderTemplate(r *PacketFlowRuntime, template string, data interface{}, extra map[string]interface{}) *AtomResult {
+	fields := map[string]interface{}{"template": template, "data": data}
+	for key, value := range extra {
+		fields[key] = value
+	}
+	return runAtom(r, "df", "template_render", fields)
+}
+
+func TestTemplateRenderConditionalsRangesAndFunctions(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	data := map[string]interface{}{
+		"name":  "ada",
+		"admin": true,
+		"items": []interface{}{map[string]interface{}{"sku": "a1", "qty": 2.0}, map[string]interface{}{"sku": "b2", "qty": 1.0}},
+		"tags":  []interface{}{"x", "y", "z"},
+		"empty": "",
+	}
+
+	for _, tc := range []struct {
+		template, want string
+	}{
+		{`Hello {{.name | upper}}`, "Hello ADA"},
+		{`{{if .admin}}admin{{else}}user{{end}}`, "admin"},
+		{`{{if and .admin (eq .name "bob")}}bob{{else if .admin}}other admin{{end}}`, "other admin"},
+		{`{{range $i, $item := .items}}{{if $i}}, {{end}}{{$item.sku}}x{{$item.qty}}{{end}}`, "a1x2, b2x1"},
+		{`{{range .missing}}never{{else}}none{{end}}`, "none"},
+		{`{{join .tags "-"}} {{len .tags}}`, "x-y-z 3"},
+		{`{{default "anonymous" .empty}} {{default "anonymous" .name}}`, "anonymous ada"},
+		{`{{add 2 .items}}|{{sub 5 3}}|{{add 0.5 "1"}}`, "2|2|1.5"},
+		{`{{json .tags}}`, `["x","y","z"]`},
+		{`{{replace .name "a" "4"}} {{contains .name "d"}} {{hasPrefix .name "ad"}}`, "4d4 true true"},
+		{`{{.nope}}`, "<no value>"},
+	} {
+		result := renderTemplate(r, tc.template, data, nil)
+		if !result.Success {
+			t.Errorf("%s failed: %+v", tc.template, result.Error)
+			continue
+		}
+		if got := resultMap(t, result); got["output"] != tc.want || got["length"] != len(tc.want) {
+			t.Errorf("%s rendered %v, want %q", tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestTemplateRenderErrorsAreInputErrors(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for _, tc := range []struct {
+		name     string
+		template string
+		extra    map[string]interface{}
+		want     string
+	}{
+		{"unclosed action", `{{if .x}}open`, nil, "unexpected EOF"},
+		{"stray end", `{{end}}`, nil, "unexpected {{end}}"},
+		{"exec is unavailable", `{{exec "ls"}}`, nil, `function "exec" not defined`},
+		{"file access is unavailable", `{{readFile "/etc/passwd"}}`, nil, `function "readFile" not defined`},
+		{"strict missing key", `{{.nope}}`, map[string]interface{}{"strict": true}, "nope"},
+		{"execution error", `{{index .tags 10}}`, nil, "index out of range"},
+		{"empty template", ``, nil, "template is required"},
+	} {
+		result := renderTemplate(r, tc.template, map[string]interface{}{"tags": []interface{}{"a"}}, tc.extra)
+		if result.Success || result.Error.Code != "E400" || !result.Error.Permanent || !strings.Contains(result.Error.Message, tc.want) {
+			t.Errorf("%s: %+v, want E400 mentioning %q", tc.name, result.Error, tc.want)
+		}
+	}
+
+	if result := renderTemplate(r, strings.Repeat("x", MaxTemplateLength+1), nil, nil); result.Success || result.Error.Code != "E400" {
+		t.Fatalf("oversized template = %+v, want E400", result.Error)
+	}
+}
+
+func TestTemplateRenderCapsOutput(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	loop := `{{range .}}0123456789{{end}}`
+	items := make([]interface{}, 100)
+
+	result := renderTemplate(r, loop, items, map[string]interface{}{"max_output": 500})
+	if result.Success || result.Error.Code != "E413" || !strings.Contains(result.Error.Message, "500 bytes") {
+		t.Fatalf("1000 bytes of output under a 500 byte cap = %+v, want E413", result.Error)
+	}
+	if result := renderTemplate(r, loop, items, map[string]interface{}{"max_output": 1000}); !result.Success || resultMap(t, result)["length"] != 1000 {
+		t.Fatalf("output exactly at the cap = %+v", result)
+	}
+
+	// The default cap applies without max_output, and max_output cannot exceed the maximum
+	huge := make([]interface{}, DefaultTemplateOutput/10+1)
+	if result := renderTemplate(r, loop, huge, nil); result.Success || result.Error.Code != "E413" {
+		t.Fatalf("output past the default cap = %+v, want E413", result.Error)
+	}
+	if output, err := NewPacketUtils(nil).RenderTemplate(loop, make([]interface{}, MaxTemplateOutput/10+1), MaxTemplateOutput, false); err == nil {
+		t.Fatalf("rendered %d bytes past the maximum", len(output))
+	}
+}
+
+// ============================================================================
+// Field error details
+// ============================================================================
+
+func fieldSummary(t *testing.T, details interface{}) string {
+	t.Helper()
+	fields, ok := details.(map[string]interface{})["fields"].([]FieldError)
+	if !ok {
+		t.Fatalf("details carry no fields: %#v", details)
+	}
+	var parts []string
+	for _, field := range fields {
+		parts = append(parts, field.Field+" "+field.Message)
+	}
+	return strings.Join(parts, "; ")
+}
+
+func TestHandlerFieldErrorDetailsSurvive(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	returned := NewFieldError("E422", "bad order", map[string]string{"sku": "unknown", "qty": "must be positive"})
+	mustRegister(t, r, "tt", "fields", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return nil, returned
+	}, PacketMetadata{})
+	mustRegister(t, r, "tt", "wrapped", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return nil, fmt.Errorf("checking order: %w", NewFieldError("E400", "bad order", map[string]string{"sku": "required"}))
+	}, PacketMetadata{})
+
+	result := runAtom(r, "tt", "fields", nil)
+	if result.Success || result.Error.Code != "E422" || result.Error.Message != "bad order" || result.Error.Permanent {
+		t.Fatalf("field error = %+v", result.Error)
+	}
+	if got := fieldSummary(t, result.Error.Details); got != "qty must be positive; sku unknown" {
+		t.Fatalf("fields = %s", got)
+	}
+	if result.Error == returned {
+		t.Fatal("result shares the handler's error")
+	}
+
+	// A wrapped AtomError keeps its code and details rather than being categorized
+	result = runAtom(r, "tt", "wrapped", nil)
+	if result.Success || result.Error.Code != "E400" || !result.Error.Permanent {
+		t.Fatalf("wrapped field error = %+v", result.Error)
+	}
+	if got := fieldSummary(t, result.Error.Details); got != "sku required" {
+		t.Fatalf("wrapped fields = %s", got)
+	}
+}
+
+func TestFieldErrorDetailsReachHTTPClients(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "fields", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return nil, NewFieldError("E422", "bad order", map[string]string{"qty": "must be positive"})
+	}, PacketMetadata{})
+	_, server := newTestServer(t, r)
+
+	var result struct {
+		Success bool `json:"success"`
+		Error   struct {
+			Code    string `json:"code"`
+			Details struct {
+				Fields []FieldError `json:"fields"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	postJSON(t, server.URL+"/submit", "", `{"id": "fields_1", "g": "tt", "e": "fields"}`, &result)
+	if result.Success || result.Error.Code != "E422" || len(result.Error.Details.Fields) != 1 || result.Error.Details.Fields[0] != (FieldError{Field: "qty", Message: "must be positive"}) {
+		t.Fatalf("HTTP result = %+v", result)
+	}
+}
+
+func TestValidateReportsFieldErrors(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	record := map[string]interface{}{"email": "not-an-email", "id": "550e8400-e29b-41d4-a716-446655440000"}
+	schema := map[string]interface{}{"email": "email", "id": "uuid", "phone": "phone"}
+
+	result := runAtom(r, "df", "validate", map[string]interface{}{"data": record, "schema": schema})
+	got := resultMap(t, result)
+	if got["valid"] != false {
+		t.Fatalf("result = %v, want invalid", got)
+	}
+	var errs []string
+	for _, field := range got["errors"].([]FieldError) {
+		errs = append(errs, field.Field+" "+field.Message)
+	}
+	if strings.Join(errs, "; ") != "email must match schema email; phone required" {
+		t.Fatalf("errors = %v", errs)
+	}
+
+	result = runAtom(r, "df", "validate", map[string]interface{}{"data": record, "schema": schema, "strict": true})
+	if result.Success || result.Error.Code != "E422" || !strings.Contains(result.Error.Message, "2 field(s)") {
+		t.Fatalf("strict object validation = %+v, want E422", result.Error)
+	}
+	if got := fieldSummary(t, result.Error.Details); got != "email must match schema email; phone required" {
+		t.Fatalf("strict fields = %s", got)
+	}
+
+	result = runAtom(r, "df", "validate", map[string]interface{}{"data": "nope", "schema": "email", "strict": true})
+	if result.Success || result.Error.Code != "E422" || fieldSummary(t, result.Error.Details) != "data validation failed for schema: email" {
+		t.Fatalf("strict string validation = %+v", result.Error)
+	}
+	if got := resultMap(t, runAtom(r, "df", "validate", map[string]interface{}{"data": record, "schema": map[string]interface{}{"id": "uuid"}})); got["valid"] != true {
+		t.Fatalf("valid record = %v", got)
+	}
+}
+
+func TestValidateInputErrorsNameTheField(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for _, tc := range []struct {
+		name string
+		data map[string]interface{}
+		want string
+	}{
+		{"schema not a string or object", map[string]interface{}{"data": "x", "schema": 5.0}, "schema must be a string or an object"},
+		{"object schema with scalar data", map[string]interface{}{"data": "x", "schema": map[string]interface{}{"a": "email"}}, "data must be an object"},
+		{"field schema not a string", map[string]interface{}{"data": map[string]interface{}{"a": "x"}, "schema": map[string]interface{}{"a": 1.0}}, "schema.a must be a string"},
+	} {
+		result := runAtom(r, "df", "validate", tc.data)
+		if result.Success || result.Error.Code != "E400" || !result.Error.Permanent {
+			t.Errorf("%s: %+v, want a permanent E400", tc.name, result.Error)
+			continue
+		}
+		if got := fieldSummary(t, result.Error.Details); got != tc.want {
+			t.Errorf("%s: fields = %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// ============================================================================
+// Handler error codes
+// ============================================================================
+
+// codedError picks its own code and, when retryable is set, overrides the
+// permanence the code implies
+type codedError struct {
+	code      string
+	retryable bool
+}
+
+func (e codedError) Error() string   { return "payment timeout not found" }
+func (e codedError) Code() string    { return e.code }
+func (e codedError) Permanent() bool { return !e.retryable }
+
+func registerFailing(t *testing.T, r *PacketFlowRuntime, element string, err error) {
+	t.Helper()
+	mustRegister(t, r, "tt", element, "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		return nil, err
+	}, PacketMetadata{})
+}
+
+func TestHandlerErrorCodesSurviveUnchanged(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	// Each message would be categorized as E408 or E404 if the code were guessed
+	registerFailing(t, r, "explicit", NewCodedError("E402", "payment timeout"))
+	registerFailing(t, r, "coded", codedError{code: "E402"})
+	registerFailing(t, r, "retryable", codedError{code: "E402", retryable: true})
+	registerFailing(t, r, "wrapped", fmt.Errorf("charging card: %w", NewCodedError("E402", "payment not found")))
+	registerFailing(t, r, "wrapped_coded", fmt.Errorf("charging card: %w", codedError{code: "E429", retryable: true}))
+
+	for _, tc := range []struct {
+		element   string
+		code      string
+		message   string
+		permanent bool
+	}{
+		{"explicit", "E402", "payment timeout", true},
+		{"coded", "E402", "payment timeout not found", true},
+		{"retryable", "E402", "payment timeout not found", false},
+		{"wrapped", "E402", "charging card: payment not found", true},
+		{"wrapped_coded", "E429", "charging card: payment timeout not found", false},
+	} {
+		result := runAtom(r, "tt", tc.element, nil)
+		if result.Success || result.Error.Code != tc.code || result.Error.Message != tc.message || result.Error.Permanent != tc.permanent {
+			t.Errorf("%s: %+v, want %s %q permanent=%v", tc.element, result.Error, tc.code, tc.message, tc.permanent)
+		}
+	}
+}
+
+func TestPlainHandlerErrorsAreStillCategorized(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerFailing(t, r, "timeout", errors.New("upstream timeout"))
+	registerFailing(t, r, "missing", errors.New("order not found"))
+	registerFailing(t, r, "input", fmt.Errorf("bad sku: %w", ErrInvalidInput))
+	registerFailing(t, r, "other", errors.New("boom"))
+
+	for element, want := range map[string]string{"timeout": "E408", "missing": "E404", "input": "E400", "other": "E500"} {
+		result := runAtom(r, "tt", element, nil)
+		if result.Success || result.Error.Code != want || result.Error.Permanent != isPermanentCode(want) {
+			t.Errorf("%s: %+v, want %s", element, result.Error, want)
+		}
+	}
+}
+
+func TestHandlerErrorCodeReachesHTTPClients(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerFailing(t, r, "explicit", NewCodedError("E402", "payment timeout"))
+	_, server := newTestServer(t, r)
+
+	var result struct {
+		Success bool      `json:"success"`
+		Error   AtomError `json:"error"`
+	}
+	postJSON(t, server.URL+"/submit", "", `{"id": "coded_1", "g": "tt", "e": "explicit"}`, &result)
+	if result.Success || result.Error.Code != "E402" || !result.Error.Permanent {
+		t.Fatalf("HTTP result = %+v", result)
+	}
+}
+
+// ============================================================================
+// CSV
+// ============================================================================
+
+func TestCSVRoundTripsQuotedFields(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	text := "name,note,qty\n" +
+		"ada,\"likes commas, a lot\",2\n" +
+		"bob,\"two\nlines\",1\n" +
+		"\"c \"\"the\"\" d\",,3\n"
+
+	parsed := resultMap(t, runAtom(r, "df", "csv_parse", map[string]interface{}{"input": text}))
+	want := []interface{}{
+		map[string]interface{}{"name": "ada", "note": "likes commas, a lot", "qty": "2"},
+		map[string]interface{}{"name": "bob", "note": "two\nlines", "qty": "1"},
+		map[string]interface{}{"name": `c "the" d`, "note": "", "qty": "3"},
+	}
+	if !reflect.DeepEqual(parsed["records"], want) || parsed["count"] != 3 {
+		t.Fatalf("parsed = %#v", parsed)
+	}
+	if !reflect.DeepEqual(parsed["columns"], []string{"name", "note", "qty"}) {
+		t.Fatalf("columns = %v", parsed["columns"])
+	}
+
+	stringified := resultMap(t, runAtom(r, "df", "csv_stringify", map[string]interface{}{"records": parsed["records"]}))
+	if stringified["output"] != text || stringified["count"] != 3 {
+		t.Fatalf("stringified = %q, want %q", stringified["output"], text)
+	}
+}
+
+func TestCSVDelimiterAndHeaderOptions(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	text := "a;\"b;c\"\n1;2\n"
+
+	parsed := resultMap(t, runAtom(r, "df", "csv_parse", map[string]interface{}{"input": text, "delimiter": ";", "header": false}))
+	want := []interface{}{[]interface{}{"a", "b;c"}, []interface{}{"1", "2"}}
+	if !reflect.DeepEqual(parsed["records"], want) || len(parsed["columns"].([]string)) != 0 {
+		t.Fatalf("headerless parse = %#v", parsed)
+	}
+	stringified := resultMap(t, runAtom(r, "df", "csv_stringify", map[string]interface{}{"records": parsed["records"], "delimiter": ";", "header": false}))
+	if stringified["output"] != text {
+		t.Fatalf("headerless stringify = %q, want %q", stringified["output"], text)
+	}
+
+	if empty := resultMap(t, runAtom(r, "df", "csv_parse", map[string]interface{}{"input": ""})); empty["count"] != 0 {
+		t.Fatalf("empty input = %v", empty)
+	}
+}
+
+func TestCSVRaggedRowPolicies(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	text := "a,b,c\n1,2,3\n4,5\n6,7,8,9\n"
+
+	result := runAtom(r, "df", "csv_parse", map[string]interface{}{"input": text})
+	if result.Success || result.Error.Code != "E400" || !strings.Contains(result.Error.Message, "record 2 has 2 fields, expected 3") {
+		t.Fatalf("default ragged policy = %+v, want E400", result.Error)
+	}
+
+	padded := resultMap(t, runAtom(r, "df", "csv_parse", map[string]interface{}{"input": text, "ragged": CSVRaggedPad}))
+	want := []interface{}{
+		map[string]interface{}{"a": "1", "b": "2", "c": "3"},
+		map[string]interface{}{"a": "4", "b": "5", "c": ""},
+		map[string]interface{}{"a": "6", "b": "7", "c": "8"},
+	}
+	if !reflect.DeepEqual(padded["records"], want) {
+		t.Fatalf("padded = %#v", padded["records"])
+	}
+
+	skipped := resultMap(t, runAtom(r, "df", "csv_parse", map[string]interface{}{"input": text, "ragged": CSVRaggedSkip}))
+	if !reflect.DeepEqual(skipped["records"], want[:1]) || skipped["count"] != 1 {
+		t.Fatalf("skipped = %#v", skipped)
+	}
+}
+
+func TestCSVStringifyColumnsAndValues(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	records := []interface{}{
+		map[string]interface{}{"id": 1.0, "price": 2.5, "tags": []interface{}{"x", "y"}, "ok": true},
+		map[string]interface{}{"id": 2.0, "extra": "only here"},
+	}
+
+	// Columns default to the sorted union of keys; missing values are empty
+	got := resultMap(t, runAtom(r, "df", "csv_stringify", map[string]interface{}{"records": records}))
+	want := "extra,id,ok,price,tags\n,1,true,2.5,\"[\"\"x\"\",\"\"y\"\"]\"\nonly here,2,,,\n"
+	if got["output"] != want {
+		t.Fatalf("default columns = %q, want %q", got["output"], want)
+	}
+
+	got = resultMap(t, runAtom(r, "df", "csv_stringify", map[string]interface{}{"records": records, "columns": []interface{}{"price", "id"}}))
+	if got["output"] != "price,id\n2.5,1\n,2\n" {
+		t.Fatalf("ordered columns = %q", got["output"])
+	}
+}
+
+func TestCSVInvalidOptions(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for _, tc := range []struct {
+		name    string
+		element string
+		data    map[string]interface{}
+	}{
+		{"multi-character delimiter", "csv_parse", map[string]interface{}{"input": "a", "delimiter": "::"}},
+		{"quote delimiter", "csv_parse", map[string]interface{}{"input": "a", "delimiter": `"`}},
+		{"unknown ragged policy", "csv_parse", map[string]interface{}{"input": "a", "ragged": "drop"}},
+		{"unterminated quote", "csv_parse", map[string]interface{}{"input": "a,\"b\n"}},
+		{"non-string column", "csv_stringify", map[string]interface{}{"records": []interface{}{}, "columns": []interface{}{1.0}}},
+		{"scalar record", "csv_stringify", map[string]interface{}{"records": []interface{}{"a"}}},
+	} {
+		result := runAtom(r, "df", tc.element, tc.data)
+		if result.Success || result.Error.Code != "E400" {
+			t.Errorf("%s: %+v, want E400", tc.name, result.Error)
+		}
+	}
+}
+
+// ============================================================================
+// XML transforms
+// ============================================================================
+
+func TestXMLParseNestedElementsAndAttributes(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	document := `<?xml version="1.0"?>
+<order xmlns="urn:orders" id="7">
+  <customer>ada</customer>
+  <item sku="a1">2</item>
+  <item sku="b2">1</item>
+  <shipping><address><city>Paris</city></address><express/></shipping>
+  <note>fragile &amp; urgent</note>
+</order>`
+
+	got, err := r.utils.TransformWithParams(document, "xml_parse", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"order": map[string]interface{}{
+		XMLAttrsKey: map[string]interface{}{"id": "7"},
+		"customer":  "ada",
+		"item": []interface{}{
+			map[string]interface{}{XMLAttrsKey: map[string]interface{}{"sku": "a1"}, XMLTextKey: "2"},
+			map[string]interface{}{XMLAttrsKey: map[string]interface{}{"sku": "b2"}, XMLTextKey: "1"},
+		},
+		"shipping": map[string]interface{}{
+			"address": map[string]interface{}{"city": "Paris"},
+			"express": "",
+		},
+		"note": "fragile & urgent",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parsed = %#v", got)
+	}
+}
+
+func TestXMLRoundTripIsStable(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	// Canonical documents (sorted attributes and children, text before
+	// children) come back byte for byte
+	document := `<order id="7" status="open">rush<item sku="a1">2</item><item sku="b2">1</item><note>fragile &amp; urgent</note></order>`
+
+	parsed, err := r.utils.TransformWithParams(document, "xml_parse", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := r.utils.TransformWithParams(parsed, "xml_stringify", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != document {
+		t.Fatalf("round trip = %s\nwant %s", output, document)
+	}
+	reparsed, err := r.utils.TransformWithParams(output, "xml_parse", nil)
+	if err != nil || !reflect.DeepEqual(reparsed, parsed) {
+		t.Fatalf("reparsed = %#v, %v", reparsed, err)
+	}
+
+	// The packet path, with a root param and indentation
+	data := resultMap(t, runAtom(r, "df", "transform", map[string]interface{}{
+		"input":     map[string]interface{}{"b": 1.5, "a": []interface{}{"x", "y"}, "c": nil},
+		"operation": "xml_stringify",
+		"params":    map[string]interface{}{"root": "doc", "indent": "  "},
+	}))
+	want := "<doc>\n  <a>x</a>\n  <a>y</a>\n  <b>1.5</b>\n  <c></c>\n</doc>"
+	if data["result"] != want {
+		t.Fatalf("indented = %q, want %q", data["result"], want)
+	}
+}
+
+func TestXMLDecodeErrors(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for _, tc := range []struct {
+		name, document, want string
+	}{
+		{"unclosed element", `<a><b></a>`, "xml decode error"},
+		{"truncated", `<a>`, "xml decode error"},
+		{"multiple roots", `<a/><b/>`, "multiple root elements"},
+		{"text outside the root", `<a/>trailing`, "text outside the root element"},
+		{"no root", `  `, "no root element"},
+	} {
+		result := runAtom(r, "df", "transform", map[string]interface{}{"input": tc.document, "operation": "xml_parse"})
+		if result.Success || result.Error.Code != "E400" || !strings.Contains(result.Error.Message, tc.want) {
+			t.Errorf("%s: %+v, want E400 mentioning %q", tc.name, result.Error, tc.want)
+		}
+	}
+}
+
+func TestXMLStringifyRejectsInvalidInput(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for _, tc := range []struct {
+		name   string
+		input  interface{}
+		params map[string]interface{}
+		want   string
+	}{
+		{"no single root key", map[string]interface{}{"a": 1.0, "b": 2.0}, nil, "single root key"},
+		{"scalar without a root param", "text", nil, "single root key"},
+		{"array root", map[string]interface{}{"a": []interface{}{1.0}}, nil, "cannot be an array"},
+		{"invalid element name", map[string]interface{}{"a": map[string]interface{}{"1bad": "x"}}, nil, `invalid XML element name "1bad"`},
+		{"invalid attribute name", map[string]interface{}{"a": map[string]interface{}{XMLAttrsKey: map[string]interface{}{"a b": "x"}}}, nil, `invalid XML attribute name "a b"`},
+		{"invalid root param", "x", map[string]interface{}{"root": "<script>"}, "invalid XML element name"},
+	} {
+		_, err := r.utils.TransformWithParams(tc.input, "xml_stringify", tc.params)
+		if !errors.Is(err, ErrInvalidInput) || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: err = %v, want invalid input mentioning %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+// ============================================================================
+// df:query
+// ============================================================================
+
+func queryDocument() map[string]interface{} {
+	return map[string]interface{}{
+		"store": map[string]interface{}{
+			"name": "corner",
+			"books": []interface{}{
+				map[string]interface{}{"title": "a", "price": 8.0, "tags": []interface{}{"x", "y"}},
+				map[string]interface{}{"title": "b", "price": 12.0},
+				map[string]interface{}{"title": "c", "price": 5.0},
+				map[string]interface{}{"title": "d", "price": 20.0},
+			},
+			"hours": map[string]interface{}{"sat": "10-14", "fri": "9-17"},
+		},
+		"odd key": true,
+	}
+}
+
+func TestQueryPathDottedIndicesSlicesAndWildcards(t *testing.T) {
+	u := NewPacketUtils(nil)
+	for _, tc := range []struct {
+		path     string
+		want     string
+		multiple bool
+	}{
+		{"$", "", false},
+		{"$.store.name", "[corner]", false},
+		{"$.store.books[0].title", "[a]", false},
+		{"$.store.books[-1].title", "[d]", false},
+		{"$.store.books[0].tags[1]", "[y]", false},
+		{"$['odd key']", "[true]", false},
+		{`$.store["name"]`, "[corner]", false},
+		{"$.store.books[9].title", "[]", false},
+		{"$.store.missing.deeper", "[]", false},
+		{"$.store.name[0]", "[]", false},
+		{"$.store.books[*].title", "[a b c d]", true},
+		{"$.store.books.*.price", "[8 12 5 20]", true},
+		{"$.store.hours.*", "[9-17 10-14]", true},
+		{"$.store.books[1:3].title", "[b c]", true},
+		{"$.store.books[:2].title", "[a b]", true},
+		{"$.store.books[-2:].title", "[c d]", true},
+		{"$.store.books[::2].title", "[a c]", true},
+		{"$.store.books[1:100:2].title", "[b d]", true},
+		{"$.store.books[3:1].title", "[]", true},
+		{"$.store.books[*].tags[*]", "[x y]", true},
+	} {
+		matches, multiple, err := u.QueryPath(queryDocument(), tc.path)
+		if err != nil {
+			t.Errorf("%s: %v", tc.path, err)
+			continue
+		}
+		if tc.path == "$" {
+			if len(matches) != 1 || !reflect.DeepEqual(matches[0], queryDocument()) {
+				t.Errorf("$ = %v", matches)
+			}
+			continue
+		}
+		if got := fmt.Sprint(matches); got != tc.want || multiple != tc.multiple {
+			t.Errorf("%s = %s (multiple %v), want %s (multiple %v)", tc.path, got, multiple, tc.want, tc.multiple)
+		}
+	}
+}
+
+func TestQueryPathRejectsInvalidPaths(t *testing.T) {
+	u := NewPacketUtils(nil)
+	for path, want := range map[string]string{
+		"store.name":        "must start with $",
+		"$..name":           "recursive descent",
+		"$.store.":          "empty name",
+		"$.books[":          "unterminated [",
+		"$['name":           "unterminated quoted name",
+		"$.books[x]":        "invalid index [x]",
+		"$.books[1:2:3:4]":  "invalid slice",
+		"$.books[::0]":      "slice step must be positive",
+		"$.books[0]title":   "unexpected 't'",
+		"$.books[a:b]":      "invalid slice",
+		"$.books[1:2:-1]":   "slice step must be positive",
+		"$.books['a'.title": "unterminated quoted name",
+	} {
+		if _, _, err := u.QueryPath(queryDocument(), path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: err = %v, want %q", path, err, want)
+		}
+	}
+}
+
+func TestQueryPacketShapesResults(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	query := func(path string) map[string]interface{} {
+		return resultMap(t, runAtom(r, "df", "query", map[string]interface{}{"input": queryDocument(), "path": path}))
+	}
+
+	// Single-value paths return the value itself, or null when nothing matches
+	if got := query("$.store.books[1].price"); got["result"] != 12.0 || got["count"] != 1 {
+		t.Fatalf("single match = %v", got)
+	}
+	if got := query("$.store.nope"); got["result"] != nil || got["count"] != 0 {
+		t.Fatalf("no match = %v", got)
+	}
+
+	// Wildcards and slices always return an array, empty when nothing matches
+	if got := query("$.store.books[*].price"); !reflect.DeepEqual(got["result"], []interface{}{8.0, 12.0, 5.0, 20.0}) || got["count"] != 4 {
+		t.Fatalf("wildcard = %v", got)
+	}
+	if got := query("$.store.books[0:1].title"); !reflect.DeepEqual(got["result"], []interface{}{"a"}) {
+		t.Fatalf("one-element slice = %v", got)
+	}
+	if got := query("$.store.nope[*]"); !reflect.DeepEqual(got["result"], []interface{}{}) || got["count"] != 0 {
+		t.Fatalf("empty wildcard = %v", got)
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"input": queryDocument(), "path": "$..title"},
+		{"input": queryDocument()},
+	} {
+		if result := runAtom(r, "df", "query", data); result.Success || result.Error.Code != "E400" {
+			t.Errorf("query %v = %+v, want E400", data["path"], result.Error)
+		}
+	}
+}
+
+// ============================================================================
+// cf:benchmark
+// ============================================================================
+
+func runBenchmark(r *PacketFlowRuntime, data map[string]interface{}) *AtomResult {
+	return runAtom(r, "cf", "benchmark", data)
+}
+
+func TestBenchmarkPingReportsSaneThroughput(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	result := runBenchmark(r, map[string]interface{}{"packet": "cf:ping", "iterations": 200, "concurrency": 4})
+	if !result.Success {
+		t.Fatalf("benchmark failed: %+v", result.Error)
+	}
+	report := result.Data.(*BenchmarkReport)
+	if report.Packet != "cf:ping" || report.Iterations != 200 || report.Completed != 200 || report.Errors != 0 || report.Concurrency != 4 || report.Cancelled {
+		t.Fatalf("report = %+v", report)
+	}
+	if report.Latency.Total != 200 {
+		t.Fatalf("histogram holds %d observations, want 200", report.Latency.Total)
+	}
+	if report.ThroughputPerSec <= 0 || report.Elapsed <= 0 {
+		t.Fatalf("throughput %.1f/s over %v", report.ThroughputPerSec, report.Elapsed)
+	}
+	// Four workers cannot finish atoms faster than the quickest one took
+	if limit := float64(report.Concurrency) / report.MinLatency.Seconds(); report.ThroughputPerSec > limit {
+		t.Fatalf("throughput %.1f/s exceeds the %.1f/s the latencies allow", report.ThroughputPerSec, limit)
+	}
+	if !(report.MinLatency <= report.MeanLatency && report.MeanLatency <= report.MaxLatency) {
+		t.Fatalf("latencies min %v mean %v max %v", report.MinLatency, report.MeanLatency, report.MaxLatency)
+	}
+	if !(report.P50Latency <= report.P95Latency && report.P95Latency <= report.P99Latency) {
+		t.Fatalf("percentiles p50 %v p95 %v p99 %v", report.P50Latency, report.P95Latency, report.P99Latency)
+	}
+
+	// Benchmark atoms count towards the target's stats
+	if stats := r.GetStats(); stats.Processed < 201 {
+		t.Fatalf("processed %d atoms, want at least 201", stats.Processed)
+	}
+}
+
+func TestBenchmarkCountsErrorsByCode(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var calls int64
+	registerCounter(t, r, "count", &calls)
+
+	result := runBenchmark(r, map[string]interface{}{"packet": "tt:count", "data": map[string]interface{}{"fail": true}, "iterations": 10})
+	report := result.Data.(*BenchmarkReport)
+	if report.Completed != 10 || report.Errors != 10 || report.ErrorCodes["E400"] != 10 || calls != 10 {
+		t.Fatalf("report = %+v after %d calls", report, calls)
+	}
+}
+
+func TestBenchmarkRespectsConcurrency(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	release, running, peak := registerTracked(t, r)
+
+	done := make(chan *AtomResult, 1)
+	go func() {
+		done <- runBenchmark(r, map[string]interface{}{"packet": "tt:tracked", "iterations": 9, "concurrency": 3})
+	}()
+	waitFor(t, "three atoms in flight", func() bool { return atomic.LoadInt64(running) == 3 })
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	result := <-done
+	if report := result.Data.(*BenchmarkReport); report.Completed != 9 || report.Errors != 0 {
+		t.Fatalf("report = %+v", report)
+	}
+	if got := atomic.LoadInt64(peak); got != 3 {
+		t.Fatalf("peak concurrency %d, want 3", got)
+	}
+}
+
+func TestBenchmarkGuardsRecursionAndLimits(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{MaxConcurrent: 10})
+	if err := r.RegisterAlias("tt:bench", "cf:benchmark", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data map[string]interface{}
+		code string
+		want string
+	}{
+		{"itself", map[string]interface{}{"packet": "cf:benchmark"}, "E400", "cannot benchmark itself"},
+		{"itself through an alias", map[string]interface{}{"packet": "tt:bench"}, "E400", "cannot benchmark itself"},
+		{"zero iterations", map[string]interface{}{"packet": "cf:ping", "iterations": 0}, "E400", "iterations must be between 1 and 10000"},
+		{"too many iterations", map[string]interface{}{"packet": "cf:ping", "iterations": MaxBenchmarkIterations + 1}, "E400", "iterations"},
+		{"concurrency at MaxConcurrent", map[string]interface{}{"packet": "cf:ping", "concurrency": 10}, "E400", "concurrency must be between 1 and 9"},
+		{"not a packet key", map[string]interface{}{"packet": "ping"}, "E400", "packet key"},
+		{"unknown packet", map[string]interface{}{"packet": "tt:nope"}, "E404", "tt:nope not found"},
+	} {
+		result := runBenchmark(r, tc.data)
+		if result.Success || result.Error.Code != tc.code || !strings.Contains(result.Error.Message, tc.want) {
+			t.Errorf("%s: %+v, want %s mentioning %q", tc.name, result.Error, tc.code, tc.want)
+		}
+	}
+
+	// An atom run by a benchmark cannot start another, whatever packet it names
+	nested := r.ProcessAtom(&Atom{
+		ID: newTestAtomID(), Group: "cf", Element: "benchmark",
+		Data: map[string]interface{}{"packet": "cf:ping"},
+		Meta: map[string]interface{}{BenchmarkMeta: true},
+	})
+	if nested.Success || nested.Error.Code != "E400" || !strings.Contains(nested.Error.Message, "cannot run other benchmarks") {
+		t.Fatalf("nested benchmark = %+v, want E400", nested.Error)
+	}
+}
+
+func TestBenchmarkStopsWhenCancelled(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := r.Benchmark(&ExecutionContext{Context: cancelled, PacketKey: "cf:benchmark"}, "cf:ping", nil, 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Cancelled || report.Completed >= 1000 {
+		t.Fatalf("cancelled benchmark completed %d of 1000 (cancelled %v)", report.Completed, report.Cancelled)
+	}
+}
+
+// ============================================================================
+// Message data shapes
+// ============================================================================
+
+// replyErrorMessage decodes an error reply frame, returning its code and message
+func replyErrorMessage(t *testing.T, handler *MessageHandler, response []byte) (string, string) {
+	t.Helper()
+	message, err := handler.DecodeMessage(response)
+	if err != nil {
+		t.Fatalf("decoding reply: %v", err)
+	}
+	errData, ok := message.Data.(map[string]interface{})["error"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("reply is not an error: %v", message.Data)
+	}
+	return errData["code"].(string), errData["message"].(string)
+}
+
+func TestSubmitRejectsMisshapenDataWithClearErrors(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+	submit := handler.getMessageTypeCode("submit")
+
+	for _, tc := range []struct {
+		name string
+		data interface{}
+		want string
+	}{
+		{"nil data", nil, "Invalid atom data: expected a map, got nil"},
+		{"string data", "cf:ping", "expected a map, got string"},
+		{"array data", []interface{}{}, "expected a map, got []interface {}"},
+		{"non-string key", map[interface{}]interface{}{"g": "cf", 7: "x"}, "map key 7 is int, not a string"},
+		{"scalar d", map[string]interface{}{"g": "cf", "e": "ping", "d": "hi"}, "field d: expected a map, got string"},
+		{"scalar m", map[string]interface{}{"g": "cf", "e": "ping", "m": 5.0}, "field m: expected a map, got float64"},
+	} {
+		response, err := handler.handleDecoded(&Message{Version: 1, Type: submit, Data: tc.data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, message := replyErrorMessage(t, handler, response); code != "E400" || !strings.Contains(message, tc.want) {
+			t.Errorf("%s: %s %q, want E400 mentioning %q", tc.name, code, message, tc.want)
+		}
+	}
+}
+
+func TestSubmitAcceptsInterfaceKeyedMaps(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+
+	response, err := handler.handleDecoded(&Message{Version: 1, Type: handler.getMessageTypeCode("submit"), Data: map[interface{}]interface{}{
+		"id": "ik_1", "g": "tt", "e": "pass",
+		"d": map[interface{}]interface{}{"input": "hi"},
+		"m": map[interface{}]interface{}{"source": "legacy"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := replyError(t, handler, response); code != "" {
+		t.Fatalf("interface-keyed submit failed with %s", code)
+	}
+	message, _ := handler.DecodeMessage(response)
+	if got := message.Data.(map[string]interface{})["data"]; got != "hi" {
+		t.Fatalf("reply data = %v, want hi", got)
+	}
+
+	// Atoms without d run with empty data
+	response, _ = handler.handleDecoded(&Message{Version: 1, Type: handler.getMessageTypeCode("submit"), Data: map[string]interface{}{"id": "ik_2", "g": "cf", "e": "ping"}})
+	if code := replyError(t, handler, response); code != "" {
+		t.Fatalf("submit without d failed with %s", code)
+	}
+}
+
+func TestBatchSubmitRejectsMisshapenItems(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	handler := NewMessageHandler(r).WithCodec(JSONCodec{})
+	batch := handler.getMessageTypeCode("batch_submit")
+
+	for _, tc := range []struct {
+		name string
+		data interface{}
+		want string
+	}{
+		{"object instead of array", map[string]interface{}{"g": "cf"}, "Batch data must be an array of atoms, got map[string]interface {}"},
+		{"nil batch", nil, "got nil"},
+		{"scalar item", []interface{}{map[string]interface{}{"g": "cf", "e": "ping"}, "oops"}, "Invalid atom data at index 1: expected a map, got string"},
+		{"scalar d in item", []interface{}{map[string]interface{}{"g": "cf", "e": "ping", "d": 1.0}}, "index 0: field d"},
+	} {
+		response, err := handler.handleDecoded(&Message{Version: 1, Type: batch, Data: tc.data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code, message := replyErrorMessage(t, handler, response); code != "E400" || !strings.Contains(message, tc.want) {
+			t.Errorf("%s: %s %q, want E400 mentioning %q", tc.name, code, message, tc.want)
+		}
+	}
+
+	response, _ := handler.handleDecoded(&Message{Version: 1, Type: batch, Data: []interface{}{
+		map[interface{}]interface{}{"id": "mixed_1", "g": "cf", "e": "ping"},
+		map[string]interface{}{"id": "mixed_2", "g": "cf", "e": "ping"},
+	}})
+	if code := replyError(t, handler, response); code != "" {
+		t.Fatalf("mixed map batch failed with %s", code)
+	}
+}
+
+func TestSubmitFromStrictMsgpackEncoder(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	registerPassthrough(t, r)
+	handler := NewMessageHandler(r)
+
+	// Frames written field by field, as encoders without struct support do,
+	// using str8 keys and explicit nils
+	frame := func(data func(*msgpack.Encoder)) []byte {
+		var buf bytes.Buffer
+		encoder := msgpack.NewEncoder(&buf)
+		encoder.EncodeMapLen(3)
+		encoder.EncodeString("v")
+		encoder.EncodeInt(1)
+		encoder.EncodeString("t")
+		encoder.EncodeInt(int64(handler.getMessageTypeCode("submit")))
+		encoder.EncodeString("d")
+		data(encoder)
+		return buf.Bytes()
+	}
+
+	response, err := handler.HandleMessage(frame(func(e *msgpack.Encoder) { e.EncodeNil() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, message := replyErrorMessage(t, handler, response); code != "E400" || !strings.Contains(message, "got nil") {
+		t.Fatalf("nil data: %s %q, want E400", code, message)
+	}
+
+	response, _ = handler.HandleMessage(frame(func(e *msgpack.Encoder) { e.EncodeArrayLen(0) }))
+	if code, message := replyErrorMessage(t, handler, response); code != "E400" || !strings.Contains(message, "expected a map") {
+		t.Fatalf("array data: %s %q, want E400", code, message)
+	}
+
+	response, _ = handler.HandleMessage(frame(func(e *msgpack.Encoder) {
+		e.EncodeMapLen(5)
+		e.EncodeString("id")
+		e.EncodeString("strict_1")
+		e.EncodeString("g")
+		e.EncodeString("tt")
+		e.EncodeString("e")
+		e.EncodeString("pass")
+		e.EncodeString("d")
+		e.EncodeMapLen(1)
+		e.EncodeString("input")
+		e.EncodeMapLen(1)
+		e.EncodeString("n")
+		e.EncodeUint8(7)
+		e.EncodeString("m")
+		e.EncodeNil()
+	}))
+	if code := replyError(t, handler, response); code != "" {
+		t.Fatalf("strict encoder submit failed with %s", code)
+	}
+	message, _ := handler.DecodeMessage(response)
+	if got := fmt.Sprint(message.Data.(map[string]interface{})["data"]); got != "map[n:7]" {
+		t.Fatalf("reply data = %s, want map[n:7]", got)
+	}
+}
+
+// ============================================================================
+// Map normalization
+// ============================================================================
+
+// untypedMsgpackCodec decodes maps as map[interface{}]interface{}, as
+// msgpack libraries without string-key defaults do
+type untypedMsgpackCodec struct{ MsgpackCodec }
+
+func (untypedMsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetMapDecoder(func(d *msgpack.Decoder) (interface{}, error) {
+		return d.DecodeUntypedMap()
+	})
+	return decoder.Decode(v)
+}
+
+// interfaceKeyedPath names the first interface-keyed map in value, or ""
+func interfaceKeyedPath(value interface{}, path string) string {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		return path
+	case map[string]interface{}:
+		for key, item := range v {
+			if found := interfaceKeyedPath(item, path+"."+key); found != "" {
+				return found
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			if found := interfaceKeyedPath(item, fmt.Sprintf("%s[%d]", path, i)); found != "" {
+				return found
+			}
+		}
+	}
+	return ""
+}
+
+func TestNormalizeMapsConvertsNestedMaps(t *testing.T) {
+	input := map[interface{}]interface{}{
+		"a": []interface{}{
+			map[interface{}]interface{}{"b": map[interface{}]interface{}{"c": []interface{}{map[interface{}]interface{}{"d": 1}}}},
+			"plain",
+		},
+		7:    "seven",
+		true: map[string]interface{}{"e": map[interface{}]interface{}{"f": nil}},
+	}
+
+	got := NormalizeMaps(input)
+	want := map[string]interface{}{
+		"a": []interface{}{
+			map[string]interface{}{"b": map[string]interface{}{"c": []interface{}{map[string]interface{}{"d": 1}}}},
+			"plain",
+		},
+		"7":    "seven",
+		"true": map[string]interface{}{"e": map[string]interface{}{"f": nil}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("normalized = %#v", got)
+	}
+
+	// String-keyed maps and slices are converted in place
+	nested := map[string]interface{}{"x": map[interface{}]interface{}{"y": 1}}
+	NormalizeMaps(nested)
+	if _, ok := nested["x"].(map[string]interface{}); !ok {
+		t.Fatalf("nested map left as %T", nested["x"])
+	}
+	for _, scalar := range []interface{}{nil, "s", 1.5, []byte("b")} {
+		if got := NormalizeMaps(scalar); !reflect.DeepEqual(got, scalar) {
+			t.Errorf("NormalizeMaps(%v) = %v", scalar, got)
+		}
+	}
+}
+
+func TestDecodedSubmitDataIsStringKeyedThroughout(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	mustRegister(t, r, "tt", "shape", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		if path := interfaceKeyedPath(data, "d"); path != "" {
+			return nil, fmt.Errorf("%s is interface-keyed", path)
+		}
+		if path := interfaceKeyedPath(ctx.Atom.Meta, "m"); path != "" {
+			return nil, fmt.Errorf("%s is interface-keyed", path)
+		}
+		return data["order"].(map[string]interface{})["lines"].([]interface{})[1].(map[string]interface{})["sku"], nil
+	}, PacketMetadata{})
+
+	codec := untypedMsgpackCodec{}
+	handler := NewMessageHandler(r).WithCodec(codec)
+	atom := map[string]interface{}{
+		"id": "nested_1", "g": "tt", "e": "shape",
+		"d": map[string]interface{}{"order": map[string]interface{}{
+			"lines": []interface{}{
+				map[string]interface{}{"sku": "a1", "attrs": map[string]interface{}{"size": map[string]interface{}{"eu": 42}}},
+				map[string]interface{}{"sku": "b2", "attrs": []interface{}{map[string]interface{}{"k": "v"}}},
+			},
+		}},
+		"m": map[string]interface{}{"trace": map[string]interface{}{"span": "s1"}},
+	}
+
+	// The codec really does produce interface-keyed maps
+	var raw Message
+	encoded, _ := codec.Marshal(Message{Data: atom})
+	if err := codec.Unmarshal(encoded, &raw); err != nil || interfaceKeyedPath(raw.Data, "d") == "" {
+		t.Fatalf("codec decoded %T, %v", raw.Data, err)
+	}
+
+	response, err := handler.HandleMessage(encodeFrame(t, codec, Message{Type: handler.getMessageTypeCode("submit"), Data: atom}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := handler.DecodeMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reply.Data.(map[string]interface{})["data"]; got != "b2" {
+		t.Fatalf("reply = %v, want b2", reply.Data)
+	}
+
+	// Batches are normalized too
+	response, _ = handler.HandleMessage(encodeFrame(t, codec, Message{Type: handler.getMessageTypeCode("batch_submit"), Data: []interface{}{atom}}))
+	reply, _ = handler.DecodeMessage(response)
+	results := reply.Data.(map[string]interface{})["data"].([]interface{})
+	if len(results) != 1 || results[0].(map[string]interface{})["data"] != "b2" {
+		t.Fatalf("batch reply = %v", reply.Data)
+	}
+}
+
+// ============================================================================
+// Response Meta enrichers
+// ============================================================================
+
+func TestMetaEnrichersAddFieldsToResults(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ReactorID: "reactor-a"})
+	r.AddMetaEnricher(func(correlationID string) map[string]interface{} {
+		return map[string]interface{}{"region": "eu-west", "trace_id": "trace-" + correlationID}
+	})
+	r.AddMetaEnricher(func(correlationID string) map[string]interface{} {
+		return map[string]interface{}{"node_version": "1.2.3"}
+	})
+
+	result := r.ProcessAtom(&Atom{ID: newTestAtomID(), Group: "cf", Element: "ping", Meta: map[string]interface{}{"correlation_id": "cid-1"}})
+	if !result.Success {
+		t.Fatalf("ping failed: %+v", result.Error)
+	}
+	for key, want := range map[string]interface{}{
+		"region": "eu-west", "trace_id": "trace-cid-1", "node_version": "1.2.3",
+		"reactor_id": "reactor-a", "correlation_id": "cid-1",
+	} {
+		if result.Meta[key] != want {
+			t.Errorf("meta[%s] = %v, want %v", key, result.Meta[key], want)
+		}
+	}
+
+	// Failed atoms carry the enriched meta too
+	if failed := runAtom(r, "tt", "missing", nil); failed.Success || failed.Meta["region"] != "eu-west" {
+		t.Fatalf("failed atom meta = %v", failed.Meta)
+	}
+}
+
+func TestMetaEnricherCollisionsKeepExistingFields(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{ReactorID: "reactor-a", OmitMetaFields: []string{"timestamp"}})
+	r.AddMetaEnricher(func(string) map[string]interface{} {
+		return map[string]interface{}{"region": "eu-west", "reactor_id": "spoofed", "timestamp": 0}
+	})
+	r.AddMetaEnricher(func(string) map[string]interface{} {
+		return map[string]interface{}{"region": "us-east", "zone": "b"}
+	})
+
+	var result *AtomResult
+	logged := captureLog(func() {
+		result = runAtom(r, "cf", "ping", nil)
+		runAtom(r, "cf", "ping", nil)
+	})
+	if result.Meta["region"] != "eu-west" || result.Meta["zone"] != "b" || result.Meta["reactor_id"] != "reactor-a" {
+		t.Fatalf("meta = %v", result.Meta)
+	}
+	// Reserved fields stay reserved even when omitted
+	if _, present := result.Meta["timestamp"]; present {
+		t.Fatalf("omitted timestamp was filled by an enricher: %v", result.Meta)
+	}
+
+	// Each colliding key is reported once
+	for _, key := range []string{"reactor_id", "timestamp", "region"} {
+		if n := strings.Count(logged, fmt.Sprintf("key %q collides", key)); n != 1 {
+			t.Errorf("collision on %s logged %d times:\n%s", key, n, logged)
+		}
+	}
+}
+
+func TestOmitMetaFieldsDropsBuiltInFields(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{OmitMetaFields: []string{"duration_ms", "reactor_id"}})
+	result := runAtom(r, "cf", "ping", nil)
+	for _, key := range []string{"duration_ms", "reactor_id"} {
+		if _, present := result.Meta[key]; present {
+			t.Errorf("meta has omitted %s: %v", key, result.Meta)
+		}
+	}
+	if _, present := result.Meta["timestamp"]; !present {
+		t.Fatalf("meta lost timestamp: %v", result.Meta)
+	}
+	if _, present := result.Meta["correlation_id"]; !present {
+		t.Fatalf("meta lost correlation_id: %v", result.Meta)
+	}
+}
+
+func TestMetaEnrichersReachHTTPClients(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	r.AddMetaEnricher(func(string) map[string]interface{} {
+		return map[string]interface{}{"region": "eu-west"}
+	})
+	_, server := newTestServer(t, r)
+
+	var result struct {
+		Meta map[string]interface{} `json:"meta"`
+	}
+	postJSON(t, server.URL+"/submit", "", `{"id": "meta_1", "g": "cf", "e": "ping"}`, &result)
+	if result.Meta["region"] != "eu-west" {
+		t.Fatalf("HTTP meta = %v", result.Meta)
+	}
+}
+
+// ============================================================================
+// Scheduler
+// ============================================================================
+
+// recordRuns returns a task that records when it runs, and a reader for
+// the recorded times
+func recordRuns() (task func(), runs func() []time.Time) {
+	var mu sync.Mutex
+	var times []time.Time
+	task = func() {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+	}
+	runs = func() []time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]time.Time(nil), times...)
+	}
+	return task, runs
+}
+
+func TestScheduleEveryRunsAtItsInterval(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	const interval = 20 * time.Millisecond
+	task, runs := recordRuns()
+
+	start := time.Now()
+	cancel := r.ScheduleEvery(interval, task)
+	time.Sleep(10*interval + interval/2)
+	cancel()
+	elapsed := time.Since(start)
+
+	times := runs()
+	// Never faster than the interval, and not so slow that runs are skipped
+	if max := int(elapsed / interval); len(times) > max || len(times) < 5 {
+		t.Fatalf("%d runs in %v, want 5-%d", len(times), elapsed, max)
+	}
+	if first := times[0].Sub(start); first < interval {
+		t.Fatalf("first run after %v, before the %v interval", first, interval)
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < interval {
+			t.Fatalf("run %d came %v after the previous one, under the %v interval", i, gap, interval)
+		}
+	}
+
+	// Cancelling stops the task and can be repeated
+	cancel()
+	settled := len(runs())
+	time.Sleep(3 * interval)
+	if n := len(runs()); n != settled {
+		t.Fatalf("%d runs after cancel", n-settled)
+	}
+}
+
+func TestScheduleDelayJitter(t *testing.T) {
+	interval := 100 * time.Millisecond
+	for _, tc := range []struct {
+		jitter   float64
+		min, max time.Duration
+	}{
+		{0, interval, interval},
+		{-1, interval, interval},
+		{0.2, 80 * time.Millisecond, 120 * time.Millisecond},
+		{5, time.Millisecond, 200 * time.Millisecond},
+	} {
+		r := &PacketFlowRuntime{config: RuntimeConfig{ScheduleJitter: tc.jitter}}
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 200; i++ {
+			delay := r.scheduleDelay(interval)
+			if delay < tc.min || delay > tc.max {
+				t.Fatalf("jitter %v: delay %v outside [%v, %v]", tc.jitter, delay, tc.min, tc.max)
+			}
+			seen[delay] = true
+		}
+		if spread := tc.min != tc.max; spread != (len(seen) > 1) {
+			t.Errorf("jitter %v gave %d distinct delays", tc.jitter, len(seen))
+		}
+	}
+}
+
+func TestScheduledTasksStopWithTheRuntime(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	r := NewPacketFlowRuntime(RuntimeConfig{ReactorID: "test-reactor"})
+	var tasks []func() []time.Time
+	for i := 0; i < 10; i++ {
+		task, runs := recordRuns()
+		r.ScheduleEvery(5*time.Millisecond, task)
+		tasks = append(tasks, runs)
+	}
+	waitFor(t, "every task to run", func() bool {
+		for _, runs := range tasks {
+			if len(runs()) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	r.StopBackground()
+	counts := make([]int, len(tasks))
+	for i, runs := range tasks {
+		counts[i] = len(runs())
+	}
+	time.Sleep(20 * time.Millisecond)
+	for i, runs := range tasks {
+		if n := len(runs()); n != counts[i] {
+			t.Fatalf("task %d ran %d more times after StopBackground", i, n-counts[i])
+		}
+	}
+	r.Close(context.Background())
+	waitForGoroutines(t, baseline)
+}
+
+func TestScheduledTaskSurvivesPanics(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var calls int64
+	logged := captureLog(func() {
+		r.ScheduleEvery(2*time.Millisecond, func() {
+			if atomic.AddInt64(&calls, 1) == 1 {
+				panic("first run")
+			}
+		})
+		waitFor(t, "runs after the panic", func() bool { return atomic.LoadInt64(&calls) >= 3 })
+		// Wait for the task to exit before reading the log
+		r.StopBackground()
+	})
+	if !strings.Contains(logged, "Scheduled task panicked: first run") {
+		t.Fatalf("panic not logged:\n%s", logged)
+	}
+
+	var ran int64
+	logged = captureLog(func() {
+		r.ScheduleEvery(0, func() { atomic.AddInt64(&ran, 1) })()
+	})
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt64(&ran) != 0 || !strings.Contains(logged, "non-positive interval") {
+		t.Fatalf("zero interval ran %d times, logged %q", ran, logged)
+	}
+}
+
+func TestSchedulePacketProcessesAtoms(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	var calls int64
+	registerCounter(t, r, "count", &calls)
+
+	cancel, err := r.SchedulePacket(5*time.Millisecond, "tt:count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "three scheduled atoms", func() bool { return atomic.LoadInt64(&calls) >= 3 })
+	cancel()
+
+	logged := captureLog(func() {
+		if _, err := r.SchedulePacket(5*time.Millisecond, "tt:count", map[string]interface{}{"fail": true}); err != nil {
+			t.Fatal(err)
+		}
+		before := atomic.LoadInt64(&calls)
+		waitFor(t, "two failing scheduled atoms", func() bool { return atomic.LoadInt64(&calls) > before+1 })
+		r.StopBackground()
+	})
+	if !strings.Contains(logged, "Scheduled tt:count failed: bad input") {
+		t.Fatalf("failure not logged:\n%s", logged)
+	}
+
+	for key, want := range map[string]string{"count": "packet key", "tt:nope": "tt:nope not found"} {
+		if _, err := r.SchedulePacket(time.Second, key, nil); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("SchedulePacket(%s) = %v, want %q", key, err, want)
+		}
+	}
+}
+
+func TestSchedulesOfOnePacketAreNotReplayedAsEachOther(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{IdempotencyEnabled: true})
+	var mu sync.Mutex
+	submitted, ran := map[interface{}]int{}, map[interface{}]int{}
+	r.OnBeforeProcess(func(atom *Atom) {
+		mu.Lock()
+		submitted[atom.Data["tag"]]++
+		mu.Unlock()
+	})
+	mustRegister(t, r, "tt", "tagged", "", func(data map[string]interface{}, ctx *ExecutionContext) (interface{}, error) {
+		mu.Lock()
+		ran[data["tag"]]++
+		mu.Unlock()
+		return data["tag"], nil
+	}, PacketMetadata{})
+	counts := func(tag string) (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return submitted[tag], ran[tag]
+	}
+
+	// Once the first schedule has cached a few runs, a second schedule of the
+	// same packet must still run its own data every time
+	first, err := r.SchedulePacket(5*time.Millisecond, "tt:tagged", map[string]interface{}{"tag": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first schedule to run", func() bool { _, ran := counts("a"); return ran >= 3 })
+	first()
+	if _, err := r.SchedulePacket(5*time.Millisecond, "tt:tagged", map[string]interface{}{"tag": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the second schedule to submit", func() bool { submitted, _ := counts("b"); return submitted >= 3 })
+	r.StopBackground()
+	waitFor(t, "every second-schedule run to reach the handler", func() bool {
+		submitted, ran := counts("b")
+		return ran == submitted
+	})
+}
+
+// ============================================================================
+// Close
+// ============================================================================
+
+// goleak is not in the offline module cache, so Close is checked for leaks
+// by goroutine count; waitForGoroutines dumps every stack when it fails
+func TestCloseStopsAllGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	r := NewPacketFlowRuntime(RuntimeConfig{ReactorID: "test-reactor", WorkerPoolSize: 4, ReapInterval: 5})
+	httpServer := httptest.NewServer(NewPacketFlowServer(r, 0).Handler())
+	conn, _, err := dialWebSocket(t, httpServer, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the connection to register", func() bool { return r.GetStats().ConnectionCount == 1 })
+	var ticks int64
+	r.ScheduleEvery(time.Millisecond, func() { atomic.AddInt64(&ticks, 1) })
+	for i := 0; i < 20; i++ {
+		runAtom(r, "cf", "ping", nil)
+	}
+	waitFor(t, "the scheduled task to run", func() bool { return atomic.LoadInt64(&ticks) > 0 })
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Connected clients are told the runtime went away
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("read after Close = %v, want a going-away close", err)
+	}
+	conn.Close()
+	httpServer.Close()
+	http.DefaultClient.CloseIdleConnections()
+
+	waitForGoroutines(t, baseline)
+}
+
+func TestCloseRejectsLaterAtoms(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	_, server := newTestServer(t, r)
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	result := runAtom(r, "cf", "ping", nil)
+	if result.Success || result.Error.Code != "E503" || result.Error.Permanent || result.Error.Message != "runtime is closed" {
+		t.Fatalf("atom after Close = %+v, want a retryable E503", result.Error)
+	}
+	if result.Meta["reactor_id"] != "test-reactor" {
+		t.Fatalf("rejection meta = %v", result.Meta)
+	}
+
+	var reply struct {
+		Success bool      `json:"success"`
+		Error   AtomError `json:"error"`
+	}
+	postJSON(t, server.URL+"/submit", "", `{"id": "closed_1", "g": "cf", "e": "ping"}`, &reply)
+	if reply.Success || reply.Error.Code != "E503" {
+		t.Fatalf("HTTP submit after Close = %+v, want E503", reply)
+	}
+
+	// Nothing reopens a closed runtime
+	r.Drain()
+	r.MarkReady()
+	if r.State() != "closed" {
+		t.Fatalf("state = %s, want closed", r.State())
+	}
+	if result := runAtom(r, "cf", "ping", nil); result.Success {
+		t.Fatal("atom ran after Close")
+	}
+}
+
+func TestCloseWaitsForInFlightAtomsAndIsIdempotent(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	release := registerGate(t, r)
+
+	inFlight := make(chan *AtomResult, 1)
+	go func() {
+		inFlight <- runAtom(r, "tt", "gate", nil)
+	}()
+	waitFor(t, "the atom to start", func() bool { return r.GetStats().ActiveAtoms == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	err := r.Close(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "draining in-flight atoms") {
+		t.Fatalf("Close with an atom in flight = %v, want a drain deadline error", err)
+	}
+	// Later calls return the first result without waiting again
+	if again := r.Close(context.Background()); again != err {
+		t.Fatalf("second Close = %v, want %v", again, err)
+	}
+
+	// The in-flight atom still finishes; new ones are rejected meanwhile
+	if result := runAtom(r, "cf", "ping", nil); result.Success || result.Error.Code != "E503" {
+		t.Fatalf("atom during Close = %+v, want E503", result.Error)
+	}
+	close(release)
+	if result := <-inFlight; !result.Success {
+		t.Fatalf("in-flight atom = %+v", result.Error)
+	}
+}
+
+func TestCloseReturnsNilOnEveryCall(t *testing.T) {
+	r := newTestRuntime(t, RuntimeConfig{})
+	for i := 0; i < 3; i++ {
+		if err := r.Close(context.Background()); err != nil {
+			t.Fatalf("Close #%d: %v", i+1, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// diskUsage reports the total and used bytes of the filesystem holding path
+func diskUsage(path string) (total, used uint64, ok bool) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, false
+	}
+
+	total = fs.Blocks * uint64(fs.Bsize)
+	free := fs.Bfree * uint64(fs.Bsize)
+	return total, total - free, true
+}
+
+// networkCounters reads per-interface byte counters from /proc/net/dev
+func networkCounters() (map[string]netCounters, bool) {
+	file, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+
+	counters := make(map[string]netCounters)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// "  eth0: rx_bytes rx_packets ... (8 rx fields) tx_bytes ..."
+		name, stats, found := strings.Cut(scanner.Text(), ":")
+		if !found {
+			continue
+		}
+		fields := strings.Fields(stats)
+		if len(fields) < 9 {
+			continue
+		}
+
+		rx, rxErr := strconv.ParseUint(fields[0], 10, 64)
+		tx, txErr := strconv.ParseUint(fields[8], 10, 64)
+		if rxErr != nil || txErr != nil {
+			continue
+		}
+		counters[strings.TrimSpace(name)] = netCounters{RxBytes: rx, TxBytes: tx}
+	}
+
+	return counters, scanner.Err() == nil
+}
+
+// processCPUTime returns the user and system CPU time consumed by this process
+func processCPUTime() (time.Duration, bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, false
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), true
+}
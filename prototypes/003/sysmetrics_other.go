@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// diskUsage is unsupported on this platform; rm:monitor falls back to mock values
+func diskUsage(path string) (total, used uint64, ok bool) {
+	return 0, 0, false
+}
+
+// networkCounters is unsupported on this platform; rm:monitor falls back to mock values
+func networkCounters() (map[string]netCounters, bool) {
+	return nil, false
+}
+
+// processCPUTime is unsupported on this platform; CPU usage reports as 0
+func processCPUTime() (time.Duration, bool) {
+	return 0, false
+}